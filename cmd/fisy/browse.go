@@ -0,0 +1,237 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+)
+
+// A snapshotBrowser is a read-only web interface to the snapshots
+// written by cow+ destinations. The URL paths are on the form
+// <prefix><host>/<snapshot>/<path>, where the snapshot is a selector,
+// as understood by fs.OpenCOWSnapshot.
+type snapshotBrowser struct {
+	fs     fs.ReadableFileSystem
+	prefix string
+}
+
+func newSnapshotBrowser(fs fs.ReadableFileSystem, prefix string) *snapshotBrowser {
+	return &snapshotBrowser{fs: fs, prefix: prefix}
+}
+
+func (b *snapshotBrowser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, b.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	ss := strings.SplitN(strings.TrimPrefix(r.URL.Path, b.prefix), "/", 3)
+	for _, s := range ss[:len(ss)-1] {
+		// Hosts and snapshots never start with a dot, and this
+		// keeps ".." from escaping the repository.
+		if strings.HasPrefix(s, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	var err error
+	switch {
+	case ss[0] == "":
+		err = b.serveHosts(w, r)
+	case len(ss) == 1:
+		redirectToDir(w, r)
+	case ss[1] == "":
+		err = b.serveSnapshots(w, r, ss[0])
+	case len(ss) == 2:
+		redirectToDir(w, r)
+	default:
+		err = b.serveFile(w, r, ss[0], ss[1], ss[2])
+	}
+	if err != nil {
+		serveBrowseError(w, r, err)
+	}
+}
+
+// serveHosts lists the host directories.
+func (b *snapshotBrowser) serveHosts(w http.ResponseWriter, r *http.Request) error {
+	fr, err := b.fs.Open(".")
+	if err != nil {
+		return err
+	}
+	fis, err := fr.Readdir()
+	fr.Close()
+	if err != nil {
+		return err
+	}
+
+	page := &browsePage{Title: "Hosts"}
+	for _, fi := range fis {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			page.Entries = append(page.Entries, newBrowseEntry(fi.Name(), true, "", time.Time{}))
+		}
+	}
+	sort.Slice(page.Entries, func(i, j int) bool { return page.Entries[i].Name < page.Entries[j].Name })
+	return page.render(w)
+}
+
+// serveSnapshots lists the complete snapshots of a host, newest
+// first.
+func (b *snapshotBrowser) serveSnapshots(w http.ResponseWriter, r *http.Request, host string) error {
+	names, err := fs.ListCOWSnapshots(b.fs, host)
+	if err != nil {
+		return err
+	}
+
+	page := &browsePage{Title: "Snapshots of " + host, Parent: true}
+	if len(names) > 0 {
+		page.Entries = append(page.Entries, newBrowseEntry("latest", true, "", time.Time{}))
+	}
+	for _, name := range names {
+		page.Entries = append(page.Entries, newBrowseEntry(name, true, "", time.Time{}))
+	}
+	return page.render(w)
+}
+
+// serveFile lists a directory, or sends a file, in a snapshot.
+func (b *snapshotBrowser) serveFile(w http.ResponseWriter, r *http.Request, host, selector, path string) error {
+	sfs, err := fs.OpenCOWSnapshot(b.fs, host, selector)
+	if err != nil {
+		return err
+	}
+	f, err := fs.NewHTTPFileSystem(sfs).Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		if strings.HasSuffix(path, "/") {
+			http.NotFound(w, r)
+			return nil
+		}
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return nil
+	}
+	if path != "" && !strings.HasSuffix(path, "/") {
+		redirectToDir(w, r)
+		return nil
+	}
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		if fis[i].IsDir() != fis[j].IsDir() {
+			return fis[i].IsDir()
+		}
+		return fis[i].Name() < fis[j].Name()
+	})
+
+	page := &browsePage{Title: host + "/" + selector + "/" + path, Parent: true}
+	for _, fi := range fis {
+		var size string
+		switch {
+		case fi.IsDir():
+		case fi.Mode()&os.ModeSymlink != 0:
+			// Symlinks can't be followed, so they are only
+			// listed.
+			size = "symlink"
+		default:
+			size = formatDiffSize(fi)
+		}
+		page.Entries = append(page.Entries, newBrowseEntry(fi.Name(), fi.IsDir(), size, fi.ModTime()))
+	}
+	return page.render(w)
+}
+
+// redirectToDir adds a trailing slash to the request path, so
+// relative links work.
+func redirectToDir(w http.ResponseWriter, r *http.Request) {
+	u := *r.URL
+	u.Path += "/"
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// serveBrowseError sends an error response. Details of unexpected
+// errors are only logged.
+func serveBrowseError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case fs.IsNotExist(err):
+		http.NotFound(w, r)
+	case fs.IsPermission(err):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		glog.Errorf("Browsing %q failed: %v", r.URL.Path, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// A browsePage is the data of browseTemplate.
+type browsePage struct {
+	Title   string
+	Parent  bool
+	Entries []*browseEntry
+}
+
+type browseEntry struct {
+	Name    string
+	Href    string
+	Size    string
+	ModTime string
+}
+
+func newBrowseEntry(name string, isDir bool, size string, modTime time.Time) *browseEntry {
+	// The "./" keeps names with colons from looking like schemes.
+	e := &browseEntry{Name: name, Href: "./" + url.PathEscape(name), Size: size}
+	if isDir {
+		e.Name += "/"
+		e.Href += "/"
+	}
+	if !modTime.IsZero() {
+		e.ModTime = modTime.Local().Format("2006-01-02 15:04:05")
+	}
+	return e
+}
+
+func (p *browsePage) render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return browseTemplate.Execute(w, p)
+}
+
+var browseTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+td { padding: 0.2em 1em 0.2em 0; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Parent}}<p><a href="../">Up</a></p>{{end}}
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
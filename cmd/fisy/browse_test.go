@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestSnapshotBrowser(t *testing.T) {
+	raw := fs.NewMemory()
+	cow, err := fs.NewCOW(raw, "test", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if err := cow.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	fw, err := cow.Create("a/file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, "hello"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := cow.Symlink("/", "link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	s := httptest.NewServer(newSnapshotBrowser(raw, "/browse/"))
+	defer s.Close()
+	// Redirects are checked explicitly.
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	tsts := []struct {
+		Name     string
+		Path     string
+		Status   int
+		Contains string
+	}{
+		{"hosts", "/browse/", http.StatusOK, `href="./test/"`},
+		{"hostRedirect", "/browse/test", http.StatusMovedPermanently, ""},
+		{"snapshots", "/browse/test/", http.StatusOK, `href="./2021-01-01T00-00-00.000000/"`},
+		{"snapshotsLatest", "/browse/test/", http.StatusOK, `href="./latest/"`},
+		{"snapshotRedirect", "/browse/test/latest", http.StatusMovedPermanently, ""},
+		{"root", "/browse/test/latest/", http.StatusOK, `href="./a/"`},
+		{"rootSymlink", "/browse/test/latest/", http.StatusOK, "symlink"},
+		{"dir", "/browse/test/2021-01-01/a/", http.StatusOK, `href="./file.txt"`},
+		{"dirRedirect", "/browse/test/latest/a", http.StatusMovedPermanently, ""},
+		{"file", "/browse/test/latest/a/file.txt", http.StatusOK, "hello"},
+		{"fileSlash", "/browse/test/latest/a/file.txt/", http.StatusNotFound, ""},
+		{"symlink", "/browse/test/latest/link/", http.StatusForbidden, ""},
+		{"missingFile", "/browse/test/latest/missing", http.StatusNotFound, ""},
+		{"missingSnapshot", "/browse/test/1999/", http.StatusNotFound, ""},
+		{"missingHost", "/browse/other/", http.StatusNotFound, ""},
+		{"dotHost", "/browse/.index/", http.StatusNotFound, ""},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			resp, err := c.Get(s.URL + tst.Path)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			defer resp.Body.Close()
+			bs, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+
+			if resp.StatusCode != tst.Status {
+				t.Errorf("Get status: got %v, want %v", resp.StatusCode, tst.Status)
+			}
+			if !strings.Contains(string(bs), tst.Contains) {
+				t.Errorf("Get: got %q, want containing %q", bs, tst.Contains)
+			}
+			if tst.Status == http.StatusMovedPermanently {
+				if got, want := resp.Header.Get("Location"), tst.Path+"/"; got != want {
+					t.Errorf("Get Location: got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+// browsePrefix is where the snapshot browser is served on the HTTP
+// server.
+const browsePrefix = "/browse/"
+
+var browseCmd = cobra.Command{
+	Use:   "browse <destination>",
+	Short: "Serves a read-only web interface to the snapshots of a cow+ destination.",
+	Long:  "Lets a web browser list the hosts, snapshots and directories of a cow+ destination, and download files. It is served under " + browsePrefix + " on the server given by --http-addr, until interrupted. Anyone who can reach the server can read all snapshots.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		return runBrowse(ctx, args[0])
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(&browseCmd)
+}
+
+func runBrowse(ctx context.Context, destSpec string) (rerr error) {
+	if httpAddr == "" {
+		return errors.New("--http-addr is required")
+	}
+
+	u, err := parseFileSystemSpec(destSpec)
+	if err != nil {
+		return err
+	}
+	// Opening the COW file system would start a new snapshot.
+	raw, close, err := makeFileSystemFromURL(cowRepositoryURL(u))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := close(rerr); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	http.Handle(browsePrefix, newSnapshotBrowser(raw, browsePrefix))
+	glog.Infof("Serving snapshots of %s at %s%s", destSpec, httpAddr, browsePrefix)
+
+	<-ctx.Done()
+	return nil
+}
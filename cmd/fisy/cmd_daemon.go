@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+var (
+	controlSocketPath string
+	daemonStatePath   string
+	daemonBackoff     time.Duration
+	daemonMaxBackoff  time.Duration
+)
+
+// defaultSocketPath is where the daemon listens, and where the status
+// command connects, by default.
+var defaultSocketPath = os.ExpandEnv("$HOME/.cache/fisy/daemon.sock")
+
+var daemonCmd = cobra.Command{
+	Use:   "daemon",
+	Short: "Runs scheduled jobs.",
+	Long: `Runs the jobs that have a schedule in the jobs configuration file. Jobs run one at a time, and a failed run is retried with exponential back-off. Flags given on the command line override the job configurations.
+
+The status of the jobs can be queried with "fisy status".`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		return runDaemon(ctx, cmd)
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	addTransferFlags(daemonCmd.Flags())
+	daemonCmd.Flags().StringVar(&controlSocketPath, "control-socket", defaultSocketPath, "path of the unix socket to listen for status requests on")
+	daemonCmd.Flags().StringVar(&daemonStatePath, "state-file", os.ExpandEnv("$HOME/.cache/fisy/daemon-state.json"), "path of the file to keep job statuses in between restarts")
+	daemonCmd.Flags().DurationVar(&daemonBackoff, "failure-backoff", time.Minute, "delay before retrying a failed run")
+	daemonCmd.Flags().DurationVar(&daemonMaxBackoff, "max-failure-backoff", time.Hour, "maximum delay before retrying a failed run, after repeated failures")
+
+	rootCmd.AddCommand(&daemonCmd)
+}
+
+func runDaemon(ctx context.Context, cmd *cobra.Command) error {
+	cfg, err := loadJobsConfig(jobsConfigPath)
+	if err != nil {
+		return err
+	}
+
+	d, err := newDaemon(cfg, func(ctx context.Context, name string) error {
+		// Jobs set the transfer flags, and must not affect
+		// each other.
+		defer saveTransferFlags()()
+		return runJob(ctx, cmd, name)
+	}, daemonStatePath, daemonBackoff, daemonMaxBackoff)
+	if err != nil {
+		return err
+	}
+	uploadStarted = d.setUpload
+
+	ln, err := listenControlSocket(controlSocketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(controlSocketPath)
+
+	server := &http.Server{Handler: d}
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			glog.Errorf("Control socket server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	glog.Infof("Listening for status requests on %s.", controlSocketPath)
+	return d.Run(ctx)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/transfer"
+)
+
+var (
+	diffConc int
+	diffJSON bool
+)
+
+var diffCmd = cobra.Command{
+	Use:   "diff <old> <new>",
+	Short: "Shows what changed between two file systems.",
+	Long:  "Shows files that were added, removed, modified, or only had their metadata changed, between two file systems. A cow+ URL reads an existing snapshot, selected with the \"snapshot\" query parameter (\"latest\", \"latest~<n>\" or a time prefix like \"2021-01-02\") and \"host\" (defaults to this machine's hostname).",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runDiff(cmd.Context(), os.Stdout, args[0], args[1])
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	diffCmd.Flags().IntVar(&diffConc, "file-concurrency", runtime.NumCPU()*32, "number of files/directories to work on concurrently")
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "print the differences as JSON")
+
+	rootCmd.AddCommand(&diffCmd)
+}
+
+func runDiff(ctx context.Context, w io.Writer, oldSpec, newSpec string) (rerr error) {
+	opts := []transfer.DiffOpt{transfer.WithDiffConcurrency(diffConc)}
+
+	oldFS, newFS, close, shared, err := makeDiffFileSystems(oldSpec, newSpec)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := close(rerr); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	if shared {
+		opts = append(opts, transfer.WithSharedInodes())
+	}
+
+	var mu sync.Mutex
+	var es []*transfer.DiffEntry
+	d := transfer.NewDiff(oldFS, newFS, func(e *transfer.DiffEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		es = append(es, e)
+	}, opts...)
+	if err := d.Run(ctx); err != nil {
+		return err
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Path < es[j].Path })
+
+	if diffJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newDiffOutput(es))
+	}
+	return printDiff(w, es)
+}
+
+// makeDiffFileSystems opens the two file systems to compare. If both
+// are snapshots in the same cow+ destination, it is only opened once,
+// and shared is true, since unchanged files are then hardlinks.
+func makeDiffFileSystems(oldSpec, newSpec string) (oldFS, newFS fs.ReadableFileSystem, close func(error) error, shared bool, rerr error) {
+	oldURL, err := parseFileSystemSpec(oldSpec)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	newURL, err := parseFileSystemSpec(newSpec)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+
+	if strings.HasPrefix(oldURL.Scheme, "cow+") && oldURL.Scheme == newURL.Scheme && cowRepositoryURL(oldURL).String() == cowRepositoryURL(newURL).String() {
+		raw, close, err := makeFileSystemFromURL(cowRepositoryURL(oldURL))
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		oldFS, err := makeCOWSnapshot(raw, oldURL)
+		if err != nil {
+			close(err)
+			return nil, nil, nil, false, err
+		}
+		newFS, err := makeCOWSnapshot(raw, newURL)
+		if err != nil {
+			close(err)
+			return nil, nil, nil, false, err
+		}
+		return oldFS, newFS, close, true, nil
+	}
+
+	oldFS, oldClose, err := makeReadableFileSystem(oldSpec)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	newFS, newClose, err := makeReadableFileSystem(newSpec)
+	if err != nil {
+		oldClose(err)
+		return nil, nil, nil, false, err
+	}
+	return oldFS, newFS, func(err error) error {
+		nerr := newClose(err)
+		if oerr := oldClose(err); nerr == nil {
+			nerr = oerr
+		}
+		return nerr
+	}, false, nil
+}
+
+// printDiff writes a table of differences, followed by a summary.
+func printDiff(w io.Writer, es []*transfer.DiffEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, e := range es {
+		var size, detail string
+		switch e.Change {
+		case transfer.Added:
+			size = formatDiffSize(e.New)
+		case transfer.Removed:
+			size = formatDiffSize(e.Old)
+		case transfer.Modified:
+			size = formatDiffSize(e.Old) + " -> " + formatDiffSize(e.New)
+		case transfer.MetadataChanged:
+			size = formatDiffSize(e.New)
+			detail = " (" + formatMetadataChange(e.Old, e.New) + ")"
+		}
+		fmt.Fprintf(tw, "%c\t%s\t%s%s\n", e.Change, size, e.Path, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	s := newDiffSummary(es)
+	_, err := fmt.Fprintf(w, "%d added (%d bytes), %d removed (%d bytes), %d modified, %d metadata changed.\n", s.Added, s.AddedBytes, s.Removed, s.RemovedBytes, s.Modified, s.Metadata)
+	return err
+}
+
+// formatDiffSize returns the size of a file, or "-" for directories.
+func formatDiffSize(fi os.FileInfo) string {
+	if fi.IsDir() {
+		return "-"
+	}
+	return fmt.Sprint(fi.Size())
+}
+
+// formatMetadataChange describes a metadata-only change.
+func formatMetadataChange(oldFI, newFI os.FileInfo) string {
+	if oldFI.Mode() != newFI.Mode() {
+		return fmt.Sprintf("%v -> %v", oldFI.Mode(), newFI.Mode())
+	}
+	oa, _ := fs.FileAttrsFromFileInfo(oldFI)
+	na, _ := fs.FileAttrsFromFileInfo(newFI)
+	return fmt.Sprintf("%d:%d -> %d:%d", oa.UID, oa.GID, na.UID, na.GID)
+}
+
+// A diffOutput is the JSON output of a diff.
+type diffOutput struct {
+	Entries []*diffOutputEntry `json:"entries"`
+	Summary diffSummary        `json:"summary"`
+}
+
+type diffOutputEntry struct {
+	Path   string          `json:"path"`
+	Change string          `json:"change"`
+	Old    *diffOutputFile `json:"old,omitempty"`
+	New    *diffOutputFile `json:"new,omitempty"`
+}
+
+type diffOutputFile struct {
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+}
+
+// A diffSummary counts differences. Bytes are only counted for
+// files.
+type diffSummary struct {
+	Added        int    `json:"added"`
+	AddedBytes   uint64 `json:"added_bytes"`
+	Removed      int    `json:"removed"`
+	RemovedBytes uint64 `json:"removed_bytes"`
+	Modified     int    `json:"modified"`
+	Metadata     int    `json:"metadata"`
+}
+
+func newDiffOutput(es []*transfer.DiffEntry) *diffOutput {
+	out := &diffOutput{Entries: []*diffOutputEntry{}, Summary: newDiffSummary(es)}
+	for _, e := range es {
+		out.Entries = append(out.Entries, &diffOutputEntry{
+			Path:   string(e.Path),
+			Change: e.Change.String(),
+			Old:    newDiffOutputFile(e.Old),
+			New:    newDiffOutputFile(e.New),
+		})
+	}
+	return out
+}
+
+func newDiffOutputFile(fi os.FileInfo) *diffOutputFile {
+	if fi == nil {
+		return nil
+	}
+	attrs, _ := fs.FileAttrsFromFileInfo(fi)
+	return &diffOutputFile{
+		Size:    fi.Size(),
+		Mode:    fi.Mode().String(),
+		ModTime: fi.ModTime(),
+		UID:     attrs.UID,
+		GID:     attrs.GID,
+	}
+}
+
+func newDiffSummary(es []*transfer.DiffEntry) diffSummary {
+	var s diffSummary
+	for _, e := range es {
+		switch e.Change {
+		case transfer.Added:
+			s.Added++
+			if !e.New.IsDir() {
+				s.AddedBytes += uint64(e.New.Size())
+			}
+		case transfer.Removed:
+			s.Removed++
+			if !e.Old.IsDir() {
+				s.RemovedBytes += uint64(e.Old.Size())
+			}
+		case transfer.Modified:
+			s.Modified++
+		case transfer.MetadataChanged:
+			s.Metadata++
+		}
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/transfer"
+)
+
+func TestRunDiff(t *testing.T) {
+	defer func(j bool) { diffJSON = j }(diffJSON)
+
+	tmpd, err := ioutil.TempDir("", "diff-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	srcd := filepath.Join(tmpd, "src")
+	destd := filepath.Join(tmpd, "dest")
+	for _, d := range []string{srcd, destd} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(srcd, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	upload := func(i int) {
+		t.Helper()
+		cow, err := fs.NewCOW(fs.NewLocal(destd), "test", start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		u := transfer.NewUpload(cow, fs.NewLocal(srcd), transfer.WithConcurrency(1), transfer.WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }))
+		if err := u.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if err := cow.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+	}
+
+	writeFile("same", "same")
+	writeFile("removed", "removed")
+	upload(0)
+	if err := os.Remove(filepath.Join(srcd, "removed")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	writeFile("added", "added!")
+	upload(1)
+
+	oldSpec := "cow+file://" + destd + "?host=test&snapshot=latest~1"
+	newSpec := "cow+file://" + destd + "?host=test"
+
+	t.Run("text", func(t *testing.T) {
+		diffJSON = false
+		var buf bytes.Buffer
+		if err := runDiff(context.Background(), &buf, oldSpec, newSpec); err != nil {
+			t.Fatalf("runDiff failed: %v", err)
+		}
+
+		want := "A  6  added\nR  7  removed\n1 added (6 bytes), 1 removed (7 bytes), 0 modified, 0 metadata changed.\n"
+		if got := buf.String(); got != want {
+			t.Errorf("runDiff: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		diffJSON = true
+		var buf bytes.Buffer
+		if err := runDiff(context.Background(), &buf, oldSpec, newSpec); err != nil {
+			t.Fatalf("runDiff failed: %v", err)
+		}
+
+		var got diffOutput
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if len(got.Entries) != 2 || got.Entries[0].Change != "added" || got.Entries[0].New.Size != 6 || got.Entries[1].Change != "removed" || got.Entries[1].Old == nil {
+			t.Errorf("runDiff: got %+v, want added and removed", got.Entries)
+		}
+		if want := (diffSummary{Added: 1, AddedBytes: 6, Removed: 1, RemovedBytes: 7}); got.Summary != want {
+			t.Errorf("runDiff summary: got %+v, want %+v", got.Summary, want)
+		}
+	})
+
+	t.Run("sourceAndSnapshot", func(t *testing.T) {
+		diffJSON = false
+		var buf bytes.Buffer
+		if err := runDiff(context.Background(), &buf, newSpec, srcd); err != nil {
+			t.Fatalf("runDiff failed: %v", err)
+		}
+		if got := buf.String(); !strings.HasPrefix(got, "0 added") {
+			t.Errorf("runDiff: got %q, want no differences", got)
+		}
+	})
+
+	t.Run("missingSnapshot", func(t *testing.T) {
+		err := runDiff(context.Background(), ioutil.Discard, "cow+file://"+destd+"?host=test&snapshot=1999", newSpec)
+		if !fs.IsNotExist(err) {
+			t.Errorf("runDiff error: got %v, want ENOENT", err)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/transfer"
+)
+
+var (
+	exportFormat string
+	exportOutput string
+)
+
+var exportCmd = cobra.Command{
+	Use:   "export <source>",
+	Short: "Writes a file system as a tar or zip archive.",
+	Long:  "Writes a file system as an archive, to a file or standard output. A cow+ URL reads an existing snapshot, like in \"fisy diff\". Tar archives keep hardlinks, symlinks, modes, owners and modification times. Zip archives don't keep hardlinks or owners.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		return runExport(ctx, args[0], exportOutput, exportFormat)
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "file to write the archive to (- is standard output)")
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "archive format: tar, tar.gz or zip (defaults to the output file extension, or tar)")
+
+	rootCmd.AddCommand(&exportCmd)
+}
+
+func runExport(ctx context.Context, srcSpec, output, format string) (rerr error) {
+	if format == "" {
+		format = exportFormatFromName(output)
+	}
+	switch format {
+	case "tar", "tar.gz", "tgz", "zip":
+	default:
+		return fmt.Errorf("unknown archive format: %s", format)
+	}
+
+	src, srcClose, err := makeReadableFileSystem(srcSpec)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := srcClose(rerr); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	w := io.Writer(os.Stdout)
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && rerr == nil {
+				rerr = err
+			}
+			if rerr != nil {
+				// Don't leave a truncated archive behind.
+				os.Remove(output)
+			}
+		}()
+		w = f
+	}
+
+	switch format {
+	case "tar":
+		return transfer.ExportTar(ctx, w, src)
+
+	case "tar.gz", "tgz":
+		zw := gzip.NewWriter(w)
+		if err := transfer.ExportTar(ctx, zw, src); err != nil {
+			return err
+		}
+		return zw.Close()
+
+	default:
+		return transfer.ExportZip(ctx, w, src)
+	}
+}
+
+// exportFormatFromName returns the archive format matching a file
+// name extension, or "tar".
+func exportFormatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	default:
+		return "tar"
+	}
+}
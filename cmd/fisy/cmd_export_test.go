@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunExport(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "export-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	srcd := filepath.Join(tmpd, "src")
+	if err := os.Mkdir(srcd, 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcd, "a"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	t.Run("tarGz", func(t *testing.T) {
+		out := filepath.Join(tmpd, "out.tgz")
+		if err := runExport(context.Background(), srcd, out, ""); err != nil {
+			t.Fatalf("runExport failed: %v", err)
+		}
+
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader failed: %v", err)
+		}
+		tr := tar.NewReader(zr)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		bs, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if hdr.Name != "a" || string(bs) != "hello" {
+			t.Errorf("runExport: got %q %q, want %q %q", hdr.Name, bs, "a", "hello")
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("Next: got %v, want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("removesOnError", func(t *testing.T) {
+		out := filepath.Join(tmpd, "missing.tar")
+		if err := runExport(context.Background(), filepath.Join(tmpd, "missing"), out, ""); err == nil {
+			t.Fatalf("runExport: got %v, want error", err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("Stat: got %v, want not exist", err)
+		}
+	})
+
+	t.Run("unknownFormat", func(t *testing.T) {
+		if err := runExport(context.Background(), srcd, "-", "rar"); err == nil {
+			t.Errorf("runExport: got %v, want error", err)
+		}
+	})
+}
+
+func TestExportFormatFromName(t *testing.T) {
+	tsts := []struct {
+		Name string
+		Want string
+	}{
+		{"-", "tar"},
+		{"out.tar", "tar"},
+		{"out.tar.gz", "tar.gz"},
+		{"out.tgz", "tar.gz"},
+		{"out.zip", "zip"},
+	}
+	for _, tst := range tsts {
+		if got := exportFormatFromName(tst.Name); got != tst.Want {
+			t.Errorf("exportFormatFromName(%q): got %q, want %q", tst.Name, got, tst.Want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	hostKeyAdd            bool
+	hostKeyKnownHostsPath string
+)
+
+var hostKeyCmd = cobra.Command{
+	Use:   "hostkey <host>[:<port>]",
+	Short: "Fetches and prints the SSH host key of a server.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runHostKey(args[0])
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	hostKeyCmd.Flags().BoolVar(&hostKeyAdd, "add", false, "add the key to known_hosts, unless the host already has a different key")
+	hostKeyCmd.Flags().StringVar(&hostKeyKnownHostsPath, "knownhosts", defaultKnownHostsPath(), "path of the known_hosts file to use with --add")
+
+	rootCmd.AddCommand(&hostKeyCmd)
+}
+
+func runHostKey(host string) error {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += defaultPortSuffix
+	}
+
+	key, err := fetchHostKey(host)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %s key fingerprint is %s.\n", host, key.Type(), ssh.FingerprintSHA256(key))
+	fmt.Println(knownhosts.Line([]string{knownhosts.Normalize(host)}, key))
+
+	if !hostKeyAdd {
+		return nil
+	}
+
+	hkcb, err := makeHostKeyCallback(hostKeyKnownHostsPath, acceptNewHostKeyPolicy)
+	if err != nil {
+		return err
+	}
+	return hkcb(host, &net.TCPAddr{}, key)
+}
+
+// errHostKeyFetched is used to abort the SSH handshake once the host
+// key is known.
+var errHostKeyFetched = errors.New("host key fetched")
+
+// fetchHostKey connects to an SSH server and returns its host key,
+// without authenticating.
+func fetchHostKey(host string) (ssh.PublicKey, error) {
+	var key ssh.PublicKey
+	cfg := ssh.ClientConfig{
+		User: os.Getenv("LOGNAME"),
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errHostKeyFetched
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	sc, err := ssh.Dial("tcp", host, &cfg)
+	if err == nil {
+		sc.Close()
+		return nil, fmt.Errorf("server %s didn't present a host key", host)
+	}
+	if key == nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var jobsCmd = cobra.Command{
+	Use:   "jobs",
+	Short: "Validates the jobs configuration file and lists the jobs.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runJobs()
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(&jobsCmd)
+}
+
+func runJobs() error {
+	cfg, err := loadJobsConfig(jobsConfigPath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range cfg.jobNames() {
+		job := cfg.Jobs[name]
+		fmt.Fprintf(w, "%s\t%s -> %s\t%s\n", name, job.Source, job.Destination, job.Description)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/fs"
+)
+
+var runCmd = cobra.Command{
+	Use:   "run <job>",
+	Short: "Runs a job from the jobs configuration file.",
+	Long:  "Runs a job from the jobs configuration file. Flags given on the command line override the job configuration.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runJob(cmd.Context(), cmd, args[0])
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	addTransferFlags(runCmd.Flags())
+
+	rootCmd.AddCommand(&runCmd)
+}
+
+func runJob(ctx context.Context, cmd *cobra.Command, name string) (rerr error) {
+	cfg, err := loadJobsConfig(jobsConfigPath)
+	if err != nil {
+		return err
+	}
+	job, ok := cfg.Jobs[name]
+	if !ok {
+		return fmt.Errorf("unknown job: %s", name)
+	}
+	job.apply(cmd.Flags())
+
+	if err := runJobHook(job.Hooks.Pre, name, job, false, nil); err != nil {
+		return fmt.Errorf("pre hook: %w", err)
+	}
+	defer func() {
+		if err := runJobHook(job.Hooks.Post, name, job, true, rerr); err != nil && rerr == nil {
+			rerr = fmt.Errorf("post hook: %w", err)
+		}
+	}()
+
+	var finish func(fs.WriteableFileSystem) error
+	if job.Retention.isSet() {
+		finish = func(dest fs.WriteableFileSystem) error {
+			cow, ok := dest.(*fs.COW)
+			if !ok {
+				return fmt.Errorf("retention requires a cow+ destination: %s", job.Destination)
+			}
+			removed, err := cow.Prune(job.Retention.cowRetention(), timeNow())
+			for _, path := range removed {
+				glog.Infof("Removed snapshot %q.", path)
+			}
+			return err
+		}
+	}
+
+	return runTransfer(ctx, cmd, job.Source, job.Destination, finish)
+}
+
+// runJobHook runs a hook command in the shell. The job is described in
+// environment variables. If post is true, the result of the transfer
+// is also set.
+func runJobHook(command, name string, job *jobConfig, post bool, transferErr error) error {
+	if command == "" {
+		return nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"FISY_JOB="+name,
+		"FISY_SOURCE="+job.Source,
+		"FISY_DESTINATION="+job.Destination)
+	if post {
+		if transferErr == nil {
+			cmd.Env = append(cmd.Env, "FISY_RESULT=success")
+		} else {
+			cmd.Env = append(cmd.Env, "FISY_RESULT=failure", "FISY_ERROR="+transferErr.Error())
+		}
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/remote"
+)
+
+var serveCmd = cobra.Command{
+	Use:   "serve",
+	Short: "Answers helper requests on stdin and stdout.",
+	Long:  "Answers requests from a fisy client that connected over SSH, with sftp:// URLs. It gives faster listing, hashing, hardlinking and removal than plain SFTP. It is started by the client if the URL names the command, like sftp://host/path?serve=fisy+serve, and doesn't need to be run manually.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return remote.Serve(os.Stdin, os.Stdout)
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(&serveCmd)
+}
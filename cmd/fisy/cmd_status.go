@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+var statusCmd = cobra.Command{
+	Use:   "status",
+	Short: "Shows the status of the jobs run by the daemon.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sts, err := fetchDaemonStatus(cmd.Context(), controlSocketPath)
+		if err != nil {
+			return err
+		}
+
+		if statusJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(sts)
+		}
+		return printDaemonStatus(os.Stdout, sts, timeNow())
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&controlSocketPath, "control-socket", defaultSocketPath, "path of the daemon's unix socket")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the status as JSON")
+
+	rootCmd.AddCommand(&statusCmd)
+}
+
+// printDaemonStatus writes a table of job statuses.
+func printDaemonStatus(w io.Writer, sts []*daemonJobStatus, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "JOB\tSTATE\tLAST RUN\tNEXT RUN\tLAST ERROR\n")
+	for _, st := range sts {
+		state := "idle"
+		if st.Running {
+			state = "running"
+			if p := st.Progress; p != nil {
+				state = fmt.Sprintf("running (%d/%d files, %d/%d bytes)", p.UploadedFiles, p.SourceFiles, p.UploadedBytes, p.SourceBytes)
+			}
+		} else if st.Failures > 0 {
+			state = fmt.Sprintf("failing (%d)", st.Failures)
+		}
+
+		next := "-"
+		if !st.Running {
+			next = formatStatusTime(st.NextRun, now)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", st.Name, state, formatStatusTime(st.LastStart, now), next, st.LastError)
+	}
+	return tw.Flush()
+}
+
+// formatStatusTime formats a time relative to now, rounded to seconds.
+func formatStatusTime(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := t.Sub(now).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%v ago", -d)
+	}
+	return fmt.Sprintf("in %v", d)
+}
@@ -2,63 +2,145 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/remote"
 	"github.com/tommie/fisy/transfer"
 	"github.com/tommie/fisy/transfer/terminal"
 )
 
 var (
-	fileConc   int
-	gidMapSpec string
-	ignoreSpec string
-	printOps   []string
-	uidMapSpec string
+	dedup              bool
+	detectMoves        bool
+	excludeIfPresent   []string
+	fileConc           int
+	gidMapSpec         string
+	ignoreFiles        []string
+	ignoreFrom         []string
+	ignoreSpec         string
+	ignoreTypes        []string
+	listingCacheDir    string
+	maxSizeSpec        string
+	minSizeSpec        string
+	modifiedAfterSpec  string
+	modifiedBeforeSpec string
+	printOps           []string
+	uidMapSpec         string
+
+	retryPolicy = remote.DefaultRetryPolicy
+
+	// uploadStarted is called by runUpload with each new upload, so
+	// the daemon can report progress.
+	uploadStarted = func(*transfer.Upload) {}
 )
 
 var transferCmd = cobra.Command{
 	Use:   "transfer <source> <destination>",
 	Short: "Transfers files in one direction.",
+	Long:  "Makes the destination a copy of the source. The source can also be a tar archive, like tar:///backups/2019.tar.gz, or a snapshot of a cow+ destination, like in \"fisy diff\".",
 	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runTransfer(cmd.Context(), cmd, args[0], args[1])
+		return runTransfer(cmd.Context(), cmd, args[0], args[1], nil)
 	},
 	SilenceUsage: true,
 }
 
 func init() {
-	transferCmd.PersistentFlags().IntVar(&fileConc, "file-concurrency", runtime.NumCPU()*32, "number of files/directories to work on concurrently")
-	transferCmd.PersistentFlags().StringVar(&gidMapSpec, "gid-map", "id", "GID mapping to use ('id' is identity transform, 'current' means use current effective group)")
-	transferCmd.PersistentFlags().StringVar(&ignoreSpec, "ignore", "", "filter to apply to ignore some files")
-	transferCmd.PersistentFlags().StringSliceVar(&printOps, "print-operations", nil, "types of file operations to print verbosely (a combination of create, update, keep, remove)")
-	transferCmd.PersistentFlags().StringVar(&uidMapSpec, "uid-map", "id", "UID mapping to use ('id' is identity transform, 'current' means use current effective user)")
+	addTransferFlags(transferCmd.PersistentFlags())
 
 	rootCmd.AddCommand(&transferCmd)
 }
 
-func runTransfer(ctx context.Context, cmd *cobra.Command, srcSpec, destSpec string) (rerr error) {
-	ctx, cancel := context.WithCancel(ctx)
+// addTransferFlags registers the flags that control a transfer. They
+// are shared by all commands that transfer files.
+func addTransferFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&dedup, "dedup", false, "link files to stored copies with the same content and metadata, for cow+ destinations (reads each file twice)")
+	flags.BoolVar(&detectMoves, "detect-moves", false, "keep moved files from their old path, using source inodes remembered in the listing cache directory, for cow+ destinations")
+	flags.IntVar(&fileConc, "file-concurrency", runtime.NumCPU()*32, "number of files/directories to work on concurrently")
+	flags.StringVar(&gidMapSpec, "gid-map", "id", "GID mapping to use ('id' is identity transform, 'current' means use current effective group, or a table like '1000:2001,2000-2999:5000,name:server-group,*:100')")
+	flags.StringVar(&ignoreSpec, "ignore", "", "filter to apply to ignore some files")
+	flags.StringSliceVar(&ignoreFrom, "ignore-from", nil, "files to read additional ignore filters from")
+	flags.StringSliceVar(&ignoreTypes, "ignore-type", nil, "types of files to ignore (a combination of symlink, device, fifo, socket, special)")
+	flags.StringVar(&minSizeSpec, "min-size", "", "ignore regular files smaller than this, e.g. 10k")
+	flags.StringVar(&maxSizeSpec, "max-size", "", "ignore regular files larger than this, e.g. 1G")
+	flags.StringVar(&modifiedBeforeSpec, "modified-before", "", "ignore files not modified before this time (RFC 3339, YYYY-MM-DD or an age like 30d)")
+	flags.StringVar(&modifiedAfterSpec, "modified-after", "", "ignore files not modified after this time (RFC 3339, YYYY-MM-DD or an age like 30d)")
+	flags.StringSliceVar(&excludeIfPresent, "exclude-if-present", nil, "ignore directories containing a file with this name (CACHEDIR.TAG must have a valid signature)")
+	flags.StringSliceVar(&ignoreFiles, "ignore-file", []string{".fisyignore"}, "names of per-directory ignore files to read from the source, in .gitignore format (e.g. .fisyignore,.gitignore)")
+	flags.StringVar(&listingCacheDir, "listing-cache-dir", os.ExpandEnv("$HOME/.cache/fisy/listings"), "directory to cache destination listings in, for cow+ destinations (empty disables)")
+	flags.StringSliceVar(&printOps, "print-operations", nil, "types of file operations to print verbosely (a combination of create, update, keep, remove)")
+	flags.StringVar(&uidMapSpec, "uid-map", "id", "UID mapping to use ('id' is identity transform, 'current' means use current effective user, or a table like '1000:2001,2000-2999:5000,name:server-passwd,*:65534')")
+	flags.IntVar(&retryPolicy.MaxAttempts, "retry-max-attempts", retryPolicy.MaxAttempts, "maximum number of attempts per file on network errors (0 is unlimited)")
+	flags.DurationVar(&retryPolicy.MaxElapsed, "retry-max-elapsed", retryPolicy.MaxElapsed, "maximum time to retry a file on network errors (0 is unlimited)")
+	flags.DurationVar(&retryPolicy.InitialDelay, "retry-initial-delay", retryPolicy.InitialDelay, "back-off after the first network error")
+	flags.DurationVar(&retryPolicy.MaxDelay, "retry-max-delay", retryPolicy.MaxDelay, "maximum back-off between retries")
+	flags.Float64Var(&retryPolicy.Multiplier, "retry-multiplier", retryPolicy.Multiplier, "factor to grow the back-off by after each retry")
+	flags.Float64Var(&retryPolicy.Jitter, "retry-jitter", retryPolicy.Jitter, "fraction of each back-off to randomize, between 0 and 1")
+}
 
-	filter, err := parseIgnoreFilter(ignoreSpec)
-	if err != nil {
-		return err
-	}
+// saveTransferFlags returns a function that restores the transfer
+// flag variables to their current values. This allows running
+// several jobs in one process.
+func saveTransferFlags() func() {
+	savedDedup := dedup
+	savedDetectMoves := detectMoves
+	savedExcludeIfPresent := excludeIfPresent
+	savedFileConc := fileConc
+	savedGidMapSpec := gidMapSpec
+	savedIgnoreFiles := ignoreFiles
+	savedIgnoreFrom := ignoreFrom
+	savedIgnoreSpec := ignoreSpec
+	savedIgnoreTypes := ignoreTypes
+	savedListingCacheDir := listingCacheDir
+	savedMaxSizeSpec := maxSizeSpec
+	savedMinSizeSpec := minSizeSpec
+	savedModifiedAfterSpec := modifiedAfterSpec
+	savedModifiedBeforeSpec := modifiedBeforeSpec
+	savedPrintOps := printOps
+	savedUidMapSpec := uidMapSpec
+	savedRetryPolicy := retryPolicy
 
-	gidMap, err := makeIDMapping(gidMapSpec)
-	if err != nil {
-		return fmt.Errorf("GID mapping: %w", err)
+	return func() {
+		dedup = savedDedup
+		detectMoves = savedDetectMoves
+		excludeIfPresent = savedExcludeIfPresent
+		fileConc = savedFileConc
+		gidMapSpec = savedGidMapSpec
+		ignoreFiles = savedIgnoreFiles
+		ignoreFrom = savedIgnoreFrom
+		ignoreSpec = savedIgnoreSpec
+		ignoreTypes = savedIgnoreTypes
+		listingCacheDir = savedListingCacheDir
+		maxSizeSpec = savedMaxSizeSpec
+		minSizeSpec = savedMinSizeSpec
+		modifiedAfterSpec = savedModifiedAfterSpec
+		modifiedBeforeSpec = savedModifiedBeforeSpec
+		printOps = savedPrintOps
+		uidMapSpec = savedUidMapSpec
+		retryPolicy = savedRetryPolicy
 	}
+}
 
-	uidMap, err := makeIDMapping(uidMapSpec)
+// runTransfer uploads from the source to the destination. If finish
+// is not nil, it is called after the destination has been closed
+// successfully.
+func runTransfer(ctx context.Context, cmd *cobra.Command, srcSpec, destSpec string, finish func(fs.WriteableFileSystem) error) (rerr error) {
+	opts, printOpsMap, err := makeUploadOpts()
 	if err != nil {
-		return fmt.Errorf("UID mapping: %w", err)
+		return err
 	}
 
-	src, srcClose, err := makeFileSystem(srcSpec)
+	src, srcClose, err := makeReadableFileSystem(srcSpec)
 	if err != nil {
 		return err
 	}
@@ -71,33 +153,152 @@ func runTransfer(ctx context.Context, cmd *cobra.Command, srcSpec, destSpec stri
 		return err
 	}
 	defer func() {
-		destClose(rerr)
+		if err := destClose(rerr); err == nil && rerr == nil && finish != nil {
+			rerr = finish(dest)
+		}
 	}()
 
+	if dedup {
+		cow, ok := dest.(*fs.COW)
+		if !ok {
+			return fmt.Errorf("--dedup requires a cow+ destination: %s", destSpec)
+		}
+		opts = append(opts, transfer.WithDeduplicator(cow))
+	}
+
+	if detectMoves {
+		cow, ok := dest.(*fs.COW)
+		if !ok {
+			return fmt.Errorf("--detect-moves requires a cow+ destination: %s", destSpec)
+		}
+		if listingCacheDir == "" {
+			return fmt.Errorf("--detect-moves requires --listing-cache-dir")
+		}
+		tracker, err := openMoveTracker(srcSpec, destSpec, cow)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, transfer.WithMoveTracker(tracker))
+
+		prevFinish := finish
+		finish = func(dest fs.WriteableFileSystem) error {
+			if err := tracker.Save(string(cow.WriteRoot())); err != nil {
+				glog.Warningf("Saving the move tracker failed (ignored): %v", err)
+			}
+			if prevFinish != nil {
+				return prevFinish(dest)
+			}
+			return nil
+		}
+	}
+
+	if cow, ok := dest.(*fs.COW); ok && listingCacheDir != "" {
+		cache, err := openListingCache(srcSpec, destSpec, cow)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, transfer.WithListingCache(cache))
+
+		// The cache is valid for the snapshot being written, once
+		// it is complete.
+		prevFinish := finish
+		finish = func(dest fs.WriteableFileSystem) error {
+			if err := cache.Save(string(cow.WriteRoot())); err != nil {
+				glog.Warningf("Saving the listing cache failed (ignored): %v", err)
+			}
+			if prevFinish != nil {
+				return prevFinish(dest)
+			}
+			return nil
+		}
+	}
+
+	return runUpload(ctx, dest, src, nil, opts, printOpsMap)
+}
+
+// openListingCache opens the listing cache for a source and
+// destination. Listings are only used if the destination still reads
+// from the snapshot written when the cache was saved.
+func openListingCache(srcSpec, destSpec string, cow *fs.COW) (*transfer.FileListingCache, error) {
+	h := sha256.Sum256([]byte(srcSpec + "\x00" + destSpec))
+	path := filepath.Join(listingCacheDir, hex.EncodeToString(h[:16])+".gob")
+	return transfer.OpenFileListingCache(path, string(cow.ReadRoot()))
+}
+
+// openMoveTracker opens the move tracker for a source and
+// destination. It is stored next to the listing cache, and is only
+// used if the destination still reads from the snapshot written when
+// it was saved.
+func openMoveTracker(srcSpec, destSpec string, cow *fs.COW) (*transfer.FileMoveTracker, error) {
+	h := sha256.Sum256([]byte(srcSpec + "\x00" + destSpec))
+	path := filepath.Join(listingCacheDir, hex.EncodeToString(h[:16])+".moves.gob")
+	return transfer.OpenFileMoveTracker(path, string(cow.ReadRoot()))
+}
+
+// makeUploadOpts creates upload options from the transfer flags. The
+// file hook depends on the progress output, so it is added by
+// runUpload, using the returned operations to print.
+func makeUploadOpts() ([]transfer.UploadOpt, map[transfer.FileOperation]bool, error) {
+	if retryPolicy.Jitter < 0 || retryPolicy.Jitter > 1 {
+		return nil, nil, fmt.Errorf("retry jitter must be between 0 and 1: %v", retryPolicy.Jitter)
+	}
+
+	filter, err := makeIgnoreFilter(timeNow())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gidMap, err := makeIDMapping(gidMapSpec, groupIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GID mapping: %w", err)
+	}
+
+	uidMap, err := makeIDMapping(uidMapSpec, userIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UID mapping: %w", err)
+	}
+
 	printOpsMap, err := parsePrintOps(printOps)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	p := terminal.NewProgress(os.Stdout, 1*time.Second)
-	u := transfer.NewUpload(
-		dest, src,
+	return []transfer.UploadOpt{
 		transfer.WithIgnoreFilter(filter),
+		transfer.WithIgnoreFiles(nonEmptyStrings(ignoreFiles)...),
+		transfer.WithExcludeIfPresent(nonEmptyStrings(excludeIfPresent)...),
 		transfer.WithConcurrency(fileConc),
-		transfer.WithFileHook(func(fi os.FileInfo, op transfer.FileOperation, uploadedBytes *uint64, err error) {
-			if !printOpsMap[op] {
-				return
-			}
-			p.FileHook(fi, op, uploadedBytes, err)
-		}),
 		transfer.WithGIDMap(gidMap),
 		transfer.WithUIDMap(uidMap),
-	)
+		transfer.WithRetryPolicy(retryPolicy),
+	}, printOpsMap, nil
+}
+
+// runUpload performs one upload, showing progress. If paths is nil,
+// the whole tree is transferred.
+func runUpload(ctx context.Context, dest fs.WriteableFileSystem, src fs.ReadableFileSystem, paths []fs.Path, opts []transfer.UploadOpt, printOpsMap map[transfer.FileOperation]bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := terminal.NewProgress(os.Stdout, 1*time.Second)
+	opts = append(append([]transfer.UploadOpt(nil), opts...), transfer.WithFileHook(func(fi os.FileInfo, op transfer.FileOperation, uploadedBytes *uint64, err error) {
+		if !printOpsMap[op] {
+			return
+		}
+		p.FileHook(fi, op, uploadedBytes, err)
+	}))
+	u := transfer.NewUpload(dest, src, opts...)
+	uploadStarted(u)
 
 	go p.RunUpload(ctx, u)
 
-	if err := u.Run(ctx); err != nil {
-		cancel()
+	var err error
+	if paths == nil {
+		err = u.Run(ctx)
+	} else {
+		err = u.RunPaths(ctx, paths)
+	}
+	if err != nil {
 		return err
 	}
 	cancel()
@@ -126,3 +327,15 @@ func parsePrintOps(ss []string) (map[transfer.FileOperation]bool, error) {
 	}
 	return ret, nil
 }
+
+// nonEmptyStrings returns the strings that are not empty. It allows
+// flags like --ignore-file= to clear a list.
+func nonEmptyStrings(ss []string) []string {
+	var ret []string
+	for _, s := range ss {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/fs"
+)
+
+var (
+	unlockHost  string
+	unlockForce bool
+)
+
+var unlockCmd = cobra.Command{
+	Use:   "unlock <destination>",
+	Short: "Removes the lock of a cow+ destination.",
+	Long:  "Removes the lock that stops concurrent transfers to a cow+ destination from the same host. A lock held by a running process on this machine is only removed with --force.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runUnlock(args[0])
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	unlockCmd.Flags().StringVar(&unlockHost, "host", "", "host whose snapshots to unlock (defaults to this machine's hostname)")
+	unlockCmd.Flags().BoolVar(&unlockForce, "force", false, "remove the lock even if its process is still running")
+
+	rootCmd.AddCommand(&unlockCmd)
+}
+
+func runUnlock(destSpec string) (rerr error) {
+	u, err := parseFileSystemSpec(destSpec)
+	if err != nil {
+		return err
+	}
+	// The lock is in the underlying file system. Opening the COW
+	// file system would try to take it.
+	uu := *u
+	uu.Scheme = strings.TrimPrefix(uu.Scheme, "cow+")
+
+	host := unlockHost
+	if host == "" {
+		host, err = os.Hostname()
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, close, err := makeFileSystemFromURL(&uu)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := close(rerr); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	l, err := fs.ReadCOWLock(raw, host)
+	if fs.IsNotExist(err) {
+		fmt.Printf("Host %q is not locked.\n", host)
+		return nil
+	} else if err != nil && !unlockForce {
+		return fmt.Errorf("%w; use --force to remove it anyway", err)
+	}
+
+	if l != nil && !unlockForce && !l.Stale() {
+		if hostname, err := os.Hostname(); err == nil && hostname == l.Hostname {
+			return fmt.Errorf("the lock is held by a running process (PID %d); use --force to remove it anyway", l.PID)
+		}
+	}
+
+	if err := fs.RemoveCOWLock(raw, host); err != nil {
+		return err
+	}
+	if l != nil {
+		fmt.Printf("Removed the lock of host %q, held by PID %d on %s since %v.\n", host, l.PID, l.Hostname, l.Start.Local())
+	} else {
+		fmt.Printf("Removed the lock of host %q.\n", host)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestRunUnlock(t *testing.T) {
+	defer func(h string, f bool) { unlockHost, unlockForce = h, f }(unlockHost, unlockForce)
+
+	tmpd, err := ioutil.TempDir("", "unlock-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	raw := fs.NewLocal(tmpd)
+	unlockHost = "test"
+
+	if err := runUnlock("cow+file://" + tmpd); err != nil {
+		t.Fatalf("runUnlock failed: %v", err)
+	}
+
+	cow, err := fs.NewCOW(raw, "test", time.Now())
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	defer cow.Unlock()
+
+	// The lock is held by this process.
+	if err := runUnlock("cow+file://" + tmpd); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("runUnlock error: got %v, want containing --force", err)
+	}
+
+	unlockForce = true
+	if err := runUnlock("cow+file://" + tmpd); err != nil {
+		t.Fatalf("runUnlock failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpd, "test", ".lock")); !os.IsNotExist(err) {
+		t.Errorf("Lstat error: got %v, want ENOENT", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/watch"
+)
+
+var (
+	watchQuietPeriod    time.Duration
+	watchMaxDelay       time.Duration
+	watchRescanInterval time.Duration
+)
+
+var watchCmd = cobra.Command{
+	Use:   "watch (<job> | <source> <destination>)",
+	Short: "Continuously transfers files as they change.",
+	Long: `Watches a local source for changes, and transfers the changed files and directories in batches. A full transfer is done when starting, periodically, and when change events may have been lost.
+
+With a single argument, runs a job from the jobs configuration file. The job hooks run around each batch.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if len(args) == 2 {
+			return runWatch(ctx, args[0], args[1], nil)
+		}
+
+		cfg, err := loadJobsConfig(jobsConfigPath)
+		if err != nil {
+			return err
+		}
+		job, ok := cfg.Jobs[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown job: %s", args[0])
+		}
+		job.apply(cmd.Flags())
+
+		return runWatch(ctx, job.Source, job.Destination, func(batch func() error) error {
+			if err := runJobHook(job.Hooks.Pre, args[0], job, false, nil); err != nil {
+				return fmt.Errorf("pre hook: %w", err)
+			}
+			err := batch()
+			if herr := runJobHook(job.Hooks.Post, args[0], job, true, err); herr != nil && err == nil {
+				err = fmt.Errorf("post hook: %w", herr)
+			}
+			return err
+		})
+	},
+	SilenceUsage: true,
+}
+
+func init() {
+	addTransferFlags(watchCmd.Flags())
+	watchCmd.Flags().DurationVar(&watchQuietPeriod, "quiet-period", 2*time.Second, "time without changes before a batch is transferred")
+	watchCmd.Flags().DurationVar(&watchMaxDelay, "max-delay", 30*time.Second, "maximum time a batch is delayed by continuous changes")
+	watchCmd.Flags().DurationVar(&watchRescanInterval, "rescan-interval", time.Hour, "time between full transfers, to catch missed changes (0 disables)")
+
+	rootCmd.AddCommand(&watchCmd)
+}
+
+// runWatch transfers batches of changes until the context is
+// done. If wrap is not nil, each batch runs through it. A failed batch
+// is logged, and makes the next batch a full transfer.
+func runWatch(ctx context.Context, srcSpec, destSpec string, wrap func(func() error) error) (rerr error) {
+	srcURL, err := parseFileSystemSpec(srcSpec)
+	if err != nil {
+		return err
+	}
+	if srcURL.Scheme != "file" {
+		return fmt.Errorf("watching requires a local source: %s", srcSpec)
+	}
+	destURL, err := parseFileSystemSpec(destSpec)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(destURL.Scheme, "cow+") {
+		// Each batch would become a snapshot missing all
+		// unchanged files.
+		return fmt.Errorf("watching does not support cow+ destinations: %s", destSpec)
+	}
+	if wrap == nil {
+		wrap = func(batch func() error) error { return batch() }
+	}
+
+	src, srcClose, err := makeFileSystemFromURL(srcURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		srcClose(rerr)
+	}()
+
+	dest, destClose, err := makeFileSystemFromURL(destURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := destClose(rerr); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	w, err := watch.NewWatcher(srcURL.Path,
+		watch.WithQuietPeriod(watchQuietPeriod),
+		watch.WithMaxDelay(watchMaxDelay),
+		watch.WithRescanInterval(watchRescanInterval))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for {
+		b, err := w.Next(ctx)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var paths []fs.Path
+		if b.Rescan {
+			glog.Infof("Transferring everything...")
+		} else {
+			paths = b.Paths
+			glog.Infof("Transferring %d changed paths...", len(paths))
+		}
+
+		err = wrap(func() error {
+			// Options are recreated, since filters can
+			// depend on the current time.
+			opts, printOpsMap, err := makeUploadOpts()
+			if err != nil {
+				return err
+			}
+			return runUpload(ctx, dest, src, paths, opts, printOpsMap)
+		})
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			glog.Errorf("Transfer failed, will retry with a full transfer: %v", err)
+			w.Rescan()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/tommie/fisy/fs"
+)
+
+var (
+	cryptKeyFile        string
+	cryptPassphraseFile string
+	cryptNames          bool
+)
+
+// cryptPassphraseEnv is the environment variable a passphrase can be
+// given in, instead of a file.
+const cryptPassphraseEnv = "FISY_CRYPT_PASSPHRASE"
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cryptKeyFile, "crypt-key-file", "", "file containing at least 32 random bytes, used as the key of crypt+ file systems")
+	rootCmd.PersistentFlags().StringVar(&cryptPassphraseFile, "crypt-passphrase-file", "", "file whose first line is the passphrase of crypt+ file systems (or set "+cryptPassphraseEnv+")")
+	rootCmd.PersistentFlags().BoolVar(&cryptNames, "crypt-names", false, "encrypt file names when creating a new crypt+ file system; names longer than 175 bytes are then rejected")
+}
+
+// makeCryptKey returns the key of crypt+ file systems, from the key
+// file, the passphrase file or the environment, in that order.
+func makeCryptKey() (fs.CryptKeyFunc, error) {
+	if cryptKeyFile != "" {
+		bs, err := ioutil.ReadFile(cryptKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return fs.CryptKeyFromSecret(bs), nil
+	}
+
+	if cryptPassphraseFile != "" {
+		bs, err := ioutil.ReadFile(cryptPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return fs.CryptKeyFromPassphrase(strings.SplitN(string(bs), "\n", 2)[0]), nil
+	}
+
+	if s := os.Getenv(cryptPassphraseEnv); s != "" {
+		return fs.CryptKeyFromPassphrase(s), nil
+	}
+
+	return nil, fmt.Errorf("crypt+ file systems need --crypt-key-file, --crypt-passphrase-file or %s", cryptPassphraseEnv)
+}
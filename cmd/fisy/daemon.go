@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/transfer"
+)
+
+// A daemonJobStatus is the state of a scheduled job. It is returned
+// by the status request, and persisted in the state file, except for
+// Running and Progress.
+type daemonJobStatus struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+
+	LastStart   time.Time `json:"last_start"`
+	LastEnd     time.Time `json:"last_end"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Failures is the number of consecutive failed runs.
+	Failures int       `json:"failures"`
+	NextRun  time.Time `json:"next_run"`
+
+	Running  bool                  `json:"running"`
+	Progress *transfer.UploadStats `json:"progress,omitempty"`
+}
+
+// A daemon runs scheduled jobs, one at a time. Failed runs are
+// retried with exponential back-off, but never later than the next
+// scheduled run.
+type daemon struct {
+	run        func(ctx context.Context, name string) error
+	statePath  string
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.Mutex
+	status map[string]*daemonJobStatus
+	upload *transfer.Upload
+}
+
+// newDaemon creates a daemon for the jobs that have a schedule. The
+// previous state is read from the state file, if it exists. The run
+// function is called to run a job.
+func newDaemon(cfg *jobsConfig, run func(ctx context.Context, name string) error, statePath string, backoff, maxBackoff time.Duration) (*daemon, error) {
+	d := &daemon{
+		run:        run,
+		statePath:  statePath,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		status:     map[string]*daemonJobStatus{},
+	}
+
+	saved, err := readDaemonState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := timeNow()
+	for _, name := range cfg.jobNames() {
+		interval := time.Duration(cfg.Jobs[name].Schedule.Interval)
+		if interval == 0 {
+			continue
+		}
+
+		st := saved[name]
+		if st == nil {
+			st = &daemonJobStatus{}
+		}
+		st.Name = name
+		st.Interval = interval
+		st.Running = false
+		st.Progress = nil
+		st.NextRun = d.nextRun(st, now)
+		d.status[name] = st
+	}
+	if len(d.status) == 0 {
+		return nil, fmt.Errorf("no jobs have a schedule")
+	}
+
+	return d, nil
+}
+
+// nextRun returns when the job should run next.
+func (d *daemon) nextRun(st *daemonJobStatus, now time.Time) time.Time {
+	next := st.LastStart.Add(st.Interval)
+	if st.Failures > 0 {
+		backoff := d.backoff
+		for i := 1; i < st.Failures && backoff < d.maxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+		if t := st.LastEnd.Add(backoff); t.Before(next) {
+			next = t
+		}
+	}
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
+
+// Run runs jobs as they become due, until the context is done.
+func (d *daemon) Run(ctx context.Context) error {
+	for {
+		name, at := d.due()
+		if wait := at.Sub(timeNow()); wait > 0 {
+			glog.V(1).Infof("Next run is job %q at %v.", name, at)
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil
+			case <-t.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		d.runJob(ctx, name)
+	}
+}
+
+// due returns the job that should run first, and when.
+func (d *daemon) due() (string, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var name string
+	var at time.Time
+	for _, st := range d.status {
+		if name == "" || st.NextRun.Before(at) || (st.NextRun.Equal(at) && st.Name < name) {
+			name = st.Name
+			at = st.NextRun
+		}
+	}
+	return name, at
+}
+
+// runJob runs a job once, and updates its status.
+func (d *daemon) runJob(ctx context.Context, name string) {
+	d.mu.Lock()
+	st := d.status[name]
+	st.Running = true
+	st.LastStart = timeNow()
+	d.mu.Unlock()
+
+	glog.Infof("Running job %q...", name)
+	err := d.run(ctx, name)
+
+	d.mu.Lock()
+	st.Running = false
+	st.LastEnd = timeNow()
+	d.upload = nil
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	} else {
+		st.Failures = 0
+		st.LastError = ""
+		st.LastSuccess = st.LastEnd
+	}
+	st.NextRun = d.nextRun(st, st.LastEnd)
+	failures, next := st.Failures, st.NextRun
+	d.mu.Unlock()
+
+	if err != nil {
+		glog.Errorf("Job %q failed (attempt %d), will run again at %v: %v", name, failures, next, err)
+	} else {
+		glog.Infof("Job %q finished, will run again at %v.", name, next)
+	}
+
+	if err := d.saveState(); err != nil {
+		glog.Warningf("Saving the daemon state failed (ignored): %v", err)
+	}
+}
+
+// setUpload records the upload of the running job, for progress
+// reporting.
+func (d *daemon) setUpload(u *transfer.Upload) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.upload = u
+}
+
+// Status returns the status of all scheduled jobs, sorted by name.
+func (d *daemon) Status() []*daemonJobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ret []*daemonJobStatus
+	for _, st := range d.status {
+		stc := *st
+		if st.Running && d.upload != nil {
+			stats := d.upload.Stats()
+			stc.Progress = &stats
+		}
+		ret = append(ret, &stc)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// ServeHTTP handles control requests. Only "GET /status" is
+// supported.
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/status" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.Status()); err != nil {
+		glog.Warningf("Writing status response failed: %v", err)
+	}
+}
+
+// saveState writes the job statuses to the state file. The file is
+// replaced atomically.
+func (d *daemon) saveState() error {
+	bs, err := json.MarshalIndent(d.Status(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(d.statePath), filepath.Base(d.statePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.statePath)
+}
+
+// readDaemonState reads a state file written by saveState. A missing
+// file is the same as an empty file.
+func readDaemonState(path string) (map[string]*daemonJobStatus, error) {
+	bs, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sts []*daemonJobStatus
+	if err := json.Unmarshal(bs, &sts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ret := make(map[string]*daemonJobStatus, len(sts))
+	for _, st := range sts {
+		ret[st.Name] = st
+	}
+	return ret, nil
+}
+
+// listenControlSocket listens on a unix socket. A stale socket file is
+// removed, but it is an error if another daemon is listening.
+func listenControlSocket(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// controlSocketClient returns an HTTP client that connects to the
+// daemon's unix socket, whatever the host in the URL is.
+func controlSocketClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// fetchDaemonStatus asks a daemon for the status of its jobs.
+func fetchDaemonStatus(ctx context.Context, path string) ([]*daemonJobStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://fisy/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := controlSocketClient(path).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status request failed: %s", resp.Status)
+	}
+
+	var sts []*daemonJobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&sts); err != nil {
+		return nil, err
+	}
+	return sts, nil
+}
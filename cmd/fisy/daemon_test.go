@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonNextRun(t *testing.T) {
+	d := &daemon{backoff: time.Minute, maxBackoff: 10 * time.Minute}
+	now := time.Unix(1000000, 0)
+
+	tsts := []struct {
+		Name string
+		St   daemonJobStatus
+		Want time.Time
+	}{
+		{"never", daemonJobStatus{Interval: time.Hour}, now},
+		{"due", daemonJobStatus{Interval: time.Hour, LastStart: now.Add(-2 * time.Hour)}, now},
+		{"later", daemonJobStatus{Interval: time.Hour, LastStart: now.Add(-time.Minute)}, now.Add(59 * time.Minute)},
+		{"failed", daemonJobStatus{Interval: time.Hour, LastStart: now, LastEnd: now, Failures: 1}, now.Add(time.Minute)},
+		{"failedTwice", daemonJobStatus{Interval: time.Hour, LastStart: now, LastEnd: now, Failures: 2}, now.Add(2 * time.Minute)},
+		{"failedMax", daemonJobStatus{Interval: time.Hour, LastStart: now, LastEnd: now, Failures: 100}, now.Add(10 * time.Minute)},
+		{"failedInterval", daemonJobStatus{Interval: 5 * time.Minute, LastStart: now, LastEnd: now, Failures: 100}, now.Add(5 * time.Minute)},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if got := d.nextRun(&tst.St, now); !got.Equal(tst.Want) {
+				t.Errorf("nextRun: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestDaemonRun(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "daemon-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	cfg := &jobsConfig{Jobs: map[string]*jobConfig{
+		"hourly": {Schedule: jobScheduleConfig{Interval: configDuration(time.Hour)}},
+		"manual": {},
+	}}
+	statePath := filepath.Join(tmpd, "state.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs []string
+	d, err := newDaemon(cfg, func(ctx context.Context, name string) error {
+		runs = append(runs, name)
+		if len(runs) == 1 {
+			return errors.New("mocked error")
+		}
+		cancel()
+		return nil
+	}, statePath, time.Millisecond, time.Millisecond)
+	if err != nil {
+		t.Fatalf("newDaemon failed: %v", err)
+	}
+
+	if err := d.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if want := []string{"hourly", "hourly"}; strings.Join(runs, ",") != strings.Join(want, ",") {
+		t.Errorf("runs: got %v, want %v", runs, want)
+	}
+
+	sts := d.Status()
+	if len(sts) != 1 {
+		t.Fatalf("Status: got %+v, want one job", sts)
+	}
+	st := sts[0]
+	if st.Failures != 0 || st.LastError != "" || st.LastSuccess.IsZero() {
+		t.Errorf("Status: got %+v, want a success", st)
+	}
+	if want := st.LastStart.Add(time.Hour); !st.NextRun.Equal(want) {
+		t.Errorf("NextRun: got %v, want %v", st.NextRun, want)
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		d2, err := newDaemon(cfg, nil, statePath, time.Millisecond, time.Millisecond)
+		if err != nil {
+			t.Fatalf("newDaemon failed: %v", err)
+		}
+		if got := d2.Status()[0]; !got.LastSuccess.Equal(st.LastSuccess) || !got.NextRun.Equal(st.NextRun) {
+			t.Errorf("Status: got %+v, want %+v", got, st)
+		}
+	})
+
+	t.Run("noSchedule", func(t *testing.T) {
+		_, err := newDaemon(&jobsConfig{}, nil, statePath, time.Millisecond, time.Millisecond)
+		if err == nil {
+			t.Errorf("newDaemon error: got %v, want an error", err)
+		}
+	})
+}
+
+func TestDaemonControlSocket(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "daemon-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	cfg := &jobsConfig{Jobs: map[string]*jobConfig{
+		"a": {Schedule: jobScheduleConfig{Interval: configDuration(time.Hour)}},
+	}}
+	d, err := newDaemon(cfg, nil, filepath.Join(tmpd, "state.json"), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("newDaemon failed: %v", err)
+	}
+
+	path := filepath.Join(tmpd, "daemon.sock")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ln, err := listenControlSocket(path)
+	if err != nil {
+		t.Fatalf("listenControlSocket failed: %v", err)
+	}
+	server := &http.Server{Handler: d}
+	go server.Serve(ln)
+	defer server.Close()
+
+	if _, err := listenControlSocket(path); err == nil {
+		t.Errorf("listenControlSocket error: got %v, want already listening", err)
+	}
+
+	sts, err := fetchDaemonStatus(context.Background(), path)
+	if err != nil {
+		t.Fatalf("fetchDaemonStatus failed: %v", err)
+	}
+	if len(sts) != 1 || sts[0].Name != "a" || sts[0].Interval != time.Hour {
+		t.Errorf("fetchDaemonStatus: got %+v, want job a", sts)
+	}
+
+	var buf bytes.Buffer
+	if err := printDaemonStatus(&buf, sts, sts[0].NextRun); err != nil {
+		t.Fatalf("printDaemonStatus failed: %v", err)
+	}
+	if want := "a    idle   never     in 0s"; !strings.Contains(buf.String(), want) {
+		t.Errorf("printDaemonStatus: got %q, want containing %q", buf.String(), want)
+	}
+}
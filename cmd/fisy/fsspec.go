@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/pkg/sftp"
 	"github.com/tommie/fisy/fs"
 	"github.com/tommie/fisy/remote"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // makeFileSystem creates a file system from a specification
@@ -29,6 +35,117 @@ func makeFileSystem(s string) (fs.WriteableFileSystem, func(error) error, error)
 	return makeFileSystemFromURL(u)
 }
 
+// makeReadableFileSystem is like makeFileSystem, but only for
+// reading. A cow+ URL selects an existing snapshot, with the "host"
+// and "snapshot" query parameters, instead of starting a new one. See
+// fs.OpenCOWSnapshot for the selectors. A tar URL reads an archive.
+func makeReadableFileSystem(s string) (fs.ReadableFileSystem, func(error) error, error) {
+	u, err := parseFileSystemSpec(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme == "tar" {
+		return makeTarFileSystem(u.Path)
+	}
+	if !strings.HasPrefix(u.Scheme, "cow+") {
+		return makeFileSystemFromURL(u)
+	}
+
+	raw, close, err := makeFileSystemFromURL(cowRepositoryURL(u))
+	if err != nil {
+		return nil, nil, err
+	}
+	sfs, err := makeCOWSnapshot(raw, u)
+	if err != nil {
+		close(err)
+		return nil, nil, err
+	}
+	return sfs, close, nil
+}
+
+// makeTarFileSystem opens a tar archive, which may be compressed with
+// gzip or bzip2. A compressed archive is first decompressed into an
+// unlinked temporary file, since the contents are read in any order.
+func makeTarFileSystem(path string) (fs.ReadableFileSystem, func(error) error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, nil, err
+	}
+	var zr io.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1F, 0x8B}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		zr = gr
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		zr = bzip2.NewReader(br)
+	}
+	if zr != nil {
+		tmpf, err := ioutil.TempFile("", "fisy-tar-")
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		os.Remove(tmpf.Name())
+		_, err = io.Copy(tmpf, zr)
+		f.Close()
+		if err != nil {
+			tmpf.Close()
+			return nil, nil, fmt.Errorf("decompressing %s: %w", path, err)
+		}
+		f = tmpf
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	tfs, err := fs.NewTar(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("indexing %s: %w", path, err)
+	}
+	return tfs, func(error) error { return f.Close() }, nil
+}
+
+// cowRepositoryURL returns the URL of the file system a cow+ URL
+// writes snapshots to, without the snapshot selection.
+func cowRepositoryURL(u *url.URL) *url.URL {
+	uu := *u
+	uu.Scheme = strings.TrimPrefix(uu.Scheme, "cow+")
+	q := uu.Query()
+	q.Del("host")
+	q.Del("snapshot")
+	uu.RawQuery = q.Encode()
+	return &uu
+}
+
+// makeCOWSnapshot opens the snapshot a cow+ URL selects. The host
+// defaults to this machine's hostname.
+func makeCOWSnapshot(raw fs.ReadableFileSystem, u *url.URL) (*fs.COWSnapshot, error) {
+	q := u.Query()
+	host := q.Get("host")
+	if host == "" {
+		var err error
+		host, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs.OpenCOWSnapshot(raw, host, q.Get("snapshot"))
+}
+
 // parseFileSystemSpec parses a string into a URL.
 //
 // Valid non-URLs shortcuts are:
@@ -56,6 +173,12 @@ func parseFileSystemSpec(s string) (*url.URL, error) {
 // system and a close function, or an error. The close function takes
 // an error. In some file systems, passing non-nil will cause changes
 // to be rolled back.
+//
+// Encrypted snapshots are written with cow+crypt+, where all
+// snapshots share the encryption parameters of the crypt+ file
+// system. The opposite order is rejected, since each snapshot would
+// get its own parameters. With encrypted names, crypt+ can't store
+// names longer than 175 bytes, since they would exceed NAME_MAX.
 func makeFileSystemFromURL(u *url.URL) (fs.WriteableFileSystem, func(error) error, error) {
 	if strings.HasPrefix(u.Scheme, "cow+") {
 		uu := *u
@@ -70,41 +193,105 @@ func makeFileSystemFromURL(u *url.URL) (fs.WriteableFileSystem, func(error) erro
 			return nil, nil, err
 		}
 		cfs, err := fs.NewCOW(raw, host, timeNow())
+		var lerr *fs.COWLockedError
+		if errors.As(err, &lerr) {
+			close(err)
+			return nil, nil, fmt.Errorf("%w (use \"fisy unlock\" if it is stale)", err)
+		} else if err != nil {
+			close(err)
+			return nil, nil, err
+		}
+		if l := cfs.BrokenLock(); l != nil {
+			glog.Warningf("Broke a stale lock of host %q: %v", host, l)
+		}
 		return cfs, func(err error) error {
 			if err == nil {
 				if err := cfs.Finish(); err != nil {
+					cfs.Unlock()
 					return err
 				}
+			} else if uerr := cfs.Unlock(); uerr != nil {
+				glog.Warningf("Releasing the lock of host %q failed: %v", host, uerr)
 			}
 			return close(err)
-		}, err
+		}, nil
+	}
+
+	if strings.HasPrefix(u.Scheme, "crypt+") {
+		uu := *u
+		uu.Scheme = uu.Scheme[6:]
+		if strings.HasPrefix(uu.Scheme, "cow+") {
+			return nil, nil, fmt.Errorf("crypt+ can't be used over cow+, use cow+crypt+ instead: %s", u.Scheme)
+		}
+
+		key, err := makeCryptKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		raw, close, err := makeFileSystemFromURL(&uu)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfs, err := fs.NewCrypt(raw, key, cryptNames)
+		if err != nil {
+			close(err)
+			return nil, nil, err
+		}
+		return cfs, close, nil
 	}
 
 	switch u.Scheme {
 	case "file":
 		return fs.NewLocal(u.Path), func(error) error { return nil }, nil
 
-	case "sftp":
-		host := u.Host
-		if u.Port() == "" {
-			host += defaultPortSuffix
+	case "tar":
+		return nil, nil, fmt.Errorf("tar archives can only be read: %s", u.Path)
+
+	case "s3":
+		client, err := makeS3Client(u)
+		if err != nil {
+			return nil, nil, err
 		}
+		return fs.NewS3(client, u.Path), func(error) error { return nil }, nil
+
+	case "webdav", "webdavs":
+		return fs.NewWebDAV(makeWebDAVClient(u)), func(error) error { return nil }, nil
+
+	case "mem":
+		// A scratch file system, discarded on close.
+		return fs.NewMemory(), func(error) error { return nil }, nil
 
-		user := os.Getenv("LOGNAME")
-		if u.User != nil {
-			if s := u.User.Username(); s != "" {
-				user = s
+	case "sftp":
+		dcfg, err := makeSSHDialConfig(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		var opts []remote.ReconnectingSFTPClientOpt
+		if s := u.Query().Get("sessions"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, nil, fmt.Errorf("invalid number of sessions: %s", s)
 			}
+			opts = append(opts, remote.WithPoolSize(n))
 		}
-		knownHostsPath := filepath.Join(os.Getenv("HOME"), ".ssh/known_hosts")
-		if path := u.Query().Get("knownhosts"); path != "" {
-			knownHostsPath = path
+		if dcfg.ServerAliveInterval > 0 {
+			opts = append(opts, remote.WithKeepalive(dcfg.ServerAliveInterval, time.Duration(dcfg.ServerAliveCountMax)*dcfg.ServerAliveInterval))
 		}
-		agentSockPath := os.Getenv("SSH_AUTH_SOCK")
-		if path := u.Query().Get("authsock"); path != "" {
-			agentSockPath = path
+		opTimeout := defaultSFTPOperationTimeout
+		if s := u.Query().Get("optimeout"); s != "" {
+			opTimeout, err = time.ParseDuration(s)
+			if err != nil || opTimeout < 0 {
+				return nil, nil, fmt.Errorf("invalid operation timeout: %s", s)
+			}
 		}
-		sftpc, err := remote.NewReconnectingSFTPClient(sftpClientDialler(host, user, knownHostsPath, agentSockPath))
+		if opTimeout > 0 {
+			opts = append(opts, remote.WithOperationTimeout(opTimeout))
+		}
+		// The helper is opt-in, e.g. "?serve=fisy+serve", since
+		// servers restricted to SFTP would stall every connection
+		// until helperStartTimeout.
+		serveCmd := u.Query().Get("serve")
+		sftpc, err := remote.NewReconnectingSFTPClient(sftpClientDialler(dcfg, serveCmd), opts...)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -115,54 +302,248 @@ func makeFileSystemFromURL(u *url.URL) (fs.WriteableFileSystem, func(error) erro
 	}
 }
 
+// makeS3Client creates a client for the bucket of an "s3" URL. The
+// credentials are read from the usual AWS environment variables. The
+// region and endpoint can be set with query parameters, e.g. for
+// other S3-compatible services.
+func makeS3Client(u *url.URL) (*remote.S3Client, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing S3 bucket: %s", u)
+	}
+	q := u.Query()
+
+	region := firstNonEmpty(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint, err := url.Parse(firstNonEmpty(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	creds := remote.S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 URLs")
+	}
+
+	return remote.NewS3Client(endpoint, region, u.Host, creds), nil
+}
+
+// webDAVPasswordEnv is the environment variable the password of
+// "webdav" URLs can be given in, instead of in the URL.
+const webDAVPasswordEnv = "FISY_WEBDAV_PASSWORD"
+
+// makeWebDAVClient creates a client for a "webdav" (HTTP) or "webdavs"
+// (HTTPS) URL. If the URL has a user, Basic authentication is used.
+func makeWebDAVClient(u *url.URL) *remote.WebDAVClient {
+	base := &url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	var opts []remote.WebDAVClientOpt
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = os.Getenv(webDAVPasswordEnv)
+		}
+		opts = append(opts, remote.WithWebDAVBasicAuth(u.User.Username(), password))
+	}
+	return remote.NewWebDAVClient(base, opts...)
+}
+
+// firstNonEmpty returns the first non-empty string.
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
 var (
 	// Note that ":ssh" doesn't work with the sftp library. It
 	// would try to match a host key named "host:ssh" instead of
 	// canonicalizing it to just "host".
 	defaultPortSuffix = ":22"
 
+	// defaultServerAliveInterval is used unless ssh_config or the
+	// URL sets a keepalive interval. Unlike OpenSSH, keepalives are
+	// on by default, since a half-dead connection would otherwise
+	// hang a transfer.
+	defaultServerAliveInterval = 30 * time.Second
+
+	// defaultSFTPOperationTimeout is the deadline of each SFTP
+	// operation, unless the URL sets one.
+	defaultSFTPOperationTimeout = 5 * time.Minute
+
+	// helperStartTimeout is how long to wait for the helper to
+	// start, before using plain SFTP.
+	helperStartTimeout = 10 * time.Second
+
 	// timeNow is a mock injection point.
 	timeNow = time.Now
 )
 
-// sftpClientDialler returns a dialler that can connect to the given host.
-func sftpClientDialler(host, user, knownHostsPath, agentSockPath string) func() (remote.CloseableSFTPClient, error) {
-	return func() (remote.CloseableSFTPClient, error) {
-		hkcb, err := knownhosts.New(knownHostsPath)
-		if err != nil {
-			return nil, err
+// makeSSHDialConfig creates an SSH dial configuration from an "sftp"
+// URL. Query parameters take precedence over ssh_config.
+func makeSSHDialConfig(u *url.URL) (*sshDialConfig, error) {
+	q := u.Query()
+
+	sshConfigPath := defaultSSHConfigPath()
+	if path := q.Get("sshconfig"); path != "" {
+		sshConfigPath = path
+	}
+	sshcfg, err := readSSHConfig(sshConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var user string
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	cfg := sshDialConfig{
+		sshEndpoint:    resolveSSHEndpoint(sshcfg, user, u.Hostname(), u.Port()),
+		KnownHostsPath: defaultKnownHostsPath(),
+		AgentSockPath:  os.Getenv("SSH_AUTH_SOCK"),
+	}
+
+	if path := q.Get("knownhosts"); path != "" {
+		cfg.KnownHostsPath = path
+	}
+	hkPolicySpec := hostKeyPolicySpec
+	if s := q.Get("hostkeypolicy"); s != "" {
+		hkPolicySpec = s
+	}
+	cfg.HostKeyPolicy, err = parseHostKeyPolicy(hkPolicySpec)
+	if err != nil {
+		return nil, err
+	}
+	if path := q.Get("authsock"); path != "" {
+		cfg.AgentSockPath = path
+	}
+
+	proxyJump := sshcfg.Get(u.Hostname(), "ProxyJump")
+	if _, ok := q["proxyjump"]; ok {
+		proxyJump = q.Get("proxyjump")
+	}
+	cfg.ProxyJump, err = parseProxyJump(sshcfg, proxyJump)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ProxyCommand = sshcfg.Get(u.Hostname(), "ProxyCommand")
+	if _, ok := q["proxycommand"]; ok {
+		cfg.ProxyCommand = q.Get("proxycommand")
+	}
+	if cfg.ProxyCommand == "none" {
+		cfg.ProxyCommand = ""
+	}
+
+	cfg.ServerAliveInterval = defaultServerAliveInterval
+	if s := sshcfg.Get(u.Hostname(), "ServerAliveInterval"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid ServerAliveInterval: %s", s)
 		}
-		agentConn, err := net.Dial("unix", agentSockPath)
-		if err != nil {
-			return nil, err
+		cfg.ServerAliveInterval = time.Duration(n) * time.Second
+	}
+	if s := q.Get("keepalive"); s != "" {
+		cfg.ServerAliveInterval, err = time.ParseDuration(s)
+		if err != nil || cfg.ServerAliveInterval < 0 {
+			return nil, fmt.Errorf("invalid keepalive interval: %s", s)
 		}
-		cfg := ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers),
-			},
-			HostKeyCallback: hkcb,
-			Timeout:         30 * time.Second,
+	}
+	cfg.ServerAliveCountMax = 3
+	if s := sshcfg.Get(u.Hostname(), "ServerAliveCountMax"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid ServerAliveCountMax: %s", s)
 		}
+		cfg.ServerAliveCountMax = n
+	}
+
+	return &cfg, nil
+}
 
-		sc, err := ssh.Dial("tcp", host, &cfg)
+// sftpClientDialler returns a dialler that can connect to the given
+// host. Every reconnect goes through the same jump hosts or proxy
+// command. If serveCmd is not empty, it is run on the server to start
+// a helper. Without the helper, plain SFTP is used.
+func sftpClientDialler(cfg *sshDialConfig, serveCmd string) func() (remote.CloseableSFTPClient, error) {
+	return func() (remote.CloseableSFTPClient, error) {
+		sc, closeSSH, err := dialSSH(cfg)
 		if err != nil {
 			return nil, err
 		}
 
 		sftpc, err := sftp.NewClient(sc)
 		if err != nil {
+			closeSSH()
 			return nil, err
 		}
 
-		return &connectedSFTPClient{
-			Client: sftpc,
-			closers: []func() error{
-				sc.Close,
-				agentConn.Close,
-			},
-		}, nil
+		c := &connectedSFTPClient{
+			Client:  sftpc,
+			sshc:    sc,
+			closers: []func() error{closeSSH},
+		}
+		if serveCmd != "" {
+			helper, closeHelper, err := startHelper(sc, serveCmd)
+			if err != nil {
+				glog.Infof("Remote helper %q is not available, using plain SFTP: %v", serveCmd, err)
+			} else {
+				c.helper = helper
+				c.closers = append([]func() error{closeHelper}, c.closers...)
+			}
+		}
+		return c, nil
+	}
+}
+
+// startHelper runs the helper command on the server, and waits for
+// it to start. It fails if the command doesn't exist.
+func startHelper(sc *ssh.Client, command string) (*remote.HelperClient, func() error, error) {
+	sess, err := sc.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, nil, err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, nil, err
+	}
+	if err := sess.Start(command); err != nil {
+		sess.Close()
+		return nil, nil, err
+	}
+
+	// Closing the session makes the handshake fail, if the command
+	// doesn't answer.
+	timer := time.AfterFunc(helperStartTimeout, func() { sess.Close() })
+	hc, err := remote.NewHelperClient(stdout, stdin)
+	if !timer.Stop() && err == nil {
+		err = fmt.Errorf("helper didn't start within %v", helperStartTimeout)
+	}
+	if err != nil {
+		sess.Close()
+		return nil, nil, err
 	}
+
+	return hc, func() error {
+		hc.Close()
+		// The session is already closed if the helper exited.
+		if err := sess.Close(); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}, nil
 }
 
 // A connectSFTPClient is an SFTP client that can close multiple
@@ -171,18 +552,52 @@ func sftpClientDialler(host, user, knownHostsPath, agentSockPath string) func()
 type connectedSFTPClient struct {
 	*sftp.Client
 
+	sshc    *ssh.Client
+	helper  *remote.HelperClient
 	closers []func() error
+
+	// closeOnce makes Abort and Close run the closers only once.
+	closeOnce sync.Once
+	closeErr  error
 }
 
-// close runs Client.Close and then all the other closers.
-func (c connectedSFTPClient) Close() error {
+// Helper returns the "fisy serve" helper, or nil.
+func (c *connectedSFTPClient) Helper() *remote.HelperClient {
+	return c.helper
+}
+
+// Keepalive sends an OpenSSH keepalive request and waits for the
+// reply. Servers reject unknown requests, but any reply shows the
+// connection is alive.
+func (c *connectedSFTPClient) Keepalive() error {
+	_, _, err := c.sshc.SendRequest("keepalive@openssh.com", true, nil)
+	return err
+}
+
+// Abort runs the closers without closing the SFTP session first,
+// which could block on a stalled connection.
+func (c *connectedSFTPClient) Abort() error {
+	return c.runClosers()
+}
+
+// close runs Client.Close and then all the other closers. After
+// Abort, only Client.Close is run.
+func (c *connectedSFTPClient) Close() error {
 	if err := c.Client.Close(); err != nil {
 		return err
 	}
-	for _, fun := range c.closers {
-		if err := fun(); err != nil {
-			return err
+	return c.runClosers()
+}
+
+// runClosers runs the closers the first time it is called, and
+// returns the same error every time.
+func (c *connectedSFTPClient) runClosers() error {
+	c.closeOnce.Do(func() {
+		for _, fun := range c.closers {
+			if err := fun(); err != nil && c.closeErr == nil {
+				c.closeErr = err
+			}
 		}
-	}
-	return nil
+	})
+	return c.closeErr
 }
@@ -1,25 +1,34 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"crypto/rsa"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pkg/sftp"
 	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/remote"
+	"github.com/tommie/fisy/remote/testutil"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/webdav"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -76,6 +85,10 @@ func TestMakeFileSystemFromURL(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
+		// Let makeFileSystemFromURL take the lock.
+		if err := cow.Unlock(); err != nil {
+			panic(err)
+		}
 		return cow
 	}
 
@@ -94,6 +107,9 @@ func TestMakeFileSystemFromURL(t *testing.T) {
 		WantErr error
 	}{
 		{url.URL{}, nil, fmt.Errorf("unknown URL scheme: ")},
+		{url.URL{Scheme: "sftp", Host: "host", RawQuery: "sessions=0"}, nil, fmt.Errorf("invalid number of sessions: 0")},
+		{url.URL{Scheme: "sftp", Host: "host", RawQuery: "keepalive=x"}, nil, fmt.Errorf("invalid keepalive interval: x")},
+		{url.URL{Scheme: "sftp", Host: "host", RawQuery: "optimeout=-1s"}, nil, fmt.Errorf("invalid operation timeout: -1s")},
 		{url.URL{Scheme: "file", Path: tmpd}, fs.NewLocal(tmpd), nil},
 		{url.URL{Scheme: "cow+file", Path: tmpd}, newCOW(fs.NewLocal(tmpd), hostname, timeNow()), nil},
 	}
@@ -117,6 +133,19 @@ func TestMakeFileSystemFromURL(t *testing.T) {
 		})
 	}
 
+	t.Run("mem", func(t *testing.T) {
+		wfs, done, err := makeFileSystemFromURL(&url.URL{Scheme: "mem"})
+		if err != nil {
+			t.Fatalf("makeFileSystemFromURL failed: %v", err)
+		}
+		if _, ok := wfs.(*fs.Memory); !ok {
+			t.Errorf("makeFileSystemFromURL: got %T, want *fs.Memory", wfs)
+		}
+		if err := done(nil); err != nil {
+			t.Errorf("done failed: %v", err)
+		}
+	})
+
 	t.Run("sftp", func(t *testing.T) {
 		sshAddr, agentPath, knownHostsPath, done, err := newTestSFTPServer(tmpd)
 		if err != nil {
@@ -129,23 +158,114 @@ func TestMakeFileSystemFromURL(t *testing.T) {
 			defaultPortSuffix = ":22"
 		}()
 
-		wfs, close, err := makeFileSystemFromURL(&url.URL{
-			Scheme: "sftp",
-			// We don't use the port here, so we exercise the defaultPortSuffix code path.
-			Host: fmt.Sprintf("[%s]", sshAddr.IP.String()),
-			User: url.User("tester"),
-			Path: tmpd,
-			RawQuery: url.Values{
-				"authsock":   []string{agentPath},
-				"knownhosts": []string{knownHostsPath},
-			}.Encode(),
-		})
+		// The helper is only started if the URL names it.
+		tsts := []struct {
+			Name      string
+			Serve     []string
+			WantExecs int32
+		}{
+			{"plain", nil, 0},
+			{"serve", []string{"fisy serve"}, 1},
+		}
+		for _, tst := range tsts {
+			t.Run(tst.Name, func(t *testing.T) {
+				execs := atomic.LoadInt32(&testSFTPServerExecs)
+				wfs, close, err := makeFileSystemFromURL(&url.URL{
+					Scheme: "sftp",
+					// We don't use the port here, so we exercise the defaultPortSuffix code path.
+					Host: fmt.Sprintf("[%s]", sshAddr.IP.String()),
+					User: url.User("tester"),
+					Path: tmpd,
+					RawQuery: url.Values{
+						"authsock":   []string{agentPath},
+						"knownhosts": []string{knownHostsPath},
+						"sessions":   []string{"2"},
+						"keepalive":  []string{"10ms"},
+						"optimeout":  []string{"1m"},
+						"serve":      tst.Serve,
+					}.Encode(),
+				})
+				if err != nil {
+					t.Fatalf("makeFileSystemFromURL failed: %v", err)
+				}
+
+				if _, ok := wfs.(*fs.SFTP); !ok {
+					t.Errorf("makeFileSystemFromURL: got %T, want *fs.SFTP", wfs)
+				}
+				if got := atomic.LoadInt32(&testSFTPServerExecs) - execs; got != tst.WantExecs {
+					t.Errorf("commands run: got %v, want %v", got, tst.WantExecs)
+				}
+
+				if err := close(nil); err != nil {
+					t.Errorf("close failed: %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		s := httptest.NewServer(testutil.NewFakeS3("bucket"))
+		defer s.Close()
+
+		u := &url.URL{Scheme: "s3", Host: "bucket", Path: "/backups", RawQuery: url.Values{"endpoint": []string{s.URL}}.Encode()}
+
+		for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+			if v, ok := os.LookupEnv(k); ok {
+				defer os.Setenv(k, v)
+			} else {
+				defer os.Unsetenv(k)
+			}
+			os.Unsetenv(k)
+		}
+		if _, _, err := makeFileSystemFromURL(u); err == nil {
+			t.Errorf("makeFileSystemFromURL: got %v, want missing credentials", err)
+		}
+
+		os.Setenv("AWS_ACCESS_KEY_ID", "id")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		wfs, close, err := makeFileSystemFromURL(u)
 		if err != nil {
 			t.Fatalf("makeFileSystemFromURL failed: %v", err)
 		}
+		if _, ok := wfs.(*fs.S3); !ok {
+			t.Errorf("makeFileSystemFromURL: got %T, want *fs.S3", wfs)
+		}
+		if err := wfs.Mkdir("a", 0755, -1, -1); err != nil {
+			t.Errorf("Mkdir failed: %v", err)
+		}
 
-		if _, ok := wfs.(*fs.SFTP); !ok {
-			t.Errorf("makeFileSystemFromURL: got %T, want *fs.SFTP", wfs)
+		if err := close(nil); err != nil {
+			t.Errorf("close failed: %v", err)
+		}
+	})
+
+	t.Run("webdav", func(t *testing.T) {
+		dav := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "tester" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			dav.ServeHTTP(w, r)
+		}))
+		defer s.Close()
+
+		if v, ok := os.LookupEnv(webDAVPasswordEnv); ok {
+			defer os.Setenv(webDAVPasswordEnv, v)
+		} else {
+			defer os.Unsetenv(webDAVPasswordEnv)
+		}
+		os.Setenv(webDAVPasswordEnv, "secret")
+
+		wfs, close, err := makeFileSystemFromURL(&url.URL{Scheme: "webdav", Host: strings.TrimPrefix(s.URL, "http://"), User: url.User("tester")})
+		if err != nil {
+			t.Fatalf("makeFileSystemFromURL failed: %v", err)
+		}
+		if _, ok := wfs.(*fs.WebDAV); !ok {
+			t.Errorf("makeFileSystemFromURL: got %T, want *fs.WebDAV", wfs)
+		}
+		if err := wfs.Mkdir("a", 0755, -1, -1); err != nil {
+			t.Errorf("Mkdir failed: %v", err)
 		}
 
 		if err := close(nil); err != nil {
@@ -154,6 +274,131 @@ func TestMakeFileSystemFromURL(t *testing.T) {
 	})
 }
 
+func TestConnectedSFTPClientKeepalive(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "fsspec-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	sshAddr, agentPath, knownHostsPath, done, err := newTestSFTPServer(tmpd)
+	if err != nil {
+		t.Fatalf("newTestSFTPServer failed: %v", err)
+	}
+	defer done()
+
+	client, err := sftpClientDialler(&sshDialConfig{
+		sshEndpoint:    sshEndpoint{User: "tester", Addr: sshAddr.String()},
+		KnownHostsPath: knownHostsPath,
+		HostKeyPolicy:  strictHostKeyPolicy,
+		AgentSockPath:  agentPath,
+	}, "")()
+	if err != nil {
+		t.Fatalf("sftpClientDialler failed: %v", err)
+	}
+	defer client.Close()
+
+	var nclosed int
+	cc := client.(*connectedSFTPClient)
+	cc.closers = append(cc.closers, func() error {
+		nclosed++
+		return nil
+	})
+
+	kc, ok := client.(remote.KeepaliveSFTPClient)
+	if !ok {
+		t.Fatalf("sftpClientDialler: got %T, want a remote.KeepaliveSFTPClient", client)
+	}
+	if err := kc.Keepalive(); err != nil {
+		t.Errorf("Keepalive failed: %v", err)
+	}
+
+	if err := kc.Abort(); err != nil {
+		t.Errorf("Abort failed: %v", err)
+	}
+	if _, err := kc.Lstat(tmpd); err == nil {
+		t.Errorf("Lstat after Abort: got nil, want error")
+	}
+	if err := kc.Keepalive(); err == nil {
+		t.Errorf("Keepalive after Abort: got nil, want error")
+	}
+
+	// Closing after an abort must not run the closers again.
+	kc.Close()
+	if want := 1; nclosed != want {
+		t.Errorf("closer calls: got %v, want %v", nclosed, want)
+	}
+}
+
+func TestConnectedSFTPClientHelper(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "fsspec-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	sshAddr, agentPath, knownHostsPath, done, err := newTestSFTPServer(tmpd)
+	if err != nil {
+		t.Fatalf("newTestSFTPServer failed: %v", err)
+	}
+	defer done()
+
+	if err := ioutil.WriteFile(filepath.Join(tmpd, "file"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	tsts := []struct {
+		Name       string
+		Command    string
+		WantHelper bool
+	}{
+		{"serve", "fisy serve", true},
+		{"missing", "fisy-missing serve", false},
+		{"disabled", "", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			client, err := sftpClientDialler(&sshDialConfig{
+				sshEndpoint:    sshEndpoint{User: "tester", Addr: sshAddr.String()},
+				KnownHostsPath: knownHostsPath,
+				HostKeyPolicy:  strictHostKeyPolicy,
+				AgentSockPath:  agentPath,
+			}, tst.Command)()
+			if err != nil {
+				t.Fatalf("sftpClientDialler failed: %v", err)
+			}
+			defer func() {
+				if err := client.Close(); err != nil {
+					t.Errorf("Close failed: %v", err)
+				}
+			}()
+
+			h := client.(remote.HelperSFTPClient).Helper()
+			if got := h != nil; got != tst.WantHelper {
+				t.Fatalf("Helper: got %v, want %v", h, tst.WantHelper)
+			}
+			if h != nil {
+				sum, err := h.HashFile(filepath.Join(tmpd, "file"))
+				if err != nil {
+					t.Fatalf("HashFile failed: %v", err)
+				}
+				if want := sha256.Sum256([]byte("hello")); sum != want {
+					t.Errorf("HashFile: got %x, want %x", sum, want)
+				}
+			}
+
+			// Plain SFTP works either way.
+			if _, err := client.Lstat(tmpd); err != nil {
+				t.Errorf("Lstat failed: %v", err)
+			}
+		})
+	}
+}
+
+// testSFTPServerExecs counts the commands run on servers from
+// newTestSFTPServer. It must be accessed atomically.
+var testSFTPServerExecs int32
+
 func newTestSFTPServer(tmpd string) (*net.TCPAddr, string, string, func() error, error) {
 	var closed uint32
 	var eg errgroup.Group
@@ -246,6 +491,12 @@ func newTestSFTPServer(tmpd string) (*net.TCPAddr, string, string, func() error,
 			eg.Go(func() error {
 				defer sconn.Close()
 				for nchan := range nchans {
+					if nchan.ChannelType() == "direct-tcpip" {
+						if err := serveTestDirectTCPIP(&eg, nchan); err != nil {
+							return err
+						}
+						continue
+					}
 					if nchan.ChannelType() != "session" {
 						nchan.Reject(ssh.UnknownChannelType, "unhandled channel type")
 						continue
@@ -254,24 +505,48 @@ func newTestSFTPServer(tmpd string) (*net.TCPAddr, string, string, func() error,
 					if err != nil {
 						return err
 					}
-					s, err := sftp.NewServer(ch)
-					if err != nil {
-						return err
-					}
 
 					eg.Go(func() error {
 						for req := range reqs {
-							if req.WantReply {
-								req.Reply(req.Type == "subsystem", nil)
-							}
-						}
-						return nil
-					})
-					eg.Go(func() error {
-						defer ch.Close()
+							switch req.Type {
+							case "subsystem":
+								req.Reply(true, nil)
+								s, err := sftp.NewServer(ch)
+								if err != nil {
+									return err
+								}
+								eg.Go(func() error {
+									defer ch.Close()
 
-						if err := s.Serve(); err != nil && err != io.EOF {
-							return err
+									if err := s.Serve(); err != nil && err != io.EOF {
+										return err
+									}
+									return nil
+								})
+
+							case "exec":
+								// Like a shell, it accepts any
+								// command, but only knows "fisy
+								// serve".
+								atomic.AddInt32(&testSFTPServerExecs, 1)
+								req.Reply(true, nil)
+								var payload struct{ Command string }
+								ssh.Unmarshal(req.Payload, &payload)
+								eg.Go(func() error {
+									defer ch.Close()
+
+									if payload.Command != "fisy serve" {
+										ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{127}))
+										return nil
+									}
+									return remote.Serve(ch, ch)
+								})
+
+							default:
+								if req.WantReply {
+									req.Reply(false, nil)
+								}
+							}
 						}
 						return nil
 					})
@@ -283,3 +558,156 @@ func newTestSFTPServer(tmpd string) (*net.TCPAddr, string, string, func() error,
 
 	return sl.Addr().(*net.TCPAddr), agentPath, knownHostsPath, done, nil
 }
+
+// serveTestDirectTCPIP accepts a port forwarding channel, as used by
+// jump hosts.
+func serveTestDirectTCPIP(eg *errgroup.Group, nchan ssh.NewChannel) error {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nchan.ExtraData(), &payload); err != nil {
+		return err
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+	if err != nil {
+		return nchan.Reject(ssh.ConnectionFailed, err.Error())
+	}
+	ch, reqs, err := nchan.Accept()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	eg.Go(func() error {
+		defer ch.CloseWrite()
+		io.Copy(ch, conn)
+		return nil
+	})
+	eg.Go(func() error {
+		defer conn.Close()
+		io.Copy(conn, ch)
+		return nil
+	})
+	return nil
+}
+
+func TestMakeFileSystemFromURLCrypt(t *testing.T) {
+	defer func(k string, n bool) { cryptKeyFile, cryptNames = k, n }(cryptKeyFile, cryptNames)
+
+	tmpd, err := ioutil.TempDir("", "fsspec-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	cryptKeyFile = ""
+	if _, _, err := makeFileSystemFromURL(&url.URL{Scheme: "crypt+file", Path: tmpd}); err == nil || !strings.Contains(err.Error(), "--crypt-key-file") {
+		t.Errorf("makeFileSystemFromURL error: got %v, want missing key", err)
+	}
+
+	cryptKeyFile = filepath.Join(tmpd, "key")
+	if err := ioutil.WriteFile(cryptKeyFile, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	cryptNames = true
+	destd := filepath.Join(tmpd, "dest")
+	if err := os.Mkdir(destd, 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	wfs, done, err := makeFileSystemFromURL(&url.URL{Scheme: "crypt+file", Path: destd})
+	if err != nil {
+		t.Fatalf("makeFileSystemFromURL failed: %v", err)
+	}
+	if _, ok := wfs.(*fs.Crypt); !ok {
+		t.Errorf("makeFileSystemFromURL: got %T, want *fs.Crypt", wfs)
+	}
+	if err := wfs.Mkdir("secret", 0700, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := done(nil); err != nil {
+		t.Errorf("done failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(destd, "secret")); !os.IsNotExist(err) {
+		t.Errorf("Stat error: got %v, want an encrypted name", err)
+	}
+
+	t.Run("cow", func(t *testing.T) {
+		if _, _, err := makeFileSystemFromURL(&url.URL{Scheme: "crypt+cow+file", Path: destd}); err == nil || !strings.Contains(err.Error(), "cow+crypt+") {
+			t.Errorf("makeFileSystemFromURL error: got %v, want crypt+ over cow+ rejected", err)
+		}
+
+		cowd := filepath.Join(tmpd, "cow")
+		if err := os.Mkdir(cowd, 0700); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		wfs, done, err := makeFileSystemFromURL(&url.URL{Scheme: "cow+crypt+file", Path: cowd})
+		if err != nil {
+			t.Fatalf("makeFileSystemFromURL failed: %v", err)
+		}
+		if _, ok := wfs.(*fs.COW); !ok {
+			t.Errorf("makeFileSystemFromURL: got %T, want *fs.COW", wfs)
+		}
+		if err := done(nil); err != nil {
+			t.Errorf("done failed: %v", err)
+		}
+	})
+}
+
+func TestMakeReadableFileSystemTar(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "fsspec-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	path := filepath.Join(tmpd, "archive.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0600, Size: 5}); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	if _, err := io.WriteString(tw, "hello"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	for _, c := range []io.Closer{tw, zw, f} {
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	rfs, done, err := makeReadableFileSystem("tar://" + path)
+	if err != nil {
+		t.Fatalf("makeReadableFileSystem failed: %v", err)
+	}
+	defer done(nil)
+
+	if _, ok := rfs.(*fs.Tar); !ok {
+		t.Errorf("makeReadableFileSystem: got %T, want *fs.Tar", rfs)
+	}
+	fr, err := rfs.Open("a")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(bs) != "hello" {
+		t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+	}
+
+	if _, _, err := makeFileSystem("tar://" + path); err == nil {
+		t.Errorf("makeFileSystem: got %v, want error", err)
+	}
+}
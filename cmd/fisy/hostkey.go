@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var hostKeyPolicySpec string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&hostKeyPolicySpec, "host-key-policy", string(strictHostKeyPolicy), "what to do with SSH hosts not in known_hosts ('strict' rejects, 'accept-new' adds them, 'ask' prompts). Overridden by the hostkeypolicy URL parameter")
+}
+
+// defaultKnownHostsPath returns the path of the user's known_hosts file.
+func defaultKnownHostsPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh/known_hosts")
+}
+
+// parseHostKeyPolicy parses a specification for a host key policy.
+func parseHostKeyPolicy(s string) (hostKeyPolicy, error) {
+	ss := hostKeyPolicy(s)
+	switch ss {
+	case strictHostKeyPolicy, acceptNewHostKeyPolicy, askHostKeyPolicy:
+		return ss, nil
+	default:
+		return "", fmt.Errorf("unknown host key policy: %s", s)
+	}
+}
+
+// A hostKeyPolicy decides what happens when a server presents a host
+// key that is not in the known_hosts file. Changed keys are always
+// rejected.
+type hostKeyPolicy string
+
+const (
+	strictHostKeyPolicy    hostKeyPolicy = "strict"
+	acceptNewHostKeyPolicy hostKeyPolicy = "accept-new"
+	askHostKeyPolicy       hostKeyPolicy = "ask"
+)
+
+// makeHostKeyCallback returns a host key callback that verifies keys
+// against the known_hosts file, and handles unknown hosts according
+// to the policy.
+func makeHostKeyCallback(knownHostsPath string, policy hostKeyPolicy) (ssh.HostKeyCallback, error) {
+	hkcb, err := knownhosts.New(knownHostsPath)
+	if os.IsNotExist(err) && policy != strictHostKeyPolicy {
+		// Every host is unknown.
+		hkcb = func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	} else if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known, err := lookupKnownHost(hkcb, hostname, remote, key); known || err != nil {
+			return err
+		}
+
+		// Pooled connections dial concurrently, so another one
+		// may have added the host while we waited.
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		current, err := knownhosts.New(knownHostsPath)
+		if os.IsNotExist(err) {
+			current = func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+		} else if err != nil {
+			return err
+		}
+		if known, err := lookupKnownHost(current, hostname, remote, key); known || err != nil {
+			return err
+		}
+
+		switch policy {
+		case acceptNewHostKeyPolicy:
+			// Continue.
+
+		case askHostKeyPolicy:
+			ok, err := hostKeyPrompt(hostname, key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("host key for %s was rejected", hostname)
+			}
+
+		default:
+			return fmt.Errorf("host %s is not in %s (presented %s key %s); use `fisy hostkey --add` or host key policy 'accept-new' to trust it", hostname, knownHostsPath, key.Type(), ssh.FingerprintSHA256(key))
+		}
+
+		return appendKnownHost(knownHostsPath, hostname, key)
+	}, nil
+}
+
+// lookupKnownHost returns whether the host key is in known_hosts. A
+// *HostKeyChangedError is returned if the host has another key.
+func lookupKnownHost(hkcb ssh.HostKeyCallback, hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	err := hkcb(hostname, remote, key)
+	var kerr *knownhosts.KeyError
+	if !errors.As(err, &kerr) {
+		return err == nil, err
+	}
+	if len(kerr.Want) > 0 {
+		return false, &HostKeyChangedError{Host: hostname, Key: key, Want: kerr.Want}
+	}
+	return false, nil
+}
+
+// A HostKeyChangedError is returned if a server presents a host key
+// that differs from what is in known_hosts.
+type HostKeyChangedError struct {
+	Host string
+	Key  ssh.PublicKey
+	Want []knownhosts.KnownKey
+}
+
+func (e *HostKeyChangedError) Error() string {
+	var wants []string
+	for _, kk := range e.Want {
+		wants = append(wants, fmt.Sprintf("%s %s (%s:%d)", kk.Key.Type(), ssh.FingerprintSHA256(kk.Key), kk.Filename, kk.Line))
+	}
+	return fmt.Sprintf("host key for %s has changed: presented %s %s, known %s", e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key), strings.Join(wants, ", "))
+}
+
+// knownHostsMu serializes adding hosts to known_hosts files.
+var knownHostsMu sync.Mutex
+
+// appendKnownHost adds a host key line to the known_hosts file,
+// creating it if needed. The caller must hold knownHostsMu.
+func appendKnownHost(knownHostsPath, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(knownHostsPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHostsPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+
+	// Make sure we don't append to an unterminated line.
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() > 0 {
+		bs := make([]byte, 1)
+		if _, err := f.ReadAt(bs, fi.Size()-1); err != nil {
+			return err
+		}
+		if bs[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+
+	if _, err := io.WriteString(f, line); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// hostKeyPrompt asks the user whether to trust a host key. It is a
+// mock injection point.
+var hostKeyPrompt = promptHostKey
+
+// promptHostKey asks the user on the controlling terminal whether to
+// trust a host key.
+func promptHostKey(hostname string, key ssh.PublicKey) (bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("cannot ask about unknown host %s: %w", hostname, err)
+	}
+	defer tty.Close()
+
+	return askHostKey(tty, hostname, key)
+}
+
+// askHostKey writes a question about a host key, and reads a yes/no
+// answer.
+func askHostKey(rw io.ReadWriter, hostname string, key ssh.PublicKey) (bool, error) {
+	fmt.Fprintf(rw, "The authenticity of host %s can't be established.\n%s key fingerprint is %s.\n", hostname, key.Type(), ssh.FingerprintSHA256(key))
+
+	r := bufio.NewReader(rw)
+	for {
+		fmt.Fprint(rw, "Are you sure you want to continue connecting (yes/no)? ")
+		s, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseHostKeyPolicy(t *testing.T) {
+	for _, s := range []string{"strict", "accept-new", "ask"} {
+		got, err := parseHostKeyPolicy(s)
+		if err != nil {
+			t.Fatalf("parseHostKeyPolicy(%q) failed: %v", s, err)
+		}
+		if got != hostKeyPolicy(s) {
+			t.Errorf("parseHostKeyPolicy: got %q, want %q", got, s)
+		}
+	}
+
+	if _, err := parseHostKeyPolicy("yolo"); err == nil {
+		t.Errorf("parseHostKeyPolicy(yolo): got nil, want error")
+	}
+}
+
+func TestMakeHostKeyCallback(t *testing.T) {
+	const hostname = "example.com:22"
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	key1 := newTestPublicKey(t, 1)
+	key2 := newTestPublicKey(t, 2)
+
+	newKnownHosts := func(t *testing.T, keys ...ssh.PublicKey) string {
+		tmpd, err := ioutil.TempDir("", "hostkey-test-")
+		if err != nil {
+			t.Fatalf("TempDir failed: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tmpd) })
+
+		path := filepath.Join(tmpd, "known_hosts")
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)+"\n")
+		}
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		return path
+	}
+
+	t.Run("known", func(t *testing.T) {
+		hkcb, err := makeHostKeyCallback(newKnownHosts(t, key1), strictHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		if err := hkcb(hostname, addr, key1); err != nil {
+			t.Errorf("callback failed: %v", err)
+		}
+	})
+
+	t.Run("strictUnknown", func(t *testing.T) {
+		path := newKnownHosts(t)
+		hkcb, err := makeHostKeyCallback(path, strictHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		err = hkcb(hostname, addr, key1)
+		if err == nil || !strings.Contains(err.Error(), "fisy hostkey") {
+			t.Errorf("callback error: got %v, want containing %q", err, "fisy hostkey")
+		}
+
+		if bs, _ := ioutil.ReadFile(path); len(bs) != 0 {
+			t.Errorf("known_hosts: got %q, want empty", bs)
+		}
+	})
+
+	t.Run("acceptNew", func(t *testing.T) {
+		path := newKnownHosts(t)
+		hkcb, err := makeHostKeyCallback(path, acceptNewHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		if err := hkcb(hostname, addr, key1); err != nil {
+			t.Fatalf("callback failed: %v", err)
+		}
+
+		hkcb, err = makeHostKeyCallback(path, strictHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+		if err := hkcb(hostname, addr, key1); err != nil {
+			t.Errorf("callback after accept failed: %v", err)
+		}
+	})
+
+	t.Run("acceptNewMissingFile", func(t *testing.T) {
+		path := filepath.Join(filepath.Dir(newKnownHosts(t)), "sub", "known_hosts")
+		hkcb, err := makeHostKeyCallback(path, acceptNewHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		if err := hkcb(hostname, addr, key1); err != nil {
+			t.Fatalf("callback failed: %v", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Stat failed: %v", err)
+		}
+	})
+
+	t.Run("acceptNewConcurrent", func(t *testing.T) {
+		path := newKnownHosts(t)
+		hkcb, err := makeHostKeyCallback(path, acceptNewHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := hkcb(hostname, addr, key1); err != nil {
+					t.Errorf("callback failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if got, want := bytes.Count(bs, []byte("example.com ")), 1; got != want {
+			t.Errorf("known_hosts lines: got %d, want %d in %q", got, want, bs)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		hkcb, err := makeHostKeyCallback(newKnownHosts(t, key1), acceptNewHostKeyPolicy)
+		if err != nil {
+			t.Fatalf("makeHostKeyCallback failed: %v", err)
+		}
+
+		err = hkcb(hostname, addr, key2)
+		if _, ok := err.(*HostKeyChangedError); !ok {
+			t.Fatalf("callback error: got %#v, want HostKeyChangedError", err)
+		}
+		for _, key := range []ssh.PublicKey{key1, key2} {
+			if want := ssh.FingerprintSHA256(key); !strings.Contains(err.Error(), want) {
+				t.Errorf("callback error: got %v, want containing %q", err, want)
+			}
+		}
+	})
+
+	t.Run("ask", func(t *testing.T) {
+		for _, answer := range []bool{false, true} {
+			var nprompts int
+			hostKeyPrompt = func(string, ssh.PublicKey) (bool, error) {
+				nprompts++
+				return answer, nil
+			}
+			defer func() {
+				hostKeyPrompt = promptHostKey
+			}()
+
+			hkcb, err := makeHostKeyCallback(newKnownHosts(t), askHostKeyPolicy)
+			if err != nil {
+				t.Fatalf("makeHostKeyCallback failed: %v", err)
+			}
+
+			if err := hkcb(hostname, addr, key1); (err == nil) != answer {
+				t.Errorf("callback(%v) error: got %v", answer, err)
+			}
+			if want := 1; nprompts != want {
+				t.Errorf("prompts: got %v, want %v", nprompts, want)
+			}
+		}
+	})
+}
+
+func TestAppendKnownHostTerminatesLine(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "hostkey-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	path := filepath.Join(tmpd, "known_hosts")
+	if err := ioutil.WriteFile(path, []byte("# no newline"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := appendKnownHost(path, "example.com:22", newTestPublicKey(t, 1)); err != nil {
+		t.Fatalf("appendKnownHost failed: %v", err)
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.HasPrefix(bs, []byte("# no newline\nexample.com ")) {
+		t.Errorf("appendKnownHost: got %q", bs)
+	}
+}
+
+func TestAskHostKey(t *testing.T) {
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("maybe\nyes\n"), &buf}
+
+	ok, err := askHostKey(rw, "example.com:22", newTestPublicKey(t, 1))
+	if err != nil {
+		t.Fatalf("askHostKey failed: %v", err)
+	}
+	if !ok {
+		t.Errorf("askHostKey: got %v, want true", ok)
+	}
+	if got, want := strings.Count(buf.String(), "(yes/no)"), 2; got != want {
+		t.Errorf("askHostKey questions: got %v, want %v", got, want)
+	}
+}
+
+func TestFetchHostKey(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "hostkey-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	sshAddr, _, knownHostsPath, done, err := newTestSFTPServer(tmpd)
+	if err != nil {
+		t.Fatalf("newTestSFTPServer failed: %v", err)
+	}
+	defer done()
+
+	key, err := fetchHostKey(sshAddr.String())
+	if err != nil {
+		t.Fatalf("fetchHostKey failed: %v", err)
+	}
+
+	hkcb, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		t.Fatalf("knownhosts.New failed: %v", err)
+	}
+	if err := hkcb(sshAddr.String(), sshAddr, key); err != nil {
+		t.Errorf("fetchHostKey returned an unknown key: %v", err)
+	}
+}
+
+func TestRunHostKeyAdd(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "hostkey-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	// A server that only presents its host key.
+	hk, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %v", err)
+	}
+	sconfig := &ssh.ServerConfig{NoClientAuth: true}
+	sconfig.AddHostKey(hk)
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, sconfig)
+			}()
+		}
+	}()
+
+	// An existing known_hosts file, with another host.
+	path := filepath.Join(tmpd, "known_hosts")
+	if err := ioutil.WriteFile(path, []byte(knownhosts.Line([]string{"other.example.com"}, newTestPublicKey(t, 1))+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	hostKeyAdd, hostKeyKnownHostsPath = true, path
+	defer func() {
+		hostKeyAdd, hostKeyKnownHostsPath = false, defaultKnownHostsPath()
+	}()
+
+	// The second time, the host is already known.
+	for i := 0; i < 2; i++ {
+		if err := runHostKey(sl.Addr().String()); err != nil {
+			t.Fatalf("runHostKey failed: %v", err)
+		}
+	}
+
+	hkcb, err := knownhosts.New(path)
+	if err != nil {
+		t.Fatalf("knownhosts.New failed: %v", err)
+	}
+	if err := hkcb(sl.Addr().String(), sl.Addr(), hk.PublicKey()); err != nil {
+		t.Errorf("runHostKey didn't add the key: %v", err)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if got, want := strings.Count(string(bs), "\n"), 2; got != want {
+		t.Errorf("known_hosts lines: got %v, want %v", got, want)
+	}
+}
+
+// newTestPublicKey returns a deterministic public key.
+func newTestPublicKey(t *testing.T, seed byte) ssh.PublicKey {
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	key, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatalf("NewPublicKey failed: %v", err)
+	}
+	return key
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // makeIDMapping returns a mapping function for a specification of a
-// UID/GID mapping.
-func makeIDMapping(s string) (func(int) int, error) {
+// UID/GID mapping. It maps local IDs to server IDs. Names are looked
+// up in the local database db.
+func makeIDMapping(s string, db *idDatabase) (func(int) int, error) {
 	kind, err := parseIDMappingSpec(s)
 	if err != nil {
 		return nil, err
@@ -17,6 +24,37 @@ func makeIDMapping(s string) (func(int) int, error) {
 		return func(src int) int { return src }, nil
 	case currentIDMapping:
 		return func(src int) int { return -1 }, nil
+	case tableIDMapping:
+		t, err := parseIDMappingTable(s)
+		if err != nil {
+			return nil, err
+		}
+		return t.forward(db)
+	default:
+		panic(fmt.Errorf("unhandled ID mapping kind: %s", kind))
+	}
+}
+
+// makeReverseIDMapping is like makeIDMapping, but maps server IDs to
+// local IDs, as needed when downloading. A table default has no
+// reverse, so unmatched IDs are kept.
+func makeReverseIDMapping(s string, db *idDatabase) (func(int) int, error) {
+	kind, err := parseIDMappingSpec(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case identityIDMapping:
+		return func(src int) int { return src }, nil
+	case currentIDMapping:
+		return func(src int) int { return -1 }, nil
+	case tableIDMapping:
+		t, err := parseIDMappingTable(s)
+		if err != nil {
+			return nil, err
+		}
+		return t.reverse(db)
 	default:
 		panic(fmt.Errorf("unhandled ID mapping kind: %s", kind))
 	}
@@ -29,7 +67,10 @@ func parseIDMappingSpec(s string) (idMappingKind, error) {
 	case identityIDMapping, currentIDMapping:
 		return ss, nil
 	default:
-		return "", fmt.Errorf("unknown ID mapping: %s", s)
+		if _, err := parseIDMappingTable(s); err != nil {
+			return "", fmt.Errorf("unknown ID mapping: %s: %w", s, err)
+		}
+		return tableIDMapping, nil
 	}
 }
 
@@ -38,4 +79,283 @@ type idMappingKind = string
 const (
 	identityIDMapping idMappingKind = "id"
 	currentIDMapping  idMappingKind = "current"
+
+	// tableIDMapping is a comma-separated list of entries. The
+	// first matching entry is used:
+	//
+	//   1000:2001        maps a single ID
+	//   1000-1999:5000   maps a range, here to 5000-5999
+	//   name:FILE        maps by name, where FILE is the server's
+	//                    passwd or group file
+	//   *:65534          maps unmatched IDs ("current" is allowed)
+	//
+	// IDs not matched by any entry are kept.
+	tableIDMapping idMappingKind = "table"
+)
+
+// An idMappingTable is a parsed tableIDMapping.
+type idMappingTable struct {
+	ranges []idRange
+
+	// namesPath is the path of the server's name table, or empty.
+	namesPath string
+
+	hasDefault bool
+	defaultID  int
+}
+
+// An idRange maps [First, First+Count) to [Dest, Dest+Count).
+type idRange struct {
+	First, Count, Dest int
+}
+
+// parseIDMappingTable parses a tableIDMapping.
+func parseIDMappingTable(s string) (*idMappingTable, error) {
+	var ret idMappingTable
+	for _, e := range strings.Split(s, ",") {
+		i := strings.IndexByte(e, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("expected a colon: %q", e)
+		}
+		from, to := e[:i], e[i+1:]
+
+		switch {
+		case from == "name":
+			if to == "" || ret.namesPath != "" {
+				return nil, fmt.Errorf("expected one name table: %q", e)
+			}
+			ret.namesPath = to
+
+		case from == "*":
+			if ret.hasDefault {
+				return nil, fmt.Errorf("more than one default: %q", e)
+			}
+			ret.hasDefault = true
+			if to == currentIDMapping {
+				ret.defaultID = -1
+			} else if id, ok := parseID(to); ok {
+				ret.defaultID = id
+			} else {
+				return nil, fmt.Errorf("invalid ID: %q", e)
+			}
+
+		default:
+			last := from
+			if i := strings.IndexByte(from, '-'); i >= 0 {
+				from, last = from[:i], from[i+1:]
+			}
+			first, ok1 := parseID(from)
+			lastID, ok2 := parseID(last)
+			dest, ok3 := parseID(to)
+			if !ok1 || !ok2 || !ok3 || lastID < first {
+				return nil, fmt.Errorf("invalid ID mapping entry: %q", e)
+			}
+			ret.ranges = append(ret.ranges, idRange{First: first, Count: lastID - first + 1, Dest: dest})
+		}
+	}
+	return &ret, nil
+}
+
+// parseID parses a non-negative ID.
+func parseID(s string) (int, bool) {
+	v, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, false
+	}
+	return int(v), true
+}
+
+// forward returns a function mapping local IDs to server IDs.
+func (t *idMappingTable) forward(db *idDatabase) (func(int) int, error) {
+	var names *idNameMapping
+	if t.namesPath != "" {
+		server, err := readIDNameTable(t.namesPath)
+		if err != nil {
+			return nil, err
+		}
+		names = newIDNameMapping(db.lookupName, func(name string) (int, error) {
+			id, ok := server[name]
+			if !ok {
+				return 0, fmt.Errorf("unknown %s on server: %s", db.kind, name)
+			}
+			return id, nil
+		})
+	}
+
+	return func(src int) int {
+		for _, r := range t.ranges {
+			if src >= r.First && src < r.First+r.Count {
+				return r.Dest + src - r.First
+			}
+		}
+		if names != nil {
+			if id, ok := names.lookup(src); ok {
+				return id
+			}
+		}
+		if t.hasDefault {
+			return t.defaultID
+		}
+		return src
+	}, nil
+}
+
+// reverse returns a function mapping server IDs to local IDs.
+func (t *idMappingTable) reverse(db *idDatabase) (func(int) int, error) {
+	var names *idNameMapping
+	if t.namesPath != "" {
+		server, err := readIDNameTable(t.namesPath)
+		if err != nil {
+			return nil, err
+		}
+		serverNames := make(map[int]string, len(server))
+		for name, id := range server {
+			if prev, ok := serverNames[id]; !ok || name < prev {
+				serverNames[id] = name
+			}
+		}
+		names = newIDNameMapping(func(id int) (string, error) {
+			name, ok := serverNames[id]
+			if !ok {
+				return "", fmt.Errorf("unknown %s ID on server: %d", db.kind, id)
+			}
+			return name, nil
+		}, db.lookupID)
+	}
+
+	return func(dest int) int {
+		for _, r := range t.ranges {
+			if dest >= r.Dest && dest < r.Dest+r.Count {
+				return r.First + dest - r.Dest
+			}
+		}
+		if names != nil {
+			if id, ok := names.lookup(dest); ok {
+				return id
+			}
+		}
+		return dest
+	}, nil
+}
+
+// readIDNameTable reads a file in passwd or group format, and returns
+// a map from name to ID. Lines with only "name:id" are also accepted.
+func readIDNameTable(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string]int{}
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		idField := 1
+		if len(fields) > 2 {
+			idField = 2
+		}
+		var id int
+		ok := false
+		if len(fields) > 1 {
+			id, ok = parseID(fields[idField])
+		}
+		if !ok || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: invalid name table entry: %q", path, lineno, line)
+		}
+		if _, exists := ret[fields[0]]; !exists {
+			ret[fields[0]] = id
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// An idNameMapping maps IDs by going through names. The results are
+// cached, since lookups can be expensive.
+type idNameMapping struct {
+	lookupName func(int) (string, error)
+	lookupID   func(string) (int, error)
+
+	mu    sync.Mutex
+	cache map[int]int
+}
+
+func newIDNameMapping(lookupName func(int) (string, error), lookupID func(string) (int, error)) *idNameMapping {
+	return &idNameMapping{
+		lookupName: lookupName,
+		lookupID:   lookupID,
+		cache:      map[int]int{},
+	}
+}
+
+// lookup returns the mapped ID, or false if either lookup failed.
+func (m *idNameMapping) lookup(id int) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.cache[id]; ok {
+		return v, v >= 0
+	}
+
+	v := -1
+	if name, err := m.lookupName(id); err == nil {
+		if mapped, err := m.lookupID(name); err == nil {
+			v = mapped
+		}
+	}
+	m.cache[id] = v
+	return v, v >= 0
+}
+
+// An idDatabase looks up names of local users or groups.
+type idDatabase struct {
+	kind       string
+	lookupName func(int) (string, error)
+	lookupID   func(string) (int, error)
+}
+
+var (
+	// userIDs and groupIDs are mock injection points.
+	userIDs = &idDatabase{
+		kind: "user",
+		lookupName: func(id int) (string, error) {
+			u, err := user.LookupId(strconv.Itoa(id))
+			if err != nil {
+				return "", err
+			}
+			return u.Username, nil
+		},
+		lookupID: func(name string) (int, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, err
+			}
+			return strconv.Atoi(u.Uid)
+		},
+	}
+	groupIDs = &idDatabase{
+		kind: "group",
+		lookupName: func(id int) (string, error) {
+			g, err := user.LookupGroupId(strconv.Itoa(id))
+			if err != nil {
+				return "", err
+			}
+			return g.Name, nil
+		},
+		lookupID: func(name string) (int, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return 0, err
+			}
+			return strconv.Atoi(g.Gid)
+		},
+	}
 )
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestMakeIDMapping(t *testing.T) {
 	t.Run("id", func(t *testing.T) {
-		fun, err := makeIDMapping("id")
+		fun, err := makeIDMapping("id", userIDs)
 		if err != nil {
 			t.Fatalf("makeIDMapping failed: %v", err)
 		}
@@ -17,7 +21,7 @@ func TestMakeIDMapping(t *testing.T) {
 	})
 
 	t.Run("current", func(t *testing.T) {
-		fun, err := makeIDMapping("current")
+		fun, err := makeIDMapping("current", userIDs)
 		if err != nil {
 			t.Fatalf("makeIDMapping failed: %v", err)
 		}
@@ -28,6 +32,104 @@ func TestMakeIDMapping(t *testing.T) {
 	})
 }
 
+func TestMakeIDMappingTable(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "idmapspec-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	namesPath := filepath.Join(tmpd, "passwd")
+	if err := ioutil.WriteFile(namesPath, []byte("# Server users.\nalice:x:3001:3001::/home/alice:/bin/sh\nbob:3002\n"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	localIDs := map[string]int{"alice": 1001, "bob": 1002, "carol": 1003}
+	db := &idDatabase{
+		kind: "user",
+		lookupName: func(id int) (string, error) {
+			for name, v := range localIDs {
+				if v == id {
+					return name, nil
+				}
+			}
+			return "", fmt.Errorf("unknown user ID: %d", id)
+		},
+		lookupID: func(name string) (int, error) {
+			id, ok := localIDs[name]
+			if !ok {
+				return 0, fmt.Errorf("unknown user: %s", name)
+			}
+			return id, nil
+		},
+	}
+
+	spec := "1000:2000,500-599:5000,name:" + namesPath + ",*:65534"
+
+	t.Run("forward", func(t *testing.T) {
+		fun, err := makeIDMapping(spec, db)
+		if err != nil {
+			t.Fatalf("makeIDMapping failed: %v", err)
+		}
+
+		tsts := []struct {
+			id, want int
+		}{
+			{1000, 2000},
+			{500, 5000},
+			{599, 5099},
+			{600, 65534},
+			{1001, 3001},
+			{1002, 3002},
+			{1003, 65534},
+			{4242, 65534},
+		}
+		for _, tst := range tsts {
+			if got := fun(tst.id); got != tst.want {
+				t.Errorf("makeIDMapping(%d): got %v, want %v", tst.id, got, tst.want)
+			}
+		}
+	})
+
+	t.Run("reverse", func(t *testing.T) {
+		fun, err := makeReverseIDMapping(spec, db)
+		if err != nil {
+			t.Fatalf("makeReverseIDMapping failed: %v", err)
+		}
+
+		tsts := []struct {
+			id, want int
+		}{
+			{2000, 1000},
+			{5042, 542},
+			{3001, 1001},
+			{3002, 1002},
+			{65534, 65534},
+		}
+		for _, tst := range tsts {
+			if got := fun(tst.id); got != tst.want {
+				t.Errorf("makeReverseIDMapping(%d): got %v, want %v", tst.id, got, tst.want)
+			}
+		}
+	})
+
+	t.Run("currentDefault", func(t *testing.T) {
+		fun, err := makeIDMapping("1000:2000,*:current", db)
+		if err != nil {
+			t.Fatalf("makeIDMapping failed: %v", err)
+		}
+		if got, want := fun(42), -1; got != want {
+			t.Errorf("makeIDMapping: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("missingNames", func(t *testing.T) {
+		if _, err := makeIDMapping("name:"+filepath.Join(tmpd, "missing"), db); !os.IsNotExist(err) {
+			t.Errorf("makeIDMapping err: got %v, want not exist", err)
+		}
+	})
+}
+
 func TestParseIDMappingSpec(t *testing.T) {
 	t.Run("id", func(t *testing.T) {
 		got, err := parseIDMappingSpec("id")
@@ -48,4 +150,22 @@ func TestParseIDMappingSpec(t *testing.T) {
 			t.Errorf("parseIDMappingSpec: got %v, want %v", got, want)
 		}
 	})
+
+	t.Run("table", func(t *testing.T) {
+		got, err := parseIDMappingSpec("1000:2001,1001:2002,3000-3999:4000,name:/etc/passwd,*:65534")
+		if err != nil {
+			t.Fatalf("parseIDMappingSpec failed: %v", err)
+		}
+		if want := tableIDMapping; got != want {
+			t.Errorf("parseIDMappingSpec: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{"", "ident", "1000", "a:1", "1:b", "2-1:5", "*:1,*:2", "name:", "-1:2"} {
+			if _, err := parseIDMappingSpec(s); err == nil {
+				t.Errorf("parseIDMappingSpec(%q): got %v, want error", s, err)
+			}
+		}
+	})
 }
@@ -1,12 +1,88 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sabhiram/go-gitignore"
 	"github.com/tommie/fisy/fs"
 )
 
+// makeIgnoreFilter creates a filter from the selection flags. Times
+// given as ages are relative to now.
+func makeIgnoreFilter(now time.Time) (func(fs.Path, os.FileInfo) bool, error) {
+	lines := []string{ignoreSpec}
+	for _, path := range ignoreFrom {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ignore file: %w", err)
+		}
+		lines = append(lines, string(bs))
+	}
+	pathFilter, err := parseIgnoreFilter(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	minSize, err := parseSizeLimit(minSizeSpec)
+	if err != nil {
+		return nil, fmt.Errorf("minimum size: %w", err)
+	}
+	maxSize, err := parseSizeLimit(maxSizeSpec)
+	if err != nil {
+		return nil, fmt.Errorf("maximum size: %w", err)
+	}
+	before, err := parseTimeLimit(modifiedBeforeSpec, now)
+	if err != nil {
+		return nil, fmt.Errorf("modified before: %w", err)
+	}
+	after, err := parseTimeLimit(modifiedAfterSpec, now)
+	if err != nil {
+		return nil, fmt.Errorf("modified after: %w", err)
+	}
+	types, err := parseFileTypes(ignoreTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p fs.Path, fi os.FileInfo) bool {
+		if pathFilter(p) {
+			return true
+		}
+		if fi == nil {
+			return false
+		}
+
+		mode := fi.Mode()
+		if mode&types != 0 {
+			return true
+		}
+		if mode.IsDir() {
+			// Directories are traversed, even if old.
+			return false
+		}
+		if mode.IsRegular() {
+			if minSize > 0 && fi.Size() < minSize {
+				return true
+			}
+			if maxSize > 0 && fi.Size() > maxSize {
+				return true
+			}
+		}
+		if !before.IsZero() && !fi.ModTime().Before(before) {
+			return true
+		}
+		if !after.IsZero() && !fi.ModTime().After(after) {
+			return true
+		}
+		return false
+	}, nil
+}
+
 func parseIgnoreFilter(lines string) (func(fs.Path) bool, error) {
 	gi := ignore.CompileIgnoreLines(strings.Split(lines, "\n")...)
 
@@ -14,3 +90,85 @@ func parseIgnoreFilter(lines string) (func(fs.Path) bool, error) {
 		return gi.MatchesPath(string(p))
 	}, nil
 }
+
+// parseSizeLimit parses a size in bytes, with an optional binary
+// suffix, like "10M". An empty string means no limit, and returns
+// zero.
+func parseSizeLimit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	num := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	var shift uint
+	if n := len(num); n > 0 {
+		if sh, ok := sizeSuffixShifts[num[n-1]]; ok {
+			shift = sh
+			num = num[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 || v > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return v << shift, nil
+}
+
+// sizeSuffixShifts maps size suffixes to their binary exponents.
+var sizeSuffixShifts = map[byte]uint{
+	'k': 10,
+	'K': 10,
+	'M': 20,
+	'G': 30,
+	'T': 40,
+}
+
+// parseTimeLimit parses a point in time. It is either an RFC 3339
+// timestamp, a local date like "2006-01-02", or an age relative to
+// now, like "36h" or "30d". An empty string returns the zero time.
+func parseTimeLimit(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time or age: %q", s)
+}
+
+// parseFileTypes returns the mode bits matching the named file
+// types.
+func parseFileTypes(ss []string) (os.FileMode, error) {
+	var ret os.FileMode
+	for _, s := range ss {
+		switch s {
+		case "symlink":
+			ret |= os.ModeSymlink
+		case "device":
+			ret |= os.ModeDevice | os.ModeCharDevice
+		case "fifo":
+			ret |= os.ModeNamedPipe
+		case "socket":
+			ret |= os.ModeSocket
+		case "special":
+			ret |= os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+		default:
+			return 0, fmt.Errorf("unknown file type: %s", s)
+		}
+	}
+	return ret, nil
+}
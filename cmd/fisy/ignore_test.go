@@ -1,7 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
 )
 
 func TestParseIgnoreFilter(t *testing.T) {
@@ -17,3 +23,147 @@ func TestParseIgnoreFilter(t *testing.T) {
 		t.Errorf("parseIgnoreFilter /a/b/d: got %v, want %v", !want, want)
 	}
 }
+
+func TestMakeIgnoreFilter(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "ignore-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	fromPath := filepath.Join(tmpd, "ignore")
+	if err := ioutil.WriteFile(fromPath, []byte("*.o\n"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	defer func(is string, ifr, it []string, mins, maxs, mb, ma string) {
+		ignoreSpec, ignoreFrom, ignoreTypes = is, ifr, it
+		minSizeSpec, maxSizeSpec, modifiedBeforeSpec, modifiedAfterSpec = mins, maxs, mb, ma
+	}(ignoreSpec, ignoreFrom, ignoreTypes, minSizeSpec, maxSizeSpec, modifiedBeforeSpec, modifiedAfterSpec)
+	ignoreSpec = "/a/"
+	ignoreFrom = []string{fromPath}
+	ignoreTypes = []string{"special"}
+	minSizeSpec = "1"
+	maxSizeSpec = "1k"
+	modifiedBeforeSpec = "1d"
+	modifiedAfterSpec = "2021-01-01T00:00:00Z"
+
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	fun, err := makeIgnoreFilter(now)
+	if err != nil {
+		t.Fatalf("makeIgnoreFilter failed: %v", err)
+	}
+
+	mtime := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	tsts := []struct {
+		name string
+		path fs.Path
+		fi   os.FileInfo
+		want bool
+	}{
+		{"kept", "/b", &fakeFileInfo{size: 10, mtime: mtime}, false},
+		{"nilFileInfo", "/b", nil, false},
+		{"ignorePattern", "/a/", &fakeFileInfo{mode: os.ModeDir, mtime: mtime}, true},
+		{"ignoreFrom", "/x.o", &fakeFileInfo{size: 10, mtime: mtime}, true},
+		{"special", "/b", &fakeFileInfo{mode: os.ModeNamedPipe, mtime: mtime}, true},
+		{"symlink", "/b", &fakeFileInfo{mode: os.ModeSymlink, mtime: mtime}, false},
+		{"tooSmall", "/b", &fakeFileInfo{size: 0, mtime: mtime}, true},
+		{"tooLarge", "/b", &fakeFileInfo{size: 1025, mtime: mtime}, true},
+		{"tooNew", "/b", &fakeFileInfo{size: 10, mtime: now.Add(-time.Hour)}, true},
+		{"tooOld", "/b", &fakeFileInfo{size: 10, mtime: mtime.AddDate(-1, 0, 0)}, true},
+		{"oldDir", "/b/", &fakeFileInfo{mode: os.ModeDir, mtime: mtime.AddDate(-1, 0, 0)}, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			if got := fun(tst.path, tst.fi); got != tst.want {
+				t.Errorf("filter(%q): got %v, want %v", tst.path, got, tst.want)
+			}
+		})
+	}
+}
+
+func TestParseSizeLimit(t *testing.T) {
+	tsts := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"42", 42, false},
+		{"10k", 10 << 10, false},
+		{"10KiB", 10 << 10, false},
+		{"3M", 3 << 20, false},
+		{"2GB", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"-1", 0, true},
+		{"1.5M", 0, true},
+		{"10X", 0, true},
+		{"9999999999T", 0, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.s, func(t *testing.T) {
+			got, err := parseSizeLimit(tst.s)
+			if (err != nil) != tst.wantErr {
+				t.Fatalf("parseSizeLimit err: got %v, want %v", err, tst.wantErr)
+			}
+			if got != tst.want {
+				t.Errorf("parseSizeLimit: got %v, want %v", got, tst.want)
+			}
+		})
+	}
+}
+
+func TestParseTimeLimit(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tsts := []struct {
+		s       string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2021-01-02T03:04:05Z", time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"2021-01-02", time.Date(2021, 1, 2, 0, 0, 0, 0, time.Local), false},
+		{"30d", now.AddDate(0, 0, -30), false},
+		{"36h", now.Add(-36 * time.Hour), false},
+		{"-1h", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.s, func(t *testing.T) {
+			got, err := parseTimeLimit(tst.s, now)
+			if (err != nil) != tst.wantErr {
+				t.Fatalf("parseTimeLimit err: got %v, want %v", err, tst.wantErr)
+			}
+			if !got.Equal(tst.want) {
+				t.Errorf("parseTimeLimit: got %v, want %v", got, tst.want)
+			}
+		})
+	}
+}
+
+func TestParseFileTypes(t *testing.T) {
+	got, err := parseFileTypes([]string{"symlink", "fifo"})
+	if err != nil {
+		t.Fatalf("parseFileTypes failed: %v", err)
+	}
+	if want := os.ModeSymlink | os.ModeNamedPipe; got != want {
+		t.Errorf("parseFileTypes: got %v, want %v", got, want)
+	}
+
+	if _, err := parseFileTypes([]string{"dir"}); err == nil {
+		t.Errorf("parseFileTypes(dir): got %v, want error", err)
+	}
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+
+	mode  os.FileMode
+	mtime time.Time
+	size  int64
+}
+
+func (fi *fakeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fakeFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fakeFileInfo) Size() int64        { return fi.size }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"github.com/tommie/fisy/fs"
+)
+
+var jobsConfigPath string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&jobsConfigPath, "jobs-config", os.ExpandEnv("$HOME/.config/fisy/jobs.toml"), "path of the file describing jobs")
+}
+
+// A jobsConfig is the contents of a jobs configuration file. Jobs are
+// TOML tables named "job.<name>":
+//
+//   [job.home]
+//   source = "/home/me"
+//   destination = "cow+sftp://backup/srv/fisy"
+//   ignore = ["/.cache/"]
+//
+//   [job.home.retention]
+//   keep_last = 30
+//
+//   [job.home.schedule]
+//   interval = "6h"
+type jobsConfig struct {
+	Jobs map[string]*jobConfig `toml:"job"`
+}
+
+// A jobConfig describes a named transfer. Empty values mean the
+// command line flag default is used.
+type jobConfig struct {
+	Description string `toml:"description"`
+	Source      string `toml:"source"`
+	Destination string `toml:"destination"`
+
+	// Ignore lines are in .gitignore format.
+	Ignore           []string `toml:"ignore"`
+	IgnoreFrom       []string `toml:"ignore_from"`
+	IgnoreFiles      []string `toml:"ignore_files"`
+	IgnoreTypes      []string `toml:"ignore_types"`
+	MinSize          string   `toml:"min_size"`
+	MaxSize          string   `toml:"max_size"`
+	ModifiedBefore   string   `toml:"modified_before"`
+	ModifiedAfter    string   `toml:"modified_after"`
+	ExcludeIfPresent []string `toml:"exclude_if_present"`
+	UIDMap           string   `toml:"uid_map"`
+	GIDMap           string   `toml:"gid_map"`
+	FileConcurrency  int      `toml:"file_concurrency"`
+	PrintOperations  []string `toml:"print_operations"`
+	Dedup            bool     `toml:"dedup"`
+	DetectMoves      bool     `toml:"detect_moves"`
+
+	Retry     jobRetryConfig     `toml:"retry"`
+	Retention jobRetentionConfig `toml:"retention"`
+	Schedule  jobScheduleConfig  `toml:"schedule"`
+	Hooks     jobHooksConfig     `toml:"hooks"`
+}
+
+// A jobRetryConfig overrides parts of the retry policy. Unset fields
+// are nil.
+type jobRetryConfig struct {
+	MaxAttempts  *int            `toml:"max_attempts"`
+	MaxElapsed   *configDuration `toml:"max_elapsed"`
+	InitialDelay *configDuration `toml:"initial_delay"`
+	MaxDelay     *configDuration `toml:"max_delay"`
+	Multiplier   *float64        `toml:"multiplier"`
+	Jitter       *float64        `toml:"jitter"`
+}
+
+// A jobRetentionConfig selects which old snapshots to remove after a
+// successful run. It requires a "cow+" destination.
+type jobRetentionConfig struct {
+	KeepLast int            `toml:"keep_last"`
+	MaxAge   configDuration `toml:"max_age"`
+}
+
+// isSet returns whether any retention rule is configured.
+func (c *jobRetentionConfig) isSet() bool {
+	return c.KeepLast != 0 || c.MaxAge != 0
+}
+
+// cowRetention converts the configuration to a COW retention policy.
+func (c *jobRetentionConfig) cowRetention() fs.COWRetention {
+	return fs.COWRetention{KeepLast: c.KeepLast, MaxAge: time.Duration(c.MaxAge)}
+}
+
+// A jobScheduleConfig makes the daemon run a job periodically.
+type jobScheduleConfig struct {
+	// Interval is the time between the starts of successful
+	// runs. Zero means the daemon doesn't run the job.
+	Interval configDuration `toml:"interval"`
+}
+
+// A jobHooksConfig contains shell commands to run before and after a
+// job.
+type jobHooksConfig struct {
+	// Pre runs before the transfer. If it fails, the job is
+	// aborted.
+	Pre string `toml:"pre"`
+
+	// Post runs after the transfer, even if it failed.
+	Post string `toml:"post"`
+}
+
+// A configDuration is a time.Duration that can be decoded from a
+// string, like "1h30m".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalText(bs []byte) error {
+	v, err := time.ParseDuration(string(bs))
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+// loadJobsConfig reads and validates a jobs configuration file. A
+// missing file is the same as an empty file.
+func loadJobsConfig(path string) (*jobsConfig, error) {
+	var cfg jobsConfig
+	md, err := toml.DecodeFile(path, &cfg)
+	if errors.Is(err, os.ErrNotExist) {
+		return &jobsConfig{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, fmt.Errorf("%s: unknown key: %s", path, keys[0])
+	}
+
+	for _, name := range cfg.jobNames() {
+		if err := cfg.Jobs[name].validate(); err != nil {
+			return nil, fmt.Errorf("%s: job %q: %w", path, name, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// jobNames returns the names of all jobs, sorted.
+func (cfg *jobsConfig) jobNames() []string {
+	var ret []string
+	for name := range cfg.Jobs {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// validate checks that the job can be run.
+func (c *jobConfig) validate() error {
+	if c.Source == "" {
+		return fmt.Errorf("source is missing")
+	}
+	if _, err := parseFileSystemSpec(c.Source); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if c.Destination == "" {
+		return fmt.Errorf("destination is missing")
+	}
+	destURL, err := parseFileSystemSpec(c.Destination)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+
+	if _, err := parseFileTypes(c.IgnoreTypes); err != nil {
+		return fmt.Errorf("ignore_types: %w", err)
+	}
+	if _, err := parseSizeLimit(c.MinSize); err != nil {
+		return fmt.Errorf("min_size: %w", err)
+	}
+	if _, err := parseSizeLimit(c.MaxSize); err != nil {
+		return fmt.Errorf("max_size: %w", err)
+	}
+	if _, err := parseTimeLimit(c.ModifiedBefore, time.Time{}); err != nil {
+		return fmt.Errorf("modified_before: %w", err)
+	}
+	if _, err := parseTimeLimit(c.ModifiedAfter, time.Time{}); err != nil {
+		return fmt.Errorf("modified_after: %w", err)
+	}
+
+	if c.UIDMap != "" {
+		if _, err := parseIDMappingSpec(c.UIDMap); err != nil {
+			return fmt.Errorf("uid_map: %w", err)
+		}
+	}
+	if c.GIDMap != "" {
+		if _, err := parseIDMappingSpec(c.GIDMap); err != nil {
+			return fmt.Errorf("gid_map: %w", err)
+		}
+	}
+	if c.FileConcurrency < 0 {
+		return fmt.Errorf("file_concurrency must not be negative: %d", c.FileConcurrency)
+	}
+	if _, err := parsePrintOps(c.PrintOperations); err != nil {
+		return fmt.Errorf("print_operations: %w", err)
+	}
+
+	if j := c.Retry.Jitter; j != nil && (*j < 0 || *j > 1) {
+		return fmt.Errorf("retry jitter must be between 0 and 1: %v", *j)
+	}
+
+	if c.Retention.KeepLast < 0 || c.Retention.MaxAge < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if c.Retention.isSet() && !strings.HasPrefix(destURL.Scheme, "cow+") {
+		return fmt.Errorf("retention requires a cow+ destination: %s", c.Destination)
+	}
+
+	if c.Dedup && !strings.HasPrefix(destURL.Scheme, "cow+") {
+		return fmt.Errorf("dedup requires a cow+ destination: %s", c.Destination)
+	}
+	if c.DetectMoves && !strings.HasPrefix(destURL.Scheme, "cow+") {
+		return fmt.Errorf("detect_moves requires a cow+ destination: %s", c.Destination)
+	}
+
+	if c.Schedule.Interval < 0 {
+		return fmt.Errorf("schedule interval must not be negative")
+	}
+
+	return nil
+}
+
+// apply sets the transfer flag variables from the job, unless the
+// flag was given on the command line.
+func (c *jobConfig) apply(flags *pflag.FlagSet) {
+	set := func(name string, fun func()) {
+		if !flags.Changed(name) {
+			fun()
+		}
+	}
+
+	if c.Ignore != nil {
+		set("ignore", func() { ignoreSpec = strings.Join(c.Ignore, "\n") })
+	}
+	if c.IgnoreFrom != nil {
+		set("ignore-from", func() { ignoreFrom = c.IgnoreFrom })
+	}
+	if c.IgnoreFiles != nil {
+		set("ignore-file", func() { ignoreFiles = c.IgnoreFiles })
+	}
+	if c.IgnoreTypes != nil {
+		set("ignore-type", func() { ignoreTypes = c.IgnoreTypes })
+	}
+	if c.MinSize != "" {
+		set("min-size", func() { minSizeSpec = c.MinSize })
+	}
+	if c.MaxSize != "" {
+		set("max-size", func() { maxSizeSpec = c.MaxSize })
+	}
+	if c.ModifiedBefore != "" {
+		set("modified-before", func() { modifiedBeforeSpec = c.ModifiedBefore })
+	}
+	if c.ModifiedAfter != "" {
+		set("modified-after", func() { modifiedAfterSpec = c.ModifiedAfter })
+	}
+	if c.ExcludeIfPresent != nil {
+		set("exclude-if-present", func() { excludeIfPresent = c.ExcludeIfPresent })
+	}
+	if c.UIDMap != "" {
+		set("uid-map", func() { uidMapSpec = c.UIDMap })
+	}
+	if c.GIDMap != "" {
+		set("gid-map", func() { gidMapSpec = c.GIDMap })
+	}
+	if c.FileConcurrency != 0 {
+		set("file-concurrency", func() { fileConc = c.FileConcurrency })
+	}
+	if c.PrintOperations != nil {
+		set("print-operations", func() { printOps = c.PrintOperations })
+	}
+	if c.Dedup {
+		set("dedup", func() { dedup = true })
+	}
+	if c.DetectMoves {
+		set("detect-moves", func() { detectMoves = true })
+	}
+
+	r := &c.Retry
+	if r.MaxAttempts != nil {
+		set("retry-max-attempts", func() { retryPolicy.MaxAttempts = *r.MaxAttempts })
+	}
+	if r.MaxElapsed != nil {
+		set("retry-max-elapsed", func() { retryPolicy.MaxElapsed = time.Duration(*r.MaxElapsed) })
+	}
+	if r.InitialDelay != nil {
+		set("retry-initial-delay", func() { retryPolicy.InitialDelay = time.Duration(*r.InitialDelay) })
+	}
+	if r.MaxDelay != nil {
+		set("retry-max-delay", func() { retryPolicy.MaxDelay = time.Duration(*r.MaxDelay) })
+	}
+	if r.Multiplier != nil {
+		set("retry-multiplier", func() { retryPolicy.Multiplier = *r.Multiplier })
+	}
+	if r.Jitter != nil {
+		set("retry-jitter", func() { retryPolicy.Jitter = *r.Jitter })
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/remote"
+)
+
+func TestLoadJobsConfig(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "jobconfig-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	t.Run("valid", func(t *testing.T) {
+		path := filepath.Join(tmpd, "valid.toml")
+		if err := ioutil.WriteFile(path, []byte(`
+[job.home]
+description = "Home directory"
+source = "/home/me"
+destination = "cow+sftp://backup/srv/fisy"
+ignore = ["/.cache/", "*.o"]
+uid_map = "current"
+file_concurrency = 8
+
+[job.home.retry]
+max_attempts = 0
+max_elapsed = "10m"
+
+[job.home.retention]
+keep_last = 3
+max_age = "720h"
+
+[job.home.schedule]
+interval = "6h"
+
+[job.home.hooks]
+post = "true"
+
+[job.etc]
+source = "/etc"
+destination = "/mnt/etc"
+`), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		cfg, err := loadJobsConfig(path)
+		if err != nil {
+			t.Fatalf("loadJobsConfig failed: %v", err)
+		}
+
+		if got, want := cfg.jobNames(), []string{"etc", "home"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("jobNames: got %v, want %v", got, want)
+		}
+		job := cfg.Jobs["home"]
+		if want := "/home/me"; job.Source != want {
+			t.Errorf("Source: got %q, want %q", job.Source, want)
+		}
+		if job.Retry.MaxAttempts == nil || *job.Retry.MaxAttempts != 0 {
+			t.Errorf("Retry.MaxAttempts: got %v, want 0", job.Retry.MaxAttempts)
+		}
+		if job.Retry.MaxDelay != nil {
+			t.Errorf("Retry.MaxDelay: got %v, want nil", *job.Retry.MaxDelay)
+		}
+		if want := configDuration(6 * time.Hour); job.Schedule.Interval != want {
+			t.Errorf("Schedule.Interval: got %v, want %v", job.Schedule.Interval, want)
+		}
+		if want := (fs.COWRetention{KeepLast: 3, MaxAge: 720 * time.Hour}); job.Retention.cowRetention() != want {
+			t.Errorf("Retention: got %+v, want %+v", job.Retention.cowRetention(), want)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		cfg, err := loadJobsConfig(filepath.Join(tmpd, "missing.toml"))
+		if err != nil {
+			t.Fatalf("loadJobsConfig failed: %v", err)
+		}
+		if len(cfg.Jobs) != 0 {
+			t.Errorf("loadJobsConfig: got %v, want no jobs", cfg.Jobs)
+		}
+	})
+
+	tsts := []struct {
+		Name    string
+		Config  string
+		WantErr string
+	}{
+		{"unknownKey", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\nsauce = 1\n", "unknown key: job.a.sauce"},
+		{"noSource", "[job.a]\ndestination = \"/b\"\n", `job "a": source is missing`},
+		{"noDestination", "[job.a]\nsource = \"/a\"\n", `job "a": destination is missing`},
+		{"uidMap", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\nuid_map = \"x\"\n", "uid_map: unknown ID mapping: x"},
+		{"maxSize", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\nmax_size = \"big\"\n", "max_size: invalid size"},
+		{"ignoreTypes", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\nignore_types = [\"dir\"]\n", "unknown file type: dir"},
+		{"printOperations", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\nprint_operations = [\"x\"]\n", "unknown file operation: x"},
+		{"jitter", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\n[job.a.retry]\njitter = 2.0\n", "retry jitter must be between 0 and 1"},
+		{"retentionNotCOW", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\n[job.a.retention]\nkeep_last = 1\n", "retention requires a cow+ destination"},
+		{"dedupNotCOW", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\ndedup = true\n", "dedup requires a cow+ destination"},
+		{"detectMovesNotCOW", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\ndetect_moves = true\n", "detect_moves requires a cow+ destination"},
+		{"schedule", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\n[job.a.schedule]\ninterval = \"-1h\"\n", "schedule interval must not be negative"},
+		{"duration", "[job.a]\nsource = \"/a\"\ndestination = \"/b\"\n[job.a.retry]\nmax_delay = \"soon\"\n", "invalid duration"},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			path := filepath.Join(tmpd, tst.Name+".toml")
+			if err := ioutil.WriteFile(path, []byte(tst.Config), 0600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			_, err := loadJobsConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tst.WantErr) {
+				t.Errorf("loadJobsConfig error: got %v, want containing %q", err, tst.WantErr)
+			}
+		})
+	}
+}
+
+func TestJobConfigApply(t *testing.T) {
+	defer func(fc int, us, gs, is string) {
+		fileConc, uidMapSpec, gidMapSpec, ignoreSpec = fc, us, gs, is
+	}(fileConc, uidMapSpec, gidMapSpec, ignoreSpec)
+	defer func(p remote.RetryPolicy) { retryPolicy = p }(retryPolicy)
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addTransferFlags(flags)
+	if err := flags.Parse([]string{"--uid-map=id", "--retry-max-elapsed=1m"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	maxElapsed := configDuration(time.Hour)
+	maxAttempts := 7
+	job := jobConfig{
+		Ignore:          []string{"/a/", "/b/"},
+		UIDMap:          "current",
+		GIDMap:          "current",
+		FileConcurrency: 3,
+		Retry: jobRetryConfig{
+			MaxAttempts: &maxAttempts,
+			MaxElapsed:  &maxElapsed,
+		},
+	}
+	job.apply(flags)
+
+	if want := "/a/\n/b/"; ignoreSpec != want {
+		t.Errorf("ignoreSpec: got %q, want %q", ignoreSpec, want)
+	}
+	if want := "id"; uidMapSpec != want {
+		t.Errorf("uidMapSpec: got %q, want %q", uidMapSpec, want)
+	}
+	if want := "current"; gidMapSpec != want {
+		t.Errorf("gidMapSpec: got %q, want %q", gidMapSpec, want)
+	}
+	if want := 3; fileConc != want {
+		t.Errorf("fileConc: got %v, want %v", fileConc, want)
+	}
+	if want := 7; retryPolicy.MaxAttempts != want {
+		t.Errorf("retryPolicy.MaxAttempts: got %v, want %v", retryPolicy.MaxAttempts, want)
+	}
+	if want := time.Minute; retryPolicy.MaxElapsed != want {
+		t.Errorf("retryPolicy.MaxElapsed: got %v, want %v", retryPolicy.MaxElapsed, want)
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "jobconfig-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	srcd := filepath.Join(tmpd, "src")
+	if err := os.Mkdir(srcd, 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	hookPath := filepath.Join(tmpd, "hook.log")
+
+	defer func(s string) { jobsConfigPath = s }(jobsConfigPath)
+	jobsConfigPath = filepath.Join(tmpd, "jobs.toml")
+	if err := ioutil.WriteFile(jobsConfigPath, []byte(fmt.Sprintf(`
+[job.test]
+source = %q
+destination = "mem://"
+
+[job.test.hooks]
+pre = "echo pre $FISY_JOB $FISY_DESTINATION >>%s"
+post = "echo post $FISY_RESULT >>%s"
+
+[job.same]
+source = %q
+destination = "mem://"
+
+[job.same.hooks]
+pre = "echo hook $FISY_RESULT >>%s"
+post = "echo hook $FISY_RESULT >>%s"
+`, srcd, hookPath, hookPath, srcd, hookPath, hookPath)), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := runJob(context.Background(), &runCmd, "test"); err != nil {
+		t.Fatalf("runJob failed: %v", err)
+	}
+
+	bs, err := ioutil.ReadFile(hookPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if want := "pre test mem://\npost success\n"; string(bs) != want {
+		t.Errorf("hooks: got %q, want %q", bs, want)
+	}
+
+	// The pre hook doesn't get a result, even if it is the same
+	// command as the post hook.
+	if err := os.Remove(hookPath); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := runJob(context.Background(), &runCmd, "same"); err != nil {
+		t.Fatalf("runJob failed: %v", err)
+	}
+	bs, err = ioutil.ReadFile(hookPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if want := "hook\nhook success\n"; string(bs) != want {
+		t.Errorf("hooks: got %q, want %q", bs, want)
+	}
+
+	if err := runJob(context.Background(), &runCmd, "missing"); err == nil || err.Error() != "unknown job: missing" {
+		t.Errorf("runJob error: got %v, want unknown job", err)
+	}
+}
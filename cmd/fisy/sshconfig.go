@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// An sshConfig is a parsed OpenSSH client configuration file. Only
+// the subset of keywords fisy needs is interpreted, and "Match"
+// blocks are ignored.
+type sshConfig struct {
+	blocks []*sshConfigBlock
+}
+
+// An sshConfigBlock is the global section or a "Host" section.
+type sshConfigBlock struct {
+	patterns []string
+	values   map[string]string
+}
+
+// defaultSSHConfigPath returns the path of the user's ssh_config.
+func defaultSSHConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh/config")
+}
+
+// readSSHConfig reads an ssh_config file. A missing file yields an
+// empty configuration.
+func readSSHConfig(path string) (*sshConfig, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &sshConfig{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseSSHConfig(f)
+}
+
+// parseSSHConfig parses the contents of an ssh_config file.
+func parseSSHConfig(r io.Reader) (*sshConfig, error) {
+	block := &sshConfigBlock{patterns: []string{"*"}, values: map[string]string{}}
+	cfg := &sshConfig{blocks: []*sshConfigBlock{block}}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t=")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(line[:i])
+		arg := strings.TrimLeft(line[i:], " \t")
+		arg = strings.TrimSpace(strings.TrimPrefix(arg, "="))
+
+		switch key {
+		case "host":
+			block = &sshConfigBlock{patterns: strings.Fields(arg), values: map[string]string{}}
+			cfg.blocks = append(cfg.blocks, block)
+
+		case "match":
+			glog.V(1).Infof("Ignoring unsupported ssh_config Match block: %s", arg)
+			block = &sshConfigBlock{values: map[string]string{}}
+			cfg.blocks = append(cfg.blocks, block)
+
+		default:
+			if key != "proxycommand" {
+				arg = strings.Trim(arg, `"`)
+			}
+			// The first obtained value wins.
+			if _, ok := block.values[key]; !ok {
+				block.values[key] = arg
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Get returns the value of a keyword for the given host alias, or
+// the empty string. The keyword is case-insensitive.
+func (cfg *sshConfig) Get(host, key string) string {
+	key = strings.ToLower(key)
+	for _, block := range cfg.blocks {
+		if !matchSSHHostPatterns(block.patterns, host) {
+			continue
+		}
+		if v, ok := block.values[key]; ok {
+			if key == "hostname" {
+				v = strings.ReplaceAll(v, "%h", host)
+			}
+			return v
+		}
+	}
+	return ""
+}
+
+// matchSSHHostPatterns returns true if any pattern matches, and no
+// negated pattern matches.
+func matchSSHHostPatterns(patterns []string, host string) bool {
+	var matched bool
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if ok, _ := filepath.Match(p[1:], host); ok {
+				return false
+			}
+		} else if ok, _ := filepath.Match(p, host); ok {
+			matched = true
+		}
+	}
+	return matched
+}
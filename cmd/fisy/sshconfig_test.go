@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	cfg, err := parseSSHConfig(strings.NewReader(`
+# A comment.
+User globaluser
+
+Host backup !ignored.example.com *.example.com
+  HostName backup.internal
+  Port=2222
+  ProxyJump bastion
+  User backupuser
+
+Host bastion
+  HostName "%h.example.net"
+  ProxyCommand nc -X connect %h %p
+
+Match exec "true"
+  User matched
+
+Host *
+  User fallback
+  Port 22
+`))
+	if err != nil {
+		t.Fatalf("parseSSHConfig failed: %v", err)
+	}
+
+	tsts := []struct {
+		Host string
+		Key  string
+		Want string
+	}{
+		{"backup", "HostName", "backup.internal"},
+		{"backup", "port", "2222"},
+		{"backup", "ProxyJump", "bastion"},
+		{"backup", "User", "globaluser"},
+		{"a.example.com", "HostName", "backup.internal"},
+		{"ignored.example.com", "HostName", ""},
+		{"ignored.example.com", "Port", "22"},
+		{"bastion", "HostName", "bastion.example.net"},
+		{"bastion", "ProxyCommand", "nc -X connect %h %p"},
+		{"other", "HostName", ""},
+		{"other", "Port", "22"},
+	}
+	for _, tst := range tsts {
+		if got := cfg.Get(tst.Host, tst.Key); got != tst.Want {
+			t.Errorf("Get(%q, %q): got %q, want %q", tst.Host, tst.Key, got, tst.Want)
+		}
+	}
+}
+
+func TestReadSSHConfigMissingFile(t *testing.T) {
+	cfg, err := readSSHConfig("/does/not/exist")
+	if err != nil {
+		t.Fatalf("readSSHConfig failed: %v", err)
+	}
+	if got := cfg.Get("host", "HostName"); got != "" {
+		t.Errorf("Get: got %q, want empty", got)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An sshEndpoint is a user and an address of an SSH server.
+type sshEndpoint struct {
+	User string
+	Addr string
+}
+
+// An sshDialConfig describes how to reach an SSH server.
+type sshDialConfig struct {
+	sshEndpoint
+
+	KnownHostsPath string
+	HostKeyPolicy  hostKeyPolicy
+	AgentSockPath  string
+
+	// ProxyJump lists the jump hosts to go through, in order.
+	ProxyJump []sshEndpoint
+
+	// ProxyCommand is run by the shell, and its stdin/stdout is
+	// used as the transport to the first hop. It is ignored if
+	// ProxyJump is set.
+	ProxyCommand string
+
+	// ServerAliveInterval is how often to send keepalives on an
+	// idle connection. Zero disables keepalives.
+	ServerAliveInterval time.Duration
+
+	// ServerAliveCountMax is how many intervals a keepalive may go
+	// unanswered before the connection is declared stalled.
+	ServerAliveCountMax int
+}
+
+// resolveSSHEndpoint fills in the address and user of an SSH server
+// from ssh_config, and falls back to defaults. Any of user and port
+// may be empty.
+func resolveSSHEndpoint(sshcfg *sshConfig, user, host, port string) sshEndpoint {
+	alias := host
+	if s := sshcfg.Get(alias, "HostName"); s != "" {
+		host = s
+	}
+	if port == "" {
+		port = sshcfg.Get(alias, "Port")
+	}
+	if port == "" {
+		port = strings.TrimPrefix(defaultPortSuffix, ":")
+	}
+	if user == "" {
+		user = sshcfg.Get(alias, "User")
+	}
+	if user == "" {
+		user = os.Getenv("LOGNAME")
+	}
+	return sshEndpoint{User: user, Addr: net.JoinHostPort(host, port)}
+}
+
+// parseProxyJump parses a comma-separated list of jump hosts on the
+// form "[user@]host[:port]" or "ssh://[user@]host[:port]". The value
+// "none" means no jump hosts.
+func parseProxyJump(sshcfg *sshConfig, s string) ([]sshEndpoint, error) {
+	if s == "" || s == "none" {
+		return nil, nil
+	}
+
+	var ret []sshEndpoint
+	for _, hop := range strings.Split(s, ",") {
+		if !strings.Contains(hop, "://") {
+			hop = "ssh://" + hop
+		}
+		u, err := url.Parse(hop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host %q: %w", hop, err)
+		}
+		if u.Scheme != "ssh" || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid jump host: %s", hop)
+		}
+
+		var user string
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		ret = append(ret, resolveSSHEndpoint(sshcfg, user, u.Hostname(), u.Port()))
+	}
+	return ret, nil
+}
+
+// dialSSH connects to an SSH server, possibly through jump hosts or a
+// proxy command. The returned function closes the client and all
+// intermediate connections.
+func dialSSH(cfg *sshDialConfig) (*ssh.Client, func() error, error) {
+	var closers []func() error
+	closeAll := func() error {
+		var rerr error
+		for i := len(closers); i > 0; i-- {
+			if err := closers[i-1](); err != nil && rerr == nil {
+				rerr = err
+			}
+		}
+		return rerr
+	}
+
+	agentConn, err := net.Dial("unix", cfg.AgentSockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	closers = append(closers, agentConn.Close)
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers),
+	}
+
+	hops := append(append([]sshEndpoint{}, cfg.ProxyJump...), cfg.sshEndpoint)
+	var client *ssh.Client
+	for _, hop := range hops {
+		hkcb, err := makeHostKeyCallback(cfg.KnownHostsPath, cfg.HostKeyPolicy)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		ccfg := ssh.ClientConfig{
+			User:            hop.User,
+			Auth:            auth,
+			HostKeyCallback: hkcb,
+			Timeout:         30 * time.Second,
+		}
+
+		var conn net.Conn
+		switch {
+		case client != nil:
+			conn, err = client.Dial("tcp", hop.Addr)
+			if err != nil {
+				err = fmt.Errorf("jumping to %s: %w", hop.Addr, err)
+			}
+		case cfg.ProxyCommand != "":
+			conn, err = dialProxyCommand(expandProxyCommand(cfg.ProxyCommand, hop), hop.Addr)
+		default:
+			conn, err = net.DialTimeout("tcp", hop.Addr, ccfg.Timeout)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		c, chans, reqs, err := remote.NewSSHClientConn(conn, hop.Addr, &ccfg)
+		if err != nil {
+			conn.Close()
+			closeAll()
+			return nil, nil, err
+		}
+		client = ssh.NewClient(c, chans, reqs)
+		closers = append(closers, client.Close)
+	}
+
+	return client, closeAll, nil
+}
+
+// expandProxyCommand replaces the ssh_config tokens %h, %p, %r and %%
+// in a proxy command.
+func expandProxyCommand(s string, hop sshEndpoint) string {
+	host, port, err := net.SplitHostPort(hop.Addr)
+	if err != nil {
+		host = hop.Addr
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", port,
+		"%r", hop.User,
+	).Replace(s)
+}
+
+// dialProxyCommand starts a shell command and returns a connection
+// talking to its stdin and stdout. The address is what the connection
+// reports as its remote address.
+func dialProxyCommand(command, addr string) (net.Conn, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("proxy command %q: %w", command, err)
+	}
+
+	return &proxyCommandConn{
+		Reader:      stdout,
+		WriteCloser: stdin,
+		cmd:         cmd,
+		addr:        proxyCommandAddr(addr),
+	}, nil
+}
+
+// A proxyCommandConn is a net.Conn on top of the stdin and stdout of
+// a subprocess. Deadlines are not supported.
+type proxyCommandConn struct {
+	io.Reader
+	io.WriteCloser
+
+	cmd       *exec.Cmd
+	addr      proxyCommandAddr
+	closeOnce sync.Once
+}
+
+// Close closes stdin and terminates the subprocess.
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.WriteCloser.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr                { return c.addr }
+func (c *proxyCommandConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// A proxyCommandAddr is the net.Addr of a proxyCommandConn. It is
+// the "host:port" the command connects to, which is what host key
+// checking expects.
+type proxyCommandAddr string
+
+func (a proxyCommandAddr) Network() string { return "proxycommand" }
+func (a proxyCommandAddr) String() string  { return string(a) }
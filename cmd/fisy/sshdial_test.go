@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	defer os.Setenv("LOGNAME", os.Getenv("LOGNAME"))
+	os.Setenv("LOGNAME", "me")
+
+	sshcfg, err := parseSSHConfig(strings.NewReader("Host j2\n  HostName jump2.example.com\n  User bob\n"))
+	if err != nil {
+		t.Fatalf("parseSSHConfig failed: %v", err)
+	}
+
+	got, err := parseProxyJump(sshcfg, "alice@j1:2200,j2,ssh://[::1]")
+	if err != nil {
+		t.Fatalf("parseProxyJump failed: %v", err)
+	}
+	want := []sshEndpoint{
+		{User: "alice", Addr: "j1:2200"},
+		{User: "bob", Addr: "jump2.example.com:22"},
+		{User: "me", Addr: "[::1]:22"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProxyJump: got %+v, want %+v", got, want)
+	}
+
+	if got, err := parseProxyJump(sshcfg, "none"); err != nil || got != nil {
+		t.Errorf("parseProxyJump(none): got %+v, %v, want nil", got, err)
+	}
+
+	if _, err := parseProxyJump(sshcfg, "http://host"); err == nil {
+		t.Errorf("parseProxyJump(http): got nil, want error")
+	}
+}
+
+func TestExpandProxyCommand(t *testing.T) {
+	got := expandProxyCommand("connect %r@%h %p 100%%", sshEndpoint{User: "alice", Addr: "example.com:2222"})
+	if want := "connect alice@example.com 2222 100%"; got != want {
+		t.Errorf("expandProxyCommand: got %q, want %q", got, want)
+	}
+}
+
+func TestDialProxyCommand(t *testing.T) {
+	conn, err := dialProxyCommand("cat", "example.com:22")
+	if err != nil {
+		t.Fatalf("dialProxyCommand failed: %v", err)
+	}
+	defer conn.Close()
+
+	if got, want := conn.RemoteAddr().String(), "example.com:22"; got != want {
+		t.Errorf("RemoteAddr: got %q, want %q", got, want)
+	}
+
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	bs := make([]byte, 5)
+	if _, err := io.ReadFull(conn, bs); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := "hello"; string(bs) != want {
+		t.Errorf("Read: got %q, want %q", bs, want)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestDialSSHProxyJump(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "sshdial-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	sshAddr, agentPath, knownHostsPath, done, err := newTestSFTPServer(tmpd)
+	if err != nil {
+		t.Fatalf("newTestSFTPServer failed: %v", err)
+	}
+	defer done()
+
+	// The server acts as its own jump host.
+	ep := sshEndpoint{User: "tester", Addr: sshAddr.String()}
+	sc, closeSSH, err := dialSSH(&sshDialConfig{
+		sshEndpoint:    ep,
+		KnownHostsPath: knownHostsPath,
+		HostKeyPolicy:  strictHostKeyPolicy,
+		AgentSockPath:  agentPath,
+		ProxyJump:      []sshEndpoint{ep, ep},
+	})
+	if err != nil {
+		t.Fatalf("dialSSH failed: %v", err)
+	}
+	defer closeSSH()
+
+	sftpc, err := sftp.NewClient(sc)
+	if err != nil {
+		t.Fatalf("sftp.NewClient failed: %v", err)
+	}
+	defer sftpc.Close()
+
+	if _, err := sftpc.Stat(tmpd); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+
+	if err := closeSSH(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+}
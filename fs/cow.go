@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,10 +17,19 @@ import (
 //
 // On Finish, the file system writes a "<host>/<time>.complete" file
 // and updates the ".latest" symlinks.
+//
+// Only one process at a time can write snapshots for a host. This is
+// enforced by a "<host>/.lock" file, taken by NewCOW and released by
+// Finish or Unlock.
+//
+// Optionally, complete files are recorded in a content index shared
+// by all hosts, in ".index". See LinkContent and AddContent.
 type COW struct {
-	fs    WriteableFileSystem
-	rroot Path
-	wroot Path
+	fs     WriteableFileSystem
+	rroot  Path
+	wroot  Path
+	owner  Path
+	broken *COWLock
 
 	initOnce  sync.Once
 	initGroup errgroup.Group
@@ -28,6 +38,9 @@ type COW struct {
 const (
 	latestPath     Path = ".latest"
 	completeSuffix Path = ".complete"
+
+	// cowTimeFormat is the layout of the time directory names.
+	cowTimeFormat = "2006-01-02T15-04-05.000000"
 )
 
 var ErrHostIsEmpty = errors.New("host must be non-empty")
@@ -35,13 +48,38 @@ var ErrHostIsEmpty = errors.New("host must be non-empty")
 // NewCOW returns a new copy-on-write file system at the given
 // location, for a given hostname and timestamp. The time directory
 // must not exist, and the timestamp must be later than what the
-// ".latest" file points to.
+// ".latest" file points to. If another process holds the lock of the
+// host, a *COWLockedError is returned. A stale lock, left by a process
+// on this machine that no longer exists, is broken.
 func NewCOW(fs WriteableFileSystem, host string, t time.Time) (*COW, error) {
 	if host == "" {
 		return nil, ErrHostIsEmpty
 	}
 
-	ts := Path(t.Format("2006-01-02T15-04-05.000000"))
+	owner, broken, err := lockCOW(fs, host, t)
+	if err != nil {
+		return nil, err
+	}
+
+	rdir, err := findCOWReadRoot(fs, host, t)
+	if err != nil {
+		unlockCOW(fs, Path(host), owner)
+		return nil, err
+	}
+
+	return &COW{
+		fs:     fs,
+		rroot:  rdir,
+		wroot:  Path(host).Resolve(Path(t.Format(cowTimeFormat))),
+		owner:  owner,
+		broken: broken,
+	}, nil
+}
+
+// findCOWReadRoot returns the snapshot to keep files from, for a new
+// snapshot with the given timestamp.
+func findCOWReadRoot(fs WriteableFileSystem, host string, t time.Time) (Path, error) {
+	ts := Path(t.Format(cowTimeFormat))
 	rdir, err := fs.Readlink(Path(host).Resolve(latestPath))
 	if err == nil {
 		rdir = Path(host).Resolve(rdir)
@@ -50,18 +88,36 @@ func NewCOW(fs WriteableFileSystem, host string, t time.Time) (*COW, error) {
 		if IsNotExist(err) {
 			rdir = Path(host).Resolve(ts)
 		} else if err != nil {
-			return nil, err
+			return "", err
 		}
 	}
 	if ts < rdir.Base() {
-		return nil, fmt.Errorf("there is a newer timestamp already: new %v, existing %v", ts, rdir)
+		return "", fmt.Errorf("there is a newer timestamp already: new %v, existing %v", ts, rdir)
 	}
 
-	return &COW{
-		fs:    fs,
-		rroot: rdir,
-		wroot: Path(host).Resolve(ts),
-	}, nil
+	return rdir, nil
+}
+
+// ReadRoot returns the directory of the snapshot files are kept from.
+func (fs *COW) ReadRoot() Path {
+	return fs.rroot
+}
+
+// WriteRoot returns the directory of the snapshot being written.
+func (fs *COW) WriteRoot() Path {
+	return fs.wroot
+}
+
+// BrokenLock returns the stale lock NewCOW broke, or nil.
+func (fs *COW) BrokenLock() *COWLock {
+	return fs.broken
+}
+
+// Unlock releases the host lock, without finishing the snapshot. It
+// does nothing if the lock has already been released, or broken by
+// another process.
+func (fs *COW) Unlock() error {
+	return unlockCOW(fs.fs, fs.wroot.Dir(), fs.owner)
 }
 
 // init creates the host/time directories if they don't exist.
@@ -96,6 +152,16 @@ func (fs *COW) Open(path Path) (FileReader, error) {
 	return fs.fs.Open(fs.rroot.Resolve(path))
 }
 
+// Prefetch prefetches the tree in the snapshot files are kept from,
+// if the underlying file system is a Prefetcher.
+func (fs *COW) Prefetch(path Path) error {
+	pf, ok := fs.fs.(Prefetcher)
+	if !ok {
+		return nil
+	}
+	return pf.Prefetch(fs.rroot.Resolve(path))
+}
+
 func (fs *COW) Readlink(path Path) (Path, error) {
 	return fs.fs.Readlink(fs.rroot.Resolve(path))
 }
@@ -114,7 +180,10 @@ func (fs *COW) Finish() error {
 		return err
 	}
 	// Mark it as the latest overall.
-	return fs.atomicSymlink(fs.wroot, latestPath)
+	if err := fs.atomicSymlink(fs.wroot, latestPath); err != nil {
+		return err
+	}
+	return fs.Unlock()
 }
 
 func (fs *COW) Create(path Path) (FileWriter, error) {
@@ -124,6 +193,16 @@ func (fs *COW) Create(path Path) (FileWriter, error) {
 	return fs.fs.Create(fs.wroot.Resolve(path))
 }
 
+// KeepFrom is like Keep, but for a file that was at another path in
+// the snapshot being read, e.g. because it was moved. It only works
+// for files.
+func (fs *COW) KeepFrom(oldpath, path Path) error {
+	if err := fs.init(); err != nil {
+		return err
+	}
+	return fs.fs.Link(fs.rroot.Resolve(oldpath), fs.wroot.Resolve(path))
+}
+
 func (fs *COW) Keep(path Path) error {
 	if err := fs.init(); err != nil {
 		return err
@@ -203,3 +282,125 @@ func (fs *COW) Lchown(path Path, uid, gid int) error {
 func (fs *COW) Chtimes(path Path, atime time.Time, mtime time.Time) error {
 	return fs.fs.Chtimes(fs.wroot.Resolve(path), atime, mtime)
 }
+
+// A COWRetention selects which complete snapshots of a host to keep.
+// Zero values disable the respective rule. If both rules are set, a
+// snapshot is kept if either rule keeps it.
+type COWRetention struct {
+	// KeepLast is the number of newest snapshots to keep.
+	KeepLast int
+
+	// MaxAge is how old a snapshot can be before it is removed.
+	MaxAge time.Duration
+}
+
+// Prune removes complete snapshots of this host that r doesn't
+// keep. The latest snapshot, and incomplete snapshots, are never
+// removed. It should be called after Finish. Returns the removed
+// snapshot directories.
+func (fs *COW) Prune(r COWRetention, now time.Time) ([]Path, error) {
+	if r.KeepLast <= 0 && r.MaxAge <= 0 {
+		return nil, nil
+	}
+
+	hostDir := fs.wroot.Dir()
+	snapshots, err := ListCOWSnapshots(fs.fs, string(hostDir))
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := fs.fs.Readlink(hostDir.Resolve(latestPath))
+	if err != nil && !IsNotExist(err) {
+		return nil, err
+	}
+
+	var removed []Path
+	for i, name := range snapshots {
+		if Path(name) == latest || (r.KeepLast > 0 && i < r.KeepLast) {
+			continue
+		}
+		if r.MaxAge > 0 {
+			t, err := time.ParseInLocation(cowTimeFormat, name, time.Local)
+			if err != nil || now.Sub(t) <= r.MaxAge {
+				continue
+			}
+		}
+
+		// Unmark it first, so a partial removal isn't mistaken
+		// for a complete snapshot.
+		dir := hostDir.Resolve(Path(name))
+		if err := fs.fs.Remove(dir + completeSuffix); err != nil {
+			return removed, err
+		}
+		if err := removeTree(fs.fs, dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// ListCOWSnapshots returns the names of the complete snapshots of a
+// host, newest first. The names are times in the COW time format.
+func ListCOWSnapshots(fs ReadableFileSystem, host string) ([]string, error) {
+	fr, err := fs.Open(Path(host))
+	if err != nil {
+		return nil, err
+	}
+	fis, err := fr.Readdir()
+	fr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, fi := range fis {
+		names[fi.Name()] = true
+	}
+	var snapshots []string
+	for _, fi := range fis {
+		if fi.IsDir() && names[fi.Name()+string(completeSuffix)] {
+			snapshots = append(snapshots, fi.Name())
+		}
+	}
+	// The timestamps sort chronologically. Newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(snapshots)))
+	return snapshots, nil
+}
+
+// removeTree is like RemoveAll, but makes directories writable if
+// needed. Snapshots keep the modes of the source.
+func removeTree(fs WriteableFileSystem, path Path) error {
+	err := fs.RemoveAll(path)
+	if err == nil || !IsPermission(err) {
+		return err
+	}
+
+	var rec func(Path) error
+	rec = func(path Path) error {
+		if err := fs.Chmod(path, 0700); err != nil {
+			return err
+		}
+		fr, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+		fis, err := fr.Readdir()
+		fr.Close()
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				if err := rec(path.Resolve(Path(fi.Name()))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := rec(path); err != nil {
+		return err
+	}
+	return fs.RemoveAll(path)
+}
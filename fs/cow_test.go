@@ -32,6 +32,10 @@ func TestNewCOWSanityChecks(t *testing.T) {
 		fs, done := newTestCOW(t)
 		defer done()
 
+		if err := fs.Unlock(); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+
 		_, err := NewCOW(fs.fs, "test", now.Add(-2*time.Hour))
 		if err == nil || !strings.Contains(err.Error(), "newer timestamp") {
 			t.Fatalf("NewCOW error: got %v, want containing %q", err, "newer timestamp")
@@ -236,6 +240,72 @@ func TestCOWFinish(t *testing.T) {
 	}
 }
 
+func TestCOWPrune(t *testing.T) {
+	day := 24 * time.Hour
+	tsts := []struct {
+		Name      string
+		Retention COWRetention
+		Want      []Path
+	}{
+		{"none", COWRetention{}, nil},
+		{"keepLast", COWRetention{KeepLast: 2}, []Path{"test/2", "test/3"}},
+		{"maxAge", COWRetention{MaxAge: 2*day + time.Hour}, []Path{"test/3"}},
+		{"both", COWRetention{KeepLast: 3, MaxAge: day + time.Hour}, []Path{"test/3"}},
+		{"keepsLatest", COWRetention{MaxAge: time.Hour}, []Path{"test/2", "test/3"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			raw := NewMemory()
+			if err := raw.Mkdir("test", 0750, -1, -1); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			names := map[Path]Path{}
+			for i := 0; i < 5; i++ {
+				name := Path(now.Add(-time.Duration(i) * day).Local().Format(cowTimeFormat))
+				names[name] = Path(fmt.Sprint("test/", i))
+				if err := raw.Mkdir(Path("test").Resolve(name), 0550, -1, -1); err != nil {
+					t.Fatalf("Mkdir failed: %v", err)
+				}
+				// The oldest is incomplete, and the latest is not
+				// the newest.
+				if i < 4 {
+					if err := raw.Symlink(name, Path("test").Resolve(name+completeSuffix)); err != nil {
+						t.Fatalf("Symlink failed: %v", err)
+					}
+				}
+				if i == 1 {
+					if err := raw.Symlink(name, Path("test").Resolve(latestPath)); err != nil {
+						t.Fatalf("Symlink failed: %v", err)
+					}
+				}
+			}
+			fs, err := NewCOW(raw, "test", now)
+			if err != nil {
+				t.Fatalf("NewCOW failed: %v", err)
+			}
+
+			removed, err := fs.Prune(tst.Retention, now)
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+
+			var got []Path
+			for _, p := range removed {
+				got = append(got, names[p.Base()])
+				if _, err := raw.Open(p); !IsNotExist(err) {
+					t.Errorf("Open(%q) error: got %v, want ENOENT", p, err)
+				}
+				if _, err := raw.Readlink(p + completeSuffix); !IsNotExist(err) {
+					t.Errorf("Readlink(%q) error: got %v, want ENOENT", p+completeSuffix, err)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tst.Want) {
+				t.Errorf("Prune: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
 func TestCOWCreate(t *testing.T) {
 	fs, done := newTestCOW(t)
 	defer done()
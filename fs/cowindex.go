@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+)
+
+// contentIndexPath is the directory of the content index, shared by
+// all hosts. Each entry is a symlink to a stored file, named by its
+// content key.
+const contentIndexPath Path = ".index"
+
+// A ContentKey identifies the content and metadata of a regular
+// file. Files with equal keys can share an inode, since a hardlink
+// also shares the metadata.
+type ContentKey struct {
+	Hash    [sha256.Size]byte
+	Size    int64
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime int64
+}
+
+// indexPath returns the path of the index entry. Note that the name
+// reveals the content hash, unless names are encrypted.
+func (k *ContentKey) indexPath() Path {
+	h := sha256.New()
+	h.Write(k.Hash[:])
+	for _, v := range []int64{k.Size, int64(k.Mode), int64(k.UID), int64(k.GID), k.ModTime} {
+		binary.Write(h, binary.BigEndian, v)
+	}
+	s := hex.EncodeToString(h.Sum(nil))
+	return contentIndexPath.Resolve(Path(s[:2])).Resolve(Path(s))
+}
+
+// LinkContent creates a file as a hardlink to a stored file with the
+// same content key, from any host and snapshot. Returns false if the
+// index has no such file. Entries whose snapshot has been removed are
+// ignored, and replaced by AddContent.
+func (fs *COW) LinkContent(path Path, key *ContentKey) (bool, error) {
+	target, err := fs.fs.Readlink(key.indexPath())
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := fs.init(); err != nil {
+		return false, err
+	}
+	if err := fs.fs.Link(target, fs.wroot.Resolve(path)); IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddContent records a complete file of the snapshot in the content
+// index. An existing entry for the key is replaced.
+func (fs *COW) AddContent(path Path, key *ContentKey) error {
+	idx := key.indexPath()
+	for _, dir := range []Path{contentIndexPath, idx.Dir()} {
+		if err := fs.fs.Mkdir(dir, 0750, -1, -1); err != nil && !IsExist(err) {
+			return err
+		}
+	}
+
+	// The temporary name depends on the target, so concurrent
+	// additions of the same key don't collide.
+	target := fs.wroot.Resolve(path)
+	th := sha256.Sum256([]byte(target))
+	tmp := idx + Path(".new-"+hex.EncodeToString(th[:4]))
+	if err := fs.fs.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := fs.fs.Rename(tmp, idx); err != nil {
+		fs.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
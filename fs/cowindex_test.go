@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCOWContentIndex(t *testing.T) {
+	raw := NewMemory()
+	key := &ContentKey{Hash: [32]byte{1}, Size: 5, Mode: 0644, UID: 1, GID: 2, ModTime: 1000}
+
+	fs, err := NewCOW(raw, "a", now)
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if linked, err := fs.LinkContent("file", key); err != nil || linked {
+		t.Fatalf("LinkContent: got %v, %v, want false", linked, err)
+	}
+	writeTestFile(t, fs, "file", []byte("hello"))
+	if err := fs.AddContent("file", key); err != nil {
+		t.Fatalf("AddContent failed: %v", err)
+	}
+	if err := fs.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	fs2, err := NewCOW(raw, "b", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if linked, err := fs2.LinkContent("moved", key); err != nil || !linked {
+		t.Fatalf("LinkContent: got %v, %v, want true", linked, err)
+	}
+	if got := readTestFile(t, raw, fs2.WriteRoot().Resolve("moved")); string(got) != "hello" {
+		t.Errorf("Read: got %q, want %q", got, "hello")
+	}
+
+	other := *key
+	other.ModTime++
+	if linked, err := fs2.LinkContent("other", &other); err != nil || linked {
+		t.Errorf("LinkContent(other): got %v, %v, want false", linked, err)
+	}
+
+	t.Run("removedSnapshot", func(t *testing.T) {
+		if err := raw.RemoveAll(fs.WriteRoot()); err != nil {
+			t.Fatalf("RemoveAll failed: %v", err)
+		}
+		if linked, err := fs2.LinkContent("again", key); err != nil || linked {
+			t.Fatalf("LinkContent: got %v, %v, want false", linked, err)
+		}
+
+		if err := fs2.AddContent("moved", key); err != nil {
+			t.Fatalf("AddContent failed: %v", err)
+		}
+		if linked, err := fs2.LinkContent("again", key); err != nil || !linked {
+			t.Errorf("LinkContent: got %v, %v, want true", linked, err)
+		}
+	})
+}
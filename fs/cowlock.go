@@ -0,0 +1,221 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cowLockPath is the lock file in a host directory. It is a symlink
+// whose target describes the owner, since creating a symlink is
+// atomic, and fails if the file exists, also over SFTP.
+const cowLockPath Path = ".lock"
+
+// Mock injection points.
+var (
+	osHostname = os.Hostname
+	osGetpid   = os.Getpid
+
+	// processExists returns whether a local process is running.
+	processExists = func(pid int) bool {
+		err := syscall.Kill(pid, 0)
+		return err == nil || err == syscall.EPERM
+	}
+)
+
+// A COWLock describes the process writing a snapshot for a host.
+type COWLock struct {
+	Hostname string
+	PID      int
+	Start    time.Time
+}
+
+// String returns the lock in the format stored in the lock file.
+func (l *COWLock) String() string {
+	return fmt.Sprintf("pid=%d host=%s start=%s", l.PID, l.Hostname, l.Start.UTC().Format(time.RFC3339))
+}
+
+// Stale returns whether the owner is known to be gone. This is only
+// the case if it ran on this machine, and the process no longer
+// exists.
+func (l *COWLock) Stale() bool {
+	hostname, err := osHostname()
+	if err != nil || l.Hostname != hostname {
+		return false
+	}
+	return !processExists(l.PID)
+}
+
+// parseCOWLock parses the output of COWLock.String.
+func parseCOWLock(s string) (*COWLock, error) {
+	var l COWLock
+	for _, f := range strings.Fields(s) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid COW lock: %q", s)
+		}
+
+		var err error
+		switch kv[0] {
+		case "pid":
+			l.PID, err = strconv.Atoi(kv[1])
+		case "host":
+			l.Hostname = kv[1]
+		case "start":
+			l.Start, err = time.Parse(time.RFC3339, kv[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid COW lock: %q: %w", s, err)
+		}
+	}
+	if l.PID <= 0 || l.Hostname == "" {
+		return nil, fmt.Errorf("invalid COW lock: %q", s)
+	}
+	return &l, nil
+}
+
+// A COWLockedError is returned by NewCOW if another process is
+// writing a snapshot for the same host.
+type COWLockedError struct {
+	Host string
+	Lock *COWLock
+
+	// Orphan is a lock file that was moved aside while breaking a
+	// stale lock, and couldn't be put back because another process
+	// took the lock. Its owner may still be running. It is empty
+	// if there is no such file.
+	Orphan Path
+}
+
+func (e *COWLockedError) Error() string {
+	msg := fmt.Sprintf("snapshots of host %q are locked by PID %d on %s, since %v", e.Host, e.Lock.PID, e.Lock.Hostname, e.Lock.Start.Local())
+	if e.Orphan != "" {
+		msg += fmt.Sprintf(" (another lock was left in %q)", e.Orphan)
+	}
+	return msg
+}
+
+// ReadCOWLock returns the lock of a host directory. The error
+// satisfies IsNotExist if the host isn't locked.
+func ReadCOWLock(fs ReadableFileSystem, host string) (*COWLock, error) {
+	target, err := fs.Readlink(Path(host).Resolve(cowLockPath))
+	if err != nil {
+		return nil, err
+	}
+	return parseCOWLock(string(target))
+}
+
+// RemoveCOWLock removes the lock of a host directory, whoever owns it.
+func RemoveCOWLock(fs WriteableFileSystem, host string) error {
+	return fs.Remove(Path(host).Resolve(cowLockPath))
+}
+
+// lockCOW takes the lock of a host directory. A stale lock is broken,
+// and returned. The owner string identifies the new lock.
+func lockCOW(fs WriteableFileSystem, host string, t time.Time) (owner Path, broken *COWLock, rerr error) {
+	hostname, err := osHostname()
+	if err != nil {
+		return "", nil, err
+	}
+	pid := osGetpid()
+	owner = Path((&COWLock{Hostname: hostname, PID: pid, Start: t}).String())
+	path := Path(host).Resolve(cowLockPath)
+	// Only processes on this machine break locks, so the PID makes
+	// the name unique. The time tells apart locks in one process.
+	aside := Path(host).Resolve(Path(fmt.Sprintf("%s.broken-%d-%d", cowLockPath, pid, t.UnixNano())))
+
+	if err := fs.Mkdir(Path(host), 0750, -1, -1); err != nil && !IsExist(err) {
+		return "", nil, err
+	}
+
+	for {
+		serr := fs.Symlink(owner, path)
+		if serr == nil {
+			return owner, broken, nil
+		}
+
+		// SFTP servers don't have to report EEXIST, so the lock
+		// is read to find out why it failed.
+		target, err := fs.Readlink(path)
+		if IsNotExist(err) {
+			if IsExist(serr) {
+				// Another process is breaking the lock.
+				continue
+			}
+			return "", nil, serr
+		} else if err != nil {
+			return "", nil, err
+		}
+		l, err := parseCOWLock(string(target))
+		if err != nil {
+			return "", nil, err
+		}
+		if broken != nil || !l.Stale() {
+			return "", nil, &COWLockedError{Host: host, Lock: l}
+		}
+
+		ok, err := breakCOWLock(fs, host, aside, target)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			broken = l
+		}
+	}
+}
+
+// breakCOWLock removes the lock, if it still has the given target.
+// Another process may break the same lock, and take a new one, between
+// reading and removing it. The lock is therefore moved aside, and only
+// removed after checking it is the one we read. Returns false if the
+// lock had changed.
+//
+// If another process takes the lock before a new lock has been put
+// back, the moved lock is left aside, and a *COWLockedError naming it
+// is returned.
+func breakCOWLock(fs WriteableFileSystem, host string, aside, target Path) (bool, error) {
+	path := Path(host).Resolve(cowLockPath)
+	if err := fs.Rename(path, aside); IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	got, err := fs.Readlink(aside)
+	if err != nil {
+		return false, err
+	}
+	if got != target {
+		// It's a new lock, so put it back.
+		if err := fs.Symlink(got, path); err != nil {
+			if l, rerr := ReadCOWLock(fs, host); rerr == nil {
+				return false, &COWLockedError{Host: host, Lock: l, Orphan: aside}
+			}
+			return false, err
+		}
+	}
+	if err := fs.Remove(aside); err != nil {
+		return false, err
+	}
+	return got == target, nil
+}
+
+// unlockCOW releases the lock of a host directory, if it is still
+// held by the owner.
+func unlockCOW(fs WriteableFileSystem, host Path, owner Path) error {
+	path := host.Resolve(cowLockPath)
+	target, err := fs.Readlink(path)
+	if IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if target != owner {
+		// The lock was broken, and is now someone else's.
+		return nil
+	}
+	return fs.Remove(path)
+}
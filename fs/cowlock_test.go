@@ -0,0 +1,284 @@
+package fs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCOWLock(t *testing.T) {
+	want := &COWLock{Hostname: "host", PID: 42, Start: now}
+	got, err := parseCOWLock(want.String())
+	if err != nil {
+		t.Fatalf("parseCOWLock failed: %v", err)
+	}
+	if *got != *want {
+		t.Errorf("parseCOWLock: got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "pid=1", "host=a", "pid=x host=a", "pid=1 host=a start=x", "garbage"} {
+		if _, err := parseCOWLock(s); err == nil {
+			t.Errorf("parseCOWLock(%q) error: got %v, want an error", s, err)
+		}
+	}
+}
+
+func TestNewCOWLock(t *testing.T) {
+	defer func(h func() (string, error), p func() int, e func(int) bool) {
+		osHostname, osGetpid, processExists = h, p, e
+	}(osHostname, osGetpid, processExists)
+	osHostname = func() (string, error) { return "here", nil }
+	osGetpid = func() int { return 100 }
+	alive := map[int]bool{100: true}
+	processExists = func(pid int) bool { return alive[pid] }
+
+	raw := NewMemory()
+	fs, err := NewCOW(raw, "test", now)
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	l, err := ReadCOWLock(raw, "test")
+	if err != nil {
+		t.Fatalf("ReadCOWLock failed: %v", err)
+	}
+	if want := (COWLock{Hostname: "here", PID: 100, Start: now}); *l != want {
+		t.Errorf("ReadCOWLock: got %+v, want %+v", l, want)
+	}
+
+	t.Run("locked", func(t *testing.T) {
+		_, err := NewCOW(raw, "test", now.Add(time.Hour))
+		var lerr *COWLockedError
+		if !errors.As(err, &lerr) || lerr.Lock.PID != 100 {
+			t.Fatalf("NewCOW error: got %v, want COWLockedError", err)
+		}
+	})
+
+	t.Run("otherHost", func(t *testing.T) {
+		fs2, err := NewCOW(raw, "test2", now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		if err := fs2.Unlock(); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+	})
+
+	t.Run("finishUnlocks", func(t *testing.T) {
+		if err := fs.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		if _, err := ReadCOWLock(raw, "test"); !IsNotExist(err) {
+			t.Errorf("ReadCOWLock error: got %v, want ENOENT", err)
+		}
+	})
+
+	t.Run("breaksStale", func(t *testing.T) {
+		stale := &COWLock{Hostname: "here", PID: 200, Start: now}
+		if err := raw.Symlink(Path(stale.String()), "test/.lock"); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+
+		fs, err := NewCOW(raw, "test", now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		if got := fs.BrokenLock(); got == nil || *got != *stale {
+			t.Errorf("BrokenLock: got %+v, want %+v", got, stale)
+		}
+		if err := fs.Unlock(); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+	})
+
+	t.Run("keepsRemote", func(t *testing.T) {
+		remote := &COWLock{Hostname: "there", PID: 200, Start: now}
+		if err := raw.Symlink(Path(remote.String()), "test/.lock"); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+		defer RemoveCOWLock(raw, "test")
+
+		if _, err := NewCOW(raw, "test", now.Add(time.Hour)); err == nil {
+			t.Fatalf("NewCOW error: got %v, want COWLockedError", err)
+		}
+	})
+
+	t.Run("unlockBroken", func(t *testing.T) {
+		fs, err := NewCOW(raw, "test", now.Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		if err := RemoveCOWLock(raw, "test"); err != nil {
+			t.Fatalf("RemoveCOWLock failed: %v", err)
+		}
+		other := &COWLock{Hostname: "there", PID: 300, Start: now}
+		if err := raw.Symlink(Path(other.String()), "test/.lock"); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+
+		if err := fs.Unlock(); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+		if l, err := ReadCOWLock(raw, "test"); err != nil || *l != *other {
+			t.Errorf("ReadCOWLock: got %+v, %v, want %+v", l, err, other)
+		}
+	})
+}
+
+func TestLockCOWConcurrentBreakers(t *testing.T) {
+	defer func(h func() (string, error), p func() int, e func(int) bool) {
+		osHostname, osGetpid, processExists = h, p, e
+	}(osHostname, osGetpid, processExists)
+	osHostname = func() (string, error) { return "here", nil }
+	osGetpid = func() int { return 100 }
+	alive := map[int]bool{100: true}
+	processExists = func(pid int) bool { return alive[pid] }
+
+	raw := NewMemory()
+	if err := raw.Mkdir("test", 0700, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	stale := &COWLock{Hostname: "here", PID: 200, Start: now}
+	if err := raw.Symlink(Path(stale.String()), "test/.lock"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	// The first breaker is paused after reading the stale lock,
+	// while the second one breaks it and takes a new lock.
+	renaming := make(chan struct{})
+	resume := make(chan struct{})
+	var once sync.Once
+	slow := &renameHookFileSystem{WriteableFileSystem: raw, beforeRename: func() {
+		once.Do(func() {
+			close(renaming)
+			<-resume
+		})
+	}}
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := lockCOW(slow, "test", now.Add(time.Hour))
+		errc <- err
+	}()
+	<-renaming
+
+	owner, broken, err := lockCOW(raw, "test", now.Add(2*time.Hour))
+	close(resume)
+	if err != nil {
+		t.Fatalf("lockCOW failed: %v", err)
+	}
+	if broken == nil || *broken != *stale {
+		t.Errorf("lockCOW broken: got %+v, want %+v", broken, stale)
+	}
+
+	var lerr *COWLockedError
+	if err := <-errc; !errors.As(err, &lerr) {
+		t.Fatalf("lockCOW error: got %v, want COWLockedError", err)
+	}
+	if got, err := raw.Readlink("test/.lock"); err != nil || got != owner {
+		t.Errorf("Readlink: got %q, %v, want %q", got, err, owner)
+	}
+
+	// The lock moved aside is gone.
+	dir, err := raw.Open("test")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer dir.Close()
+	fis, err := dir.Readdir()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != ".lock" {
+		t.Errorf("Readdir: got %v, want only .lock", fis)
+	}
+}
+
+func TestLockCOWBreakerLosesRestore(t *testing.T) {
+	defer func(h func() (string, error), p func() int, e func(int) bool) {
+		osHostname, osGetpid, processExists = h, p, e
+	}(osHostname, osGetpid, processExists)
+	osHostname = func() (string, error) { return "here", nil }
+	osGetpid = func() int { return 100 }
+	alive := map[int]bool{100: true}
+	processExists = func(pid int) bool { return alive[pid] }
+
+	raw := NewMemory()
+	if err := raw.Mkdir("test", 0700, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	stale := &COWLock{Hostname: "here", PID: 200, Start: now}
+	if err := raw.Symlink(Path(stale.String()), "test/.lock"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	// The first breaker reads the stale lock. Before it moves it
+	// aside, a second process breaks it and takes a new lock. While
+	// the new lock is moved aside, a third process takes the lock.
+	var second, third Path
+	slow := &renameHookFileSystem{
+		WriteableFileSystem: raw,
+		beforeRename: func() {
+			if second != "" {
+				return
+			}
+			var err error
+			second, _, err = lockCOW(raw, "test", now.Add(2*time.Hour))
+			if err != nil {
+				t.Fatalf("lockCOW failed: %v", err)
+			}
+		},
+		afterRename: func() {
+			if third != "" {
+				return
+			}
+			var err error
+			third, _, err = lockCOW(raw, "test", now.Add(3*time.Hour))
+			if err != nil {
+				t.Fatalf("lockCOW failed: %v", err)
+			}
+		},
+	}
+	_, _, err := lockCOW(slow, "test", now.Add(time.Hour))
+	var lerr *COWLockedError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("lockCOW error: got %v, want COWLockedError", err)
+	}
+	if got := Path(lerr.Lock.String()); got != third {
+		t.Errorf("lockCOW Lock: got %q, want %q", got, third)
+	}
+	if lerr.Orphan == "" {
+		t.Fatalf("lockCOW Orphan: got %q, want non-empty", lerr.Orphan)
+	}
+	if !strings.Contains(lerr.Error(), string(lerr.Orphan)) {
+		t.Errorf("Error: got %q, want it to contain %q", lerr.Error(), lerr.Orphan)
+	}
+
+	if got, err := raw.Readlink("test/.lock"); err != nil || got != third {
+		t.Errorf("Readlink: got %q, %v, want %q", got, err, third)
+	}
+	// The second process's lock is kept, so it can be found.
+	if got, err := raw.Readlink(lerr.Orphan); err != nil || got != second {
+		t.Errorf("Readlink(%q): got %q, %v, want %q", lerr.Orphan, got, err, second)
+	}
+}
+
+// A renameHookFileSystem calls functions before and after each
+// Rename. The functions may be nil.
+type renameHookFileSystem struct {
+	WriteableFileSystem
+
+	beforeRename func()
+	afterRename  func()
+}
+
+func (fs *renameHookFileSystem) Rename(oldpath Path, newpath Path) error {
+	if fs.beforeRename != nil {
+		fs.beforeRename()
+	}
+	err := fs.WriteableFileSystem.Rename(oldpath, newpath)
+	if fs.afterRename != nil {
+		fs.afterRename()
+	}
+	return err
+}
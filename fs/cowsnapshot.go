@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A COWSnapshot is a read-only view of a complete snapshot written by
+// COW. Opening it doesn't take the lock of the host.
+type COWSnapshot struct {
+	fs   ReadableFileSystem
+	root Path
+}
+
+// OpenCOWSnapshot selects a complete snapshot of a host, in the file
+// system a COW writes to. The selector is one of
+//
+//	latest         - The snapshot ".latest" of the host points to.
+//	latest~<n>     - The nth complete snapshot before that.
+//	<time prefix>  - The newest complete snapshot whose time starts
+//	                 with the prefix, e.g. "2021-01-02" or
+//	                 "2021-01-02T15-04-05.000000".
+//
+// An empty selector means "latest". If no snapshot matches, the error
+// satisfies IsNotExist.
+func OpenCOWSnapshot(fs ReadableFileSystem, host, selector string) (*COWSnapshot, error) {
+	if host == "" {
+		return nil, ErrHostIsEmpty
+	}
+	hostDir := Path(host)
+
+	snapshots, err := ListCOWSnapshots(fs, host)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := selectCOWSnapshot(fs, hostDir, snapshots, selector)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, &os.PathError{Op: "snapshot", Path: string(hostDir) + "@" + selector, Err: os.ErrNotExist}
+	}
+
+	return &COWSnapshot{fs: fs, root: hostDir.Resolve(Path(name))}, nil
+}
+
+// selectCOWSnapshot returns the name of the snapshot the selector
+// matches, or an empty string.
+func selectCOWSnapshot(fs ReadableFileSystem, hostDir Path, snapshots []string, selector string) (string, error) {
+	if selector == "" {
+		selector = "latest"
+	}
+
+	if s := strings.TrimPrefix(selector, "latest"); s != selector {
+		n := 0
+		if s != "" {
+			var err error
+			n, err = strconv.Atoi(strings.TrimPrefix(s, "~"))
+			if err != nil || !strings.HasPrefix(s, "~") || n < 0 {
+				return "", fmt.Errorf("invalid snapshot selector: %q", selector)
+			}
+		}
+
+		latest, err := fs.Readlink(hostDir.Resolve(latestPath))
+		if IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		for i, name := range snapshots {
+			if Path(name) == latest.Base() {
+				if i+n < len(snapshots) {
+					return snapshots[i+n], nil
+				}
+				break
+			}
+		}
+		return "", nil
+	}
+
+	for _, name := range snapshots {
+		if strings.HasPrefix(name, selector) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// Root returns the directory of the snapshot, in the underlying file
+// system.
+func (fs *COWSnapshot) Root() Path {
+	return fs.root
+}
+
+func (fs *COWSnapshot) Open(path Path) (FileReader, error) {
+	return fs.fs.Open(fs.root.Resolve(path))
+}
+
+func (fs *COWSnapshot) Readlink(path Path) (Path, error) {
+	return fs.fs.Readlink(fs.root.Resolve(path))
+}
+
+func (fs *COWSnapshot) Stat() (FSInfo, error) {
+	return fs.fs.Stat()
+}
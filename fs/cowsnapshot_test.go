@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestOpenCOWSnapshot(t *testing.T) {
+	day := 24 * time.Hour
+	raw := NewMemory()
+	if err := raw.Mkdir("test", 0750, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	var names []Path
+	for i := 0; i < 4; i++ {
+		name := Path(now.Add(-time.Duration(i) * day).Format(cowTimeFormat))
+		names = append(names, name)
+		if err := raw.Mkdir(Path("test").Resolve(name), 0750, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		// The oldest is incomplete, and the latest is not the
+		// newest.
+		if i < 3 {
+			if err := raw.Symlink(name, Path("test").Resolve(name+completeSuffix)); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+		}
+		if i == 1 {
+			if err := raw.Symlink(name, Path("test").Resolve(latestPath)); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+		}
+	}
+
+	tsts := []struct {
+		Name     string
+		Selector string
+		Want     int
+	}{
+		{"empty", "", 1},
+		{"latest", "latest", 1},
+		{"latestBefore", "latest~1", 2},
+		{"latestBeforeMissing", "latest~2", -1},
+		{"date", string(names[0][:10]), 0},
+		{"full", string(names[2]), 2},
+		{"incomplete", string(names[3]), -1},
+		{"noMatch", "2000", -1},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			fs, err := OpenCOWSnapshot(raw, "test", tst.Selector)
+			if tst.Want < 0 {
+				if !IsNotExist(err) {
+					t.Fatalf("OpenCOWSnapshot error: got %v, want ENOENT", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenCOWSnapshot failed: %v", err)
+			}
+			if want := Path("test").Resolve(names[tst.Want]); fs.Root() != want {
+				t.Errorf("Root: got %q, want %q", fs.Root(), want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := OpenCOWSnapshot(raw, "test", "latest~x"); err == nil || IsNotExist(err) {
+			t.Errorf("OpenCOWSnapshot error: got %v, want invalid selector", err)
+		}
+	})
+
+	t.Run("missingHost", func(t *testing.T) {
+		if _, err := OpenCOWSnapshot(raw, "other", ""); !IsNotExist(err) {
+			t.Errorf("OpenCOWSnapshot error: got %v, want ENOENT", err)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		fw, err := raw.Create(Path("test").Resolve(names[1]).Resolve("file"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := fw.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		fs, err := OpenCOWSnapshot(raw, "test", "latest")
+		if err != nil {
+			t.Fatalf("OpenCOWSnapshot failed: %v", err)
+		}
+		fr, err := fs.Open("file")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if got, want := string(bs), "hello"; got != want {
+			t.Errorf("ReadAll: got %q, want %q", got, want)
+		}
+	})
+}
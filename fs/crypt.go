@@ -0,0 +1,648 @@
+package fs
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Crypt is a file system that encrypts file contents, symlink targets
+// and, optionally, names before they reach the underlying file
+// system. Modes, owners, times and the directory structure are not
+// encrypted. Sizes are mapped back to plaintext sizes, so files can be
+// compared to the source.
+//
+// Each file is encrypted in chunks with XChaCha20-Poly1305, using a
+// random file ID stored in its header. The path is not used, so files
+// can be hardlinked and renamed, e.g. by COW. Names are encrypted
+// deterministically, with AES-CTR and a synthetic IV, so paths can be
+// looked up.
+//
+// The salt and a key check value are stored in a ".fisy-crypt" file
+// in the root of the underlying file system.
+type Crypt struct {
+	fs      WriteableFileSystem
+	names   bool
+	content cipher.AEAD
+	nameEnc cipher.Block
+	nameMAC []byte
+}
+
+const (
+	cryptParamsPath Path = ".fisy-crypt"
+	cryptVersion         = 1
+
+	cryptMagic      = "fisyenc1"
+	cryptFileIDSize = 16
+	cryptHeaderSize = len(cryptMagic) + cryptFileIDSize
+	cryptChunkSize  = 64 * 1024
+	cryptNameIVSize = aes.BlockSize
+
+	// cryptMaxNameSize is the longest name that can be encrypted,
+	// so the base64 encoding fits in NAME_MAX (255) bytes.
+	cryptMaxNameSize = 255*3/4 - cryptNameIVSize
+)
+
+var (
+	// ErrCryptWrongKey is returned by NewCrypt if the key doesn't
+	// match the one the file system was created with.
+	ErrCryptWrongKey = errors.New("wrong encryption key or passphrase")
+
+	// ErrCryptCorrupt is returned when reading data that wasn't
+	// encrypted with the key, or has been modified or truncated.
+	ErrCryptCorrupt = errors.New("encrypted data is corrupt")
+)
+
+// A CryptKeyFunc derives the master key of a Crypt file system from
+// its salt.
+type CryptKeyFunc func(salt []byte) ([]byte, error)
+
+// CryptKeyFromSecret uses a random secret, e.g. read from a key file,
+// as the master key. It must be at least 32 bytes.
+func CryptKeyFromSecret(secret []byte) CryptKeyFunc {
+	return func(salt []byte) ([]byte, error) {
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("the encryption key must be at least 32 bytes, got %d", len(secret))
+		}
+		return secret, nil
+	}
+}
+
+// CryptKeyFromPassphrase derives the master key from a passphrase,
+// using scrypt.
+func CryptKeyFromPassphrase(passphrase string) CryptKeyFunc {
+	return func(salt []byte) ([]byte, error) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("the passphrase is empty")
+		}
+		return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	}
+}
+
+// cryptParams is the contents of the parameters file.
+type cryptParams struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Names   bool   `json:"names"`
+	Check   []byte `json:"check"`
+}
+
+// NewCrypt returns an encrypting file system on top of fs. If fs has
+// no parameters file, one is created, and names selects whether names
+// are encrypted. Otherwise, the stored setting is used, and the key
+// must match.
+//
+// Encrypted names are longer than the plaintext, so with names
+// encrypted, path components longer than 175 bytes are rejected with
+// an error satisfying errors.Is(err, syscall.ENAMETOOLONG).
+func NewCrypt(fs WriteableFileSystem, key CryptKeyFunc, names bool) (*Crypt, error) {
+	params, err := readCryptParams(fs)
+	create := IsNotExist(err)
+	if create {
+		params = &cryptParams{Version: cryptVersion, Salt: make([]byte, 32), Names: names}
+		if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if params.Version != cryptVersion {
+		return nil, fmt.Errorf("unsupported encryption version: %d", params.Version)
+	}
+
+	master, err := key(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	subkey := func(info string) []byte {
+		bs := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, master, params.Salt, []byte(info)), bs); err != nil {
+			panic(err)
+		}
+		return bs
+	}
+
+	mac := hmac.New(sha256.New, subkey("fisy check"))
+	mac.Write([]byte(cryptMagic))
+	check := mac.Sum(nil)
+	if create {
+		params.Check = check
+		if err := writeCryptParams(fs, params); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal(params.Check, check) {
+		return nil, ErrCryptWrongKey
+	}
+
+	content, err := chacha20poly1305.NewX(subkey("fisy content"))
+	if err != nil {
+		return nil, err
+	}
+	nameEnc, err := aes.NewCipher(subkey("fisy name encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Crypt{
+		fs:      fs,
+		names:   params.Names,
+		content: content,
+		nameEnc: nameEnc,
+		nameMAC: subkey("fisy name authentication"),
+	}, nil
+}
+
+// readCryptParams reads the parameters file.
+func readCryptParams(fs ReadableFileSystem) (*cryptParams, error) {
+	fr, err := fs.Open(cryptParamsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, err
+	}
+	var params cryptParams
+	if err := json.Unmarshal(bs, &params); err != nil {
+		return nil, fmt.Errorf("%s: %w", cryptParamsPath, err)
+	}
+	return &params, nil
+}
+
+// writeCryptParams atomically creates the parameters file.
+func writeCryptParams(fs WriteableFileSystem, params *cryptParams) error {
+	bs, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	tmp := cryptParamsPath + ".new"
+	fw, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(bs); err != nil {
+		fw.Close()
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, cryptParamsPath)
+}
+
+// path maps a path to the underlying file system.
+func (fs *Crypt) path(path Path) (Path, error) {
+	if path.Resolve(".") == cryptParamsPath {
+		return "", &os.PathError{Op: "crypt", Path: string(path), Err: os.ErrPermission}
+	}
+	if !fs.names {
+		return path, nil
+	}
+
+	comps := strings.Split(string(path), "/")
+	for i, comp := range comps {
+		if comp == "" || comp == "." || comp == ".." {
+			continue
+		}
+		if len(comp) > cryptMaxNameSize {
+			return "", &os.PathError{Op: "crypt", Path: string(path), Err: fmt.Errorf("names longer than %d bytes can't be encrypted: %w", cryptMaxNameSize, syscall.ENAMETOOLONG)}
+		}
+		comps[i] = fs.encryptName(comp)
+	}
+	return Path(strings.Join(comps, "/")), nil
+}
+
+// encryptName encrypts a path component. The IV is an HMAC of the
+// name, which also authenticates it.
+func (fs *Crypt) encryptName(name string) string {
+	mac := hmac.New(sha256.New, fs.nameMAC)
+	mac.Write([]byte(name))
+	bs := make([]byte, cryptNameIVSize+len(name))
+	copy(bs, mac.Sum(nil)[:cryptNameIVSize])
+	cipher.NewCTR(fs.nameEnc, bs[:cryptNameIVSize]).XORKeyStream(bs[cryptNameIVSize:], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// decryptName reverses encryptName.
+func (fs *Crypt) decryptName(s string) (string, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(bs) <= cryptNameIVSize {
+		return "", fmt.Errorf("%q: %w", s, ErrCryptCorrupt)
+	}
+	name := make([]byte, len(bs)-cryptNameIVSize)
+	cipher.NewCTR(fs.nameEnc, bs[:cryptNameIVSize]).XORKeyStream(name, bs[cryptNameIVSize:])
+
+	mac := hmac.New(sha256.New, fs.nameMAC)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:cryptNameIVSize], bs[:cryptNameIVSize]) {
+		return "", fmt.Errorf("%q: %w", s, ErrCryptCorrupt)
+	}
+	return string(name), nil
+}
+
+// cryptNonce returns the nonce of a chunk. The last chunk is marked, so
+// truncation is detected.
+func cryptNonce(fileID []byte, index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, fileID)
+	v := index << 8
+	if last {
+		v |= 1
+	}
+	binary.BigEndian.PutUint64(nonce[cryptFileIDSize:], v)
+	return nonce
+}
+
+// cryptPlainSize returns the plaintext size of an encrypted file.
+func cryptPlainSize(size int64) int64 {
+	overhead := int64(chacha20poly1305.Overhead)
+	size -= int64(cryptHeaderSize)
+	if size < overhead {
+		return 0
+	}
+	nchunks := (size + cryptChunkSize + overhead - 1) / (cryptChunkSize + overhead)
+	return size - nchunks*overhead
+}
+
+// fileInfo maps information about an underlying file.
+func (fs *Crypt) fileInfo(fi os.FileInfo) (os.FileInfo, error) {
+	cfi := &cryptFileInfo{FileInfo: fi, name: fi.Name(), size: fi.Size()}
+	if fi.Mode().IsRegular() {
+		cfi.size = cryptPlainSize(fi.Size())
+	}
+	if fs.names {
+		name, err := fs.decryptName(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		cfi.name = name
+	}
+	return cfi, nil
+}
+
+func (fs *Crypt) Open(path Path) (FileReader, error) {
+	upath, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := fs.fs.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFileReader{FileReader: fr, fs: fs, root: path.Resolve(".") == "."}, nil
+}
+
+// Prefetch prefetches the tree, if the underlying file system is a
+// Prefetcher.
+func (fs *Crypt) Prefetch(path Path) error {
+	pf, ok := fs.fs.(Prefetcher)
+	if !ok {
+		return nil
+	}
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return pf.Prefetch(upath)
+}
+
+func (fs *Crypt) Readlink(path Path) (Path, error) {
+	upath, err := fs.path(path)
+	if err != nil {
+		return "", err
+	}
+	target, err := fs.fs.Readlink(upath)
+	if err != nil {
+		return "", err
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(string(target))
+	if err != nil || len(bs) < fs.content.NonceSize() {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: ErrCryptCorrupt}
+	}
+	pt, err := fs.content.Open(nil, bs[:fs.content.NonceSize()], bs[fs.content.NonceSize():], nil)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: ErrCryptCorrupt}
+	}
+	return Path(pt), nil
+}
+
+func (fs *Crypt) Stat() (FSInfo, error) {
+	return fs.fs.Stat()
+}
+
+func (fs *Crypt) Create(path Path) (FileWriter, error) {
+	upath, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, cryptHeaderSize)
+	copy(hdr, cryptMagic)
+	if _, err := io.ReadFull(rand.Reader, hdr[len(cryptMagic):]); err != nil {
+		return nil, err
+	}
+
+	fw, err := fs.fs.Create(upath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(hdr); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	return &cryptFileWriter{
+		FileWriter: fw,
+		fs:         fs,
+		fileID:     hdr[len(cryptMagic):],
+		buf:        make([]byte, 0, cryptChunkSize),
+	}, nil
+}
+
+func (fs *Crypt) Keep(path Path) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Keep(upath)
+}
+
+func (fs *Crypt) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Mkdir(upath, mode, uid, gid)
+}
+
+func (fs *Crypt) Link(oldpath Path, newpath Path) error {
+	uold, err := fs.path(oldpath)
+	if err != nil {
+		return err
+	}
+	unew, err := fs.path(newpath)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Link(uold, unew)
+}
+
+func (fs *Crypt) Symlink(oldpath Path, newpath Path) error {
+	unew, err := fs.path(newpath)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, fs.content.NonceSize(), fs.content.NonceSize()+len(oldpath)+fs.content.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	bs := fs.content.Seal(nonce, nonce, []byte(oldpath), nil)
+	return fs.fs.Symlink(Path(base64.RawURLEncoding.EncodeToString(bs)), unew)
+}
+
+func (fs *Crypt) Rename(oldpath Path, newpath Path) error {
+	uold, err := fs.path(oldpath)
+	if err != nil {
+		return err
+	}
+	unew, err := fs.path(newpath)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Rename(uold, unew)
+}
+
+func (fs *Crypt) RemoveAll(path Path) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.RemoveAll(upath)
+}
+
+func (fs *Crypt) Remove(path Path) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Remove(upath)
+}
+
+func (fs *Crypt) Chmod(path Path, mode os.FileMode) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Chmod(upath, mode)
+}
+
+func (fs *Crypt) Lchown(path Path, uid, gid int) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Lchown(upath, uid, gid)
+}
+
+func (fs *Crypt) Chtimes(path Path, atime time.Time, mtime time.Time) error {
+	upath, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.fs.Chtimes(upath, atime, mtime)
+}
+
+// A cryptFileInfo has the plaintext name and size. Sys is from the
+// underlying file.
+type cryptFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (fi *cryptFileInfo) Name() string { return fi.name }
+func (fi *cryptFileInfo) Size() int64  { return fi.size }
+
+// A cryptFileReader decrypts a file, or the names of a directory.
+type cryptFileReader struct {
+	FileReader
+	fs   *Crypt
+	root bool
+
+	br     *bufio.Reader
+	fileID []byte
+	index  uint64
+	chunk  []byte
+	plain  []byte
+	buf    []byte
+	last   bool
+}
+
+func (r *cryptFileReader) Read(bs []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(bs, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk. The header is read
+// first, if needed.
+func (r *cryptFileReader) readChunk() error {
+	overhead := r.fs.content.Overhead()
+	if r.br == nil {
+		r.br = bufio.NewReaderSize(r.FileReader, cryptChunkSize+overhead)
+		hdr := make([]byte, cryptHeaderSize)
+		if _, err := io.ReadFull(r.br, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCryptCorrupt
+		} else if err != nil {
+			return err
+		}
+		if string(hdr[:len(cryptMagic)]) != cryptMagic {
+			return ErrCryptCorrupt
+		}
+		r.fileID = hdr[len(cryptMagic):]
+		r.chunk = make([]byte, cryptChunkSize+overhead)
+		r.plain = make([]byte, 0, cryptChunkSize)
+	}
+
+	n, err := io.ReadFull(r.br, r.chunk)
+	switch err {
+	case nil:
+		// A full chunk is the last if nothing follows.
+		if _, err := r.br.Peek(1); err == io.EOF {
+			r.last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		r.last = true
+	case io.EOF:
+		// The last chunk is missing.
+		return ErrCryptCorrupt
+	default:
+		return err
+	}
+
+	pt, err := r.fs.content.Open(r.plain[:0], cryptNonce(r.fileID, r.index, r.last), r.chunk[:n], nil)
+	if err != nil {
+		return ErrCryptCorrupt
+	}
+	r.index++
+	r.buf = pt
+	return nil
+}
+
+func (r *cryptFileReader) Readdir() ([]os.FileInfo, error) {
+	fis, err := r.FileReader.Readdir()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if r.root && Path(fi.Name()) == cryptParamsPath {
+			continue
+		}
+		cfi, err := r.fs.fileInfo(fi)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cfi)
+	}
+	return ret, nil
+}
+
+func (r *cryptFileReader) Stat() (os.FileInfo, error) {
+	fi, err := r.FileReader.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cfi := &cryptFileInfo{FileInfo: fi, name: fi.Name(), size: fi.Size()}
+	if fi.Mode().IsRegular() {
+		cfi.size = cryptPlainSize(fi.Size())
+	}
+	// The name of an open file is rarely used, and the root has
+	// no encrypted name, so it is left as is.
+	return cfi, nil
+}
+
+// A cryptFileWriter encrypts a file in chunks. A full chunk is only
+// written once more data arrives, since the last chunk is marked.
+type cryptFileWriter struct {
+	FileWriter
+	fs     *Crypt
+	fileID []byte
+	index  uint64
+	buf    []byte
+	err    error
+}
+
+func (w *cryptFileWriter) Write(bs []byte) (int, error) {
+	n := len(bs)
+	for len(bs) > 0 {
+		if len(w.buf) == cryptChunkSize {
+			if err := w.writeChunk(false); err != nil {
+				return n - len(bs), err
+			}
+		}
+		m := cryptChunkSize - len(w.buf)
+		if m > len(bs) {
+			m = len(bs)
+		}
+		w.buf = append(w.buf, bs[:m]...)
+		bs = bs[m:]
+	}
+	return n, nil
+}
+
+// writeChunk encrypts and writes the buffered plaintext.
+func (w *cryptFileWriter) writeChunk(last bool) error {
+	if w.err != nil {
+		return w.err
+	}
+	ct := w.fs.content.Seal(nil, cryptNonce(w.fileID, w.index, last), w.buf, nil)
+	if _, err := w.FileWriter.Write(ct); err != nil {
+		w.err = err
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *cryptFileWriter) Close() error {
+	err := w.writeChunk(true)
+	if cerr := w.FileWriter.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,298 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var cryptIsAWriteableFileSystem WriteableFileSystem = &Crypt{}
+
+var testCryptKey = CryptKeyFromSecret(bytes.Repeat([]byte{42}, 32))
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, names := range []bool{false, true} {
+		t.Run(fmt.Sprint("names=", names), func(t *testing.T) {
+			raw := NewMemory()
+			fs, err := NewCrypt(raw, testCryptKey, names)
+			if err != nil {
+				t.Fatalf("NewCrypt failed: %v", err)
+			}
+			if err := fs.Mkdir("dir", 0755, -1, -1); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+
+			sizes := []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3 * cryptChunkSize}
+			for _, size := range sizes {
+				content := bytes.Repeat([]byte("plaintext"), size/9+1)[:size]
+				path := Path(fmt.Sprintf("dir/file%d", size))
+				writeTestFile(t, fs, path, content)
+
+				if got := readTestFile(t, fs, path); !bytes.Equal(got, content) {
+					t.Errorf("Read(%q): got %d bytes, want %d", path, len(got), len(content))
+				}
+
+				upath, err := fs.path(path)
+				if err != nil {
+					t.Fatalf("path failed: %v", err)
+				}
+				if names == (upath == path) {
+					t.Errorf("path(%q): got %q, want encrypted %v", path, upath, names)
+				}
+				if size > 0 && bytes.Contains(readTestFile(t, raw, upath), []byte("plaintext")) {
+					t.Errorf("Read(%q): got plaintext in the underlying file", upath)
+				}
+			}
+
+			fr, err := fs.Open("dir")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			fis, err := fr.Readdir()
+			fr.Close()
+			if err != nil {
+				t.Fatalf("Readdir failed: %v", err)
+			}
+			sort.Slice(fis, func(i, j int) bool { return fis[i].Size() < fis[j].Size() })
+			for i, fi := range fis {
+				if want := fmt.Sprintf("file%d", sizes[i]); fi.Name() != want {
+					t.Errorf("Readdir Name: got %q, want %q", fi.Name(), want)
+				}
+				if want := int64(sizes[i]); fi.Size() != want {
+					t.Errorf("Readdir Size: got %v, want %v", fi.Size(), want)
+				}
+			}
+
+			fr, err = fs.Open(".")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			fis, err = fr.Readdir()
+			fr.Close()
+			if err != nil {
+				t.Fatalf("Readdir failed: %v", err)
+			}
+			if len(fis) != 1 || fis[0].Name() != "dir" {
+				t.Errorf("Readdir(.): got %v, want only dir", fis)
+			}
+
+			if err := fs.Symlink("dir/file0", "link"); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+			if got, err := fs.Readlink("link"); err != nil || got != "dir/file0" {
+				t.Errorf("Readlink: got %q, %v, want %q", got, err, "dir/file0")
+			}
+
+			if _, err := fs.Create(cryptParamsPath); err == nil {
+				t.Errorf("Create(%q) error: got %v, want an error", cryptParamsPath, err)
+			}
+		})
+	}
+}
+
+func TestNewCrypt(t *testing.T) {
+	raw := NewMemory()
+	if _, err := NewCrypt(raw, CryptKeyFromPassphrase("secret"), true); err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+
+	fs, err := NewCrypt(raw, CryptKeyFromPassphrase("secret"), false)
+	if err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+	if !fs.names {
+		t.Errorf("NewCrypt names: got %v, want the stored true", fs.names)
+	}
+
+	if _, err := NewCrypt(raw, CryptKeyFromPassphrase("wrong"), true); err != ErrCryptWrongKey {
+		t.Errorf("NewCrypt error: got %v, want ErrCryptWrongKey", err)
+	}
+
+	if _, err := NewCrypt(NewMemory(), CryptKeyFromSecret([]byte("short")), true); err == nil {
+		t.Errorf("NewCrypt error: got %v, want key too short", err)
+	}
+}
+
+func TestCryptLongName(t *testing.T) {
+	fs, err := NewCrypt(NewMemory(), testCryptKey, true)
+	if err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+
+	name := strings.Repeat("a", cryptMaxNameSize)
+	upath, err := fs.path(Path("dir/" + name))
+	if err != nil {
+		t.Fatalf("path failed: %v", err)
+	}
+	if got := len(upath.Base()); got > 255 {
+		t.Errorf("path(%q) length: got %d, want at most 255", name, got)
+	}
+
+	long := Path("dir/" + name + "a")
+	if _, err := fs.Create(long); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("Create error: got %v, want ENAMETOOLONG", err)
+	}
+	if err := fs.Mkdir(long, 0755, -1, -1); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("Mkdir error: got %v, want ENAMETOOLONG", err)
+	}
+}
+
+func TestCryptFileWriterPartialWrite(t *testing.T) {
+	raw := NewMemory()
+	fs, err := NewCrypt(raw, testCryptKey, false)
+	if err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+	fw, err := fs.Create("file")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer fw.Close()
+	cw := fw.(*cryptFileWriter)
+	wantErr := errors.New("mock error")
+	cw.FileWriter = &failingFileWriter{FileWriter: cw.FileWriter, err: wantErr}
+
+	// The first chunk is buffered, and flushing it fails.
+	n, err := fw.Write(make([]byte, cryptChunkSize+10))
+	if err != wantErr {
+		t.Errorf("Write error: got %v, want %v", err, wantErr)
+	}
+	if want := cryptChunkSize; n != want {
+		t.Errorf("Write: got %d, want %d", n, want)
+	}
+}
+
+// A failingFileWriter fails all writes.
+type failingFileWriter struct {
+	FileWriter
+
+	err error
+}
+
+func (w *failingFileWriter) Write(bs []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestCryptCorrupt(t *testing.T) {
+	raw := NewMemory()
+	fs, err := NewCrypt(raw, testCryptKey, false)
+	if err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+	content := bytes.Repeat([]byte{1}, 2*cryptChunkSize)
+	writeTestFile(t, fs, "file", content)
+	ct := readTestFile(t, raw, "file")
+
+	tsts := []struct {
+		Name string
+		Data []byte
+	}{
+		{"empty", nil},
+		{"modified", append(append([]byte{}, ct[:100]...), append([]byte{ct[100] ^ 1}, ct[101:]...)...)},
+		{"truncated", ct[:cryptHeaderSize+cryptChunkSize+fs.content.Overhead()]},
+		{"truncatedHeader", ct[:cryptHeaderSize]},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			fw, err := raw.Create("file")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			fw.Write(tst.Data)
+			fw.Close()
+
+			fr, err := fs.Open("file")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer fr.Close()
+			if _, err := ioutil.ReadAll(fr); !errors.Is(err, ErrCryptCorrupt) {
+				t.Errorf("ReadAll error: got %v, want ErrCryptCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestCryptCOW(t *testing.T) {
+	raw := NewMemory()
+	cfs, err := NewCrypt(raw, testCryptKey, true)
+	if err != nil {
+		t.Fatalf("NewCrypt failed: %v", err)
+	}
+
+	cow, err := NewCOW(cfs, "host", now)
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	writeTestFile(t, cow, "file", []byte("hello"))
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	cow, err = NewCOW(cfs, "host", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if err := cow.Keep("file"); err != nil {
+		t.Fatalf("Keep failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	fr, err := cfs.Open(cow.WriteRoot())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fis, err := fr.Readdir()
+	fr.Close()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "file" || fis[0].Size() != 5 {
+		t.Fatalf("Readdir: got %v, want file of 5 bytes", fis)
+	}
+	attrs, _ := FileAttrsFromFileInfo(fis[0])
+	if attrs.NLinks != 2 {
+		t.Errorf("Readdir NLinks: got %v, want 2", attrs.NLinks)
+	}
+	if got := readTestFile(t, cfs, cow.WriteRoot().Resolve("file")); string(got) != "hello" {
+		t.Errorf("Read: got %q, want %q", got, "hello")
+	}
+}
+
+func writeTestFile(t *testing.T, fs WriteableFileSystem, path Path, content []byte) {
+	t.Helper()
+
+	fw, err := fs.Create(path)
+	if err != nil {
+		t.Fatalf("Create(%q) failed: %v", path, err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatalf("Write(%q) failed: %v", path, err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close(%q) failed: %v", path, err)
+	}
+}
+
+func readTestFile(t *testing.T, fs ReadableFileSystem, path Path) []byte {
+	t.Helper()
+
+	fr, err := fs.Open(path)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", path, err)
+	}
+	defer fr.Close()
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll(%q) failed: %v", path, err)
+	}
+	return bs
+}
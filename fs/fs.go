@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"crypto/sha256"
 	"io"
 	"os"
 	"path/filepath"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/pkg/sftp"
+	"github.com/tommie/fisy/remote"
 )
 
 // A ReadableFileSystem can only be read from.
@@ -61,6 +63,21 @@ type WriteableFileSystem interface {
 	Chtimes(path Path, atime time.Time, mtime time.Time) error
 }
 
+// A FileHasher can compute the SHA-256 hash of a file, possibly
+// without transferring its contents.
+type FileHasher interface {
+	// HashFile returns the hash of the contents of a regular file.
+	HashFile(path Path) ([sha256.Size]byte, error)
+}
+
+// A Prefetcher can list a directory tree in advance, which makes
+// Readdir calls below it cheaper.
+type Prefetcher interface {
+	// Prefetch lists the tree at path. Each listing is only used
+	// once. It does nothing if prefetching isn't available.
+	Prefetch(path Path) error
+}
+
 // A FileReader represents an open file stream or directory that can be read from.
 type FileReader interface {
 	io.Reader
@@ -112,6 +129,9 @@ type FSInfo struct {
 	FreeSpace uint64
 }
 
+// FileAttrs are the system-specific attributes of a file. A FileInfo
+// whose Sys returns a *FileAttrs has them directly, without depending
+// on the platform's syscall.Stat_t.
 type FileAttrs struct {
 	UID        int
 	GID        int
@@ -122,15 +142,27 @@ type FileAttrs struct {
 
 // FileAttrsFromFileInfo extracts system-specific file attributes from a FileInfo.
 func FileAttrsFromFileInfo(fi os.FileInfo) (FileAttrs, bool) {
+	if attrs, ok := fi.Sys().(*FileAttrs); ok {
+		return *attrs, true
+	}
 	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
 		return FileAttrs{
 			UID:        int(st.Uid),
 			GID:        int(st.Gid),
-			AccessTime: time.Unix(st.Atim.Sec, st.Atim.Nsec),
-			NLinks:     st.Nlink,
+			AccessTime: time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+			NLinks:     uint64(st.Nlink),
 			Inode:      st.Ino,
 		}, true
 	}
+	if st, ok := fi.Sys().(*remote.FileStat); ok {
+		return FileAttrs{
+			UID:        int(st.UID),
+			GID:        int(st.GID),
+			AccessTime: st.Atime,
+			NLinks:     st.NLinks,
+			Inode:      st.Inode,
+		}, true
+	}
 	if fs, ok := fi.Sys().(*sftp.FileStat); ok {
 		return FileAttrs{
 			UID:        int(fs.UID),
@@ -0,0 +1,205 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// An HTTPFileSystem serves a ReadableFileSystem as an
+// http.FileSystem. Symlinks are not followed, so a tree can't expose
+// files outside of it, and opening one fails with a permission error.
+//
+// File systems without seekable files are emulated by reopening, and
+// reading forward, so serving ranges can be slow.
+type HTTPFileSystem struct {
+	fs ReadableFileSystem
+}
+
+// NewHTTPFileSystem returns an http.FileSystem reading from fs.
+func NewHTTPFileSystem(fs ReadableFileSystem) *HTTPFileSystem {
+	return &HTTPFileSystem{fs: fs}
+}
+
+// Open opens a file or directory. The name is slash-separated, and
+// relative to the root, even if it starts with a slash.
+func (hfs *HTTPFileSystem) Open(name string) (http.File, error) {
+	p := Path(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if p == "" {
+		p = "."
+	}
+
+	fi, err := hfs.lstat(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	fr, err := hfs.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFile{fs: hfs.fs, path: p, fi: fi, fr: fr}, nil
+}
+
+// lstat returns information about a file, by listing its parent
+// directories. It fails if any of the path components are symlinks.
+func (hfs *HTTPFileSystem) lstat(p Path) (os.FileInfo, error) {
+	if p == "." {
+		fr, err := hfs.fs.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer fr.Close()
+		return fr.Stat()
+	}
+
+	var fi os.FileInfo
+	var dir Path = "."
+	for _, name := range strings.Split(string(p), "/") {
+		if fi != nil && !fi.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		fis, err := readdirNames(hfs.fs, dir)
+		if err != nil {
+			return nil, err
+		}
+		fi = fis[name]
+		if fi == nil {
+			return nil, os.ErrNotExist
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil, os.ErrPermission
+		}
+		dir = dir.Resolve(Path(name))
+	}
+	return fi, nil
+}
+
+// readdirNames lists a directory, by name.
+func readdirNames(fs ReadableFileSystem, dir Path) (map[string]os.FileInfo, error) {
+	fr, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	fis, err := fr.Readdir()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]os.FileInfo, len(fis))
+	for _, fi := range fis {
+		m[fi.Name()] = fi
+	}
+	return m, nil
+}
+
+// An httpFile is an http.File. If the file isn't an io.Seeker,
+// seeking is emulated by reopening the file and reading forward.
+type httpFile struct {
+	fs   ReadableFileSystem
+	path Path
+	fi   os.FileInfo
+	fr   FileReader
+
+	// pos is where the next Read should start, and rpos is where
+	// fr is.
+	pos  int64
+	rpos int64
+
+	// fis are the remaining entries for Readdir.
+	fis     []os.FileInfo
+	listed  bool
+	listErr error
+}
+
+func (f *httpFile) Close() error {
+	return f.fr.Close()
+}
+
+func (f *httpFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *httpFile) Read(bs []byte) (int, error) {
+	if _, ok := f.fr.(io.Seeker); ok {
+		return f.fr.Read(bs)
+	}
+	if f.pos != f.rpos {
+		if err := f.seekReader(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.fr.Read(bs)
+	f.pos += int64(n)
+	f.rpos = f.pos
+	return n, err
+}
+
+// seekReader moves the reader to pos.
+func (f *httpFile) seekReader() error {
+	if f.pos < f.rpos {
+		fr, err := f.fs.Open(f.path)
+		if err != nil {
+			return err
+		}
+		f.fr.Close()
+		f.fr = fr
+		f.rpos = 0
+	}
+	n, err := io.CopyN(ioutil.Discard, f.fr, f.pos-f.rpos)
+	f.rpos += n
+	if err == io.EOF {
+		// Reading past the end gives EOF, like a seek.
+		return nil
+	}
+	return err
+}
+
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.fr.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.fi.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Readdir returns the next count directory entries, or all remaining
+// if count is not positive. Symlinks are included, but can't be
+// opened.
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		f.fis, f.listErr = f.fr.Readdir()
+		f.listed = true
+	}
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+
+	if count <= 0 || count > len(f.fis) {
+		if count > 0 && len(f.fis) == 0 {
+			return nil, io.EOF
+		}
+		count = len(f.fis)
+	}
+	fis := f.fis[:count]
+	f.fis = f.fis[count:]
+	return fis, nil
+}
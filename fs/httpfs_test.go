@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHTTPFileSystem(t *testing.T) {
+	m := NewMemory()
+	if err := m.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	for _, name := range []Path{"a/file", "a/other"} {
+		fw, err := m.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := io.WriteString(fw, "hello world"); err != nil {
+			t.Fatalf("WriteString failed: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+	if err := m.Symlink("a", "link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	tsts := []struct {
+		Name string
+		FS   ReadableFileSystem
+	}{
+		{"seeker", m},
+		{"nonSeeker", nonSeekingFileSystem{m}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			hfs := NewHTTPFileSystem(tst.FS)
+
+			f, err := hfs.Open("/a/file")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer f.Close()
+
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if fi.Name() != "file" || fi.Size() != 11 {
+				t.Errorf("Stat: got %q %v, want %q 11", fi.Name(), fi.Size(), "file")
+			}
+
+			if n, err := f.Seek(0, io.SeekEnd); err != nil || n != 11 {
+				t.Errorf("Seek(end): got %v, %v, want 11", n, err)
+			}
+			if _, err := f.Seek(6, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			bs, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if got, want := string(bs), "world"; got != want {
+				t.Errorf("ReadAll: got %q, want %q", got, want)
+			}
+
+			// Backwards.
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			bs, err = ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if got, want := string(bs), "hello world"; got != want {
+				t.Errorf("ReadAll: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	hfs := NewHTTPFileSystem(m)
+
+	t.Run("readdir", func(t *testing.T) {
+		f, err := hfs.Open("a/")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+
+		var names []string
+		for {
+			fis, err := f.Readdir(1)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Readdir failed: %v", err)
+			}
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+			}
+		}
+		if len(names) != 2 {
+			t.Errorf("Readdir: got %v, want 2 entries", names)
+		}
+	})
+
+	t.Run("root", func(t *testing.T) {
+		f, err := hfs.Open("/")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			t.Fatalf("Readdir failed: %v", err)
+		}
+		if len(fis) != 2 {
+			t.Errorf("Readdir: got %v, want 2 entries", fis)
+		}
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		for _, name := range []string{"/link", "/link/file", "/../link/file"} {
+			if _, err := hfs.Open(name); !os.IsPermission(err) {
+				t.Errorf("Open(%q) error: got %v, want EPERM", name, err)
+			}
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		for _, name := range []string{"/missing", "/a/file/x"} {
+			if _, err := hfs.Open(name); !os.IsNotExist(err) {
+				t.Errorf("Open(%q) error: got %v, want ENOENT", name, err)
+			}
+		}
+	})
+}
+
+// A nonSeekingFileSystem hides the Seek function of files.
+type nonSeekingFileSystem struct {
+	ReadableFileSystem
+}
+
+func (fs nonSeekingFileSystem) Open(path Path) (FileReader, error) {
+	fr, err := fs.ReadableFileSystem.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ FileReader }{fr}, nil
+}
@@ -0,0 +1,21 @@
+package fs
+
+// CopyLocalFile copies the contents of a file opened in a Local file
+// system to a file created in a Local file system, without passing
+// the data through user space. If the file system supports reflinks,
+// the copy shares blocks with the source until either is modified.
+//
+// It returns false, without copying anything, if either file isn't
+// local, or if the kernel can't copy between them. The caller should
+// then copy the data itself.
+func CopyLocalFile(dst FileWriter, src FileReader) (int64, bool, error) {
+	lw, ok := dst.(*localFileWriter)
+	if !ok {
+		return 0, false, nil
+	}
+	lr, ok := src.(*localFileReader)
+	if !ok {
+		return 0, false, nil
+	}
+	return copyFileInKernel(lw.File, lr.File)
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileRangeChunk is the largest number of bytes asked for in one
+// copy_file_range call.
+const copyFileRangeChunk = 1 << 30
+
+// Test mock injection points.
+var (
+	unixIoctlFileClone = unix.IoctlFileClone
+	unixCopyFileRange  = unix.CopyFileRange
+)
+
+// copyFileInKernel clones the source with FICLONE, or copies it using
+// copy_file_range(2) if cloning isn't supported, e.g. across file
+// systems. Both files must be at offset zero.
+func copyFileInKernel(dst, src *os.File) (int64, bool, error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	sc, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, err
+	}
+	dc, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var n int64
+	var ok bool
+	var cerr error
+	err = sc.Control(func(sfd uintptr) {
+		err := dc.Control(func(dfd uintptr) {
+			n, ok, cerr = copyFdInKernel(int(dfd), int(sfd), fi.Size())
+		})
+		if cerr == nil {
+			cerr = err
+		}
+	})
+	if cerr == nil {
+		cerr = err
+	}
+	if cerr != nil || !ok {
+		return n, ok, cerr
+	}
+
+	// FICLONE doesn't move the file offset.
+	if _, err := dst.Seek(n, io.SeekStart); err != nil {
+		return n, true, err
+	}
+	return n, true, nil
+}
+
+func copyFdInKernel(dfd, sfd int, size int64) (int64, bool, error) {
+	if err := unixIoctlFileClone(dfd, sfd); err == nil {
+		return size, true, nil
+	}
+
+	var n int64
+	for {
+		m, err := unixCopyFileRange(sfd, nil, dfd, nil, copyFileRangeChunk, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if n == 0 && isCopyFileRangeUnsupported(err) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return n, true, os.NewSyscallError("copy_file_range", err)
+		}
+		if m == 0 {
+			if n == 0 && size > 0 {
+				// Some special file systems report
+				// zero-length copies, like for /proc.
+				return 0, false, nil
+			}
+			return n, true, nil
+		}
+		n += int64(m)
+	}
+}
+
+// isCopyFileRangeUnsupported returns true if the error means
+// copy_file_range can't be used for the files, rather than that the
+// copy failed.
+func isCopyFileRangeUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOSYS) ||
+		errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EINVAL) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.EPERM)
+}
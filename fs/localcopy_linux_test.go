@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyFileInKernel(t *testing.T) {
+	defer func() {
+		unixIoctlFileClone = unix.IoctlFileClone
+		unixCopyFileRange = unix.CopyFileRange
+	}()
+
+	// open returns the test file, and a new file to copy to.
+	open := func(t *testing.T) (*os.File, *os.File) {
+		t.Helper()
+
+		tmpd, err := ioutil.TempDir("", "localcopy-")
+		if err != nil {
+			t.Fatalf("TempDir failed: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tmpd) })
+		if err := ioutil.WriteFile(filepath.Join(tmpd, "src"), []byte("hello world"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		src, err := os.Open(filepath.Join(tmpd, "src"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		t.Cleanup(func() { src.Close() })
+		dst, err := os.Create(filepath.Join(tmpd, "dst"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		t.Cleanup(func() { dst.Close() })
+		return dst, src
+	}
+	noClone := func(int, int) error { return syscall.EOPNOTSUPP }
+
+	t.Run("clone", func(t *testing.T) {
+		dst, src := open(t)
+		unixIoctlFileClone = func(dfd, sfd int) error { return nil }
+		unixCopyFileRange = unix.CopyFileRange
+
+		n, ok, err := copyFileInKernel(dst, src)
+		if n != 11 || !ok || err != nil {
+			t.Fatalf("copyFileInKernel: got %v, %v, %v, want 11, true, nil", n, ok, err)
+		}
+		if off, err := dst.Seek(0, io.SeekCurrent); err != nil || off != 11 {
+			t.Errorf("Seek: got %v, %v, want 11", off, err)
+		}
+	})
+
+	t.Run("copyFileRange", func(t *testing.T) {
+		dst, src := open(t)
+		unixIoctlFileClone = noClone
+		unixCopyFileRange = unix.CopyFileRange
+
+		n, ok, err := copyFileInKernel(dst, src)
+		if errors.Is(err, syscall.ENOSYS) || (err == nil && !ok) {
+			t.Skipf("copy_file_range is not supported: %v", err)
+		}
+		if n != 11 || !ok || err != nil {
+			t.Fatalf("copyFileInKernel: got %v, %v, %v, want 11, true, nil", n, ok, err)
+		}
+		got, err := ioutil.ReadFile(dst.Name())
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(got) != "hello world" {
+			t.Errorf("ReadFile: got %q, want %q", got, "hello world")
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		dst, src := open(t)
+		unixIoctlFileClone = noClone
+		unixCopyFileRange = func(int, *int64, int, *int64, int, int) (int, error) { return 0, syscall.EXDEV }
+
+		if n, ok, err := copyFileInKernel(dst, src); n != 0 || ok || err != nil {
+			t.Errorf("copyFileInKernel: got %v, %v, %v, want 0, false, nil", n, ok, err)
+		}
+	})
+
+	t.Run("zeroLength", func(t *testing.T) {
+		dst, src := open(t)
+		unixIoctlFileClone = noClone
+		unixCopyFileRange = func(int, *int64, int, *int64, int, int) (int, error) { return 0, nil }
+
+		if n, ok, err := copyFileInKernel(dst, src); n != 0 || ok || err != nil {
+			t.Errorf("copyFileInKernel: got %v, %v, %v, want 0, false, nil", n, ok, err)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		dst, src := open(t)
+		unixIoctlFileClone = noClone
+		calls := 0
+		unixCopyFileRange = func(int, *int64, int, *int64, int, int) (int, error) {
+			calls++
+			if calls == 1 {
+				return 5, nil
+			}
+			return 0, syscall.EIO
+		}
+
+		n, ok, err := copyFileInKernel(dst, src)
+		if n != 5 || !ok || !errors.Is(err, syscall.EIO) {
+			t.Errorf("copyFileInKernel: got %v, %v, %v, want 5, true, EIO", n, ok, err)
+		}
+	})
+}
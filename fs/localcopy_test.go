@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyLocalFile(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		lfs, done := newTestLocal(t)
+		defer done()
+
+		fr, err := lfs.Open("file1")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+		fw, err := lfs.Create("copy")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+
+		n, ok, err := CopyLocalFile(fw, fr)
+		if err != nil {
+			t.Fatalf("CopyLocalFile failed: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if !ok {
+			// Not supported on this platform.
+			if n != 0 {
+				t.Errorf("CopyLocalFile: got %v, want 0 bytes when not copied", n)
+			}
+			return
+		}
+
+		want := "content 1\n"
+		if n != int64(len(want)) {
+			t.Errorf("CopyLocalFile: got %v, want %v", n, len(want))
+		}
+		got, err := ioutil.ReadFile(filepath.Join(string(lfs.root), "copy"))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("ReadFile: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("notLocal", func(t *testing.T) {
+		lfs, done := newTestLocal(t)
+		defer done()
+
+		fr, err := lfs.Open("file1")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+		fw, err := NewMemory().Create("copy")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		defer fw.Close()
+
+		if n, ok, err := CopyLocalFile(fw, fr); n != 0 || ok || err != nil {
+			t.Errorf("CopyLocalFile: got %v, %v, %v, want 0, false, nil", n, ok, err)
+		}
+	})
+}
@@ -0,0 +1,692 @@
+package fs
+
+import (
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxMemorySymlinks is the number of symlinks followed in a lookup
+// before giving up with ELOOP.
+const maxMemorySymlinks = 40
+
+// Memory is a file system kept in memory. It supports hardlinks,
+// symlinks, modes, ownership and timestamps. Permission bits are
+// recorded, but not enforced. Absolute symlinks are resolved relative
+// to the root of the file system. It is safe for concurrent use.
+type Memory struct {
+	mu        sync.Mutex
+	root      *memoryInode
+	nextInode uint64
+	uid, gid  int
+}
+
+// A memoryInode is a file, directory or symlink in a Memory.
+type memoryInode struct {
+	ino   uint64
+	mode  os.FileMode
+	uid   int
+	gid   int
+	nlink uint64
+	atime time.Time
+	mtime time.Time
+
+	// data is the content of a regular file.
+	data []byte
+
+	// target is the content of a symlink.
+	target string
+
+	// entries are the children of a directory.
+	entries map[string]*memoryInode
+}
+
+// NewMemory constructs a new, empty, in-memory file system. New files
+// and directories are owned by the current user, unless specified.
+func NewMemory() *Memory {
+	fs := &Memory{
+		uid: os.Getuid(),
+		gid: os.Getgid(),
+	}
+	fs.root = fs.newInodeLocked(0755 | os.ModeDir)
+	return fs
+}
+
+// newInodeLocked creates an unlinked inode owned by the default user.
+func (fs *Memory) newInodeLocked(mode os.FileMode) *memoryInode {
+	fs.nextInode++
+	now := time.Now()
+	ino := &memoryInode{
+		ino:   fs.nextInode,
+		mode:  mode,
+		uid:   fs.uid,
+		gid:   fs.gid,
+		atime: now,
+		mtime: now,
+	}
+	if mode.IsDir() {
+		ino.entries = map[string]*memoryInode{}
+	}
+	return ino
+}
+
+// splitMemoryPath returns the components of a path. The root is an
+// empty slice.
+func splitMemoryPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// lookupLocked finds the inode of a path. Symlinks in intermediate
+// components are always followed. The last component is followed if
+// follow is true.
+func (fs *Memory) lookupLocked(p string, follow bool) (*memoryInode, error) {
+	nlinks := 0
+	return fs.walkLocked(fs.root, splitMemoryPath(p), follow, &nlinks)
+}
+
+func (fs *Memory) walkLocked(dir *memoryInode, comps []string, follow bool, nlinks *int) (*memoryInode, error) {
+	cur := dir
+	for i, comp := range comps {
+		if !cur.mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		next, ok := cur.entries[comp]
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		if next.mode&os.ModeSymlink != 0 && (follow || i < len(comps)-1) {
+			*nlinks++
+			if *nlinks > maxMemorySymlinks {
+				return nil, syscall.ELOOP
+			}
+			start := cur
+			if strings.HasPrefix(next.target, "/") {
+				start = fs.root
+			}
+			var err error
+			next, err = fs.walkLocked(start, splitMemoryPath(next.target), true, nlinks)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// lookupParentLocked finds the directory containing a path, and
+// returns it with the last component of the path. It fails for the
+// root.
+func (fs *Memory) lookupParentLocked(p string) (*memoryInode, string, error) {
+	comps := splitMemoryPath(p)
+	if len(comps) == 0 {
+		return nil, "", syscall.EBUSY
+	}
+	nlinks := 0
+	dir, err := fs.walkLocked(fs.root, comps[:len(comps)-1], true, &nlinks)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.mode.IsDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return dir, comps[len(comps)-1], nil
+}
+
+// Open opens a file or directory for reading.
+func (fs *Memory) Open(path Path) (FileReader, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), true)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: string(path), Err: err}
+	}
+	ino.atime = time.Now()
+	return &memoryFileReader{fs: fs, ino: ino, path: path}, nil
+}
+
+type memoryFileReader struct {
+	fs     *Memory
+	ino    *memoryInode
+	path   Path
+	off    int
+	closed bool
+}
+
+func (fr *memoryFileReader) Read(bs []byte) (int, error) {
+	fr.fs.mu.Lock()
+	defer fr.fs.mu.Unlock()
+
+	if fr.closed {
+		return 0, &os.PathError{Op: "read", Path: string(fr.path), Err: os.ErrClosed}
+	}
+	if fr.ino.mode.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: string(fr.path), Err: syscall.EISDIR}
+	}
+	if fr.off >= len(fr.ino.data) {
+		return 0, io.EOF
+	}
+	n := copy(bs, fr.ino.data[fr.off:])
+	fr.off += n
+	return n, nil
+}
+
+func (fr *memoryFileReader) Close() error {
+	fr.fs.mu.Lock()
+	defer fr.fs.mu.Unlock()
+
+	if fr.closed {
+		return &os.PathError{Op: "close", Path: string(fr.path), Err: os.ErrClosed}
+	}
+	fr.closed = true
+	return nil
+}
+
+// Readdir returns all directory entries, if the file represents a
+// directory. Symlinks are not followed. The entries are sorted by name.
+func (fr *memoryFileReader) Readdir() ([]os.FileInfo, error) {
+	fr.fs.mu.Lock()
+	defer fr.fs.mu.Unlock()
+
+	if fr.closed {
+		return nil, &os.PathError{Op: "readdirent", Path: string(fr.path), Err: os.ErrClosed}
+	}
+	if !fr.ino.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: string(fr.path), Err: syscall.ENOTDIR}
+	}
+
+	fis := make([]os.FileInfo, 0, len(fr.ino.entries))
+	for name, ino := range fr.ino.entries {
+		fis = append(fis, ino.fileInfo(name))
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// Stat returns metadata about the file.
+func (fr *memoryFileReader) Stat() (os.FileInfo, error) {
+	fr.fs.mu.Lock()
+	defer fr.fs.mu.Unlock()
+
+	if fr.closed {
+		return nil, &os.PathError{Op: "stat", Path: string(fr.path), Err: os.ErrClosed}
+	}
+	return fr.ino.fileInfo(path.Base("/" + string(fr.path))), nil
+}
+
+// Readlink returns the contents of the given symlink.
+func (fs *Memory) Readlink(path Path) (Path, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), false)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: err}
+	}
+	if ino.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: syscall.EINVAL}
+	}
+	return Path(ino.target), nil
+}
+
+// Stat returns information about this file system. The free space
+// is unlimited.
+func (fs *Memory) Stat() (FSInfo, error) {
+	return FSInfo{FreeSpace: math.MaxUint64}, nil
+}
+
+// Create creates (or overwrites) a file and opens it for writing. An
+// existing file is truncated, and keeps its inode and metadata.
+func (fs *Memory) Create(path Path) (FileWriter, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), true)
+	switch {
+	case err == nil:
+		if ino.mode.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: string(path), Err: syscall.EISDIR}
+		}
+		ino.data = nil
+		ino.mtime = time.Now()
+
+	case err == syscall.ENOENT:
+		dir, name, err := fs.createTargetLocked(string(path))
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: string(path), Err: err}
+		}
+		ino = fs.newInodeLocked(0666)
+		fs.linkLocked(dir, name, ino)
+
+	default:
+		return nil, &os.PathError{Op: "open", Path: string(path), Err: err}
+	}
+
+	return &memoryFileWriter{fs: fs, ino: ino, path: path}, nil
+}
+
+// createTargetLocked finds where a new file at the path should be
+// linked. Like O_CREAT, it follows a dangling symlink.
+func (fs *Memory) createTargetLocked(p string) (*memoryInode, string, error) {
+	for i := 0; i < maxMemorySymlinks; i++ {
+		dir, name, err := fs.lookupParentLocked(p)
+		if err != nil {
+			return nil, "", err
+		}
+		ino, ok := dir.entries[name]
+		if !ok {
+			return dir, name, nil
+		}
+		if ino.mode&os.ModeSymlink == 0 {
+			return nil, "", syscall.EEXIST
+		}
+		if strings.HasPrefix(ino.target, "/") {
+			p = ino.target
+		} else {
+			p = path.Join(path.Dir("/"+p), ino.target)
+		}
+	}
+	return nil, "", syscall.ELOOP
+}
+
+type memoryFileWriter struct {
+	fs     *Memory
+	ino    *memoryInode
+	path   Path
+	closed bool
+}
+
+func (fw *memoryFileWriter) Write(bs []byte) (int, error) {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+
+	if fw.closed {
+		return 0, &os.PathError{Op: "write", Path: string(fw.path), Err: os.ErrClosed}
+	}
+	fw.ino.data = append(fw.ino.data, bs...)
+	fw.ino.mtime = time.Now()
+	return len(bs), nil
+}
+
+func (fw *memoryFileWriter) Close() error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+
+	if fw.closed {
+		return &os.PathError{Op: "close", Path: string(fw.path), Err: os.ErrClosed}
+	}
+	fw.closed = true
+	return nil
+}
+
+// Chmod changes file modes and permissions.
+func (fw *memoryFileWriter) Chmod(mode os.FileMode) error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+
+	if fw.closed {
+		return &os.PathError{Op: "chmod", Path: string(fw.path), Err: os.ErrClosed}
+	}
+	fw.ino.chmod(mode)
+	return nil
+}
+
+// Chown changes the owner or group of the file.
+// If uid or gid are -1, that value is ignored.
+func (fw *memoryFileWriter) Chown(uid, gid int) error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+
+	if fw.closed {
+		return &os.PathError{Op: "chown", Path: string(fw.path), Err: os.ErrClosed}
+	}
+	fw.ino.chown(uid, gid)
+	return nil
+}
+
+// Keep informs the file system that the file should be kept. This does nothing.
+func (fs *Memory) Keep(path Path) error {
+	return nil
+}
+
+// Mkdir creates a new directory. If uid or gid are -1, that value is ignored.
+func (fs *Memory) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.lookupParentLocked(string(path))
+	if err == syscall.EBUSY {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: string(path), Err: err}
+	}
+	if _, ok := dir.entries[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: string(path), Err: syscall.EEXIST}
+	}
+
+	ino := fs.newInodeLocked(os.ModeDir)
+	ino.chmod(mode)
+	ino.chown(uid, gid)
+	fs.linkLocked(dir, name, ino)
+	return nil
+}
+
+// Link creates a hardlink to an existing file. Like link(2), a
+// symlink is linked, not followed.
+func (fs *Memory) Link(oldpath Path, newpath Path) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(oldpath), false)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: string(oldpath), New: string(newpath), Err: err}
+	}
+	if ino.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: string(oldpath), New: string(newpath), Err: syscall.EPERM}
+	}
+	dir, name, err := fs.lookupParentLocked(string(newpath))
+	if err == syscall.EBUSY {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: string(oldpath), New: string(newpath), Err: err}
+	}
+	if _, ok := dir.entries[name]; ok {
+		return &os.LinkError{Op: "link", Old: string(oldpath), New: string(newpath), Err: syscall.EEXIST}
+	}
+
+	fs.linkLocked(dir, name, ino)
+	return nil
+}
+
+// Symlink creates a symlink pointing to a file or directory.
+func (fs *Memory) Symlink(oldpath Path, newpath Path) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.lookupParentLocked(string(newpath))
+	if err == syscall.EBUSY {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: string(oldpath), New: string(newpath), Err: err}
+	}
+	if _, ok := dir.entries[name]; ok {
+		return &os.LinkError{Op: "symlink", Old: string(oldpath), New: string(newpath), Err: syscall.EEXIST}
+	}
+
+	ino := fs.newInodeLocked(0777 | os.ModeSymlink)
+	ino.target = string(oldpath)
+	fs.linkLocked(dir, name, ino)
+	return nil
+}
+
+// Rename moves a file or directory from one path to another. Like
+// rename(2), it replaces a file, or an empty directory, at the new
+// path.
+func (fs *Memory) Rename(oldpath Path, newpath Path) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lerr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: string(oldpath), New: string(newpath), Err: err}
+	}
+
+	odir, oname, err := fs.lookupParentLocked(string(oldpath))
+	if err != nil {
+		return lerr(err)
+	}
+	ino, ok := odir.entries[oname]
+	if !ok {
+		return lerr(syscall.ENOENT)
+	}
+	ndir, nname, err := fs.lookupParentLocked(string(newpath))
+	if err != nil {
+		return lerr(err)
+	}
+
+	if ino.mode.IsDir() {
+		// A directory can't be moved into itself.
+		for _, d := range fs.ancestorsLocked(ndir) {
+			if d == ino {
+				return lerr(syscall.EINVAL)
+			}
+		}
+	}
+
+	if existing, ok := ndir.entries[nname]; ok {
+		if existing == ino {
+			return nil
+		}
+		switch {
+		case ino.mode.IsDir() && !existing.mode.IsDir():
+			return lerr(syscall.ENOTDIR)
+		case !ino.mode.IsDir() && existing.mode.IsDir():
+			return lerr(syscall.EISDIR)
+		case existing.mode.IsDir() && len(existing.entries) > 0:
+			return lerr(syscall.ENOTEMPTY)
+		}
+		fs.unlinkLocked(ndir, nname)
+	}
+
+	delete(odir.entries, oname)
+	ndir.entries[nname] = ino
+	now := time.Now()
+	odir.mtime = now
+	ndir.mtime = now
+	return nil
+}
+
+// ancestorsLocked returns the directory and all directories containing
+// it, up to the root.
+func (fs *Memory) ancestorsLocked(dir *memoryInode) []*memoryInode {
+	var ret []*memoryInode
+	var rec func(*memoryInode) bool
+	rec = func(d *memoryInode) bool {
+		if d == dir {
+			ret = append(ret, d)
+			return true
+		}
+		for _, child := range d.entries {
+			if child.mode.IsDir() && rec(child) {
+				ret = append(ret, d)
+				return true
+			}
+		}
+		return false
+	}
+	rec(fs.root)
+	return ret
+}
+
+// RemoveAll recursively deletes a directory (or file). A missing path
+// is not an error.
+func (fs *Memory) RemoveAll(path Path) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.lookupParentLocked(string(path))
+	if err == syscall.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: string(path), Err: err}
+	}
+	if _, ok := dir.entries[name]; !ok {
+		return nil
+	}
+
+	fs.unlinkLocked(dir, name)
+	return nil
+}
+
+// Remove deletes a file or empty directory.
+func (fs *Memory) Remove(path Path) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.lookupParentLocked(string(path))
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: string(path), Err: err}
+	}
+	ino, ok := dir.entries[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: string(path), Err: syscall.ENOENT}
+	}
+	if ino.mode.IsDir() && len(ino.entries) > 0 {
+		return &os.PathError{Op: "remove", Path: string(path), Err: syscall.ENOTEMPTY}
+	}
+
+	fs.unlinkLocked(dir, name)
+	return nil
+}
+
+// linkLocked adds an inode to a directory.
+func (fs *Memory) linkLocked(dir *memoryInode, name string, ino *memoryInode) {
+	dir.entries[name] = ino
+	ino.nlink++
+	dir.mtime = time.Now()
+}
+
+// unlinkLocked removes an entry from a directory. Directories are
+// removed recursively.
+func (fs *Memory) unlinkLocked(dir *memoryInode, name string) {
+	ino := dir.entries[name]
+	delete(dir.entries, name)
+	ino.nlink--
+	if ino.mode.IsDir() {
+		for child := range ino.entries {
+			fs.unlinkLocked(ino, child)
+		}
+	}
+	dir.mtime = time.Now()
+}
+
+// Chmod changes file or directory modes and permissions.
+func (fs *Memory) Chmod(path Path, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), true)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: string(path), Err: err}
+	}
+	ino.chmod(mode)
+	return nil
+}
+
+// Lchown changes the owner or group of a file or directory.
+// If uid or gid are -1, that value is ignored. Symlinks are updated, not followed.
+func (fs *Memory) Lchown(path Path, uid, gid int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), false)
+	if err != nil {
+		return &os.PathError{Op: "lchown", Path: string(path), Err: err}
+	}
+	ino.chown(uid, gid)
+	return nil
+}
+
+// Chtimes modifies the file or directory metadata for access and modification times.
+func (fs *Memory) Chtimes(path Path, atime time.Time, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ino, err := fs.lookupLocked(string(path), true)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: string(path), Err: err}
+	}
+	ino.atime = atime
+	ino.mtime = mtime
+	return nil
+}
+
+// chmod sets the permission bits, keeping the file type.
+func (ino *memoryInode) chmod(mode os.FileMode) {
+	const settable = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	ino.mode = ino.mode&^settable | mode&settable
+}
+
+// chown sets the owner and group. Values of -1 are ignored.
+func (ino *memoryInode) chown(uid, gid int) {
+	if uid != -1 {
+		ino.uid = uid
+	}
+	if gid != -1 {
+		ino.gid = gid
+	}
+}
+
+// fileInfo returns a snapshot of the inode metadata. Sys returns a
+// *FileAttrs, so FileAttrsFromFileInfo works.
+func (ino *memoryInode) fileInfo(name string) os.FileInfo {
+	fi := &memoryFileInfo{
+		name:  name,
+		mode:  ino.mode,
+		mtime: ino.mtime,
+		attrs: FileAttrs{
+			UID:        ino.uid,
+			GID:        ino.gid,
+			AccessTime: ino.atime,
+			NLinks:     ino.nlink,
+			Inode:      ino.ino,
+		},
+	}
+	switch {
+	case ino.mode.IsDir():
+		// Like most Unix file systems, count "." and the ".." of
+		// subdirectories.
+		fi.attrs.NLinks = 2
+		for _, child := range ino.entries {
+			if child.mode.IsDir() {
+				fi.attrs.NLinks++
+			}
+		}
+	case ino.mode&os.ModeSymlink != 0:
+		fi.size = int64(len(ino.target))
+	default:
+		fi.size = int64(len(ino.data))
+	}
+	return fi
+}
+
+// unixFileType returns the S_IFMT bits for a file mode.
+func unixFileType(mode os.FileMode) uint32 {
+	switch {
+	case mode.IsDir():
+		return syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		return syscall.S_IFLNK
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+type memoryFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	attrs FileAttrs
+}
+
+func (fi *memoryFileInfo) Name() string       { return fi.name }
+func (fi *memoryFileInfo) Size() int64        { return fi.size }
+func (fi *memoryFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memoryFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memoryFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memoryFileInfo) Sys() interface{}   { return &fi.attrs }
@@ -0,0 +1,583 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var memoryIsAWriteableFileSystem WriteableFileSystem = &Memory{}
+
+func TestMemoryOpen(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	fr, err := mfs.Open(Path("file1"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := fr.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	if _, err := mfs.Open(Path("symlink-dangling")); !os.IsNotExist(err) {
+		t.Errorf("Open(symlink-dangling) error: got %v, want ENOENT", err)
+	}
+}
+
+func TestMemoryFileReader(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fr, err := mfs.Open(Path("hardlink-symlink"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		got, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+
+		if want := "content 1\n"; string(got) != want {
+			t.Errorf("ReadAll: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Readdir", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fr, err := mfs.Open(Path("dir1"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		got, err := fr.Readdir()
+		if err != nil {
+			t.Fatalf("Readdir failed: %v", err)
+		}
+
+		want := findMemDirEnt(testTree(), "dir1").Children
+		if len(got) != len(want) {
+			t.Fatalf("Readdir: got len %d, want len %d", len(got), len(want))
+		}
+		for i, got := range got {
+			if got.Name() != want[i].Name || got.Mode() != want[i].Mode {
+				t.Errorf("Readdir: got %v %v, want %+v", got.Name(), got.Mode(), want[i])
+			}
+		}
+	})
+
+	t.Run("ReaddirFailsNotDir", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fr, err := mfs.Open(Path("file1"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		_, err = fr.Readdir()
+		if err == nil || !strings.Contains(err.Error(), "directory") {
+			t.Fatalf("Readdir error: got %v, want ENOTDIR", err)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fr, err := mfs.Open(Path("file1"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		fi, err := fr.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if want := int64(len("content 1\n")); fi.Size() != want {
+			t.Errorf("Stat Size: got %v, want %v", fi.Size(), want)
+		}
+
+		attrs, ok := FileAttrsFromFileInfo(fi)
+		if !ok {
+			t.Fatalf("FileAttrsFromFileInfo failed")
+		}
+		if want := uint64(2); attrs.NLinks != want {
+			t.Errorf("FileAttrsFromFileInfo NLinks: got %v, want %v", attrs.NLinks, want)
+		}
+		if attrs.UID != os.Getuid() || attrs.GID != os.Getgid() {
+			t.Errorf("FileAttrsFromFileInfo owner: got %v:%v, want %v:%v", attrs.UID, attrs.GID, os.Getuid(), os.Getgid())
+		}
+	})
+}
+
+func TestMemoryReadlink(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	got, err := mfs.Readlink(Path("symlink1"))
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if want := Path("file1"); got != want {
+		t.Errorf("Readlink: got %q, want %q", got, want)
+	}
+
+	if _, err := mfs.Readlink(Path("file1")); err == nil {
+		t.Errorf("Readlink(file1) error: got nil, want EINVAL")
+	}
+}
+
+func TestMemoryCreate(t *testing.T) {
+	t.Run("new", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fw, err := mfs.Create(Path("dir1/file-create"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := fmt.Fprint(fw, "content create\n"); err != nil {
+			t.Fatalf("Fprint failed: %v", err)
+		}
+		if err := fw.Chmod(0640); err != nil {
+			t.Fatalf("Chmod failed: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+
+		tree := testTree()
+		de := findMemDirEnt(tree, "dir1")
+		de.Children = append(de.Children, &memDirEnt{
+			Name:    "file-create",
+			Mode:    0640,
+			Content: "content create\n",
+		})
+
+		if err := checkTestMemory(mfs, tree); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("truncatesHardlink", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		fw, err := mfs.Create(Path("hardlink1"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := fmt.Fprint(fw, "new\n"); err != nil {
+			t.Fatalf("Fprint failed: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+
+		tree := testTree()
+		findMemDirEnt(tree, "file1").Content = "new\n"
+
+		if err := checkTestMemory(mfs, tree); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failsOnDir", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		if _, err := mfs.Create(Path("dir1")); err == nil {
+			t.Errorf("Create error: got nil, want EISDIR")
+		}
+	})
+}
+
+func TestMemoryMkdir(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Mkdir(Path("dir-make"), 0700, 42, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := mfs.Mkdir(Path("dir-make"), 0700, -1, -1); !os.IsExist(err) {
+		t.Errorf("Mkdir error: got %v, want EEXIST", err)
+	}
+	if err := mfs.Mkdir(Path("missing/dir-make"), 0700, -1, -1); !os.IsNotExist(err) {
+		t.Errorf("Mkdir error: got %v, want ENOENT", err)
+	}
+
+	tree := append(testTree(), &memDirEnt{
+		Name: "dir-make",
+		Mode: 0700 | os.ModeDir,
+	})
+	if err := checkTestMemory(mfs, tree); err != nil {
+		t.Error(err)
+	}
+
+	attrs := statTestMemory(t, mfs, "dir-make")
+	if attrs.UID != 42 || attrs.GID != os.Getgid() {
+		t.Errorf("Mkdir owner: got %v:%v, want %v:%v", attrs.UID, attrs.GID, 42, os.Getgid())
+	}
+}
+
+func TestMemoryLink(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Link(Path("file1"), Path("hardlink-file1")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if err := mfs.Link(Path("dir1"), Path("hardlink-dir1")); err == nil {
+		t.Errorf("Link(dir1) error: got nil, want EPERM")
+	}
+
+	tree := append(testTree(), &memDirEnt{
+		Name:    "hardlink-file1",
+		Mode:    0666,
+		Content: "file1",
+	})
+	if err := checkTestMemory(mfs, tree); err != nil {
+		t.Error(err)
+	}
+
+	if want := uint64(3); statTestMemory(t, mfs, "file1").NLinks != want {
+		t.Errorf("Link NLinks: got %v, want %v", statTestMemory(t, mfs, "file1").NLinks, want)
+	}
+}
+
+func TestMemorySymlink(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Symlink(Path("dir1"), Path("symlink-dir1")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := mfs.Symlink(Path("/symlink-dir1/file-readonly"), Path("dir-private/symlink-abs")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	fr, err := mfs.Open(Path("dir-private/symlink-abs"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	got, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if want := "content readonly\n"; string(got) != want {
+		t.Errorf("ReadAll: got %q, want %q", got, want)
+	}
+
+	if err := mfs.Symlink(Path("loop"), Path("loop")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if _, err := mfs.Open(Path("loop")); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("Open(loop) error: got %v, want ELOOP", err)
+	}
+}
+
+func TestMemoryRename(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		if err := mfs.Rename(Path("file1"), Path("file-rename")); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+
+		tree := testTree()
+		findMemDirEnt(tree, "file1").Name = "file-rename"
+		findMemDirEnt(tree, "hardlink1").Content = "file-rename"
+
+		if err := checkTestMemory(mfs, tree); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("replacesFile", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		if err := mfs.Rename(Path("file1"), Path("dir-private/file2")); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+
+		tree := testTree()
+		removeMemDirEnt(&tree, "file1")
+		findMemDirEnt(tree, "dir-private/file2").Content = "content 1\n"
+		findMemDirEnt(tree, "hardlink1").Content = "dir-private/file2"
+
+		if err := checkTestMemory(mfs, tree); err != nil {
+			t.Error(err)
+		}
+		if want := uint64(2); statTestMemory(t, mfs, "hardlink1").NLinks != want {
+			t.Errorf("Rename NLinks: got %v, want %v", statTestMemory(t, mfs, "hardlink1").NLinks, want)
+		}
+	})
+
+	t.Run("dirFailsIntoItself", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		if err := mfs.Rename(Path("dir1"), Path("dir1/dir-empty/dir1")); !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("Rename error: got %v, want EINVAL", err)
+		}
+	})
+
+	t.Run("dirFailsOnNonEmpty", func(t *testing.T) {
+		mfs := newTestMemory(t)
+
+		if err := mfs.Rename(Path("dir1/dir-empty"), Path("dir-private")); !errors.Is(err, syscall.ENOTEMPTY) {
+			t.Errorf("Rename error: got %v, want ENOTEMPTY", err)
+		}
+	})
+}
+
+func TestMemoryRemoveAll(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.RemoveAll(Path("dir1")); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := mfs.RemoveAll(Path("dir1")); err != nil {
+		t.Errorf("RemoveAll(missing) failed: %v", err)
+	}
+
+	tree := testTree()
+	removeMemDirEnt(&tree, "dir1")
+
+	if err := checkTestMemory(mfs, tree); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryRemove(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Remove(Path("hardlink1")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := mfs.Remove(Path("dir1/dir-empty")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := mfs.Remove(Path("dir1")); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("Remove error: got %v, want ENOTEMPTY", err)
+	}
+
+	tree := testTree()
+	removeMemDirEnt(&tree, "hardlink1")
+	removeMemDirEnt(&tree, "dir1/dir-empty")
+
+	if err := checkTestMemory(mfs, tree); err != nil {
+		t.Error(err)
+	}
+	if want := uint64(1); statTestMemory(t, mfs, "file1").NLinks != want {
+		t.Errorf("Remove NLinks: got %v, want %v", statTestMemory(t, mfs, "file1").NLinks, want)
+	}
+}
+
+func TestMemoryChmod(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Chmod(Path("symlink1"), 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	tree := testTree()
+	findMemDirEnt(tree, "file1").Mode = 0600
+	findMemDirEnt(tree, "hardlink1").Mode = 0600
+
+	if err := checkTestMemory(mfs, tree); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryLchown(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	if err := mfs.Lchown(Path("symlink1"), 42, 43); err != nil {
+		t.Fatalf("Lchown failed: %v", err)
+	}
+
+	if attrs := statTestMemory(t, mfs, "symlink1"); attrs.UID != 42 || attrs.GID != 43 {
+		t.Errorf("Lchown owner: got %v:%v, want 42:43", attrs.UID, attrs.GID)
+	}
+	if attrs := statTestMemory(t, mfs, "file1"); attrs.UID != os.Getuid() {
+		t.Errorf("Lchown followed the symlink: got UID %v, want %v", attrs.UID, os.Getuid())
+	}
+}
+
+func TestMemoryChtimes(t *testing.T) {
+	mfs := newTestMemory(t)
+
+	atime := time.Unix(42, 0)
+	mtime := time.Unix(43, 0)
+	if err := mfs.Chtimes(Path("file1"), atime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	fr, err := mfs.Open(Path("."))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	fis, err := fr.Readdir()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	for _, fi := range fis {
+		if fi.Name() != "file1" {
+			continue
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("Chtimes mtime: got %v, want %v", fi.ModTime(), mtime)
+		}
+		attrs, _ := FileAttrsFromFileInfo(fi)
+		if !attrs.AccessTime.Equal(atime) {
+			t.Errorf("Chtimes atime: got %v, want %v", attrs.AccessTime, atime)
+		}
+	}
+}
+
+// newTestMemory creates a Memory populated with testTree.
+func newTestMemory(t *testing.T) *Memory {
+	mfs := NewMemory()
+
+	var rec func(Path, *memDirEnt) error
+	rec = func(parent Path, de *memDirEnt) error {
+		path := parent.Resolve(Path(de.Name))
+		switch {
+		case de.Mode.IsDir():
+			if err := mfs.Mkdir(path, de.Mode&^os.ModeDir, -1, -1); err != nil {
+				return err
+			}
+			for _, de := range de.Children {
+				if err := rec(path, de); err != nil {
+					return err
+				}
+			}
+			return nil
+
+		case de.Mode&os.ModeSymlink != 0:
+			return mfs.Symlink(Path(de.Content), path)
+
+		case strings.HasPrefix(de.Name, "hardlink"):
+			return mfs.Link(parent.Resolve(Path(de.Content)), path)
+
+		default:
+			fw, err := mfs.Create(path)
+			if err != nil {
+				return err
+			}
+			defer fw.Close()
+			if _, err := fmt.Fprint(fw, de.Content); err != nil {
+				return err
+			}
+			return fw.Chmod(de.Mode)
+		}
+	}
+
+	for _, de := range testTree() {
+		if err := rec(Path("."), de); err != nil {
+			t.Fatalf("testTree creation failed: %v", err)
+		}
+	}
+	return mfs
+}
+
+// checkTestMemory compares the contents of a Memory with a tree.
+func checkTestMemory(got *Memory, want []*memDirEnt) error {
+	var rec func(Path, []*memDirEnt) error
+	rec = func(dir Path, wants []*memDirEnt) error {
+		fr, err := got.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		gots, err := fr.Readdir()
+		if err != nil {
+			return err
+		}
+		wants = append([]*memDirEnt(nil), wants...)
+		sort.Slice(wants, func(i, j int) bool { return wants[i].Name < wants[j].Name })
+
+		if len(gots) != len(wants) {
+			return fmt.Errorf("different number of file nodes at %q: got %v, want %v", dir, len(gots), len(wants))
+		}
+		for i, gotfi := range gots {
+			p := dir.Resolve(Path(gotfi.Name()))
+			want := wants[i]
+			if gotfi.Name() != want.Name {
+				return fmt.Errorf("mismatching file names at %q: got %q, want %q", dir, gotfi.Name(), want.Name)
+			}
+			if gotfi.Mode() != want.Mode {
+				return fmt.Errorf("mismatching file modes at %q: got %v, want %v", p, gotfi.Mode(), want.Mode)
+			}
+			switch {
+			case gotfi.IsDir():
+				if err := rec(p, want.Children); err != nil {
+					return err
+				}
+
+			case gotfi.Mode()&os.ModeSymlink != 0:
+				s, err := got.Readlink(p)
+				if err != nil {
+					return err
+				}
+				if string(s) != want.Content {
+					return fmt.Errorf("mismatching symlink content at %q: got %q, want %q", p, s, want.Content)
+				}
+
+			default:
+				if strings.HasPrefix(gotfi.Name(), "hardlink") {
+					want2 := findMemDirEnt(wants, want.Content)
+					if want2 == nil {
+						return fmt.Errorf("invalid wanted hardlink: %v", want)
+					}
+					want = want2
+				}
+				fr, err := got.Open(p)
+				if err != nil {
+					return err
+				}
+				bs, err := ioutil.ReadAll(fr)
+				fr.Close()
+				if err != nil {
+					return err
+				}
+				if string(bs) != want.Content {
+					return fmt.Errorf("mismatching file content at %q: got %q, want %q", p, string(bs), want.Content)
+				}
+			}
+		}
+		return nil
+	}
+
+	return rec(Path("."), want)
+}
+
+// statTestMemory returns the attributes of a file, without following
+// symlinks.
+func statTestMemory(t *testing.T, mfs *Memory, path Path) FileAttrs {
+	fr, err := mfs.Open(path.Dir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	fis, err := fr.Readdir()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	for _, fi := range fis {
+		if fi.Name() == string(path.Base()) {
+			attrs, ok := FileAttrsFromFileInfo(fi)
+			if !ok {
+				t.Fatalf("FileAttrsFromFileInfo failed for %q", path)
+			}
+			return attrs
+		}
+	}
+	t.Fatalf("file not found: %q", path)
+	return FileAttrs{}
+}
@@ -0,0 +1,133 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+)
+
+// objectAttrs is the file metadata that S3 and WebDAV store next to
+// the contents, since the services have no notion of it.
+type objectAttrs struct {
+	mode     os.FileMode
+	uid, gid int
+	atime    time.Time
+	mtime    time.Time
+}
+
+// chown sets the owner and group. Values of -1 are ignored.
+func (attrs *objectAttrs) chown(uid, gid int) {
+	if uid != -1 {
+		attrs.uid = uid
+	}
+	if gid != -1 {
+		attrs.gid = gid
+	}
+}
+
+// values returns the attributes as strings, with names starting with
+// the prefix. Modes are stored in octal, like st_mode, and times in
+// RFC 3339 format.
+func (attrs *objectAttrs) values(prefix string) map[string]string {
+	return map[string]string{
+		prefix + "mode":  strconv.FormatUint(uint64(unixMode(attrs.mode)), 8),
+		prefix + "uid":   strconv.Itoa(attrs.uid),
+		prefix + "gid":   strconv.Itoa(attrs.gid),
+		prefix + "atime": attrs.atime.UTC().Format(time.RFC3339Nano),
+		prefix + "mtime": attrs.mtime.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// parseObjectAttrs reads attributes created by values. Missing or
+// invalid values are taken from def.
+func parseObjectAttrs(vals map[string]string, prefix string, def objectAttrs) objectAttrs {
+	attrs := def
+	if v, err := strconv.ParseUint(vals[prefix+"mode"], 8, 32); err == nil {
+		attrs.mode = fileModeFromUnix(uint32(v))
+	}
+	if v, err := strconv.Atoi(vals[prefix+"uid"]); err == nil {
+		attrs.uid = v
+	}
+	if v, err := strconv.Atoi(vals[prefix+"gid"]); err == nil {
+		attrs.gid = v
+	}
+	if v, err := time.Parse(time.RFC3339Nano, vals[prefix+"atime"]); err == nil {
+		attrs.atime = v
+	}
+	if v, err := time.Parse(time.RFC3339Nano, vals[prefix+"mtime"]); err == nil {
+		attrs.mtime = v
+	}
+	return attrs
+}
+
+// unixMode converts a file mode to st_mode bits.
+func unixMode(mode os.FileMode) uint32 {
+	m := unixFileType(mode) | uint32(mode&os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// fileModeFromUnix converts st_mode bits to a file mode.
+func fileModeFromUnix(m uint32) os.FileMode {
+	mode := os.FileMode(m) & os.ModePerm
+	switch m & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	}
+	if m&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// An objectFileInfo describes a file with objectAttrs. Sys returns a
+// *remote.FileStat, so FileAttrsFromFileInfo works.
+type objectFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	attrs objectAttrs
+	stat  remote.FileStat
+}
+
+func newObjectFileInfo(p Path, size int64, attrs objectAttrs) *objectFileInfo {
+	return &objectFileInfo{
+		name:  path.Base("/" + string(p)),
+		size:  size,
+		mode:  attrs.mode,
+		attrs: attrs,
+		stat: remote.FileStat{
+			UID:    uint32(attrs.uid),
+			GID:    uint32(attrs.gid),
+			Atime:  attrs.atime,
+			NLinks: 1,
+		},
+	}
+}
+
+func (fi *objectFileInfo) Name() string       { return fi.name }
+func (fi *objectFileInfo) Size() int64        { return fi.size }
+func (fi *objectFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *objectFileInfo) ModTime() time.Time { return fi.attrs.mtime }
+func (fi *objectFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *objectFileInfo) Sys() interface{}   { return &fi.stat }
@@ -0,0 +1,524 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// s3Concurrency is the maximum number of concurrent requests in
+// Readdir and RemoveAll.
+const s3Concurrency = 16
+
+// s3MetadataPrefix is prepended to the names of attributes in
+// object metadata.
+const s3MetadataPrefix = "fisy-"
+
+// errStopListing stops ListObjects early.
+var errStopListing = errors.New("stop listing")
+
+// An S3 stores files as objects in an S3-compatible bucket, below a
+// key prefix. Modes, ownership and times are stored as object
+// metadata. A directory is a marker object whose key ends in a slash,
+// but directories with objects and no marker are also listed. A
+// symlink is an object containing the target.
+//
+// There are no hardlinks, so Link copies the object on the server,
+// and Rename copies and deletes. Renaming a directory is not atomic.
+// Symlink and Mkdir use conditional writes, which the service must
+// support for COW locking to work.
+type S3 struct {
+	client *remote.S3Client
+	prefix string
+}
+
+// NewS3 creates a new file system with keys starting with the prefix.
+func NewS3(client *remote.S3Client, prefix string) *S3 {
+	return &S3{
+		client: client,
+		prefix: strings.Trim(prefix, "/"),
+	}
+}
+
+// key returns the object key of a file.
+func (fs *S3) key(p Path) string {
+	rel := strings.TrimPrefix(path.Clean("/"+string(p)), "/")
+	if fs.prefix == "" {
+		return rel
+	}
+	if rel == "" {
+		return fs.prefix
+	}
+	return fs.prefix + "/" + rel
+}
+
+// dirKey returns the key prefix of objects in a directory. It is also
+// the key of the directory marker.
+func (fs *S3) dirKey(p Path) string {
+	if k := fs.key(p); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+func (fs *S3) Open(path Path) (FileReader, error) {
+	ctx := context.Background()
+	key := fs.key(path)
+	if key != fs.key(".") {
+		rc, obj, err := fs.client.GetObject(ctx, key)
+		if err == nil {
+			fi := newS3FileInfo(path, obj)
+			if fi.mode&os.ModeSymlink != 0 {
+				rc.Close()
+				return nil, &os.PathError{Op: "s3:open", Path: key, Err: syscall.ELOOP}
+			}
+			return &s3FileReader{ReadCloser: rc, fs: fs, path: path, fi: fi}, nil
+		} else if !IsNotExist(err) {
+			return nil, &os.PathError{Op: "s3:open", Path: key, Err: err}
+		}
+	}
+
+	fi, err := fs.statDir(ctx, path)
+	if err != nil {
+		return nil, &os.PathError{Op: "s3:open", Path: key, Err: err}
+	}
+	return &s3FileReader{ReadCloser: ioutil.NopCloser(strings.NewReader("")), fs: fs, path: path, fi: fi}, nil
+}
+
+// statDir returns information about a directory, from its marker. A
+// directory without a marker exists if it contains objects.
+func (fs *S3) statDir(ctx context.Context, p Path) (*objectFileInfo, error) {
+	dk := fs.dirKey(p)
+	if dk == "" {
+		// The bucket root has no marker.
+		return newS3DirInfo(p, nil), nil
+	}
+	obj, err := fs.client.HeadObject(ctx, dk)
+	if err == nil {
+		return newS3DirInfo(p, obj), nil
+	} else if !IsNotExist(err) {
+		return nil, err
+	}
+
+	if fs.key(p) == fs.key(".") {
+		return newS3DirInfo(p, nil), nil
+	}
+	found := false
+	err = fs.client.ListObjects(ctx, dk, "", func(objs []remote.S3Object, prefixes []string) error {
+		found = len(objs) > 0
+		return errStopListing
+	})
+	if err != nil && err != errStopListing {
+		return nil, err
+	}
+	if !found {
+		return nil, syscall.ENOENT
+	}
+	return newS3DirInfo(p, nil), nil
+}
+
+type s3FileReader struct {
+	io.ReadCloser
+
+	fs   *S3
+	path Path
+	fi   *objectFileInfo
+}
+
+// Readdir lists the directory. Listings don't include metadata, so
+// each entry is fetched separately.
+func (fr *s3FileReader) Readdir() ([]os.FileInfo, error) {
+	ctx := context.Background()
+	dk := fr.fs.dirKey(fr.path)
+	if !fr.fi.IsDir() {
+		return nil, &os.PathError{Op: "s3:readdir", Path: dk, Err: syscall.ENOTDIR}
+	}
+
+	var mu sync.Mutex
+	var fis []os.FileInfo
+	eg, egctx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(s3Concurrency)
+	add := func(key string, dir bool) error {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, dk), "/")
+		if name == "" {
+			// The directory marker.
+			return nil
+		}
+		if err := sem.Acquire(egctx, 1); err != nil {
+			return err
+		}
+		eg.Go(func() error {
+			defer sem.Release(1)
+
+			var fi *objectFileInfo
+			obj, err := fr.fs.client.HeadObject(egctx, key)
+			switch {
+			case dir && IsNotExist(err):
+				fi = newS3DirInfo(Path(name), nil)
+			case err != nil:
+				return err
+			case dir:
+				fi = newS3DirInfo(Path(name), obj)
+			default:
+				fi = newS3FileInfo(Path(name), obj)
+			}
+			mu.Lock()
+			fis = append(fis, fi)
+			mu.Unlock()
+			return nil
+		})
+		return nil
+	}
+	err := fr.fs.client.ListObjects(ctx, dk, "/", func(objs []remote.S3Object, prefixes []string) error {
+		for _, obj := range objs {
+			if err := add(obj.Key, false); err != nil {
+				return err
+			}
+		}
+		for _, p := range prefixes {
+			if err := add(p, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if werr := eg.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "s3:readdir", Path: dk, Err: err}
+	}
+	return fis, nil
+}
+
+func (fr *s3FileReader) Stat() (os.FileInfo, error) {
+	return fr.fi, nil
+}
+
+func (fs *S3) Readlink(path Path) (Path, error) {
+	key := fs.key(path)
+	rc, obj, err := fs.client.GetObject(context.Background(), key)
+	if err != nil {
+		return "", &os.PathError{Op: "s3:readlink", Path: key, Err: err}
+	}
+	defer rc.Close()
+	if newS3FileInfo(path, obj).mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "s3:readlink", Path: key, Err: syscall.EINVAL}
+	}
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", &os.PathError{Op: "s3:readlink", Path: key, Err: err}
+	}
+	return Path(bs), nil
+}
+
+// Stat returns information about this file system. Buckets have no
+// size limit.
+func (fs *S3) Stat() (FSInfo, error) {
+	return FSInfo{FreeSpace: math.MaxUint64}, nil
+}
+
+// Create opens a file for writing. The contents are stored in a
+// temporary file, and uploaded when the file is closed.
+func (fs *S3) Create(path Path) (FileWriter, error) {
+	key := fs.key(path)
+	f, err := ioutil.TempFile("", "fisy-s3-")
+	if err != nil {
+		return nil, err
+	}
+	// Only the open file is needed.
+	os.Remove(f.Name())
+	now := time.Now()
+	return &s3FileWriter{
+		File:  f,
+		fs:    fs,
+		key:   key,
+		attrs: objectAttrs{mode: 0644, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now},
+	}, nil
+}
+
+type s3FileWriter struct {
+	*os.File
+
+	fs    *S3
+	key   string
+	attrs objectAttrs
+}
+
+func (fw *s3FileWriter) Close() error {
+	defer fw.File.Close()
+
+	size, err := fw.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := fw.fs.client.PutObject(context.Background(), fw.key, fw.File, size, fw.attrs.values(s3MetadataPrefix), false); err != nil {
+		return &os.PathError{Op: "s3:close", Path: fw.key, Err: err}
+	}
+	return nil
+}
+
+func (fw *s3FileWriter) Chmod(mode os.FileMode) error {
+	fw.attrs.mode = fw.attrs.mode&os.ModeType | mode&^os.ModeType
+	return nil
+}
+
+func (fw *s3FileWriter) Chown(uid, gid int) error {
+	fw.attrs.chown(uid, gid)
+	return nil
+}
+
+func (fs *S3) Keep(path Path) error {
+	return nil
+}
+
+func (fs *S3) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
+	ctx := context.Background()
+	key := fs.key(path)
+	if _, err := fs.client.HeadObject(ctx, key); err == nil {
+		return &os.PathError{Op: "s3:mkdir", Path: key, Err: os.ErrExist}
+	} else if !IsNotExist(err) {
+		return &os.PathError{Op: "s3:mkdir", Path: key, Err: err}
+	}
+
+	now := time.Now()
+	attrs := objectAttrs{mode: os.ModeDir | mode&^os.ModeType, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now}
+	attrs.chown(uid, gid)
+	if err := fs.client.PutObject(ctx, fs.dirKey(path), strings.NewReader(""), 0, attrs.values(s3MetadataPrefix), true); err != nil {
+		return &os.PathError{Op: "s3:mkdir", Path: key, Err: err}
+	}
+	return nil
+}
+
+// Link copies the object on the server, since there are no
+// hardlinks.
+func (fs *S3) Link(oldpath Path, newpath Path) error {
+	ctx := context.Background()
+	oldk, newk := fs.key(oldpath), fs.key(newpath)
+	obj, err := fs.client.HeadObject(ctx, oldk)
+	if err != nil {
+		return &os.LinkError{Op: "s3:link", Old: oldk, New: newk, Err: err}
+	}
+	if err := fs.client.CopyObject(ctx, oldk, newk, obj.Size, nil); err != nil {
+		return &os.LinkError{Op: "s3:link", Old: oldk, New: newk, Err: err}
+	}
+	return nil
+}
+
+func (fs *S3) Symlink(oldpath Path, newpath Path) error {
+	newk := fs.key(newpath)
+	now := time.Now()
+	attrs := objectAttrs{mode: os.ModeSymlink | 0777, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now}
+	if err := fs.client.PutObject(context.Background(), newk, strings.NewReader(string(oldpath)), int64(len(oldpath)), attrs.values(s3MetadataPrefix), true); err != nil {
+		return &os.LinkError{Op: "s3:symlink", Old: string(oldpath), New: newk, Err: err}
+	}
+	return nil
+}
+
+// Rename copies and deletes. A directory is renamed one object at a
+// time.
+func (fs *S3) Rename(oldpath Path, newpath Path) error {
+	ctx := context.Background()
+	oldk, newk := fs.key(oldpath), fs.key(newpath)
+	obj, err := fs.client.HeadObject(ctx, oldk)
+	if err == nil {
+		if err := fs.client.CopyObject(ctx, oldk, newk, obj.Size, nil); err != nil {
+			return &os.LinkError{Op: "s3:rename", Old: oldk, New: newk, Err: err}
+		}
+		if err := fs.client.DeleteObject(ctx, oldk); err != nil {
+			return &os.LinkError{Op: "s3:rename", Old: oldk, New: newk, Err: err}
+		}
+		return nil
+	} else if !IsNotExist(err) {
+		return &os.LinkError{Op: "s3:rename", Old: oldk, New: newk, Err: err}
+	}
+
+	olddk, newdk := fs.dirKey(oldpath), fs.dirKey(newpath)
+	var found int32
+	err = fs.forEachObject(ctx, olddk, func(obj remote.S3Object) error {
+		atomic.StoreInt32(&found, 1)
+		if err := fs.client.CopyObject(ctx, obj.Key, newdk+strings.TrimPrefix(obj.Key, olddk), obj.Size, nil); err != nil {
+			return err
+		}
+		return fs.client.DeleteObject(ctx, obj.Key)
+	})
+	if err == nil && atomic.LoadInt32(&found) == 0 {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return &os.LinkError{Op: "s3:rename", Old: oldk, New: newk, Err: err}
+	}
+	return nil
+}
+
+// forEachObject calls the function concurrently for each object with
+// the key prefix.
+func (fs *S3) forEachObject(ctx context.Context, prefix string, fun func(remote.S3Object) error) error {
+	eg, egctx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(s3Concurrency)
+	err := fs.client.ListObjects(egctx, prefix, "", func(objs []remote.S3Object, _ []string) error {
+		for _, obj := range objs {
+			obj := obj
+			if err := sem.Acquire(egctx, 1); err != nil {
+				return err
+			}
+			eg.Go(func() error {
+				defer sem.Release(1)
+				return fun(obj)
+			})
+		}
+		return nil
+	})
+	if werr := eg.Wait(); err == nil || werr != nil {
+		// The listing fails with a canceled context if a
+		// function failed.
+		err = werr
+	}
+	return err
+}
+
+func (fs *S3) RemoveAll(path Path) error {
+	ctx := context.Background()
+	key := fs.key(path)
+	err := fs.forEachObject(ctx, fs.dirKey(path), func(obj remote.S3Object) error {
+		return fs.client.DeleteObject(ctx, obj.Key)
+	})
+	if err != nil {
+		return &os.PathError{Op: "s3:removeall", Path: key, Err: err}
+	}
+	if err := fs.client.DeleteObject(ctx, key); err != nil {
+		return &os.PathError{Op: "s3:removeall", Path: key, Err: err}
+	}
+	return nil
+}
+
+func (fs *S3) Remove(path Path) error {
+	ctx := context.Background()
+	key := fs.key(path)
+	if _, err := fs.client.HeadObject(ctx, key); err == nil {
+		if err := fs.client.DeleteObject(ctx, key); err != nil {
+			return &os.PathError{Op: "s3:remove", Path: key, Err: err}
+		}
+		return nil
+	} else if !IsNotExist(err) {
+		return &os.PathError{Op: "s3:remove", Path: key, Err: err}
+	}
+
+	dk := fs.dirKey(path)
+	var keys []string
+	err := fs.client.ListObjects(ctx, dk, "", func(objs []remote.S3Object, _ []string) error {
+		for _, obj := range objs {
+			keys = append(keys, obj.Key)
+		}
+		if len(keys) > 1 {
+			return errStopListing
+		}
+		return nil
+	})
+	if err != nil && err != errStopListing {
+		return &os.PathError{Op: "s3:remove", Path: key, Err: err}
+	}
+	switch {
+	case len(keys) == 0:
+		return &os.PathError{Op: "s3:remove", Path: key, Err: syscall.ENOENT}
+	case len(keys) > 1 || keys[0] != dk:
+		return &os.PathError{Op: "s3:remove", Path: key, Err: syscall.ENOTEMPTY}
+	}
+	if err := fs.client.DeleteObject(ctx, dk); err != nil {
+		return &os.PathError{Op: "s3:remove", Path: key, Err: err}
+	}
+	return nil
+}
+
+func (fs *S3) Chmod(path Path, mode os.FileMode) error {
+	return fs.updateAttrs("s3:chmod", path, func(attrs *objectAttrs) {
+		attrs.mode = attrs.mode&os.ModeType | mode&^os.ModeType
+	})
+}
+
+func (fs *S3) Lchown(path Path, uid, gid int) error {
+	return fs.updateAttrs("s3:lchown", path, func(attrs *objectAttrs) {
+		attrs.chown(uid, gid)
+	})
+}
+
+func (fs *S3) Chtimes(path Path, atime time.Time, mtime time.Time) error {
+	return fs.updateAttrs("s3:chtimes", path, func(attrs *objectAttrs) {
+		attrs.atime = atime
+		attrs.mtime = mtime
+	})
+}
+
+// updateAttrs modifies the metadata of a file or directory, by
+// copying the object to itself. A directory without a marker gets
+// one. The bucket root has no marker, so changes to it are ignored.
+func (fs *S3) updateAttrs(op string, path Path, fun func(*objectAttrs)) error {
+	ctx := context.Background()
+	key := fs.key(path)
+	if key == "" {
+		return nil
+	}
+	obj, err := fs.client.HeadObject(ctx, key)
+	if err == nil {
+		attrs := newS3FileInfo(path, obj).attrs
+		fun(&attrs)
+		if err := fs.client.CopyObject(ctx, key, key, obj.Size, attrs.values(s3MetadataPrefix)); err != nil {
+			return &os.PathError{Op: op, Path: key, Err: err}
+		}
+		return nil
+	} else if !IsNotExist(err) {
+		return &os.PathError{Op: op, Path: key, Err: err}
+	}
+
+	fi, err := fs.statDir(ctx, path)
+	if err != nil {
+		return &os.PathError{Op: op, Path: key, Err: err}
+	}
+	attrs := fi.attrs
+	fun(&attrs)
+	// Directory markers are empty, so they are simply replaced.
+	if err := fs.client.PutObject(ctx, fs.dirKey(path), strings.NewReader(""), 0, attrs.values(s3MetadataPrefix), false); err != nil {
+		return &os.PathError{Op: op, Path: key, Err: err}
+	}
+	return nil
+}
+
+// newS3FileInfo describes a file or symlink object. Objects not
+// written by S3 are regular files owned by root.
+func newS3FileInfo(p Path, obj *remote.S3Object) *objectFileInfo {
+	attrs := parseObjectAttrs(obj.Metadata, s3MetadataPrefix, objectAttrs{mode: 0644, atime: obj.LastModified, mtime: obj.LastModified})
+	if attrs.mode.IsDir() {
+		// Only markers can be directories.
+		attrs.mode = attrs.mode &^ os.ModeDir
+	}
+	return newObjectFileInfo(p, obj.Size, attrs)
+}
+
+// newS3DirInfo describes a directory, from its marker object, if it
+// has one.
+func newS3DirInfo(p Path, obj *remote.S3Object) *objectFileInfo {
+	def := objectAttrs{mode: os.ModeDir | 0755}
+	if obj == nil {
+		return newObjectFileInfo(p, 0, def)
+	}
+	def.atime, def.mtime = obj.LastModified, obj.LastModified
+	attrs := parseObjectAttrs(obj.Metadata, s3MetadataPrefix, def)
+	attrs.mode = os.ModeDir | attrs.mode&^os.ModeType
+	return newObjectFileInfo(p, 0, attrs)
+}
@@ -0,0 +1,245 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+	"github.com/tommie/fisy/remote/testutil"
+)
+
+var s3IsAWriteableFileSystem WriteableFileSystem = &S3{}
+
+// newTestS3 returns an S3 with the prefix, in a fake bucket.
+func newTestS3(t *testing.T, prefix string) (*S3, *testutil.FakeS3) {
+	t.Helper()
+
+	fake := testutil.NewFakeS3("bucket")
+	s := httptest.NewServer(fake)
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	client := remote.NewS3Client(u, "us-east-1", "bucket", remote.S3Credentials{AccessKeyID: "id", SecretAccessKey: "secret"})
+	return NewS3(client, prefix), fake
+}
+
+// writeS3File creates a file with the given contents.
+func writeS3File(t *testing.T, s3fs *S3, path Path, content string) {
+	t.Helper()
+
+	fw, err := s3fs.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, content); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Chmod(0640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// readS3Dir returns the sorted names in a directory.
+func readS3Dir(t *testing.T, s3fs *S3, path Path) ([]string, []os.FileInfo) {
+	t.Helper()
+
+	fr, err := s3fs.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	fis, err := fr.Readdir()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, fis
+}
+
+func TestS3(t *testing.T) {
+	s3fs, fake := newTestS3(t, "backups/")
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := s3fs.Mkdir("a", 0750, 1000, 1001); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := s3fs.Mkdir("a", 0750, -1, -1); !IsExist(err) {
+		t.Errorf("Mkdir error: got %v, want EEXIST", err)
+	}
+	writeS3File(t, s3fs, "a/file", "hello")
+	if err := s3fs.Chtimes("a/file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := s3fs.Lchown("a/file", 1000, -1); err != nil {
+		t.Fatalf("Lchown failed: %v", err)
+	}
+	if err := s3fs.Symlink("a/file", "b"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := s3fs.Symlink("other", "b"); !IsExist(err) {
+		t.Errorf("Symlink error: got %v, want EEXIST", err)
+	}
+	if err := s3fs.Link("a/file", "c"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	if want := []string{"backups/a/", "backups/a/file", "backups/b", "backups/c"}; !reflect.DeepEqual(fake.Keys(), want) {
+		t.Errorf("Keys: got %v, want %v", fake.Keys(), want)
+	}
+
+	t.Run("readdir", func(t *testing.T) {
+		names, fis := readS3Dir(t, s3fs, ".")
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("Readdir: got %v, want %v", names, want)
+		}
+		if want := os.ModeDir | 0750; fis[0].Mode() != want {
+			t.Errorf("Readdir(a) Mode: got %v, want %v", fis[0].Mode(), want)
+		}
+		if want := os.ModeSymlink | 0777; fis[1].Mode() != want {
+			t.Errorf("Readdir(b) Mode: got %v, want %v", fis[1].Mode(), want)
+		}
+		if fis[2].Mode() != 0640 || fis[2].Size() != 5 || !fis[2].ModTime().Equal(mtime) {
+			t.Errorf("Readdir(c): got %v %v %v, want %v %v %v", fis[2].Mode(), fis[2].Size(), fis[2].ModTime(), os.FileMode(0640), 5, mtime)
+		}
+		attrs, ok := FileAttrsFromFileInfo(fis[2])
+		if !ok {
+			t.Fatalf("FileAttrsFromFileInfo failed")
+		}
+		if attrs.UID != 1000 {
+			t.Errorf("FileAttrsFromFileInfo UID: got %v, want %v", attrs.UID, 1000)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		fr, err := s3fs.Open("a/file")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(bs) != "hello" {
+			t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+		}
+
+		if _, err := s3fs.Open("missing"); !IsNotExist(err) {
+			t.Errorf("Open error: got %v, want ENOENT", err)
+		}
+	})
+
+	t.Run("readlink", func(t *testing.T) {
+		got, err := s3fs.Readlink("b")
+		if err != nil {
+			t.Fatalf("Readlink failed: %v", err)
+		}
+		if got != "a/file" {
+			t.Errorf("Readlink: got %q, want %q", got, "a/file")
+		}
+		if _, err := s3fs.Readlink("c"); !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("Readlink(c) error: got %v, want EINVAL", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := s3fs.Remove("a"); !errors.Is(err, syscall.ENOTEMPTY) {
+			t.Errorf("Remove error: got %v, want ENOTEMPTY", err)
+		}
+		if err := s3fs.Rename("a", "d"); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+		if names, _ := readS3Dir(t, s3fs, "d"); !reflect.DeepEqual(names, []string{"file"}) {
+			t.Errorf("Readdir(d): got %v, want [file]", names)
+		}
+		if err := s3fs.RemoveAll("d"); err != nil {
+			t.Fatalf("RemoveAll failed: %v", err)
+		}
+		if want := []string{"backups/b", "backups/c"}; !reflect.DeepEqual(fake.Keys(), want) {
+			t.Errorf("Keys: got %v, want %v", fake.Keys(), want)
+		}
+	})
+}
+
+func TestS3COW(t *testing.T) {
+	s3fs, fake := newTestS3(t, "")
+
+	cow, err := NewCOW(s3fs, "host", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if err := cow.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	fw, err := cow.Create("a/file")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, "hello"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	cow, err = NewCOW(s3fs, "host", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if _, err := NewCOW(s3fs, "host", time.Now()); err == nil {
+		t.Errorf("NewCOW: got %v, want locked", err)
+	}
+	if err := cow.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	// Kept files are copied on the server.
+	puts := fake.Requests["PUT"]
+	if err := cow.Keep("a/file"); err != nil {
+		t.Fatalf("Keep failed: %v", err)
+	}
+	if got := fake.Requests["PUT"] - puts; got != 1 {
+		t.Errorf("Keep PUT requests: got %v, want 1", got)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	snap, err := OpenCOWSnapshot(s3fs, "host", "latest")
+	if err != nil {
+		t.Fatalf("OpenCOWSnapshot failed: %v", err)
+	}
+	fr, err := snap.Open("a/file")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(bs) != "hello" {
+		t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+	}
+}
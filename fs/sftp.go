@@ -2,7 +2,12 @@ package fs
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -14,9 +19,18 @@ import (
 // An SFTP uses SFTP to read and write files. It doesn't do
 // retries, and should be used together with
 // remote.ReconnectingSFTPClient and remote.Idempotent.
+//
+// If the client is a remote.HelperRunner with a "fisy serve" helper,
+// the helper is used for prefetching, hashing, hardlinking and
+// RemoveAll. Prefetch lists a whole tree in one request, and later
+// Readdir calls use that listing, unless the directory has been
+// modified through this file system.
 type SFTP struct {
 	client remote.SFTPClient
 	root   Path
+
+	mu       sync.Mutex
+	listings map[string][]os.FileInfo
 }
 
 // NewSFTP creates a new file system at the given root path.
@@ -33,23 +47,131 @@ func (fs *SFTP) Open(path Path) (FileReader, error) {
 	if err != nil {
 		return nil, &os.PathError{Op: "sftp:open", Path: p, Err: err}
 	}
-	return &sftpFileReader{f, fs.client}, nil
+	return &sftpFileReader{f, fs}, nil
 }
 
 type sftpFileReader struct {
 	*sftp.File
 
-	client remote.SFTPClient
+	fs *SFTP
 }
 
 func (fr *sftpFileReader) Readdir() ([]os.FileInfo, error) {
-	fis, err := fr.client.ReadDir(fr.File.Name())
+	fis, err := fr.fs.readdir(fr.File.Name())
 	if err != nil {
 		return nil, &os.PathError{Op: "sftp:readdir", Path: fr.File.Name(), Err: err}
 	}
 	return fis, nil
 }
 
+// readdir lists a directory. A prefetched listing is used once, and
+// then forgotten.
+func (fs *SFTP) readdir(p string) ([]os.FileInfo, error) {
+	if fis, ok := fs.takeListing(p); ok {
+		return fis, nil
+	}
+	return fs.client.ReadDir(p)
+}
+
+// Prefetch lists the tree at path with the helper. Without a helper,
+// it does nothing.
+func (fs *SFTP) Prefetch(path Path) error {
+	p := string(fs.root.Resolve(path))
+	listings := map[string][]os.FileInfo{}
+	err := fs.withHelper(func(h *remote.HelperClient) error {
+		return h.Walk(p, func(dir string, fis []os.FileInfo) {
+			listings[dir] = fis
+		})
+	})
+	if errors.Is(err, remote.ErrNoHelper) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "sftp:prefetch", Path: p, Err: err}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.listings == nil {
+		fs.listings = listings
+		return nil
+	}
+	for dir, fis := range listings {
+		fs.listings[dir] = fis
+	}
+	return nil
+}
+
+// takeListing returns and forgets a cached listing.
+func (fs *SFTP) takeListing(p string) ([]os.FileInfo, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fis, ok := fs.listings[p]
+	if ok {
+		delete(fs.listings, p)
+	}
+	return fis, ok
+}
+
+// invalidate forgets the cached listing of the directory containing
+// p. If tree is true, listings of p and anything below it are also
+// forgotten.
+func (fs *SFTP) invalidate(p string, tree bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.listings) == 0 {
+		return
+	}
+	delete(fs.listings, string(Path(p).Dir()))
+	if !tree {
+		return
+	}
+	for dir := range fs.listings {
+		if dir == p || strings.HasPrefix(dir, p+"/") {
+			delete(fs.listings, dir)
+		}
+	}
+}
+
+// withHelper runs a function with the helper, or returns
+// remote.ErrNoHelper.
+func (fs *SFTP) withHelper(fun func(*remote.HelperClient) error) error {
+	hr, ok := fs.client.(remote.HelperRunner)
+	if !ok {
+		return remote.ErrNoHelper
+	}
+	return hr.WithHelper(fun)
+}
+
+// HashFile returns the SHA-256 hash of a file. With a helper, it is
+// computed on the server, and the contents are not transferred.
+func (fs *SFTP) HashFile(path Path) ([sha256.Size]byte, error) {
+	p := string(fs.root.Resolve(path))
+	var sum [sha256.Size]byte
+	err := fs.withHelper(func(h *remote.HelperClient) (err error) {
+		sum, err = h.HashFile(p)
+		return err
+	})
+	if !errors.Is(err, remote.ErrNoHelper) {
+		return sum, err
+	}
+
+	f, err := fs.client.Open(p)
+	if err != nil {
+		return sum, &os.PathError{Op: "sftp:open", Path: p, Err: err}
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, &os.PathError{Op: "sftp:read", Path: p, Err: err}
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
 func (fs *SFTP) Readlink(path Path) (Path, error) {
 	p := string(fs.root.Resolve(path))
 	linkdest, err := fs.client.ReadLink(p)
@@ -69,6 +191,7 @@ func (fs *SFTP) Stat() (FSInfo, error) {
 
 func (fs *SFTP) Create(path Path) (FileWriter, error) {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, false)
 	f, err := fs.client.Create(p)
 	if err != nil {
 		return nil, &os.PathError{Op: "sftp:create", Path: p, Err: err}
@@ -82,6 +205,7 @@ func (fs *SFTP) Keep(path Path) error {
 
 func (fs *SFTP) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, false)
 	if err := fs.client.Mkdir(p); err != nil {
 		if IsExist(err) {
 			return &os.PathError{Op: "sftp:mkdir", Path: p, Err: err}
@@ -107,6 +231,16 @@ func (fs *SFTP) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
 
 func (fs *SFTP) Link(oldpath Path, newpath Path) error {
 	oldp, newp := string(fs.root.Resolve(oldpath)), string(fs.root.Resolve(newpath))
+	fs.invalidate(newp, false)
+
+	// The helper batches concurrent links, as done by COW.Keep.
+	err := fs.withHelper(func(h *remote.HelperClient) error {
+		return h.Link(oldp, newp)
+	})
+	if !errors.Is(err, remote.ErrNoHelper) {
+		return err
+	}
+
 	if err := fs.client.Link(oldp, newp); err != nil {
 		return &os.LinkError{Op: "sftp:link", Old: oldp, New: newp, Err: err}
 	}
@@ -115,6 +249,7 @@ func (fs *SFTP) Link(oldpath Path, newpath Path) error {
 
 func (fs *SFTP) Symlink(oldpath Path, newpath Path) error {
 	oldp, newp := string(oldpath), string(fs.root.Resolve(newpath))
+	fs.invalidate(newp, false)
 	if err := fs.client.Symlink(oldp, newp); err != nil {
 		return &os.LinkError{Op: "sftp:symlink", Old: oldp, New: newp, Err: err}
 	}
@@ -123,6 +258,8 @@ func (fs *SFTP) Symlink(oldpath Path, newpath Path) error {
 
 func (fs *SFTP) Rename(oldpath Path, newpath Path) error {
 	oldp, newp := string(fs.root.Resolve(oldpath)), string(fs.root.Resolve(newpath))
+	fs.invalidate(oldp, true)
+	fs.invalidate(newp, true)
 	if err := fs.client.PosixRename(oldp, newp); err != nil {
 		return &os.LinkError{Op: "sftp:rename", Old: oldp, New: newp, Err: err}
 	}
@@ -130,6 +267,15 @@ func (fs *SFTP) Rename(oldpath Path, newpath Path) error {
 }
 
 func (fs *SFTP) RemoveAll(path Path) error {
+	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, true)
+	err := fs.withHelper(func(h *remote.HelperClient) error {
+		return h.RemoveAll(p)
+	})
+	if !errors.Is(err, remote.ErrNoHelper) {
+		return err
+	}
+
 	return fs.removeAll(context.Background(), path, semaphore.NewWeighted(64))
 }
 
@@ -180,6 +326,7 @@ func (fs *SFTP) removeAll(ctx context.Context, path Path, sem *semaphore.Weighte
 
 func (fs *SFTP) Remove(path Path) error {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, true)
 	if err := fs.client.Remove(p); err != nil {
 		return &os.PathError{Op: "sftp:remove", Path: p, Err: err}
 	}
@@ -188,6 +335,7 @@ func (fs *SFTP) Remove(path Path) error {
 
 func (fs *SFTP) Chmod(path Path, mode os.FileMode) error {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, false)
 	if err := fs.client.Chmod(p, mode); err != nil {
 		return &os.PathError{Op: "sftp:chmod", Path: p, Err: err}
 	}
@@ -196,6 +344,7 @@ func (fs *SFTP) Chmod(path Path, mode os.FileMode) error {
 
 func (fs *SFTP) Lchown(path Path, uid, gid int) error {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, false)
 	if err := fs.client.Chown(p, uid, gid); err != nil {
 		return &os.PathError{Op: "sftp:lchown", Path: p, Err: err}
 	}
@@ -204,6 +353,7 @@ func (fs *SFTP) Lchown(path Path, uid, gid int) error {
 
 func (fs *SFTP) Chtimes(path Path, atime time.Time, mtime time.Time) error {
 	p := string(fs.root.Resolve(path))
+	fs.invalidate(p, false)
 	if err := fs.client.Chtimes(p, atime, mtime); err != nil {
 		return &os.PathError{Op: "sftp:chtimes", Path: p, Err: err}
 	}
@@ -1,7 +1,9 @@
 package fs
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,6 +12,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/sftp"
+	"github.com/tommie/fisy/remote"
 	"github.com/tommie/fisy/remote/testutil"
 )
 
@@ -460,6 +464,152 @@ func TestSFTPChtimes(t *testing.T) {
 	}
 }
 
+func TestSFTPHashFile(t *testing.T) {
+	sfs, done := newTestSFTP(t)
+	defer done()
+
+	got, err := sfs.HashFile("file1")
+	if err != nil {
+		t.Fatalf("HashFile failed: %v", err)
+	}
+	if want := sha256.Sum256([]byte("content 1\n")); got != want {
+		t.Errorf("HashFile: got %x, want %x", got, want)
+	}
+}
+
+func TestSFTPHelper(t *testing.T) {
+	sfs, done := newTestSFTPWithHelper(t)
+	defer done()
+
+	readdir := func(path Path) []os.FileInfo {
+		t.Helper()
+
+		fr, err := sfs.Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		fis, err := fr.Readdir()
+		if err != nil {
+			t.Fatalf("Readdir failed: %v", err)
+		}
+		return fis
+	}
+
+	// Only the helper provides link counts, so they show whether
+	// a listing was prefetched.
+	hasLinkCounts := func(fis []os.FileInfo) bool {
+		for _, fi := range fis {
+			if attrs, _ := FileAttrsFromFileInfo(fi); attrs.NLinks == 0 {
+				return false
+			}
+		}
+		return len(fis) > 0
+	}
+
+	// Nothing is walked before Prefetch.
+	if got := readdir("dir1"); hasLinkCounts(got) {
+		t.Errorf("Readdir(dir1): got %v, want a plain listing", got)
+	}
+
+	if err := sfs.Prefetch("dir1"); err != nil {
+		t.Fatalf("Prefetch failed: %v", err)
+	}
+	if got := readdir(""); hasLinkCounts(got) {
+		t.Errorf("Readdir: got %v, want a plain listing outside the prefetched tree", got)
+	}
+	if got := readdir("dir1"); !hasLinkCounts(got) {
+		t.Errorf("Readdir(dir1): got %v, want link counts", got)
+	}
+
+	if err := sfs.Prefetch(""); err != nil {
+		t.Fatalf("Prefetch failed: %v", err)
+	}
+	if got, want := len(readdir("")), len(testTree()); got != want {
+		t.Errorf("Readdir: got %v entries, want %v", got, want)
+	}
+
+	// Listings from the walk are only used once, and don't see
+	// changes made by others.
+	other := filepath.Join(string(sfs.root), "dir1/dir-empty/other")
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if got := readdir("dir1/dir-empty"); len(got) != 0 {
+		t.Errorf("Readdir(dir1/dir-empty): got %v, want cached empty listing", got)
+	}
+	if got := readdir("dir1/dir-empty"); len(got) != 1 {
+		t.Errorf("Readdir(dir1/dir-empty): got %v, want one entry", got)
+	}
+
+	// Changes made through the file system invalidate listings.
+	if err := sfs.Symlink("file1", "dir-private/new"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if got := readdir("dir-private"); len(got) != 2 {
+		t.Errorf("Readdir(dir-private): got %v, want two entries", got)
+	}
+
+	got, err := sfs.HashFile("file1")
+	if err != nil {
+		t.Fatalf("HashFile failed: %v", err)
+	}
+	if want := sha256.Sum256([]byte("content 1\n")); got != want {
+		t.Errorf("HashFile: got %x, want %x", got, want)
+	}
+
+	if err := sfs.Link("file1", "dir1/link"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if err := sfs.Link("file1", "dir1/link"); !IsExist(err) {
+		t.Errorf("Link: got %v, want exists", err)
+	}
+
+	if err := sfs.RemoveAll("dir1"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(string(sfs.root), "dir1")); !os.IsNotExist(err) {
+		t.Errorf("Lstat: got %v, want not exist", err)
+	}
+}
+
+// A helperSFTPClient is an SFTP client with a helper.
+type helperSFTPClient struct {
+	*sftp.Client
+
+	helper *remote.HelperClient
+}
+
+func (c *helperSFTPClient) WithHelper(fun func(*remote.HelperClient) error) error {
+	return fun(c.helper)
+}
+
+func newTestSFTPWithHelper(t *testing.T) (*SFTP, func()) {
+	mc, stop, err := testutil.NewTestSFTPClient()
+	if err != nil {
+		t.Fatalf("NewTestSFTPClient failed: %v", err)
+	}
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go func() {
+		remote.Serve(sr, sw)
+		sw.Close()
+	}()
+	h, err := remote.NewHelperClient(cr, cw)
+	if err != nil {
+		t.Fatalf("NewHelperClient failed: %v", err)
+	}
+
+	fs, done := newTestLocal(t)
+	return NewSFTP(&helperSFTPClient{mc, h}, fs.root), func() {
+		h.Close()
+		stop()
+		done()
+	}
+}
+
 func newTestSFTP(t *testing.T) (*SFTP, func()) {
 	mc, stop, err := testutil.NewTestSFTPClient()
 	if err != nil {
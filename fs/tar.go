@@ -0,0 +1,296 @@
+package fs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Tar is a read-only file system backed by a tar archive. The archive
+// is indexed when created, and file contents are read directly from
+// it. Hardlinks in the archive share an inode number, so uploading
+// keeps them as hardlinks. Directories missing from the archive are
+// created with mode 0755. If a path occurs more than once, the last
+// entry wins, like when extracting. Symlinks are not followed. It is
+// safe for concurrent use.
+type Tar struct {
+	r    io.ReaderAt
+	root *tarInode
+}
+
+// A tarInode is a file, directory or symlink in a Tar.
+type tarInode struct {
+	hdr   *tar.Header
+	ino   uint64
+	nlink uint64
+
+	// offset is where the content of a regular file starts.
+	offset int64
+
+	// entries are the children of a directory.
+	entries map[string]*tarInode
+}
+
+// NewTar indexes an uncompressed tar archive of the given size.
+func NewTar(r io.ReaderAt, size int64) (*Tar, error) {
+	t := &Tar{r: r}
+	var nextInode uint64
+	newInode := func(hdr *tar.Header) *tarInode {
+		nextInode++
+		ino := &tarInode{hdr: hdr, ino: nextInode}
+		if hdr.Typeflag == tar.TypeDir {
+			ino.entries = map[string]*tarInode{}
+		}
+		return ino
+	}
+	t.root = newInode(&tar.Header{Typeflag: tar.TypeDir, Mode: 0755})
+
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := tarPath(hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		case tar.TypeLink:
+			target, err := t.lookup(tarPath(hdr.Linkname))
+			if err != nil {
+				return nil, &os.PathError{Op: "link", Path: string(name), Err: err}
+			}
+			if target.hdr.Typeflag == tar.TypeDir {
+				return nil, &os.PathError{Op: "link", Path: string(name), Err: syscall.EPERM}
+			}
+			if err := t.insert(name, target, newInode); err != nil {
+				return nil, err
+			}
+			continue
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return nil, &os.PathError{Op: "index", Path: string(name), Err: fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)}
+		}
+		if isSparseTarHeader(hdr) {
+			return nil, &os.PathError{Op: "index", Path: string(name), Err: fmt.Errorf("sparse files are not supported")}
+		}
+
+		ino := newInode(hdr)
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			// The reader has consumed the header blocks, but not
+			// the content.
+			ino.offset, err = sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if name == "." {
+			if hdr.Typeflag != tar.TypeDir {
+				return nil, &os.PathError{Op: "index", Path: hdr.Name, Err: syscall.ENOTDIR}
+			}
+			t.root.hdr = hdr
+			continue
+		}
+		if err := t.insert(name, ino, newInode); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// tarPath converts an archive member name to a Path. Leading slashes
+// and ".." components are dropped.
+func tarPath(name string) Path {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return Path(p[1:])
+}
+
+// isSparseTarHeader returns true if the entry is a GNU sparse file,
+// whose content isn't stored contiguously.
+func isSparseTarHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds an inode to the tree, creating missing parent
+// directories. A directory replacing a directory keeps its children.
+func (t *Tar) insert(name Path, ino *tarInode, newInode func(*tar.Header) *tarInode) error {
+	dir := t.root
+	comps := strings.Split(string(name), "/")
+	for i, comp := range comps[:len(comps)-1] {
+		child, ok := dir.entries[comp]
+		if !ok {
+			child = newInode(&tar.Header{
+				Name:     strings.Join(comps[:i+1], "/"),
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  ino.hdr.ModTime,
+			})
+			child.nlink = 1
+			dir.entries[comp] = child
+		} else if child.hdr.Typeflag != tar.TypeDir {
+			return &os.PathError{Op: "index", Path: string(name), Err: syscall.ENOTDIR}
+		}
+		dir = child
+	}
+
+	base := comps[len(comps)-1]
+	if old, ok := dir.entries[base]; ok {
+		if old.hdr.Typeflag == tar.TypeDir && ino.hdr.Typeflag == tar.TypeDir {
+			old.hdr = ino.hdr
+			return nil
+		}
+		old.nlink--
+	}
+	ino.nlink++
+	dir.entries[base] = ino
+	return nil
+}
+
+// lookup finds an inode, without following symlinks.
+func (t *Tar) lookup(name Path) (*tarInode, error) {
+	ino := t.root
+	if name == "." {
+		return ino, nil
+	}
+	for _, comp := range strings.Split(string(name), "/") {
+		if ino.hdr.Typeflag != tar.TypeDir {
+			return nil, syscall.ENOTDIR
+		}
+		child, ok := ino.entries[comp]
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		ino = child
+	}
+	return ino, nil
+}
+
+// Open opens a file or directory for reading.
+func (t *Tar) Open(path Path) (FileReader, error) {
+	ino, err := t.lookup(tarPath(string(path)))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: string(path), Err: err}
+	}
+	if ino.hdr.Typeflag == tar.TypeSymlink {
+		return nil, &os.PathError{Op: "open", Path: string(path), Err: syscall.ELOOP}
+	}
+	var r io.Reader
+	if ino.hdr.Typeflag == tar.TypeReg || ino.hdr.Typeflag == tar.TypeRegA {
+		r = io.NewSectionReader(t.r, ino.offset, ino.hdr.Size)
+	}
+	return &tarFileReader{ino: ino, path: path, r: r}, nil
+}
+
+type tarFileReader struct {
+	ino  *tarInode
+	path Path
+	r    io.Reader
+}
+
+func (fr *tarFileReader) Read(bs []byte) (int, error) {
+	if fr.ino.hdr.Typeflag == tar.TypeDir {
+		return 0, &os.PathError{Op: "read", Path: string(fr.path), Err: syscall.EISDIR}
+	}
+	if fr.r == nil {
+		return 0, io.EOF
+	}
+	return fr.r.Read(bs)
+}
+
+func (fr *tarFileReader) Close() error {
+	return nil
+}
+
+// Readdir returns all directory entries, if the file represents a
+// directory. The entries are sorted by name.
+func (fr *tarFileReader) Readdir() ([]os.FileInfo, error) {
+	if fr.ino.hdr.Typeflag != tar.TypeDir {
+		return nil, &os.PathError{Op: "readdirent", Path: string(fr.path), Err: syscall.ENOTDIR}
+	}
+
+	fis := make([]os.FileInfo, 0, len(fr.ino.entries))
+	for name, ino := range fr.ino.entries {
+		fis = append(fis, ino.fileInfo(name))
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// Stat returns metadata about the file.
+func (fr *tarFileReader) Stat() (os.FileInfo, error) {
+	return fr.ino.fileInfo(path.Base("/" + string(fr.path))), nil
+}
+
+// Readlink returns the contents of the given symlink.
+func (t *Tar) Readlink(path Path) (Path, error) {
+	ino, err := t.lookup(tarPath(string(path)))
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: err}
+	}
+	if ino.hdr.Typeflag != tar.TypeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: string(path), Err: syscall.EINVAL}
+	}
+	return Path(ino.hdr.Linkname), nil
+}
+
+// Stat returns information about this file system. Nothing can be
+// written, so there is no free space.
+func (t *Tar) Stat() (FSInfo, error) {
+	return FSInfo{FreeSpace: 0}, nil
+}
+
+// fileInfo returns the metadata of the inode. Sys returns a
+// *FileAttrs, so FileAttrsFromFileInfo works.
+func (ino *tarInode) fileInfo(name string) os.FileInfo {
+	atime := ino.hdr.AccessTime
+	if atime.IsZero() {
+		atime = ino.hdr.ModTime
+	}
+	fi := &memoryFileInfo{
+		name:  name,
+		mode:  ino.hdr.FileInfo().Mode(),
+		mtime: ino.hdr.ModTime,
+		attrs: FileAttrs{
+			UID:        ino.hdr.Uid,
+			GID:        ino.hdr.Gid,
+			AccessTime: atime,
+			NLinks:     ino.nlink,
+			Inode:      ino.ino,
+		},
+	}
+	switch ino.hdr.Typeflag {
+	case tar.TypeDir:
+		fi.attrs.NLinks = 2
+		for _, child := range ino.entries {
+			if child.hdr.Typeflag == tar.TypeDir {
+				fi.attrs.NLinks++
+			}
+		}
+	case tar.TypeSymlink:
+		fi.size = int64(len(ino.hdr.Linkname))
+	case tar.TypeReg, tar.TypeRegA:
+		fi.size = ino.hdr.Size
+	}
+	return fi
+}
@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var tarIsAReadableFileSystem ReadableFileSystem = &Tar{}
+
+// newTestTar returns a Tar of an archive with the given entries. The
+// content of regular files is their Linkname.
+func newTestTar(t *testing.T, hdrs ...*tar.Header) *Tar {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var content string
+		if hdr.Typeflag == tar.TypeReg {
+			content = hdr.Linkname
+			hdr.Linkname = ""
+			hdr.Size = int64(len(content))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader failed: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	tfs, err := NewTar(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewTar failed: %v", err)
+	}
+	return tfs
+}
+
+func TestTarOpen(t *testing.T) {
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	tfs := newTestTar(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0700},
+		&tar.Header{Name: "./a/file", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1001, ModTime: mtime, Linkname: "hello"},
+		&tar.Header{Name: "./a/link", Typeflag: tar.TypeLink, Linkname: "a/file"},
+		&tar.Header{Name: "./b", Typeflag: tar.TypeSymlink, Linkname: "a/file"},
+		&tar.Header{Name: "./c", Typeflag: tar.TypeReg, Mode: 0600, Linkname: "old"},
+		&tar.Header{Name: "../c", Typeflag: tar.TypeReg, Mode: 0600, Linkname: "new"},
+	)
+
+	t.Run("root", func(t *testing.T) {
+		fr, err := tfs.Open(".")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		fi, err := fr.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if want := os.ModeDir | 0700; fi.Mode() != want {
+			t.Errorf("Stat Mode: got %v, want %v", fi.Mode(), want)
+		}
+
+		fis, err := fr.Readdir()
+		if err != nil {
+			t.Fatalf("Readdir failed: %v", err)
+		}
+		var got []string
+		for _, fi := range fis {
+			got = append(got, fi.Name())
+		}
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Readdir: got %v, want %v", got, want)
+		}
+		if fis[0].Mode() != os.ModeDir|0755 {
+			t.Errorf("Readdir(a) Mode: got %v, want %v", fis[0].Mode(), os.ModeDir|0755)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		fr, err := tfs.Open("a/file")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(bs) != "hello" {
+			t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+		}
+
+		fi, err := fr.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		attrs, ok := FileAttrsFromFileInfo(fi)
+		if !ok {
+			t.Fatalf("FileAttrsFromFileInfo failed")
+		}
+		if attrs.UID != 1000 || attrs.GID != 1001 || attrs.NLinks != 2 {
+			t.Errorf("FileAttrsFromFileInfo: got %+v, want UID 1000, GID 1001, NLinks 2", attrs)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("Stat ModTime: got %v, want %v", fi.ModTime(), mtime)
+		}
+	})
+
+	t.Run("hardlink", func(t *testing.T) {
+		fr, err := tfs.Open("a/link")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(bs) != "hello" {
+			t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+		}
+
+		dr, err := tfs.Open("a")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer dr.Close()
+		fis, err := dr.Readdir()
+		if err != nil {
+			t.Fatalf("Readdir failed: %v", err)
+		}
+		a, _ := FileAttrsFromFileInfo(fis[0])
+		b, _ := FileAttrsFromFileInfo(fis[1])
+		if a.Inode != b.Inode {
+			t.Errorf("Readdir Inode: got %v and %v, want equal", a.Inode, b.Inode)
+		}
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		fr, err := tfs.Open("c")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(bs) != "new" {
+			t.Errorf("ReadAll: got %q, want %q", bs, "new")
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := tfs.Open("missing"); !os.IsNotExist(err) {
+			t.Errorf("Open error: got %v, want ENOENT", err)
+		}
+	})
+}
+
+func TestTarReadlink(t *testing.T) {
+	tfs := newTestTar(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "target"},
+		&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0600},
+	)
+
+	got, err := tfs.Readlink("a")
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if got != "target" {
+		t.Errorf("Readlink: got %q, want %q", got, "target")
+	}
+
+	if _, err := tfs.Readlink("b"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Readlink(b) error: got %v, want EINVAL", err)
+	}
+}
+
+func TestNewTarMissingHardlink(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "missing"}); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := NewTar(bytes.NewReader(buf.Bytes()), int64(buf.Len())); !os.IsNotExist(err) {
+		t.Errorf("NewTar error: got %v, want ENOENT", err)
+	}
+}
@@ -0,0 +1,373 @@
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+)
+
+// webDAVNamespace is the XML namespace of the properties holding file
+// attributes.
+const webDAVNamespace = "https://github.com/tommie/fisy/"
+
+// webDAVProps are the names of the attribute properties.
+var webDAVProps = func() []xml.Name {
+	var names []xml.Name
+	for k := range (&objectAttrs{}).values("") {
+		names = append(names, xml.Name{Space: webDAVNamespace, Local: k})
+	}
+	return names
+}()
+
+// webDAVQuotaAvailable is the RFC 4331 property of free space.
+var webDAVQuotaAvailable = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+
+// A WebDAV stores files on a WebDAV server. Modes, ownership and times
+// are stored as dead properties, which the server must support. A
+// symlink is a file containing the target.
+//
+// There are no hardlinks, so Link copies the file on the server.
+// Symlink creates a temporary file, and moves it into place without
+// overwriting, so COW locking works.
+type WebDAV struct {
+	client *remote.WebDAVClient
+}
+
+// NewWebDAV creates a new file system rooted at the client's base
+// URL.
+func NewWebDAV(client *remote.WebDAVClient) *WebDAV {
+	return &WebDAV{client: client}
+}
+
+// davPath returns the client path of a file.
+func davPath(p Path) string {
+	return strings.TrimPrefix(path.Clean("/"+string(p)), "/")
+}
+
+// stat returns information about a file.
+func (fs *WebDAV) stat(ctx context.Context, p Path) (*objectFileInfo, error) {
+	ress, err := fs.client.PropFind(ctx, davPath(p), 0, webDAVProps)
+	if err != nil {
+		return nil, err
+	}
+	return newWebDAVFileInfo(p, &ress[0]), nil
+}
+
+func (fs *WebDAV) Open(path Path) (FileReader, error) {
+	ctx := context.Background()
+	dp := davPath(path)
+	fi, err := fs.stat(ctx, path)
+	if err != nil {
+		return nil, &os.PathError{Op: "webdav:open", Path: dp, Err: err}
+	}
+	switch {
+	case fi.mode&os.ModeSymlink != 0:
+		return nil, &os.PathError{Op: "webdav:open", Path: dp, Err: syscall.ELOOP}
+	case fi.IsDir():
+		return &webDAVFileReader{ReadCloser: ioutil.NopCloser(strings.NewReader("")), fs: fs, path: path, fi: fi}, nil
+	}
+
+	rc, err := fs.client.Get(ctx, dp)
+	if err != nil {
+		return nil, &os.PathError{Op: "webdav:open", Path: dp, Err: err}
+	}
+	return &webDAVFileReader{ReadCloser: rc, fs: fs, path: path, fi: fi}, nil
+}
+
+type webDAVFileReader struct {
+	io.ReadCloser
+
+	fs   *WebDAV
+	path Path
+	fi   *objectFileInfo
+}
+
+func (fr *webDAVFileReader) Readdir() ([]os.FileInfo, error) {
+	dp := davPath(fr.path)
+	if !fr.fi.IsDir() {
+		return nil, &os.PathError{Op: "webdav:readdir", Path: dp, Err: syscall.ENOTDIR}
+	}
+	ress, err := fr.fs.client.PropFind(context.Background(), dp, 1, webDAVProps)
+	if err != nil {
+		return nil, &os.PathError{Op: "webdav:readdir", Path: dp, Err: err}
+	}
+	fis := make([]os.FileInfo, 0, len(ress)-1)
+	for i := range ress[1:] {
+		res := &ress[i+1]
+		fis = append(fis, newWebDAVFileInfo(Path(path.Base("/"+res.Path)), res))
+	}
+	return fis, nil
+}
+
+func (fr *webDAVFileReader) Stat() (os.FileInfo, error) {
+	return fr.fi, nil
+}
+
+func (fs *WebDAV) Readlink(path Path) (Path, error) {
+	ctx := context.Background()
+	dp := davPath(path)
+	fi, err := fs.stat(ctx, path)
+	if err != nil {
+		return "", &os.PathError{Op: "webdav:readlink", Path: dp, Err: err}
+	}
+	if fi.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "webdav:readlink", Path: dp, Err: syscall.EINVAL}
+	}
+	rc, err := fs.client.Get(ctx, dp)
+	if err != nil {
+		return "", &os.PathError{Op: "webdav:readlink", Path: dp, Err: err}
+	}
+	defer rc.Close()
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", &os.PathError{Op: "webdav:readlink", Path: dp, Err: err}
+	}
+	return Path(bs), nil
+}
+
+// Stat returns information about this file system. Servers not
+// reporting quotas are assumed to have unlimited space.
+func (fs *WebDAV) Stat() (FSInfo, error) {
+	ress, err := fs.client.PropFind(context.Background(), "", 0, []xml.Name{webDAVQuotaAvailable})
+	if err != nil {
+		return FSInfo{}, err
+	}
+	if v, err := strconv.ParseUint(strings.TrimSpace(ress[0].Props[webDAVQuotaAvailable]), 10, 64); err == nil {
+		return FSInfo{FreeSpace: v}, nil
+	}
+	return FSInfo{FreeSpace: math.MaxUint64}, nil
+}
+
+// Create opens a file for writing. The contents are streamed to the
+// server, and the attributes are set when the file is closed.
+func (fs *WebDAV) Create(path Path) (FileWriter, error) {
+	dp := davPath(path)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := fs.client.Put(context.Background(), dp, pr)
+		// Unblocks writes if the request failed early.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	now := time.Now()
+	return &webDAVFileWriter{
+		PipeWriter: pw,
+		fs:         fs,
+		path:       dp,
+		done:       done,
+		attrs:      objectAttrs{mode: 0644, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now},
+	}, nil
+}
+
+type webDAVFileWriter struct {
+	*io.PipeWriter
+
+	fs    *WebDAV
+	path  string
+	done  <-chan error
+	attrs objectAttrs
+}
+
+func (fw *webDAVFileWriter) Close() error {
+	fw.PipeWriter.Close()
+	if err := <-fw.done; err != nil {
+		return &os.PathError{Op: "webdav:close", Path: fw.path, Err: err}
+	}
+	if err := fw.fs.client.PropPatch(context.Background(), fw.path, webDAVPropValues(&fw.attrs)); err != nil {
+		return &os.PathError{Op: "webdav:close", Path: fw.path, Err: err}
+	}
+	return nil
+}
+
+func (fw *webDAVFileWriter) Chmod(mode os.FileMode) error {
+	fw.attrs.mode = fw.attrs.mode&os.ModeType | mode&^os.ModeType
+	return nil
+}
+
+func (fw *webDAVFileWriter) Chown(uid, gid int) error {
+	fw.attrs.chown(uid, gid)
+	return nil
+}
+
+func (fs *WebDAV) Keep(path Path) error {
+	return nil
+}
+
+func (fs *WebDAV) Mkdir(path Path, mode os.FileMode, uid, gid int) error {
+	ctx := context.Background()
+	dp := davPath(path)
+	if err := fs.client.Mkcol(ctx, dp); err != nil {
+		var daverr *remote.WebDAVError
+		if errors.As(err, &daverr) && daverr.StatusCode == http.StatusMethodNotAllowed {
+			err = os.ErrExist
+		}
+		return &os.PathError{Op: "webdav:mkdir", Path: dp, Err: err}
+	}
+
+	now := time.Now()
+	attrs := objectAttrs{mode: os.ModeDir | mode&^os.ModeType, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now}
+	attrs.chown(uid, gid)
+	if err := fs.client.PropPatch(ctx, dp, webDAVPropValues(&attrs)); err != nil {
+		return &os.PathError{Op: "webdav:mkdir", Path: dp, Err: err}
+	}
+	return nil
+}
+
+// Link copies the file on the server, since there are no hardlinks.
+func (fs *WebDAV) Link(oldpath Path, newpath Path) error {
+	ctx := context.Background()
+	oldp, newp := davPath(oldpath), davPath(newpath)
+	fi, err := fs.stat(ctx, oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "webdav:link", Old: oldp, New: newp, Err: err}
+	}
+	if fi.IsDir() {
+		// Like link(2), so COW.Keep falls back to Mkdir.
+		return &os.LinkError{Op: "webdav:link", Old: oldp, New: newp, Err: syscall.EPERM}
+	}
+	if err := fs.client.Copy(ctx, oldp, newp, false); err != nil {
+		return &os.LinkError{Op: "webdav:link", Old: oldp, New: newp, Err: err}
+	}
+	return nil
+}
+
+func (fs *WebDAV) Symlink(oldpath Path, newpath Path) error {
+	ctx := context.Background()
+	newp := davPath(newpath)
+	var rnd [8]byte
+	if _, err := io.ReadFull(rand.Reader, rnd[:]); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(newp), ".fisy-symlink-"+hex.EncodeToString(rnd[:]))
+
+	now := time.Now()
+	attrs := objectAttrs{mode: os.ModeSymlink | 0777, uid: os.Getuid(), gid: os.Getgid(), atime: now, mtime: now}
+	err := fs.client.Put(ctx, tmp, strings.NewReader(string(oldpath)))
+	if err == nil {
+		err = fs.client.PropPatch(ctx, tmp, webDAVPropValues(&attrs))
+		if err == nil {
+			err = fs.client.Move(ctx, tmp, newp, false)
+		}
+		if err != nil {
+			fs.client.Delete(ctx, tmp)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "webdav:symlink", Old: string(oldpath), New: newp, Err: err}
+	}
+	return nil
+}
+
+func (fs *WebDAV) Rename(oldpath Path, newpath Path) error {
+	oldp, newp := davPath(oldpath), davPath(newpath)
+	if err := fs.client.Move(context.Background(), oldp, newp, true); err != nil {
+		return &os.LinkError{Op: "webdav:rename", Old: oldp, New: newp, Err: err}
+	}
+	return nil
+}
+
+func (fs *WebDAV) RemoveAll(path Path) error {
+	dp := davPath(path)
+	if err := fs.client.Delete(context.Background(), dp); err != nil && !IsNotExist(err) {
+		return &os.PathError{Op: "webdav:removeall", Path: dp, Err: err}
+	}
+	return nil
+}
+
+func (fs *WebDAV) Remove(path Path) error {
+	ctx := context.Background()
+	dp := davPath(path)
+	ress, err := fs.client.PropFind(ctx, dp, 1, nil)
+	if err != nil {
+		return &os.PathError{Op: "webdav:remove", Path: dp, Err: err}
+	}
+	if len(ress) > 1 {
+		return &os.PathError{Op: "webdav:remove", Path: dp, Err: syscall.ENOTEMPTY}
+	}
+	if err := fs.client.Delete(ctx, dp); err != nil {
+		return &os.PathError{Op: "webdav:remove", Path: dp, Err: err}
+	}
+	return nil
+}
+
+func (fs *WebDAV) Chmod(path Path, mode os.FileMode) error {
+	return fs.updateAttrs("webdav:chmod", path, func(attrs *objectAttrs) {
+		attrs.mode = attrs.mode&os.ModeType | mode&^os.ModeType
+	})
+}
+
+func (fs *WebDAV) Lchown(path Path, uid, gid int) error {
+	return fs.updateAttrs("webdav:lchown", path, func(attrs *objectAttrs) {
+		attrs.chown(uid, gid)
+	})
+}
+
+func (fs *WebDAV) Chtimes(path Path, atime time.Time, mtime time.Time) error {
+	return fs.updateAttrs("webdav:chtimes", path, func(attrs *objectAttrs) {
+		attrs.atime = atime
+		attrs.mtime = mtime
+	})
+}
+
+// updateAttrs modifies the attribute properties of a file.
+func (fs *WebDAV) updateAttrs(op string, path Path, fun func(*objectAttrs)) error {
+	ctx := context.Background()
+	dp := davPath(path)
+	fi, err := fs.stat(ctx, path)
+	if err != nil {
+		return &os.PathError{Op: op, Path: dp, Err: err}
+	}
+	attrs := fi.attrs
+	fun(&attrs)
+	if err := fs.client.PropPatch(ctx, dp, webDAVPropValues(&attrs)); err != nil {
+		return &os.PathError{Op: op, Path: dp, Err: err}
+	}
+	return nil
+}
+
+// webDAVPropValues returns the attribute properties.
+func webDAVPropValues(attrs *objectAttrs) map[xml.Name]string {
+	props := map[xml.Name]string{}
+	for k, v := range attrs.values("") {
+		props[xml.Name{Space: webDAVNamespace, Local: k}] = v
+	}
+	return props
+}
+
+// newWebDAVFileInfo describes a resource. Files not written by WebDAV
+// are owned by root.
+func newWebDAVFileInfo(p Path, res *remote.WebDAVResource) *objectFileInfo {
+	vals := map[string]string{}
+	for name, v := range res.Props {
+		if name.Space == webDAVNamespace {
+			vals[name.Local] = v
+		}
+	}
+	def := objectAttrs{mode: 0644, atime: res.LastModified, mtime: res.LastModified}
+	if res.IsCollection {
+		def.mode = os.ModeDir | 0755
+	}
+	attrs := parseObjectAttrs(vals, "", def)
+	if res.IsCollection {
+		attrs.mode = os.ModeDir | attrs.mode&^os.ModeType
+		return newObjectFileInfo(p, 0, attrs)
+	}
+	// Only collections can be directories.
+	attrs.mode = attrs.mode &^ os.ModeDir
+	return newObjectFileInfo(p, res.Size, attrs)
+}
@@ -0,0 +1,269 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/remote"
+	"golang.org/x/net/webdav"
+)
+
+var webDAVIsAWriteableFileSystem WriteableFileSystem = &WebDAV{}
+
+// newTestWebDAV returns a WebDAV served from memory, below /dav.
+func newTestWebDAV(t *testing.T) *WebDAV {
+	t.Helper()
+
+	s := httptest.NewServer(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL + "/dav/")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return NewWebDAV(remote.NewWebDAVClient(u))
+}
+
+// readWebDAVDir returns the sorted names in a directory.
+func readWebDAVDir(t *testing.T, dfs *WebDAV, path Path) ([]string, []os.FileInfo) {
+	t.Helper()
+
+	fr, err := dfs.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	fis, err := fr.Readdir()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, fis
+}
+
+func TestWebDAV(t *testing.T) {
+	dfs := newTestWebDAV(t)
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := dfs.Mkdir("a", 0750, 1000, 1001); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := dfs.Mkdir("a", 0750, -1, -1); !IsExist(err) {
+		t.Errorf("Mkdir error: got %v, want EEXIST", err)
+	}
+	if err := dfs.Mkdir("missing/a", 0750, -1, -1); !IsNotExist(err) {
+		t.Errorf("Mkdir error: got %v, want ENOENT", err)
+	}
+	fw, err := dfs.Create("a/file")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, "hello"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Chmod(0640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := dfs.Chtimes("a/file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := dfs.Lchown("a/file", 1000, -1); err != nil {
+		t.Fatalf("Lchown failed: %v", err)
+	}
+	if err := dfs.Symlink("a/file", "b"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := dfs.Symlink("other", "b"); !IsExist(err) {
+		t.Errorf("Symlink error: got %v, want EEXIST", err)
+	}
+	if err := dfs.Link("a/file", "c"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	t.Run("readdir", func(t *testing.T) {
+		names, fis := readWebDAVDir(t, dfs, ".")
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("Readdir: got %v, want %v", names, want)
+		}
+		if want := os.ModeDir | 0750; fis[0].Mode() != want {
+			t.Errorf("Readdir(a) Mode: got %v, want %v", fis[0].Mode(), want)
+		}
+		if want := os.ModeSymlink | 0777; fis[1].Mode() != want {
+			t.Errorf("Readdir(b) Mode: got %v, want %v", fis[1].Mode(), want)
+		}
+		if fis[2].Mode() != 0640 || fis[2].Size() != 5 || !fis[2].ModTime().Equal(mtime) {
+			t.Errorf("Readdir(c): got %v %v %v, want %v %v %v", fis[2].Mode(), fis[2].Size(), fis[2].ModTime(), os.FileMode(0640), 5, mtime)
+		}
+		attrs, ok := FileAttrsFromFileInfo(fis[0])
+		if !ok {
+			t.Fatalf("FileAttrsFromFileInfo failed")
+		}
+		if attrs.UID != 1000 || attrs.GID != 1001 {
+			t.Errorf("FileAttrsFromFileInfo: got %v:%v, want %v:%v", attrs.UID, attrs.GID, 1000, 1001)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		fr, err := dfs.Open("a/file")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer fr.Close()
+		bs, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(bs) != "hello" {
+			t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+		}
+
+		if _, err := dfs.Open("missing"); !IsNotExist(err) {
+			t.Errorf("Open error: got %v, want ENOENT", err)
+		}
+		if _, err := dfs.Open("b"); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("Open(b) error: got %v, want ELOOP", err)
+		}
+	})
+
+	t.Run("readlink", func(t *testing.T) {
+		got, err := dfs.Readlink("b")
+		if err != nil {
+			t.Fatalf("Readlink failed: %v", err)
+		}
+		if got != "a/file" {
+			t.Errorf("Readlink: got %q, want %q", got, "a/file")
+		}
+		if _, err := dfs.Readlink("c"); !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("Readlink(c) error: got %v, want EINVAL", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := dfs.Remove("a"); !errors.Is(err, syscall.ENOTEMPTY) {
+			t.Errorf("Remove error: got %v, want ENOTEMPTY", err)
+		}
+		if err := dfs.Rename("a", "d"); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+		if names, _ := readWebDAVDir(t, dfs, "d"); !reflect.DeepEqual(names, []string{"file"}) {
+			t.Errorf("Readdir(d): got %v, want [file]", names)
+		}
+		if err := dfs.RemoveAll("d"); err != nil {
+			t.Fatalf("RemoveAll failed: %v", err)
+		}
+		if err := dfs.RemoveAll("d"); err != nil {
+			t.Errorf("RemoveAll(missing) failed: %v", err)
+		}
+		if err := dfs.Remove("c"); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+		if names, _ := readWebDAVDir(t, dfs, "."); !reflect.DeepEqual(names, []string{"b"}) {
+			t.Errorf("Readdir: got %v, want [b]", names)
+		}
+	})
+}
+
+func TestWebDAVCOW(t *testing.T) {
+	dfs := newTestWebDAV(t)
+
+	cow, err := NewCOW(dfs, "host", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if err := cow.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	fw, err := cow.Create("a/file")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, "hello"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fw, err = cow.Create("a/gone")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	cow, err = NewCOW(dfs, "host", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	if _, err := NewCOW(dfs, "host", time.Now()); err == nil {
+		t.Errorf("NewCOW: got %v, want locked", err)
+	}
+	// The directory is unchanged, but a/gone was removed. Keeping
+	// it must not copy the old members.
+	if err := cow.Keep("a"); err != nil {
+		t.Fatalf("Keep failed: %v", err)
+	}
+	if err := cow.Keep("a/file"); err != nil {
+		t.Fatalf("Keep failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	snap, err := OpenCOWSnapshot(dfs, "host", "latest")
+	if err != nil {
+		t.Fatalf("OpenCOWSnapshot failed: %v", err)
+	}
+	dr, err := snap.Open("a")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fis, err := dr.Readdir()
+	dr.Close()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if want := []string{"file"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdir: got %v, want %v", names, want)
+	}
+
+	fr, err := snap.Open("a/file")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(bs) != "hello" {
+		t.Errorf("ReadAll: got %q, want %q", bs, "hello")
+	}
+}
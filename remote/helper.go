@@ -0,0 +1,392 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNoHelper signals that a connection has no "fisy serve" helper,
+// so the caller should use plain SFTP.
+var ErrNoHelper = errors.New("no remote helper")
+
+// helperVersion is the protocol version. It is sent by the server
+// when it starts, and must match.
+const helperVersion = 1
+
+// maxLinkBatch is the maximum number of hardlinks in one request.
+const maxLinkBatch = 1024
+
+// A helperRequest is sent from the client to the server. Requests
+// are answered concurrently, and responses are matched by ID.
+type helperRequest struct {
+	ID    uint64
+	Op    string
+	Path  string
+	Links []helperLink
+}
+
+// A helperLink is one hardlink in a "link" request.
+type helperLink struct {
+	Old, New string
+}
+
+// A helperResponse is sent from the server to the client. A "walk"
+// request gets a stream of responses, all but the last having More
+// set. The first message from the server has ID zero, and only the
+// Version set.
+type helperResponse struct {
+	ID      uint64
+	Version int
+	More    bool
+	Err     helperError
+
+	Dirs     []helperDir
+	Hash     []byte
+	LinkErrs []helperError
+}
+
+// A helperDir is the listing of a directory in a "walk" response.
+type helperDir struct {
+	Path    string
+	Entries []*helperFileInfo
+}
+
+// A helperError is an error returned by the server. An empty Msg
+// means success. The errno is kept, so os.IsNotExist and friends
+// work on the client.
+type helperError struct {
+	Msg   string
+	Errno int
+}
+
+// newHelperError converts an error for sending to the client.
+func newHelperError(err error) helperError {
+	if err == nil {
+		return helperError{}
+	}
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	return helperError{Msg: err.Error(), Errno: int(errno)}
+}
+
+// err returns the error, or nil.
+func (e *helperError) err() error {
+	switch {
+	case e.Msg == "":
+		return nil
+	case e.Errno != 0:
+		return syscall.Errno(e.Errno)
+	default:
+		return errors.New(e.Msg)
+	}
+}
+
+// A FileStat is the system-specific part of a FileInfo returned by a
+// helper. Unlike sftp.FileStat, it includes the link count and inode
+// number.
+type FileStat struct {
+	UID    uint32
+	GID    uint32
+	Atime  time.Time
+	NLinks uint64
+	Inode  uint64
+}
+
+// A helperFileInfo is an os.FileInfo sent by the server. Its Sys
+// function returns a *FileStat.
+type helperFileInfo struct {
+	FName    string
+	FSize    int64
+	FMode    os.FileMode
+	FModTime time.Time
+	Stat     FileStat
+}
+
+func (fi *helperFileInfo) Name() string       { return fi.FName }
+func (fi *helperFileInfo) Size() int64        { return fi.FSize }
+func (fi *helperFileInfo) Mode() os.FileMode  { return fi.FMode }
+func (fi *helperFileInfo) ModTime() time.Time { return fi.FModTime }
+func (fi *helperFileInfo) IsDir() bool        { return fi.FMode.IsDir() }
+func (fi *helperFileInfo) Sys() interface{}   { return &fi.Stat }
+
+// A HelperSFTPClient is a connection that may have a helper. Helper
+// returns nil if it doesn't.
+type HelperSFTPClient interface {
+	Helper() *HelperClient
+}
+
+// A HelperRunner runs functions with the helper of a connection.
+// ReconnectingSFTPClient implements it.
+type HelperRunner interface {
+	// WithHelper calls the function with a helper, or returns
+	// ErrNoHelper.
+	WithHelper(fun func(*HelperClient) error) error
+}
+
+// A HelperClient talks to a "fisy serve" process, usually over an SSH
+// exec channel. It gives fast paths for operations that would take
+// many SFTP round trips. It is safe for concurrent use.
+type HelperClient struct {
+	w io.Closer
+
+	encMu sync.Mutex
+	enc   *gob.Encoder
+
+	mu      sync.Mutex
+	pending map[uint64]chan *helperResponse
+	nextID  uint64
+	err     error
+
+	linkMu  sync.Mutex
+	links   []*pendingLink
+	linking bool
+}
+
+// A pendingLink is a hardlink waiting to be sent in a batch.
+type pendingLink struct {
+	helperLink
+	errc chan error
+}
+
+// NewHelperClient waits for the server to start, and returns a
+// client. The error wraps ErrNoHelper if the server didn't start,
+// which is the case if the command doesn't exist. The caller has to
+// bound the wait, e.g. by closing r.
+func NewHelperClient(r io.Reader, w io.WriteCloser) (*HelperClient, error) {
+	dec := gob.NewDecoder(r)
+	var hello helperResponse
+	if err := dec.Decode(&hello); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoHelper, err)
+	}
+	if hello.Version != helperVersion {
+		return nil, fmt.Errorf("%w: unsupported protocol version %d", ErrNoHelper, hello.Version)
+	}
+
+	c := &HelperClient{
+		w:       w,
+		enc:     gob.NewEncoder(w),
+		pending: map[uint64]chan *helperResponse{},
+	}
+	go c.readLoop(dec)
+	return c, nil
+}
+
+// Close closes the request stream, which makes the server exit.
+// In-flight requests fail once the server is gone.
+func (c *HelperClient) Close() error {
+	return c.w.Close()
+}
+
+// readLoop dispatches responses until the stream fails. It is the
+// only one closing response channels.
+func (c *HelperClient) readLoop(dec *gob.Decoder) {
+	for {
+		var resp helperResponse
+		if err := dec.Decode(&resp); err != nil {
+			if err == io.EOF {
+				// The server can't end the stream while
+				// requests are outstanding.
+				err = io.ErrUnexpectedEOF
+			}
+			c.fail(&ConnectionError{Err: fmt.Errorf("remote helper: %w", err)})
+			return
+		}
+
+		c.mu.Lock()
+		ch := c.pending[resp.ID]
+		if !resp.More {
+			delete(c.pending, resp.ID)
+		}
+		c.mu.Unlock()
+
+		if ch != nil {
+			ch <- &resp
+			if !resp.More {
+				close(ch)
+			}
+		}
+	}
+}
+
+// fail makes all outstanding and future requests return err.
+func (c *HelperClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// start sends a request, and returns the channel its responses
+// arrive on. The channel is closed after the last response, or if the
+// connection fails.
+func (c *HelperClient) start(req *helperRequest) (<-chan *helperResponse, error) {
+	ch := make(chan *helperResponse, 16)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	c.encMu.Lock()
+	err := c.enc.Encode(req)
+	c.encMu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return nil, &ConnectionError{Err: fmt.Errorf("remote helper: %w", err)}
+	}
+	return ch, nil
+}
+
+// connErr returns why the connection failed.
+func (c *HelperClient) connErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// call sends a request with a single response.
+func (c *HelperClient) call(req *helperRequest) (*helperResponse, error) {
+	ch, err := c.start(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := <-ch
+	if !ok {
+		return nil, c.connErr()
+	}
+	return resp, nil
+}
+
+// Walk lists a directory tree on the server, without following
+// symlinks. The function is called with the path and entries of each
+// directory, on the form "path/subdir". Directories that can't be
+// read are skipped.
+func (c *HelperClient) Walk(path string, fun func(dir string, fis []os.FileInfo)) error {
+	ch, err := c.start(&helperRequest{Op: "walk", Path: path})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, ok := <-ch
+		if !ok {
+			return c.connErr()
+		}
+		if err := resp.Err.err(); err != nil {
+			return &os.PathError{Op: "serve:walk", Path: path, Err: err}
+		}
+		for _, d := range resp.Dirs {
+			fis := make([]os.FileInfo, len(d.Entries))
+			for i, fi := range d.Entries {
+				fis[i] = fi
+			}
+			fun(d.Path, fis)
+		}
+		if !resp.More {
+			return nil
+		}
+	}
+}
+
+// HashFile returns the SHA-256 hash of a file, computed on the
+// server.
+func (c *HelperClient) HashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	resp, err := c.call(&helperRequest{Op: "hash", Path: path})
+	if err != nil {
+		return sum, err
+	}
+	if err := resp.Err.err(); err != nil {
+		return sum, &os.PathError{Op: "serve:hash", Path: path, Err: err}
+	}
+	copy(sum[:], resp.Hash)
+	return sum, nil
+}
+
+// RemoveAll removes a file or directory tree on the server.
+func (c *HelperClient) RemoveAll(path string) error {
+	resp, err := c.call(&helperRequest{Op: "removeall", Path: path})
+	if err != nil {
+		return err
+	}
+	if err := resp.Err.err(); err != nil {
+		return &os.PathError{Op: "serve:removeall", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Link creates a hardlink. Concurrent calls are batched: while one
+// request is in flight, new links are queued, and sent together when
+// it completes.
+func (c *HelperClient) Link(oldname, newname string) error {
+	pl := &pendingLink{helperLink: helperLink{Old: oldname, New: newname}, errc: make(chan error, 1)}
+
+	c.linkMu.Lock()
+	c.links = append(c.links, pl)
+	start := !c.linking
+	c.linking = true
+	c.linkMu.Unlock()
+
+	if start {
+		go c.sendLinks()
+	}
+	return <-pl.errc
+}
+
+// sendLinks sends batches of queued hardlinks until the queue is
+// empty.
+func (c *HelperClient) sendLinks() {
+	for {
+		c.linkMu.Lock()
+		batch := c.links
+		if len(batch) > maxLinkBatch {
+			batch = batch[:maxLinkBatch]
+		}
+		c.links = c.links[len(batch):]
+		if len(batch) == 0 {
+			c.links = nil
+			c.linking = false
+			c.linkMu.Unlock()
+			return
+		}
+		c.linkMu.Unlock()
+
+		req := &helperRequest{Op: "link", Links: make([]helperLink, len(batch))}
+		for i, pl := range batch {
+			req.Links[i] = pl.helperLink
+		}
+		resp, err := c.call(req)
+		if err == nil && len(resp.LinkErrs) != len(batch) {
+			err = resp.Err.err()
+			if err == nil {
+				err = fmt.Errorf("remote helper: got %d link results, want %d", len(resp.LinkErrs), len(batch))
+			}
+		}
+		for i, pl := range batch {
+			if err != nil {
+				pl.errc <- err
+			} else if lerr := resp.LinkErrs[i].err(); lerr != nil {
+				pl.errc <- &os.LinkError{Op: "serve:link", Old: pl.Old, New: pl.New, Err: lerr}
+			} else {
+				pl.errc <- nil
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestHelperClientWalk(t *testing.T) {
+	h, dir, done := newTestHelper(t)
+	defer done()
+
+	for _, p := range []string{"a/b", "a/c", "d"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0700); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a/b/file"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	got := map[string][]string{}
+	err := h.Walk(dir, func(d string, fis []os.FileInfo) {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		got[strings.TrimPrefix(d, dir)] = names
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	want := map[string][]string{
+		"":     {"a", "d"},
+		"/a":   {"b", "c"},
+		"/a/b": {"file"},
+		"/a/c": nil,
+		"/d":   nil,
+	}
+	if len(got) != len(want) {
+		t.Errorf("Walk: got %v, want %v", got, want)
+	}
+	for d, names := range want {
+		if strings.Join(got[d], ",") != strings.Join(names, ",") {
+			t.Errorf("Walk %q: got %v, want %v", d, got[d], names)
+		}
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		err := h.Walk(filepath.Join(dir, "missing"), func(string, []os.FileInfo) {})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Walk: got %v, want %v", err, os.ErrNotExist)
+		}
+	})
+}
+
+func TestHelperClientWalkFileInfo(t *testing.T) {
+	h, dir, done := newTestHelper(t)
+	defer done()
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0640); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Link(path, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	var got os.FileInfo
+	err := h.Walk(dir, func(d string, fis []os.FileInfo) {
+		for _, fi := range fis {
+			if fi.Name() == "file" {
+				got = fi
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	want, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+
+	if got.Size() != want.Size() || got.Mode() != want.Mode() || !got.ModTime().Equal(want.ModTime()) {
+		t.Errorf("Walk: got %v %v %v, want %v %v %v", got.Size(), got.Mode(), got.ModTime(), want.Size(), want.Mode(), want.ModTime())
+	}
+	if st := got.Sys().(*FileStat); st.NLinks != 2 || st.Inode == 0 || int(st.UID) != os.Getuid() {
+		t.Errorf("Walk Sys: got %+v, want 2 links", st)
+	}
+}
+
+func TestHelperClientHashFile(t *testing.T) {
+	h, dir, done := newTestHelper(t)
+	defer done()
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	got, err := h.HashFile(path)
+	if err != nil {
+		t.Fatalf("HashFile failed: %v", err)
+	}
+	if want := sha256.Sum256([]byte("hello")); got != want {
+		t.Errorf("HashFile: got %x, want %x", got, want)
+	}
+
+	if _, err := h.HashFile(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("HashFile: got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestHelperClientLink(t *testing.T) {
+	h, dir, done := newTestHelper(t)
+	defer done()
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// Concurrent links are batched, but each gets its own result.
+	const n = 100
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			newpath := filepath.Join(dir, fmt.Sprintf("link%d", i))
+			if i == n-1 {
+				newpath = path
+			}
+			errs[i] = h.Link(path, newpath)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs[:n-1] {
+		if err != nil {
+			t.Errorf("Link %d failed: %v", i, err)
+		}
+	}
+	if err := errs[n-1]; !errors.Is(err, os.ErrExist) {
+		t.Errorf("Link: got %v, want %v", err, os.ErrExist)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if got, want := uint64(fi.Sys().(*syscall.Stat_t).Nlink), uint64(n); got != want {
+		t.Errorf("Stat NLinks: got %v, want %v", got, want)
+	}
+}
+
+func TestHelperClientRemoveAll(t *testing.T) {
+	h, dir, done := newTestHelper(t)
+	defer done()
+
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0700); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	if err := h.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "a")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat: got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestNewHelperClient(t *testing.T) {
+	t.Run("noServer", func(t *testing.T) {
+		// This is what a missing command looks like.
+		_, err := NewHelperClient(strings.NewReader(""), nopWriteCloser{ioutil.Discard})
+		if !errors.Is(err, ErrNoHelper) {
+			t.Errorf("NewHelperClient: got %v, want %v", err, ErrNoHelper)
+		}
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		_, err := NewHelperClient(strings.NewReader("Welcome!\n"), nopWriteCloser{ioutil.Discard})
+		if !errors.Is(err, ErrNoHelper) {
+			t.Errorf("NewHelperClient: got %v, want %v", err, ErrNoHelper)
+		}
+	})
+}
+
+func TestHelperClientConnectionLost(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go func() {
+		// A server that starts, but never answers.
+		Serve(strings.NewReader(""), sw)
+		io.Copy(ioutil.Discard, sr)
+	}()
+
+	h, err := NewHelperClient(cr, cw)
+	if err != nil {
+		t.Fatalf("NewHelperClient failed: %v", err)
+	}
+	defer h.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := h.HashFile("/")
+		errc <- err
+	}()
+	sw.Close()
+
+	if err := <-errc; !IsRetriable(err) {
+		t.Errorf("HashFile: got %v, want a retriable error", err)
+	}
+	if err := h.RemoveAll("/nonexistent"); !IsRetriable(err) {
+		t.Errorf("RemoveAll: got %v, want a retriable error", err)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newTestHelper returns a client connected to a server, and a
+// temporary directory.
+func newTestHelper(t *testing.T) (*HelperClient, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "helper-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(sr, sw)
+		sw.Close()
+	}()
+
+	h, err := NewHelperClient(cr, cw)
+	if err != nil {
+		t.Fatalf("NewHelperClient failed: %v", err)
+	}
+
+	return h, dir, func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+		os.RemoveAll(dir)
+	}
+}
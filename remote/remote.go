@@ -3,7 +3,14 @@ package remote
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,32 +38,164 @@ type SFTPClient interface {
 
 // Returns whether it makes sense to retry on this kind of error.
 func IsRetriable(err error) bool {
-	if eerr, ok := err.(*os.LinkError); ok {
-		err = eerr.Err
+	if err == nil {
+		return false
 	}
-	if eerr, ok := err.(*os.PathError); ok {
-		err = eerr.Err
+
+	var rerr *RetriesExhaustedError
+	if errors.As(err, &rerr) {
+		// Someone already gave up on this.
+		return false
 	}
 
-	switch err {
-	case sftp.ErrSshFxConnectionLost, sftp.ErrSshFxNoConnection:
+	switch {
+	case errors.Is(err, sftp.ErrSshFxConnectionLost),
+		errors.Is(err, sftp.ErrSshFxNoConnection),
+		errors.Is(err, ErrConnectionStalled),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETDOWN),
+		errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT):
 		return true
-	default:
-		return false
 	}
+
+	var cerr *ConnectionError
+	if errors.As(err, &cerr) && isEOF(cerr.Err) {
+		// The server went away.
+		return true
+	}
+
+	var herr *SSHHandshakeError
+	if errors.As(err, &herr) {
+		// Failed authentication and host key mismatches don't
+		// break the connection.
+		return herr.ConnErr != nil && (isEOF(herr.ConnErr) || IsRetriable(herr.ConnErr))
+	}
+
+	var s3err *S3Error
+	if errors.As(err, &s3err) {
+		return s3err.Temporary()
+	}
+
+	var daverr *WebDAVError
+	if errors.As(err, &daverr) {
+		return daverr.Temporary()
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) {
+		return dnserr.IsTimeout || dnserr.IsTemporary
+	}
+
+	var operr *net.OpError
+	if errors.As(err, &operr) {
+		// Covers refused connections and dropped links, but not
+		// a missing local socket, like the SSH agent.
+		return !strings.HasPrefix(operr.Net, "unix")
+	}
+
+	return false
+}
+
+// isEOF returns true if the error is an end of stream.
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// A ConnectionError is an error from the connection to the server,
+// rather than from the operation. Plain io.EOF is not retriable,
+// since it also signals the end of a file, but wrapped in a
+// ConnectionError, it is.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string { return e.Err.Error() }
+
+func (e *ConnectionError) Unwrap() error { return e.Err }
+
+// A RetryPolicy describes how Idempotent retries a function.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of calls. Zero means
+	// unlimited.
+	MaxAttempts int
+
+	// MaxElapsed is the maximum time spent retrying, counted
+	// from the first call. Zero means unlimited.
+	MaxElapsed time.Duration
+
+	// InitialDelay is the back-off after the first failure.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the back-off.
+	MaxDelay time.Duration
+
+	// Multiplier scales the back-off after each failure. Values
+	// below one are treated as one.
+	Multiplier float64
+
+	// Jitter is the fraction, in [0, 1], of each back-off that is
+	// randomly removed. This avoids many clients retrying in
+	// lockstep.
+	Jitter float64
+
+	// OnRetry is called, if non-nil, before each back-off. The
+	// attempt is the number of calls made so far.
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
+
+// DefaultRetryPolicy retries forever, with back-off between 300 ms
+// and one minute.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 300 * time.Millisecond,
+	MaxDelay:     1 * time.Minute,
+	Multiplier:   2,
+}
+
+// A RetriesExhaustedError is returned when a RetryPolicy gives up on
+// a retriable error.
+type RetriesExhaustedError struct {
+	Attempts int
+	Err      error
 }
 
-var timeAfter = time.After
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error { return e.Err }
+
+// Mock injection points.
+var (
+	timeAfter   = time.After
+	timeNow     = time.Now
+	randFloat64 = rand.Float64
+)
 
 // Idempotent retries an idempotent function until it succeeds or
-// returns a non-retriable error. If the context is cancelled, the
-// function will return during a back-off.
+// returns a non-retriable error, using DefaultRetryPolicy. If the
+// context is cancelled, the function will return during a back-off.
 func Idempotent(ctx context.Context, fun func() error) error {
-	const initialDelay = 300 * time.Millisecond
-	const maxDelay = 1 * time.Minute
+	return DefaultRetryPolicy.Idempotent(ctx, fun)
+}
 
-	delay := initialDelay
-	for {
+// Idempotent retries an idempotent function until it succeeds,
+// returns a non-retriable error, or the policy gives up. If the
+// context is cancelled, the function will return during a back-off.
+func (p RetryPolicy) Idempotent(ctx context.Context, fun func() error) error {
+	start := timeNow()
+	delay := p.InitialDelay
+	for attempt := 1; ; attempt++ {
 		err := fun()
 		if err == nil {
 			return nil
@@ -66,23 +205,39 @@ func Idempotent(ctx context.Context, fun func() error) error {
 			return err
 		}
 
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return &RetriesExhaustedError{Attempts: attempt, Err: err}
+		}
+
+		d := delay
+		if p.Jitter > 0 {
+			d -= time.Duration(float64(d) * p.Jitter * randFloat64())
+		}
+		if p.MaxElapsed > 0 && timeNow().Add(d).Sub(start) > p.MaxElapsed {
+			return &RetriesExhaustedError{Attempts: attempt, Err: err}
+		}
+
 		if t, ok := ctx.Deadline(); ok {
-			glog.Warningf("Got retriable error (backoff %v, deadline %v): %v", delay, t, err)
+			glog.Warningf("Got retriable error (attempt %d, backoff %v, deadline %v): %v", attempt, d, t, err)
 		} else {
-			glog.Warningf("Got retriable error (backoff %v, no deadline): %v", delay, err)
+			glog.Warningf("Got retriable error (attempt %d, backoff %v, no deadline): %v", attempt, d, err)
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, d, err)
 		}
 
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-timeAfter(delay):
+		case <-timeAfter(d):
 			// Continue.
 		}
 
-		delay *= 2
-		if delay > maxDelay {
-			delay = maxDelay
+		if p.Multiplier > 1 {
+			delay = time.Duration(float64(delay) * p.Multiplier)
+		}
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
 		}
 	}
-
 }
@@ -2,7 +2,14 @@ package remote
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
+	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
@@ -20,8 +27,27 @@ func TestIsRetriable(t *testing.T) {
 
 		{"SSHConnectionLost", true, sftp.ErrSshFxConnectionLost},
 		{"SSHNoConnection", true, sftp.ErrSshFxNoConnection},
+		{"ConnectionStalled", true, ErrConnectionStalled},
 		{"InPathError", true, &os.PathError{Err: sftp.ErrSshFxConnectionLost}},
 		{"InLinkError", true, &os.LinkError{Err: sftp.ErrSshFxConnectionLost}},
+		{"Wrapped", true, fmt.Errorf("wrapped: %w", sftp.ErrSshFxNoConnection)},
+
+		{"EOF", false, io.EOF},
+		{"UnexpectedEOF", false, io.ErrUnexpectedEOF},
+		{"ConnectionEOF", true, &ConnectionError{Err: io.EOF}},
+		{"ConnectionUnexpectedEOF", true, &os.PathError{Err: &ConnectionError{Err: fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF)}}},
+		{"DeadlineExceeded", true, &os.PathError{Err: os.ErrDeadlineExceeded}},
+		{"ECONNRESET", true, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+		{"EPIPE", true, syscall.EPIPE},
+		{"DialTCP", true, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("mocked")}},
+		{"DialUnix", false, &net.OpError{Op: "dial", Net: "unix", Err: errors.New("mocked")}},
+		{"DNSTemporary", true, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{IsTemporary: true}}},
+		{"DNSNotFound", false, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{IsNotFound: true}}},
+		{"SSHHandshakeEOF", true, &SSHHandshakeError{Err: errors.New("ssh: handshake failed: EOF"), ConnErr: io.EOF}},
+		{"SSHHandshakeReset", true, &SSHHandshakeError{Err: errors.New("mocked"), ConnErr: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}},
+		{"SSHHandshakeAuth", false, &SSHHandshakeError{Err: errors.New("ssh: handshake failed: ssh: unable to authenticate")}},
+		{"SSHHandshakeText", false, errors.New("ssh: handshake failed: EOF")},
+		{"RetriesExhausted", false, &RetriesExhaustedError{Attempts: 1, Err: &ConnectionError{Err: io.EOF}}},
 	}
 	for _, tst := range tsts {
 		tst := tst
@@ -134,3 +160,114 @@ func TestIdempotentDeadline(t *testing.T) {
 		t.Errorf("time.After calls: got %v, want >=%v", nafterCalls, want)
 	}
 }
+
+func TestRetryPolicyIdempotent(t *testing.T) {
+	ctx := context.Background()
+
+	var delays []time.Duration
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	defer func() {
+		timeAfter = time.After
+	}()
+
+	t.Run("maxAttempts", func(t *testing.T) {
+		delays = nil
+		var attempts []int
+		p := RetryPolicy{
+			MaxAttempts:  4,
+			InitialDelay: 1 * time.Second,
+			MaxDelay:     3 * time.Second,
+			Multiplier:   2,
+			OnRetry: func(attempt int, delay time.Duration, err error) {
+				attempts = append(attempts, attempt)
+			},
+		}
+
+		var i int
+		err := p.Idempotent(ctx, func() error {
+			i++
+			return sftp.ErrSshFxConnectionLost
+		})
+		var rerr *RetriesExhaustedError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("Idempotent error: got %v, want RetriesExhaustedError", err)
+		}
+		if want := 4; rerr.Attempts != want {
+			t.Errorf("RetriesExhaustedError.Attempts: got %v, want %v", rerr.Attempts, want)
+		}
+		if !errors.Is(err, sftp.ErrSshFxConnectionLost) {
+			t.Errorf("Idempotent error: got %v, want wrapping %v", err, sftp.ErrSshFxConnectionLost)
+		}
+
+		if want := 4; i != want {
+			t.Errorf("Idempotent calls: got %v, want %v", i, want)
+		}
+		if want := []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second}; !reflect.DeepEqual(delays, want) {
+			t.Errorf("Idempotent delays: got %v, want %v", delays, want)
+		}
+		if want := []int{1, 2, 3}; !reflect.DeepEqual(attempts, want) {
+			t.Errorf("OnRetry attempts: got %v, want %v", attempts, want)
+		}
+	})
+
+	t.Run("maxElapsed", func(t *testing.T) {
+		delays = nil
+		now := time.Unix(0, 0)
+		timeNow = func() time.Time { return now }
+		defer func() {
+			timeNow = time.Now
+		}()
+
+		p := RetryPolicy{
+			MaxElapsed:   10 * time.Second,
+			InitialDelay: 4 * time.Second,
+			Multiplier:   1,
+		}
+
+		var i int
+		err := p.Idempotent(ctx, func() error {
+			i++
+			now = now.Add(3 * time.Second)
+			return &ConnectionError{Err: io.EOF}
+		})
+		var rerr *RetriesExhaustedError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("Idempotent error: got %v, want RetriesExhaustedError", err)
+		}
+
+		// The clock is at 3s, 6s and 9s after the calls. Only the
+		// last would exceed 10s with the 4s back-off.
+		if want := 3; i != want {
+			t.Errorf("Idempotent calls: got %v, want %v", i, want)
+		}
+		if want := 2; len(delays) != want {
+			t.Errorf("Idempotent delays: got %v, want len %v", delays, want)
+		}
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		delays = nil
+		randFloat64 = func() float64 { return 0.5 }
+		defer func() {
+			randFloat64 = rand.Float64
+		}()
+
+		p := RetryPolicy{
+			MaxAttempts:  2,
+			InitialDelay: 1 * time.Second,
+			Jitter:       0.5,
+		}
+
+		p.Idempotent(ctx, func() error {
+			return &ConnectionError{Err: io.EOF}
+		})
+		if want := []time.Duration{750 * time.Millisecond}; !reflect.DeepEqual(delays, want) {
+			t.Errorf("Idempotent delays: got %v, want %v", delays, want)
+		}
+	})
+}
@@ -0,0 +1,585 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MaxParts is the largest number of parts in a multipart
+	// upload.
+	s3MaxParts = 10000
+
+	// defaultS3PartSize is used unless WithS3PartSize is given.
+	defaultS3PartSize = 64 << 20
+
+	// s3MetaPrefix is the header prefix of user metadata.
+	s3MetaPrefix = "X-Amz-Meta-"
+
+	// s3EmptyHash is the SHA-256 hash of an empty payload.
+	s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Credentials authenticate requests to an S3-compatible service.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken is only set for temporary credentials.
+	SessionToken string
+}
+
+// An S3Client talks to an S3-compatible object storage service. It
+// uses path-style bucket addressing, and AWS Signature Version 4. It
+// only implements what fs.S3 needs, and doesn't do retries.
+type S3Client struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	creds    S3Credentials
+	client   *http.Client
+	partSize int64
+}
+
+// An S3ClientOpt is an option for NewS3Client.
+type S3ClientOpt func(*S3Client)
+
+// WithS3HTTPClient sets the HTTP client to send requests with. The
+// default is http.DefaultClient.
+func WithS3HTTPClient(c *http.Client) S3ClientOpt {
+	return func(s3c *S3Client) {
+		s3c.client = c
+	}
+}
+
+// WithS3PartSize sets the size of parts in multipart uploads and
+// copies. Larger objects are uploaded, and copied, in parts. S3
+// requires at least 5 MiB. The default is 64 MiB.
+func WithS3PartSize(n int64) S3ClientOpt {
+	return func(c *S3Client) {
+		c.partSize = n
+	}
+}
+
+// NewS3Client creates a client for a bucket. The endpoint is the base
+// URL of the service, like https://s3.eu-north-1.amazonaws.com.
+func NewS3Client(endpoint *url.URL, region, bucket string, creds S3Credentials, opts ...S3ClientOpt) *S3Client {
+	c := &S3Client{
+		endpoint: endpoint,
+		region:   region,
+		bucket:   bucket,
+		creds:    creds,
+		client:   http.DefaultClient,
+		partSize: defaultS3PartSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// An S3Object describes an object in a bucket.
+type S3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+
+	// Metadata is the user metadata, with lowercase keys, and
+	// without the "x-amz-meta-" prefix. Listings don't return
+	// metadata.
+	Metadata map[string]string
+}
+
+// An S3Error is an error response from the service. It satisfies
+// errors.Is for os.ErrNotExist, os.ErrExist (failed preconditions)
+// and os.ErrPermission.
+type S3Error struct {
+	Op         string
+	Key        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	msg := e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("s3:%s %s: %s (HTTP %d)", e.Op, e.Key, msg, e.StatusCode)
+}
+
+func (e *S3Error) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case os.ErrExist:
+		return e.StatusCode == http.StatusPreconditionFailed || e.Code == "ConditionalRequestConflict"
+	case os.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Temporary returns true if the request may succeed if retried.
+func (e *S3Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.Code == "RequestTimeout" || e.Code == "SlowDown"
+}
+
+// HeadObject returns information about an object.
+func (c *S3Client) HeadObject(ctx context.Context, key string) (*S3Object, error) {
+	resp, err := c.do(ctx, "head", http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return s3ObjectFromResponse(key, resp)
+}
+
+// GetObject returns the contents of an object. The caller must close
+// the reader.
+func (c *S3Client) GetObject(ctx context.Context, key string) (io.ReadCloser, *S3Object, error) {
+	resp, err := c.do(ctx, "get", http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := s3ObjectFromResponse(key, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp.Body, obj, nil
+}
+
+// s3ObjectFromResponse extracts object information from response
+// headers.
+func s3ObjectFromResponse(key string, resp *http.Response) (*S3Object, error) {
+	obj := &S3Object{Key: key, Size: resp.ContentLength, Metadata: map[string]string{}}
+	if s := resp.Header.Get("Last-Modified"); s != "" {
+		t, err := http.ParseTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid Last-Modified for %s: %w", key, err)
+		}
+		obj.LastModified = t
+	}
+	for k, vs := range resp.Header {
+		if strings.HasPrefix(k, s3MetaPrefix) && len(vs) > 0 {
+			obj.Metadata[strings.ToLower(k[len(s3MetaPrefix):])] = vs[0]
+		}
+	}
+	return obj, nil
+}
+
+// PutObject creates, or replaces, an object. If exclusive is true, it
+// fails with an error satisfying errors.Is(err, os.ErrExist) if the
+// object already exists. Objects larger than the part size are
+// uploaded in parts.
+func (c *S3Client) PutObject(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, exclusive bool) error {
+	hdr := s3MetadataHeader(meta)
+	if exclusive {
+		hdr.Set("If-None-Match", "*")
+	}
+	if size <= c.partSize {
+		resp, err := c.do(ctx, "put", http.MethodPut, key, nil, hdr, body, size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	ra, ok := body.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("s3:put %s: multipart uploads need an io.ReaderAt", key)
+	}
+	return c.multipart(ctx, key, size, hdr, func(uploadID string, num int, off, n int64) (*http.Response, error) {
+		q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+		return c.do(ctx, "putpart", http.MethodPut, key, q, nil, io.NewSectionReader(ra, off, n), n)
+	})
+}
+
+// CopyObject copies an object within the bucket, on the server. If
+// meta is nil, the metadata is copied, otherwise it is replaced. The
+// size of the source selects between a single copy and a multipart
+// copy.
+func (c *S3Client) CopyObject(ctx context.Context, srcKey, dstKey string, size int64, meta map[string]string) error {
+	src := "/" + c.bucket + "/" + s3EscapePath(srcKey)
+
+	if size <= c.partSize {
+		hdr := s3MetadataHeader(meta)
+		hdr.Set("X-Amz-Copy-Source", src)
+		if meta != nil {
+			hdr.Set("X-Amz-Metadata-Directive", "REPLACE")
+		}
+		resp, err := c.do(ctx, "copy", http.MethodPut, dstKey, nil, hdr, nil, 0)
+		if err != nil {
+			return err
+		}
+		// Errors can be reported after the 200 status.
+		return checkS3ResultBody("copy", dstKey, resp)
+	}
+
+	if meta == nil {
+		obj, err := c.HeadObject(ctx, srcKey)
+		if err != nil {
+			return err
+		}
+		meta = obj.Metadata
+	}
+	return c.multipart(ctx, dstKey, size, s3MetadataHeader(meta), func(uploadID string, num int, off, n int64) (*http.Response, error) {
+		q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+		hdr := http.Header{}
+		hdr.Set("X-Amz-Copy-Source", src)
+		hdr.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+		resp, err := c.do(ctx, "copypart", http.MethodPut, dstKey, q, hdr, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			ETag string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3:copypart %s: %w", dstKey, err)
+		}
+		// Unlike UploadPart, the ETag is in the body.
+		resp.Header.Set("ETag", res.ETag)
+		return resp, nil
+	})
+}
+
+// multipart runs a multipart upload. The hdr is given when creating
+// the upload, except If-None-Match, which is given when completing
+// it. The part function uploads one part, and returns the response
+// with the ETag header. The upload is aborted on failure.
+func (c *S3Client) multipart(ctx context.Context, key string, size int64, hdr http.Header, part func(uploadID string, num int, off, n int64) (*http.Response, error)) (rerr error) {
+	partSize := c.partSize
+	if n := (size + s3MaxParts - 1) / s3MaxParts; n > partSize {
+		partSize = n
+	}
+
+	createHdr := http.Header{}
+	for k, vs := range hdr {
+		if k != "If-None-Match" {
+			createHdr[k] = vs
+		}
+	}
+	resp, err := c.do(ctx, "createmultipart", http.MethodPost, key, url.Values{"uploads": {""}}, createHdr, nil, 0)
+	if err != nil {
+		return err
+	}
+	var create struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&create)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3:createmultipart %s: %w", key, err)
+	}
+	defer func() {
+		if rerr == nil {
+			return
+		}
+		resp, err := c.do(context.Background(), "abortmultipart", http.MethodDelete, key, url.Values{"uploadId": {create.UploadID}}, nil, nil, 0)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	type completePart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for off, num := int64(0), 1; off < size; off, num = off+partSize, num+1 {
+		n := partSize
+		if size-off < n {
+			n = size - off
+		}
+		resp, err := part(create.UploadID, num, off, n)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completePart{PartNumber: num, ETag: resp.Header.Get("ETag")})
+	}
+
+	bs, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	completeHdr := http.Header{}
+	if v := hdr.Get("If-None-Match"); v != "" {
+		completeHdr.Set("If-None-Match", v)
+	}
+	resp, err = c.do(ctx, "completemultipart", http.MethodPost, key, url.Values{"uploadId": {create.UploadID}}, completeHdr, bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		return err
+	}
+	return checkS3ResultBody("completemultipart", key, resp)
+}
+
+// DeleteObject removes an object. Removing an object that doesn't
+// exist is not an error.
+func (c *S3Client) DeleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, "delete", http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjects lists objects whose keys start with the prefix, in key
+// order. If delimiter is non-empty, keys containing it after the
+// prefix are grouped into common prefixes, which end with the
+// delimiter. The function is called once per page.
+func (c *S3Client) ListObjects(ctx context.Context, prefix, delimiter string, fun func(objs []S3Object, prefixes []string) error) error {
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	for {
+		resp, err := c.do(ctx, "list", http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			IsTruncated bool
+			Contents    []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3:list %s: %w", prefix, err)
+		}
+
+		objs := make([]S3Object, 0, len(res.Contents))
+		for _, o := range res.Contents {
+			objs = append(objs, S3Object{Key: o.Key, Size: o.Size, LastModified: o.LastModified})
+		}
+		prefixes := make([]string, 0, len(res.CommonPrefixes))
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if err := fun(objs, prefixes); err != nil {
+			return err
+		}
+
+		if !res.IsTruncated {
+			return nil
+		}
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// s3MetadataHeader returns the headers of user metadata.
+func s3MetadataHeader(meta map[string]string) http.Header {
+	hdr := http.Header{}
+	for k, v := range meta {
+		hdr.Set(s3MetaPrefix+k, v)
+	}
+	return hdr
+}
+
+// checkS3ResultBody closes the response body, and returns an error if
+// it is an error document. Copies and multipart completions can fail
+// after a 200 status has been sent.
+func checkS3ResultBody(op, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(bs, []byte("<Error>")) {
+		return nil
+	}
+	return newS3Error(op, key, http.StatusInternalServerError, bs)
+}
+
+// newS3Error parses an error document.
+func newS3Error(op, key string, status int, body []byte) *S3Error {
+	var doc struct {
+		Code    string
+		Message string
+	}
+	// HEAD responses have no body, so only the status is known.
+	xml.Unmarshal(body, &doc)
+	return &S3Error{Op: op, Key: key, StatusCode: status, Code: doc.Code, Message: doc.Message}
+}
+
+// do sends a signed request about an object, or the bucket if the key
+// is empty. Responses with error statuses are returned as *S3Error.
+func (c *S3Client) do(ctx context.Context, op, method, key string, query url.Values, hdr http.Header, body io.ReadSeeker, size int64) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	payloadHash := s3EmptyHash
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	var rbody io.Reader
+	if body != nil {
+		rbody = body
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), rbody)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// Otherwise, an empty body would be sent chunked.
+		req.Body = http.NoBody
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	signS3Request(req, c.creds, c.region, payloadHash, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, newS3Error(op, key, resp.StatusCode, bs)
+	}
+	return resp, nil
+}
+
+// signS3Request adds AWS Signature Version 4 headers to a request. All
+// headers present are signed.
+func signS3Request(req *http.Request, creds S3Credentials, region, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(strings.Fields(strings.Join(vs, ",")), " ")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	h := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{amzDate[:8], region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// s3CanonicalQuery encodes a query string the way SigV4 requires:
+// sorted, and with strict escaping.
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ss []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			ss = append(ss, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(ss, "&")
+}
+
+// s3EscapePath escapes a path the way SigV4 requires, keeping
+// slashes.
+func s3EscapePath(s string) string {
+	return s3Escape(s, false)
+}
+
+// s3Escape percent-encodes everything but unreserved characters. If
+// slash is true, slashes are also encoded.
+func s3Escape(s string, slash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !slash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
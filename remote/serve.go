@@ -0,0 +1,190 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// serveConcurrency is the number of requests a server works on
+	// at the same time.
+	serveConcurrency = 16
+
+	// walkChunkSize is the approximate number of entries in each
+	// "walk" response.
+	walkChunkSize = 1024
+)
+
+// A helperServer answers requests from a HelperClient.
+type helperServer struct {
+	mu  sync.Mutex
+	enc *gob.Encoder
+	err error
+}
+
+// Serve answers helper requests read from r, using the local file
+// system, until r ends. It is what "fisy serve" runs on the SFTP
+// server, with stdin and stdout.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &helperServer{enc: gob.NewEncoder(w)}
+	s.send(&helperResponse{Version: helperVersion})
+
+	dec := gob.NewDecoder(r)
+	sem := make(chan struct{}, serveConcurrency)
+	var wg sync.WaitGroup
+	for {
+		req := &helperRequest{}
+		if err := dec.Decode(req); err == io.EOF {
+			break
+		} else if err != nil {
+			wg.Wait()
+			return err
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			s.handle(req)
+		}()
+	}
+
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// send writes a response. The first write error is kept, and later
+// responses are dropped.
+func (s *helperServer) send(resp *helperResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.Encode(resp)
+}
+
+// handle answers a request.
+func (s *helperServer) handle(req *helperRequest) {
+	resp := &helperResponse{ID: req.ID}
+	switch req.Op {
+	case "walk":
+		resp.Err = newHelperError(s.walk(req))
+
+	case "hash":
+		sum, err := hashLocalFile(req.Path)
+		resp.Hash = sum[:]
+		resp.Err = newHelperError(err)
+
+	case "link":
+		resp.LinkErrs = make([]helperError, len(req.Links))
+		for i, l := range req.Links {
+			resp.LinkErrs[i] = newHelperError(os.Link(l.Old, l.New))
+		}
+
+	case "removeall":
+		resp.Err = newHelperError(os.RemoveAll(req.Path))
+
+	default:
+		resp.Err = newHelperError(fmt.Errorf("unknown operation: %q", req.Op))
+	}
+	s.send(resp)
+}
+
+// walk sends the listings of a directory tree, in chunks. The final
+// response is sent by the caller.
+func (s *helperServer) walk(req *helperRequest) error {
+	var dirs []helperDir
+	var n int
+
+	var rec func(path string) error
+	rec = func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fis, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		d := helperDir{Path: path, Entries: make([]*helperFileInfo, len(fis))}
+		for i, fi := range fis {
+			d.Entries[i] = newHelperFileInfo(fi)
+		}
+		dirs = append(dirs, d)
+		n += len(fis) + 1
+		if n >= walkChunkSize {
+			s.send(&helperResponse{ID: req.ID, More: true, Dirs: dirs})
+			dirs = nil
+			n = 0
+		}
+
+		for _, fi := range fis {
+			if fi.IsDir() {
+				// The client lists unreadable directories
+				// itself, and gets the error.
+				rec(filepath.Join(path, fi.Name()))
+			}
+		}
+		return nil
+	}
+	if err := rec(req.Path); err != nil {
+		return err
+	}
+
+	if len(dirs) > 0 {
+		s.send(&helperResponse{ID: req.ID, More: true, Dirs: dirs})
+	}
+	return nil
+}
+
+// newHelperFileInfo converts a local FileInfo for sending.
+func newHelperFileInfo(fi os.FileInfo) *helperFileInfo {
+	hfi := &helperFileInfo{
+		FName:    fi.Name(),
+		FSize:    fi.Size(),
+		FMode:    fi.Mode(),
+		FModTime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		hfi.Stat = FileStat{
+			UID:    st.Uid,
+			GID:    st.Gid,
+			Atime:  time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+			NLinks: uint64(st.Nlink),
+			Inode:  st.Ino,
+		}
+	}
+	return hfi
+}
+
+// hashLocalFile returns the SHA-256 hash of a file.
+func hashLocalFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
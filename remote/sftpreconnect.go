@@ -4,8 +4,10 @@ import (
 	"errors"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/pkg/sftp"
 )
 
@@ -13,6 +15,10 @@ import (
 // could be started.
 var ErrClientClosed = errors.New("client is closed")
 
+// ErrConnectionStalled signals that a connection stopped responding
+// and was torn down. It is retriable.
+var ErrConnectionStalled = errors.New("connection stalled")
+
 // A CloseableSFTPClient can, in addition to SFTPClient operations,
 // also be closed cleanly.
 type CloseableSFTPClient interface {
@@ -22,26 +28,113 @@ type CloseableSFTPClient interface {
 	Close() error
 }
 
+// A KeepaliveSFTPClient can, in addition to CloseableSFTPClient
+// operations, probe the server and tear the connection down without
+// waiting for the server. Clients that implement it get keepalives.
+type KeepaliveSFTPClient interface {
+	CloseableSFTPClient
+
+	// Keepalive sends a request to the server and waits for the
+	// reply.
+	Keepalive() error
+
+	// Abort closes the underlying connection immediately, making
+	// in-flight operations fail.
+	Abort() error
+}
+
 // A ReconnectingSFTPClient will reconnect if a disconnect happens,
-// but will not do retries on its own.
+// but will not do retries on its own. It can spread operations over
+// a pool of connections, each reconnecting independently.
 type ReconnectingSFTPClient struct {
 	dialer func() (CloseableSFTPClient, error)
 
-	client    CloseableSFTPClient
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	opTimeout         time.Duration
+
+	slots []*sftpClientSlot
+	next  uint32
+}
+
+// An sftpClientSlot is one connection in a ReconnectingSFTPClient pool.
+type sftpClientSlot struct {
+	conn      *sftpConn
 	clientErr error
 	mu        sync.Mutex
+
+	// ninflight is the number of operations using this slot. It
+	// must be accessed atomically.
+	ninflight int32
+}
+
+// An sftpConn is a connected client in a slot.
+type sftpConn struct {
+	client CloseableSFTPClient
+
+	// done is closed when the client has been removed from the slot.
+	done chan struct{}
+
+	// stalled is non-zero if the client was torn down because it
+	// stopped responding. It must be accessed atomically, and is
+	// set before done is closed.
+	stalled int32
+}
+
+// A ReconnectingSFTPClientOpt is an option to NewReconnectingSFTPClient.
+type ReconnectingSFTPClientOpt func(*ReconnectingSFTPClient)
+
+// WithPoolSize sets the number of connections to spread operations
+// over. The default is one. Connections are dialled when first needed.
+func WithPoolSize(n int) ReconnectingSFTPClientOpt {
+	if n < 1 {
+		glog.Fatalf("pool size must be at least 1")
+	}
+
+	return func(c *ReconnectingSFTPClient) {
+		c.slots = make([]*sftpClientSlot, n)
+		for i := range c.slots {
+			c.slots[i] = &sftpClientSlot{}
+		}
+	}
+}
+
+// WithKeepalive makes each connection send a keepalive request every
+// interval. If the server doesn't reply within timeout, the connection
+// is declared stalled and torn down. Only clients implementing
+// KeepaliveSFTPClient are probed. The default is no keepalives.
+func WithKeepalive(interval, timeout time.Duration) ReconnectingSFTPClientOpt {
+	return func(c *ReconnectingSFTPClient) {
+		c.keepaliveInterval = interval
+		c.keepaliveTimeout = timeout
+	}
+}
+
+// WithOperationTimeout sets a deadline for each operation. If an
+// operation takes longer, its connection is declared stalled and torn
+// down. The deadline doesn't cover Read and Write on the sftp.File
+// returned by Open and Create, so a stalled transfer is only detected
+// by keepalives. The default is no deadline.
+func WithOperationTimeout(d time.Duration) ReconnectingSFTPClientOpt {
+	return func(c *ReconnectingSFTPClient) {
+		c.opTimeout = d
+	}
 }
 
 // NewReconnectingSFTPClient creates a new client using the given
 // dialer. An error is returned if the dialer couldn't create an
 // initial client.
-func NewReconnectingSFTPClient(dialer func() (CloseableSFTPClient, error)) (*ReconnectingSFTPClient, error) {
+func NewReconnectingSFTPClient(dialer func() (CloseableSFTPClient, error), opts ...ReconnectingSFTPClientOpt) (*ReconnectingSFTPClient, error) {
 	c := &ReconnectingSFTPClient{
 		dialer: dialer,
+		slots:  []*sftpClientSlot{{}},
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 
 	// Check that the dialer works.
-	_, err := c.getClient()
+	_, err := c.slots[0].getConn(c)
 	if err != nil {
 		return nil, err
 	}
@@ -49,71 +142,236 @@ func NewReconnectingSFTPClient(dialer func() (CloseableSFTPClient, error)) (*Rec
 	return c, nil
 }
 
-// getClient returns the existing client, or creates a new.
-func (c *ReconnectingSFTPClient) getClient() (SFTPClient, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// pickSlot returns the slot with the fewest in-flight operations. Ties
+// are broken round-robin.
+func (c *ReconnectingSFTPClient) pickSlot() *sftpClientSlot {
+	if len(c.slots) == 1 {
+		return c.slots[0]
+	}
 
-	if c.client == nil && c.clientErr != ErrClientClosed {
-		c.client, c.clientErr = c.dialer()
+	start := int(atomic.AddUint32(&c.next, 1))
+	var best *sftpClientSlot
+	var bestn int32
+	for i := range c.slots {
+		slot := c.slots[(start+i)%len(c.slots)]
+		n := atomic.LoadInt32(&slot.ninflight)
+		if best == nil || n < bestn {
+			best = slot
+			bestn = n
+		}
 	}
+	return best
+}
 
-	return c.client, c.clientErr
+// getConn returns the existing connection, or creates a new.
+func (s *sftpClientSlot) getConn(c *ReconnectingSFTPClient) (*sftpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil && s.clientErr != ErrClientClosed {
+		var client CloseableSFTPClient
+		client, s.clientErr = c.dialer()
+		if s.clientErr == nil {
+			s.conn = &sftpConn{client: client, done: make(chan struct{})}
+			if kc, ok := client.(KeepaliveSFTPClient); ok && c.keepaliveInterval > 0 {
+				go c.keepalive(s, s.conn, kc)
+			}
+		}
+	}
+
+	return s.conn, s.clientErr
 }
 
-// handleError closes the client if there was a disconnection error.
-func (c *ReconnectingSFTPClient) handleError(usedClient SFTPClient, err error) error {
-	if !IsRetriable(err) {
+// keepalive probes the connection until it is removed from the slot.
+// A failed or late reply tears the connection down.
+func (c *ReconnectingSFTPClient) keepalive(slot *sftpClientSlot, conn *sftpConn, kc KeepaliveSFTPClient) {
+	ticker := time.NewTicker(c.keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		errc := make(chan error, 1)
+		go func() { errc <- kc.Keepalive() }()
+
+		timer := time.NewTimer(c.keepaliveTimeout)
+		select {
+		case <-conn.done:
+			timer.Stop()
+			return
+
+		case err := <-errc:
+			timer.Stop()
+			if err == nil {
+				continue
+			}
+			glog.Warningf("SFTP keepalive failed: %v", err)
+
+		case <-timer.C:
+			glog.Warningf("SFTP keepalive not answered within %v", c.keepaliveTimeout)
+		}
+
+		slot.stall(conn)
+		return
+	}
+}
+
+// reset closes the client, if it is still the given client, so
+// the next operation will reconnect.
+func (s *sftpClientSlot) reset(usedClient SFTPClient) error {
+	s.mu.Lock()
+	if s.conn == nil || s.conn.client != usedClient {
+		s.mu.Unlock()
 		return nil
 	}
 
-	c.mu.Lock()
-	if c.client == usedClient {
-		cc := c.client
-		c.client = nil
-		c.clientErr = nil
-		c.mu.Unlock()
+	conn := s.conn
+	s.conn = nil
+	s.clientErr = nil
+	s.mu.Unlock()
 
-		return cc.Close()
-	} else {
-		c.mu.Unlock()
+	close(conn.done)
+	return conn.client.Close()
+}
+
+// stall tears the connection down, if it is still in the slot, without
+// waiting for the server. In-flight operations fail, and the next
+// operation will reconnect.
+func (s *sftpClientSlot) stall(conn *sftpConn) {
+	s.mu.Lock()
+	if s.conn != conn {
+		s.mu.Unlock()
+		return
 	}
-	return nil
+
+	s.conn = nil
+	s.clientErr = nil
+	s.mu.Unlock()
+
+	atomic.StoreInt32(&conn.stalled, 1)
+	close(conn.done)
+	if kc, ok := conn.client.(KeepaliveSFTPClient); ok {
+		if err := kc.Abort(); err != nil {
+			glog.Warningf("Failed to abort stalled SFTP connection: %v", err)
+		}
+	}
+	// A graceful close may block on the stalled connection.
+	go conn.client.Close()
 }
 
 // do runs a function with a client and closes the client if the
-// function returns a disconnection error.
+// function returns a disconnection error. If the connection stalls,
+// ErrConnectionStalled is returned.
 func (c *ReconnectingSFTPClient) do(fun func(SFTPClient) error) error {
-	client, err := c.getClient()
+	return c.doTimeout(fun, c.opTimeout)
+}
+
+// doTimeout is like do, but with the given operation timeout. Zero
+// means no deadline.
+func (c *ReconnectingSFTPClient) doTimeout(fun func(SFTPClient) error, opTimeout time.Duration) error {
+	slot := c.pickSlot()
+	atomic.AddInt32(&slot.ninflight, 1)
+	defer atomic.AddInt32(&slot.ninflight, -1)
+
+	conn, err := slot.getConn(c)
 	if err != nil {
 		return err
 	}
 
-	err = fun(client)
+	if opTimeout > 0 {
+		err = c.doWithDeadline(slot, conn, fun, opTimeout)
+	} else {
+		err = fun(conn.client)
+	}
 	if err == nil {
 		return nil
 	}
 
-	// We already have an error, so we don't report if handleErr
+	if atomic.LoadInt32(&conn.stalled) != 0 {
+		return ErrConnectionStalled
+	}
+	if isEOF(err) {
+		// None of the operations read files, so this is the
+		// connection closing.
+		err = &ConnectionError{Err: err}
+	}
+
+	// We already have an error, so we don't report if reset
 	// returns an error.
-	c.handleError(client, err)
+	if IsRetriable(err) {
+		slot.reset(conn.client)
+	}
 	return err
 }
 
-// Close closes the open client, and makes new operations fail with
+// doWithDeadline runs a function with a client, and tears the
+// connection down if the function doesn't return within the operation
+// timeout. It always waits for the function to return, since it may
+// write to variables owned by the caller. Tearing the connection down
+// makes it return soon.
+func (c *ReconnectingSFTPClient) doWithDeadline(slot *sftpClientSlot, conn *sftpConn, fun func(SFTPClient) error, opTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- fun(conn.client) }()
+
+	timer := time.NewTimer(opTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errc:
+		return err
+
+	case <-timer.C:
+		glog.Warningf("SFTP operation took longer than %v", opTimeout)
+		slot.stall(conn)
+		return <-errc
+	}
+}
+
+// Close closes the open clients, and makes new operations fail with
 // ErrClientClosed.
 func (c *ReconnectingSFTPClient) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.clientErr = ErrClientClosed
-	if c.client != nil {
-		cc := c.client
-		c.client = nil
-		return cc.Close()
+	var rerr error
+	for _, slot := range c.slots {
+		if err := slot.close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// close closes the client and makes the slot unusable.
+func (s *sftpClientSlot) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientErr = ErrClientClosed
+	if s.conn != nil {
+		conn := s.conn
+		s.conn = nil
+		close(conn.done)
+		return conn.client.Close()
 	}
 	return nil
 }
 
+// WithHelper runs a function with the "fisy serve" helper of some
+// connection, or returns ErrNoHelper. There is no operation timeout,
+// since walking a large tree takes long, but keepalives still detect
+// stalled connections.
+func (c *ReconnectingSFTPClient) WithHelper(fun func(*HelperClient) error) error {
+	return c.doTimeout(func(client SFTPClient) error {
+		hc, ok := client.(HelperSFTPClient)
+		if !ok || hc.Helper() == nil {
+			return ErrNoHelper
+		}
+		return fun(hc.Helper())
+	}, 0)
+}
+
 func (c *ReconnectingSFTPClient) Chmod(path string, mode os.FileMode) error {
 	return c.do(func(client SFTPClient) error {
 		return client.Chmod(path, mode)
@@ -132,6 +390,8 @@ func (c *ReconnectingSFTPClient) Chtimes(path string, atime time.Time, mtime tim
 	})
 }
 
+// Create creates a file. The returned file stays bound to the
+// connection that created it, and is not reconnected.
 func (c *ReconnectingSFTPClient) Create(path string) (f *sftp.File, err error) {
 	err = c.do(func(client SFTPClient) error {
 		f, err = client.Create(path)
@@ -160,6 +420,8 @@ func (c *ReconnectingSFTPClient) Mkdir(path string) error {
 	})
 }
 
+// Open opens a file. The returned file stays bound to the connection
+// that opened it, and is not reconnected.
 func (c *ReconnectingSFTPClient) Open(path string) (f *sftp.File, err error) {
 	err = c.do(func(client SFTPClient) error {
 		f, err = client.Open(path)
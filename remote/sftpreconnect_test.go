@@ -1,9 +1,13 @@
 package remote
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -54,7 +58,13 @@ func TestReconnectingSFTPClientDoHandlesDialerError(t *testing.T) {
 	}
 	defer c.Close()
 
-	c.handleError(mc, sftp.ErrSshFxConnectionLost)
+	lost := func(SFTPClient) error { return sftp.ErrSshFxConnectionLost }
+	if err := c.do(lost); err != sftp.ErrSshFxConnectionLost {
+		t.Errorf("do error: got %v, want %v", err, sftp.ErrSshFxConnectionLost)
+	}
+	if want := 1; mc.NClosed != want {
+		t.Errorf("Close calls: got %v, want %v", mc.NClosed, want)
+	}
 
 	if err := c.do(nil); err != wantErr {
 		t.Errorf("do error: got %v, want %v", err, wantErr)
@@ -81,10 +91,8 @@ func TestReconnectingSFTPClientDoesntReconnectAfterClose(t *testing.T) {
 	}
 	c.Close()
 
-	c.handleError(mc, sftp.ErrSshFxConnectionLost)
-
-	if _, err := c.getClient(); err != ErrClientClosed {
-		t.Errorf("getClient error: got %v, want %v", err, ErrClientClosed)
+	if err := c.do(func(SFTPClient) error { return sftp.ErrSshFxConnectionLost }); err != ErrClientClosed {
+		t.Errorf("do error: got %v, want %v", err, ErrClientClosed)
 	}
 
 	if want := 1; i != want {
@@ -92,6 +100,248 @@ func TestReconnectingSFTPClientDoesntReconnectAfterClose(t *testing.T) {
 	}
 }
 
+func TestReconnectingSFTPClientEOFIsConnectionError(t *testing.T) {
+	var i int
+	c, err := NewReconnectingSFTPClient(func() (CloseableSFTPClient, error) {
+		i++
+		return testutil.NewFakeSFTPClient("path"), nil
+	})
+	if err != nil {
+		t.Fatalf("NewReconnectingSFTPClient failed: %v", err)
+	}
+	defer c.Close()
+
+	err = c.do(func(SFTPClient) error { return io.EOF })
+	var cerr *ConnectionError
+	if !errors.As(err, &cerr) {
+		t.Errorf("do error: got %v, want a ConnectionError", err)
+	}
+	if !IsRetriable(err) {
+		t.Errorf("IsRetriable(%v): got false, want true", err)
+	}
+
+	if err := c.do(func(SFTPClient) error { return nil }); err != nil {
+		t.Fatalf("do failed: %v", err)
+	}
+	if want := 2; i != want {
+		t.Errorf("dialer calls: got %v, want %v", i, want)
+	}
+}
+
+func TestReconnectingSFTPClientPool(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var mcs []*blockingSFTPClient
+	c, err := NewReconnectingSFTPClient(func() (CloseableSFTPClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		mc := &blockingSFTPClient{FakeSFTPClient: testutil.NewFakeSFTPClient("path"), entered: entered, release: release}
+		if len(mcs) == 1 {
+			// A disconnection only resets the affected slot.
+			mc.err = sftp.ErrSshFxConnectionLost
+		}
+		mcs = append(mcs, mc)
+		return mc, nil
+	}, WithPoolSize(3))
+	if err != nil {
+		t.Fatalf("NewReconnectingSFTPClient failed: %v", err)
+	}
+	defer c.Close()
+
+	if want := 1; len(mcs) != want {
+		t.Fatalf("dialer calls: got %v, want %v", len(mcs), want)
+	}
+
+	// Each operation in flight forces the next one to a new slot.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.Chmod("path", 0654)
+		}()
+		<-entered
+	}
+	close(release)
+	wg.Wait()
+
+	if want := 3; len(mcs) != want {
+		t.Fatalf("dialer calls: got %v, want %v", len(mcs), want)
+	}
+	var nfailed int
+	for _, err := range errs {
+		if err == sftp.ErrSshFxConnectionLost {
+			nfailed++
+		} else if err != nil {
+			t.Errorf("Chmod failed: %v", err)
+		}
+	}
+	if want := 1; nfailed != want {
+		t.Errorf("failed Chmod calls: got %v, want %v", nfailed, want)
+	}
+	for i, mc := range mcs {
+		if want := 1; mc.NCalls["Chmod"] != want {
+			t.Errorf("mcs[%d] Chmod calls: got %v, want %v", i, mc.NCalls["Chmod"], want)
+		}
+	}
+
+	if want := 1; mcs[1].NClosed != want {
+		t.Errorf("mcs[1] Close calls: got %v, want %v", mcs[1].NClosed, want)
+	}
+	for _, i := range []int{0, 2} {
+		if want := 0; mcs[i].NClosed != want {
+			t.Errorf("mcs[%d] Close calls: got %v, want %v", i, mcs[i].NClosed, want)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if want := 1; mcs[i].NClosed != want {
+			t.Errorf("mcs[%d] Close calls: got %v, want %v", i, mcs[i].NClosed, want)
+		}
+	}
+}
+
+// A blockingSFTPClient signals when Chmod is entered, and blocks it
+// until released.
+type blockingSFTPClient struct {
+	*testutil.FakeSFTPClient
+
+	entered chan<- struct{}
+	release <-chan struct{}
+	err     error
+}
+
+func (c *blockingSFTPClient) Chmod(path string, mode os.FileMode) error {
+	if err := c.FakeSFTPClient.Chmod(path, mode); err != nil {
+		return err
+	}
+	c.entered <- struct{}{}
+	<-c.release
+	return c.err
+}
+
+func TestReconnectingSFTPClientOperationTimeout(t *testing.T) {
+	sc := newStallingSFTPClient(nil)
+	mc := testutil.NewFakeSFTPClient("path")
+	var i int
+	c, err := NewReconnectingSFTPClient(func() (CloseableSFTPClient, error) {
+		i++
+		if i == 1 {
+			return sc, nil
+		}
+		return mc, nil
+	}, WithOperationTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewReconnectingSFTPClient failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Chmod("path", 0654); err != ErrConnectionStalled {
+		t.Errorf("Chmod error: got %v, want %v", err, ErrConnectionStalled)
+	}
+	if want := int32(1); atomic.LoadInt32(&sc.NAborted) != want {
+		t.Errorf("Abort calls: got %v, want %v", sc.NAborted, want)
+	}
+
+	if err := c.Chmod("path", 0654); err != nil {
+		t.Errorf("Chmod failed: %v", err)
+	}
+	if want := 2; i != want {
+		t.Errorf("dialer calls: got %v, want %v", i, want)
+	}
+}
+
+func TestReconnectingSFTPClientKeepalive(t *testing.T) {
+	tsts := []struct {
+		Name      string
+		Keepalive func(n int32) error
+	}{
+		{"Error", func(n int32) error {
+			if n > 2 {
+				return sftp.ErrSshFxConnectionLost
+			}
+			return nil
+		}},
+		{"Timeout", func(n int32) error {
+			if n > 2 {
+				time.Sleep(time.Second)
+			}
+			return nil
+		}},
+	}
+	for _, tst := range tsts {
+		tst := tst
+		t.Run(tst.Name, func(t *testing.T) {
+			t.Parallel()
+
+			sc := newStallingSFTPClient(tst.Keepalive)
+			c, err := NewReconnectingSFTPClient(func() (CloseableSFTPClient, error) {
+				return sc, nil
+			}, WithKeepalive(time.Millisecond, 10*time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewReconnectingSFTPClient failed: %v", err)
+			}
+			defer c.Close()
+
+			// The in-flight operation fails once the keepalive gives up.
+			if err := c.Chmod("path", 0654); err != ErrConnectionStalled {
+				t.Errorf("Chmod error: got %v, want %v", err, ErrConnectionStalled)
+			}
+			if n := atomic.LoadInt32(&sc.NKeepalives); n < 3 {
+				t.Errorf("Keepalive calls: got %v, want at least 3", n)
+			}
+			if want := int32(1); atomic.LoadInt32(&sc.NAborted) != want {
+				t.Errorf("Abort calls: got %v, want %v", sc.NAborted, want)
+			}
+		})
+	}
+}
+
+// A stallingSFTPClient blocks Chmod until the connection is aborted.
+type stallingSFTPClient struct {
+	*testutil.FakeSFTPClient
+
+	keepalive   func(n int32) error
+	aborted     chan struct{}
+	abortOnce   sync.Once
+	NKeepalives int32
+	NAborted    int32
+}
+
+func newStallingSFTPClient(keepalive func(n int32) error) *stallingSFTPClient {
+	return &stallingSFTPClient{
+		FakeSFTPClient: testutil.NewFakeSFTPClient("path"),
+		keepalive:      keepalive,
+		aborted:        make(chan struct{}),
+	}
+}
+
+func (c *stallingSFTPClient) Chmod(path string, mode os.FileMode) error {
+	<-c.aborted
+	return sftp.ErrSshFxConnectionLost
+}
+
+func (c *stallingSFTPClient) Close() error {
+	return nil
+}
+
+func (c *stallingSFTPClient) Keepalive() error {
+	return c.keepalive(atomic.AddInt32(&c.NKeepalives, 1))
+}
+
+func (c *stallingSFTPClient) Abort() error {
+	atomic.AddInt32(&c.NAborted, 1)
+	c.abortOnce.Do(func() { close(c.aborted) })
+	return nil
+}
+
 func TestReconnectingSFTPClientOps(t *testing.T) {
 	tsts := []struct {
 		Name string
@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An SSHHandshakeError is returned by NewSSHClientConn if the SSH
+// handshake failed. The ssh package doesn't wrap the cause, so the
+// first read or write error on the connection is kept separately.
+type SSHHandshakeError struct {
+	// Err is the error from the ssh package.
+	Err error
+
+	// ConnErr is the first error from reading or writing the
+	// connection, or nil if the connection worked.
+	ConnErr error
+}
+
+func (e *SSHHandshakeError) Error() string { return e.Err.Error() }
+
+func (e *SSHHandshakeError) Unwrap() error { return e.ConnErr }
+
+// NewSSHClientConn is like ssh.NewClientConn, but returns an
+// SSHHandshakeError if the handshake fails.
+func NewSSHClientConn(c net.Conn, addr string, config *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	hc := &handshakeConn{Conn: c}
+	sc, chans, reqs, err := ssh.NewClientConn(hc, addr, config)
+	if err != nil {
+		return nil, nil, nil, &SSHHandshakeError{Err: err, ConnErr: hc.firstErr()}
+	}
+	return sc, chans, reqs, nil
+}
+
+// A handshakeConn records the first error from Read or Write. Errors
+// after Close are ignored, since the ssh package closes the connection
+// when the handshake fails.
+type handshakeConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func (c *handshakeConn) Read(bs []byte) (int, error) {
+	n, err := c.Conn.Read(bs)
+	c.record(err)
+	return n, err
+}
+
+func (c *handshakeConn) Write(bs []byte) (int, error) {
+	n, err := c.Conn.Write(bs)
+	c.record(err)
+	return n, err
+}
+
+func (c *handshakeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *handshakeConn) record(err error) {
+	if err == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil && !c.closed {
+		c.err = err
+	}
+}
+
+func (c *handshakeConn) firstErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
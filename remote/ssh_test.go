@@ -0,0 +1,93 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSSHClientConn(t *testing.T) {
+	ccfg := &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		cc, done := dialTestSSHServer(t, func(net.Conn) {})
+		defer done()
+
+		_, _, _, err := NewSSHClientConn(cc, "addr", ccfg)
+		var herr *SSHHandshakeError
+		if !errors.As(err, &herr) {
+			t.Fatalf("NewSSHClientConn error: got %v, want an SSHHandshakeError", err)
+		}
+		if !errors.Is(herr.ConnErr, io.EOF) {
+			t.Errorf("ConnErr: got %v, want %v", herr.ConnErr, io.EOF)
+		}
+		if !IsRetriable(err) {
+			t.Errorf("IsRetriable(%v): got false, want true", err)
+		}
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		hk, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+		if err != nil {
+			t.Fatalf("NewSignerFromKey failed: %v", err)
+		}
+		scfg := &ssh.ServerConfig{
+			PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+				return nil, errors.New("mocked")
+			},
+		}
+		scfg.AddHostKey(hk)
+
+		cc, done := dialTestSSHServer(t, func(sc net.Conn) {
+			ssh.NewServerConn(sc, scfg)
+		})
+		defer done()
+
+		_, _, _, err = NewSSHClientConn(cc, "addr", ccfg)
+		var herr *SSHHandshakeError
+		if !errors.As(err, &herr) {
+			t.Fatalf("NewSSHClientConn error: got %v, want an SSHHandshakeError", err)
+		}
+		if herr.ConnErr != nil {
+			t.Errorf("ConnErr: got %v, want nil", herr.ConnErr)
+		}
+		if IsRetriable(err) {
+			t.Errorf("IsRetriable(%v): got true, want false", err)
+		}
+	})
+}
+
+// dialTestSSHServer connects to a server that runs serve on the
+// accepted connection, and then closes it.
+func dialTestSSHServer(t *testing.T, serve func(net.Conn)) (net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		sc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer sc.Close()
+		serve(sc)
+	}()
+
+	cc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatalf("Dial failed: %v", err)
+	}
+	return cc, func() {
+		cc.Close()
+		l.Close()
+	}
+}
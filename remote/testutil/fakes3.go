@@ -0,0 +1,361 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A FakeS3 is an in-memory stand-in for an S3-compatible service,
+// with a single bucket and path-style addressing. It implements the
+// requests remote.S3Client makes. Signatures are not verified, but
+// payload hashes are.
+type FakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	uploads map[string]*fakeS3Upload
+	nextID  int
+
+	// Requests counts requests by method.
+	Requests map[string]int
+
+	// MaxKeys is the page size of listings, unless the request
+	// sets one. Zero means 1000.
+	MaxKeys int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	meta    http.Header
+	modTime time.Time
+}
+
+type fakeS3Upload struct {
+	key   string
+	meta  http.Header
+	parts map[int][]byte
+}
+
+// NewFakeS3 creates an empty bucket. Use it with httptest.NewServer.
+func NewFakeS3(bucket string) *FakeS3 {
+	return &FakeS3{
+		bucket:   bucket,
+		objects:  map[string]*fakeS3Object{},
+		uploads:  map[string]*fakeS3Upload{},
+		Requests: map[string]int{},
+	}
+}
+
+// Keys returns the keys of all objects, sorted.
+func (s *FakeS3) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the contents and user metadata of an object.
+func (s *FakeS3) Object(key string) ([]byte, map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, nil, false
+	}
+	return obj.data, fakeS3Metadata(obj.meta), true
+}
+
+// NumUploads returns the number of unfinished multipart uploads.
+func (s *FakeS3) NumUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+func (s *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Requests[r.Method]++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		fakeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	h := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(h[:]) {
+		fakeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	path := r.URL.Path
+	if path == "/"+s.bucket || path == "/"+s.bucket+"/" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			s.list(w, r.URL.Query())
+			return
+		}
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	if !strings.HasPrefix(path, "/"+s.bucket+"/") {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := path[len(s.bucket)+2:]
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := s.objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, vs := range obj.meta {
+			w.Header()[k] = vs
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		up, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		num, _ := strconv.Atoi(q.Get("partNumber"))
+		data := body
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			obj, ok := s.copySource(src)
+			if !ok {
+				fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(obj.data) || start > end {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidRange")
+				return
+			}
+			data = obj.data[start : end+1]
+		}
+		up.parts[num] = append([]byte(nil), data...)
+		etag := fakeS3ETag(data)
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etag)
+			return
+		}
+		w.Header().Set("ETag", etag)
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && s.objects[key] != nil {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		obj := &fakeS3Object{data: body, meta: fakeS3MetaHeader(r.Header), modTime: time.Now()}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			sobj, ok := s.copySource(src)
+			if !ok {
+				fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			obj.data = sobj.data
+			if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				obj.meta = sobj.meta
+			}
+			s.objects[key] = obj
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", fakeS3ETag(obj.data))
+			return
+		}
+		s.objects[key] = obj
+		w.Header().Set("ETag", fakeS3ETag(body))
+
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &fakeS3Upload{key: key, meta: fakeS3MetaHeader(r.Header), parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		up, ok := s.uploads[q.Get("uploadId")]
+		if !ok || up.key != key {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && s.objects[key] != nil {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		var data []byte
+		for i, p := range complete.Parts {
+			part, ok := up.parts[p.PartNumber]
+			if !ok || p.PartNumber != i+1 || p.ETag != fakeS3ETag(part) {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, part...)
+		}
+		s.objects[key] = &fakeS3Object{data: data, meta: up.meta, modTime: time.Now()}
+		delete(s.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list implements ListObjectsV2.
+func (s *FakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+	if v := q.Get("max-keys"); v != "" {
+		maxKeys, _ = strconv.Atoi(v)
+	}
+
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		Contents              []content
+		CommonPrefixes        []struct{ Prefix string }
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	token := q.Get("continuation-token")
+	var last string
+	for _, k := range keys {
+		name := k
+		isPrefix := false
+		if delim != "" {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				name = k[:len(prefix)+i+len(delim)]
+				isPrefix = true
+			}
+		}
+		if name <= token || name == last {
+			continue
+		}
+		if len(res.Contents)+len(res.CommonPrefixes) >= maxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = last
+			break
+		}
+		last = name
+		if isPrefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{name})
+		} else {
+			obj := s.objects[k]
+			res.Contents = append(res.Contents, content{Key: k, Size: len(obj.data), LastModified: obj.modTime.UTC().Format(time.RFC3339Nano)})
+		}
+	}
+
+	bs, err := xml.Marshal(&res)
+	if err != nil {
+		fakeS3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Write(bs)
+}
+
+// copySource looks up the object an X-Amz-Copy-Source header refers
+// to.
+func (s *FakeS3) copySource(src string) (*fakeS3Object, bool) {
+	src, err := url.PathUnescape(src)
+	if err != nil {
+		return nil, false
+	}
+	obj, ok := s.objects[strings.TrimPrefix(src, "/"+s.bucket+"/")]
+	return obj, ok
+}
+
+// fakeS3MetaHeader returns the user metadata headers of a request.
+func fakeS3MetaHeader(hdr http.Header) http.Header {
+	meta := http.Header{}
+	for k, vs := range hdr {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[k] = vs
+		}
+	}
+	return meta
+}
+
+// fakeS3Metadata converts metadata headers to the keys users set.
+func fakeS3Metadata(hdr http.Header) map[string]string {
+	meta := map[string]string{}
+	for k, vs := range hdr {
+		meta[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = vs[0]
+	}
+	return meta
+}
+
+func fakeS3ETag(data []byte) string {
+	h := md5.Sum(data)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<Error><Code>%s</Code></Error>", code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,391 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WebDAVClient talks to a WebDAV (RFC 4918) server. Paths are
+// slash-separated, unescaped, and relative to the base URL. It only
+// implements what fs.WebDAV needs, and doesn't do retries.
+type WebDAVClient struct {
+	base     *url.URL
+	client   *http.Client
+	user     string
+	password string
+	hasAuth  bool
+}
+
+// A WebDAVClientOpt is an option for NewWebDAVClient.
+type WebDAVClientOpt func(*WebDAVClient)
+
+// WithWebDAVHTTPClient sets the HTTP client to send requests with. The
+// default is http.DefaultClient.
+func WithWebDAVHTTPClient(c *http.Client) WebDAVClientOpt {
+	return func(wc *WebDAVClient) {
+		wc.client = c
+	}
+}
+
+// WithWebDAVBasicAuth makes requests use HTTP Basic authentication.
+func WithWebDAVBasicAuth(user, password string) WebDAVClientOpt {
+	return func(c *WebDAVClient) {
+		c.user = user
+		c.password = password
+		c.hasAuth = true
+	}
+}
+
+// NewWebDAVClient creates a client for the collection at the base
+// URL, like https://nas.example.com/dav/backups.
+func NewWebDAVClient(base *url.URL, opts ...WebDAVClientOpt) *WebDAVClient {
+	u := *base
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	c := &WebDAVClient{
+		base:   &u,
+		client: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// A WebDAVResource describes a file or collection.
+type WebDAVResource struct {
+	// Path is relative to the base URL, without leading or
+	// trailing slashes.
+	Path         string
+	IsCollection bool
+	Size         int64
+	LastModified time.Time
+
+	// Props holds the text of the requested properties the
+	// resource has.
+	Props map[xml.Name]string
+}
+
+// A WebDAVError is an error response from the server. It satisfies
+// errors.Is for os.ErrNotExist (including missing parents),
+// os.ErrExist (failed preconditions) and os.ErrPermission.
+type WebDAVError struct {
+	Op         string
+	Path       string
+	StatusCode int
+}
+
+func (e *WebDAVError) Error() string {
+	return fmt.Sprintf("webdav:%s %s: %s (HTTP %d)", e.Op, e.Path, http.StatusText(e.StatusCode), e.StatusCode)
+}
+
+func (e *WebDAVError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusConflict
+	case os.ErrExist:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case os.ErrPermission:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Temporary returns true if the request may succeed if retried.
+func (e *WebDAVError) Temporary() bool {
+	return e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented && e.StatusCode != http.StatusInsufficientStorage || e.StatusCode == http.StatusTooManyRequests
+}
+
+// PropFind returns information about a resource, and its members if
+// depth is 1. The resource itself is the first element. The named
+// properties are returned in WebDAVResource.Props.
+func (c *WebDAVClient) PropFind(ctx context.Context, p string, depth int, props []xml.Name) ([]WebDAVResource, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/>`)
+	for _, name := range props {
+		fmt.Fprintf(&buf, `<%s xmlns="%s"/>`, name.Local, xmlEscape(name.Space))
+	}
+	buf.WriteString(`</D:prop></D:propfind>`)
+
+	hdr := http.Header{
+		"Content-Type": {"application/xml; charset=utf-8"},
+		"Depth":        {strconv.Itoa(depth)},
+	}
+	resp, err := c.do(ctx, "propfind", "PROPFIND", p, hdr, &buf)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav:propfind %s: %w", p, err)
+	}
+
+	want := map[xml.Name]bool{}
+	for _, name := range props {
+		want[name] = true
+	}
+	var ress []WebDAVResource
+	self := -1
+	for _, r := range ms.Responses {
+		rp, err := c.relPath(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("webdav:propfind %s: %w", p, err)
+		}
+		res := WebDAVResource{Path: rp, Props: map[xml.Name]string{}}
+		for _, ps := range r.Propstats {
+			if !webDAVStatusOK(ps.Status) {
+				continue
+			}
+			for _, prop := range ps.Prop.Props {
+				switch {
+				case prop.XMLName == xml.Name{Space: "DAV:", Local: "resourcetype"}:
+					res.IsCollection = prop.Collection != nil
+				case prop.XMLName == xml.Name{Space: "DAV:", Local: "getcontentlength"}:
+					res.Size, _ = strconv.ParseInt(strings.TrimSpace(prop.Value), 10, 64)
+				case prop.XMLName == xml.Name{Space: "DAV:", Local: "getlastmodified"}:
+					res.LastModified, _ = http.ParseTime(strings.TrimSpace(prop.Value))
+				case want[prop.XMLName]:
+					res.Props[prop.XMLName] = prop.Value
+				}
+			}
+		}
+		if rp == strings.Trim(p, "/") && self < 0 {
+			self = len(ress)
+		}
+		ress = append(ress, res)
+	}
+	if self < 0 {
+		return nil, fmt.Errorf("webdav:propfind %s: missing response for the resource", p)
+	}
+	ress[0], ress[self] = ress[self], ress[0]
+	return ress, nil
+}
+
+// PropPatch sets properties of a resource. It fails unless all
+// properties were set.
+func (c *WebDAVClient) PropPatch(ctx context.Context, p string, props map[xml.Name]string) error {
+	names := make([]xml.Name, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Space != names[j].Space {
+			return names[i].Space < names[j].Space
+		}
+		return names[i].Local < names[j].Local
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop>`)
+	for _, name := range names {
+		fmt.Fprintf(&buf, `<%s xmlns="%s">%s</%s>`, name.Local, xmlEscape(name.Space), xmlEscape(props[name]), name.Local)
+	}
+	buf.WriteString(`</D:prop></D:set></D:propertyupdate>`)
+
+	hdr := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := c.do(ctx, "proppatch", "PROPPATCH", p, hdr, &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil
+	}
+	var ms webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("webdav:proppatch %s: %w", p, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !webDAVStatusOK(ps.Status) {
+				return &WebDAVError{Op: "proppatch", Path: p, StatusCode: webDAVStatusCode(ps.Status)}
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the contents of a file. The caller must close the
+// reader.
+func (c *WebDAVClient) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "get", http.MethodGet, p, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put creates, or replaces, a file. The body is sent chunked unless
+// its size is known, see http.NewRequest.
+func (c *WebDAVClient) Put(ctx context.Context, p string, body io.Reader) error {
+	if body == nil {
+		body = http.NoBody
+	}
+	resp, err := c.do(ctx, "put", http.MethodPut, p, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Mkcol creates a collection. Most servers respond with 405 Method
+// Not Allowed if the resource exists, and 409 Conflict if the parent
+// is missing.
+func (c *WebDAVClient) Mkcol(ctx context.Context, p string) error {
+	resp, err := c.do(ctx, "mkcol", "MKCOL", p+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copy copies a resource. For a collection, only the collection
+// itself is copied, not its members. If overwrite is false, it fails
+// with an error satisfying errors.Is(err, os.ErrExist) if the
+// destination exists.
+func (c *WebDAVClient) Copy(ctx context.Context, src, dst string, overwrite bool) error {
+	return c.copyMove(ctx, "copy", "COPY", src, dst, overwrite, http.Header{"Depth": {"0"}})
+}
+
+// Move renames a resource. If overwrite is false, it fails with an
+// error satisfying errors.Is(err, os.ErrExist) if the destination
+// exists. Otherwise, the destination is removed first.
+func (c *WebDAVClient) Move(ctx context.Context, src, dst string, overwrite bool) error {
+	return c.copyMove(ctx, "move", "MOVE", src, dst, overwrite, http.Header{})
+}
+
+func (c *WebDAVClient) copyMove(ctx context.Context, op, method, src, dst string, overwrite bool, hdr http.Header) error {
+	hdr.Set("Destination", c.url(dst).String())
+	hdr.Set("Overwrite", "F")
+	if overwrite {
+		hdr.Set("Overwrite", "T")
+	}
+	resp, err := c.do(ctx, op, method, src, hdr, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes a resource, including members of a collection.
+func (c *WebDAVClient) Delete(ctx context.Context, p string) error {
+	resp, err := c.do(ctx, "delete", http.MethodDelete, p, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// url returns the URL of a path.
+func (c *WebDAVClient) url(p string) *url.URL {
+	u := *c.base
+	u.Path += "/" + strings.TrimPrefix(p, "/")
+	return &u
+}
+
+// relPath converts a response href to a path relative to the base
+// URL.
+func (c *WebDAVClient) relPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	p := path.Clean("/" + u.Path)
+	base := path.Clean("/" + c.base.Path)
+	if p == base {
+		return "", nil
+	}
+	if base != "/" {
+		base += "/"
+	}
+	if !strings.HasPrefix(p, base) {
+		return "", fmt.Errorf("href outside of base URL: %s", href)
+	}
+	return p[len(base):], nil
+}
+
+// do sends a request about a path. Responses with error statuses are
+// returned as *WebDAVError.
+func (c *WebDAVClient) do(ctx context.Context, op, method, p string, hdr http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(p).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	if c.hasAuth {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &WebDAVError{Op: op, Path: strings.TrimSuffix(p, "/"), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// webDAVMultistatus is a 207 Multi-Status response body.
+type webDAVMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				Props []webDAVProp `xml:",any"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+type webDAVProp struct {
+	XMLName    xml.Name
+	Collection *struct{} `xml:"DAV: collection"`
+	Value      string    `xml:",chardata"`
+}
+
+// webDAVStatusCode parses a status line, like "HTTP/1.1 200 OK".
+func webDAVStatusCode(s string) int {
+	fs := strings.Fields(s)
+	if len(fs) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fs[1])
+	return code
+}
+
+func webDAVStatusOK(s string) bool {
+	code := webDAVStatusCode(s)
+	return code >= 200 && code < 300
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
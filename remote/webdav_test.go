@@ -0,0 +1,150 @@
+package remote
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// newTestWebDAVClient returns a client of a server storing files in
+// memory, below /dav.
+func newTestWebDAVClient(t *testing.T) *WebDAVClient {
+	t.Helper()
+
+	s := httptest.NewServer(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL + "/dav")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return NewWebDAVClient(u)
+}
+
+func TestWebDAVClientRelPath(t *testing.T) {
+	c := NewWebDAVClient(&url.URL{Scheme: "https", Host: "example.com", Path: "/dav/"})
+
+	tsts := []struct {
+		Href    string
+		Want    string
+		WantErr bool
+	}{
+		{"/dav/", "", false},
+		{"/dav", "", false},
+		{"/dav/a%20b/", "a b", false},
+		{"https://example.com/dav/a/b", "a/b", false},
+		{"/other/a", "", true},
+		{"/davx", "", true},
+	}
+	for _, tst := range tsts {
+		got, err := c.relPath(tst.Href)
+		if (err != nil) != tst.WantErr {
+			t.Errorf("relPath(%q) error: got %v, want error %v", tst.Href, err, tst.WantErr)
+		}
+		if got != tst.Want {
+			t.Errorf("relPath(%q): got %q, want %q", tst.Href, got, tst.Want)
+		}
+	}
+}
+
+func TestWebDAVClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestWebDAVClient(t)
+	prop := xml.Name{Space: "urn:test", Local: "p"}
+
+	if err := c.Mkcol(ctx, "a b"); err != nil {
+		t.Fatalf("Mkcol failed: %v", err)
+	}
+	if err := c.Put(ctx, "a b/c", strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := c.PropPatch(ctx, "a b/c", map[xml.Name]string{prop: "<&>"}); err != nil {
+		t.Fatalf("PropPatch failed: %v", err)
+	}
+
+	ress, err := c.PropFind(ctx, "a b", 1, []xml.Name{prop})
+	if err != nil {
+		t.Fatalf("PropFind failed: %v", err)
+	}
+	if len(ress) != 2 {
+		t.Fatalf("PropFind: got %+v, want 2 resources", ress)
+	}
+	if ress[0].Path != "a b" || !ress[0].IsCollection {
+		t.Errorf("PropFind[0]: got %+v, want collection %q", ress[0], "a b")
+	}
+	if ress[1].Path != "a b/c" || ress[1].IsCollection || ress[1].Size != 5 || ress[1].Props[prop] != "<&>" {
+		t.Errorf("PropFind[1]: got %+v, want file %q", ress[1], "a b/c")
+	}
+
+	rc, err := c.Get(ctx, "a b/c")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	bs, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(bs) != "hello" {
+		t.Errorf("Get: got %q, want %q", bs, "hello")
+	}
+
+	if err := c.Copy(ctx, "a b/c", "d", false); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	// Members of collections aren't copied.
+	if err := c.Copy(ctx, "a b", "f", false); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if _, err := c.PropFind(ctx, "f/c", 0, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("PropFind error: got %v, want ErrNotExist", err)
+	}
+	if err := c.Move(ctx, "a b/c", "d", false); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Move error: got %v, want ErrExist", err)
+	}
+	if err := c.Move(ctx, "a b/c", "d", true); err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	if err := c.Delete(ctx, "d"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := c.PropFind(ctx, "d", 0, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("PropFind error: got %v, want ErrNotExist", err)
+	}
+	if err := c.Put(ctx, "missing/e", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Put error: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestWebDAVErrorIsRetriable(t *testing.T) {
+	tsts := []struct {
+		Name string
+		Err  error
+		Want bool
+	}{
+		{"notFound", &WebDAVError{StatusCode: http.StatusNotFound}, false},
+		{"insufficientStorage", &WebDAVError{StatusCode: http.StatusInsufficientStorage}, false},
+		{"badGateway", &WebDAVError{StatusCode: http.StatusBadGateway}, true},
+		{"tooManyRequests", &WebDAVError{StatusCode: http.StatusTooManyRequests}, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if got := IsRetriable(tst.Err); got != tst.Want {
+				t.Errorf("IsRetriable: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+)
+
+// A Deduplicator creates files by hardlinking stored files with the
+// same content and metadata, instead of uploading them. fs.COW
+// implements it.
+type Deduplicator interface {
+	// LinkContent creates the file from a stored file with the
+	// key. Returns false if there is none.
+	LinkContent(path fs.Path, key *fs.ContentKey) (bool, error)
+
+	// AddContent records that a complete file has the key.
+	AddContent(path fs.Path, key *fs.ContentKey) error
+}
+
+// dedupFile links a regular file to a stored copy, if there is one.
+// Otherwise, it is uploaded, and added to the index. The source is
+// read twice, so this is only worth it if the destination is slower.
+func (u *Upload) dedupFile(fp *filePair, byteCount *uint64) error {
+	key, err := u.contentKey(fp)
+	if fs.IsNotExist(err) {
+		// The file was removed between listing and transferring.
+		atomic.AddUint64(&u.stats.DiscardedFiles, 1)
+		return errDiscarded
+	} else if err != nil {
+		return err
+	}
+
+	if linked, err := u.dedup.LinkContent(fp.path, key); err != nil {
+		glog.Warningf("Looking up %q in the content index failed (ignored): %v", fp.path, err)
+	} else if linked {
+		glog.V(1).Infof("Linked file %q to stored content (%d bytes).", fp.path, fp.src.Size())
+		atomic.AddUint64(&u.stats.DedupedBytes, uint64(fp.src.Size()))
+		atomic.AddUint64(&u.stats.DedupedFiles, 1)
+		return nil
+	}
+
+	// The index gets the hash of what was uploaded, in case the
+	// file changed after hashing.
+	h := sha256.New()
+	if err := u.copyFile(fp, byteCount, h); err != nil {
+		return err
+	}
+	copy(key.Hash[:], h.Sum(nil))
+	if err := u.dedup.AddContent(fp.path, key); err != nil {
+		glog.Warningf("Adding %q to the content index failed (ignored): %v", fp.path, err)
+	}
+	return nil
+}
+
+// contentKey hashes a source file, and returns the key it will have
+// at the destination.
+func (u *Upload) contentKey(fp *filePair) (*fs.ContentKey, error) {
+	sum, err := u.hashSource(fp.path)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid := u.destOwner(fp.src)
+	return &fs.ContentKey{
+		Hash:    sum,
+		Size:    fp.src.Size(),
+		Mode:    fp.src.Mode() & commonModeMask,
+		UID:     uid,
+		GID:     gid,
+		ModTime: fp.src.ModTime().Unix(),
+	}, nil
+}
+
+// hashSource returns the SHA-256 hash of a source file. If the source
+// is a fs.FileHasher, it is asked to do it.
+func (u *Upload) hashSource(path fs.Path) ([sha256.Size]byte, error) {
+	if h, ok := u.src.(fs.FileHasher); ok {
+		return h.HashFile(path)
+	}
+
+	var sum [sha256.Size]byte
+	f, err := u.src.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// destOwner returns the owner a file gets at the destination. The
+// value -1 means the current user or group.
+func (u *Upload) destOwner(fi os.FileInfo) (int, int) {
+	attrs, ok := fs.FileAttrsFromFileInfo(fi)
+	if !ok {
+		attrs.UID = -1
+		attrs.GID = -1
+	}
+	return u.uidMap(attrs.UID), u.gidMap(attrs.GID)
+}
@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestUploadRunDedup(t *testing.T) {
+	src := fs.NewMemory()
+	if err := src.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	writeMemoryFile(t, src, "a/file1", "content 1")
+	writeMemoryFile(t, src, "file2", "content 2")
+	writeMemoryFile(t, src, "empty", "")
+
+	dest := fs.NewMemory()
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(host string, i int) UploadStats {
+		t.Helper()
+
+		cow, err := fs.NewCOW(dest, host, start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		u := NewUpload(cow, src, WithConcurrency(1), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithDeduplicator(cow))
+		if err := u.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if err := cow.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		return u.Stats()
+	}
+
+	stats := run("host1", 0)
+	if stats.DedupedFiles != 0 || stats.UploadedFiles != 3 {
+		t.Errorf("Run 0: got %d deduped and %d uploaded files, want 0 and 3", stats.DedupedFiles, stats.UploadedFiles)
+	}
+
+	// Moved files are not kept, but deduplicated, also in another
+	// host. Empty files are always uploaded.
+	if err := src.Rename("file2", "a/file3"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	stats = run("host1", 1)
+	if stats.DedupedFiles != 1 || stats.DedupedBytes != 9 || stats.KeptFiles != 2 {
+		t.Errorf("Run 1: got %d deduped files (%d bytes) and %d kept, want 1 (9 bytes) and 2", stats.DedupedFiles, stats.DedupedBytes, stats.KeptFiles)
+	}
+
+	if err := src.Rename("a/file3", "file4"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	stats = run("host2", 2)
+	if stats.DedupedFiles != 1 || stats.KeptFiles != 2 || stats.UploadedFiles != 0 {
+		t.Errorf("Run 2: got %d deduped, %d kept and %d uploaded files, want 1, 2 and 0", stats.DedupedFiles, stats.KeptFiles, stats.UploadedFiles)
+	}
+
+	fr, err := dest.Open("host2/2021-01-01T00-02-00.000000/file4")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fi, err := fr.Stat()
+	fr.Close()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if attrs, _ := fs.FileAttrsFromFileInfo(fi); attrs.NLinks != 3 {
+		t.Errorf("NLinks: got %v, want 3", attrs.NLinks)
+	}
+}
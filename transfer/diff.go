@@ -0,0 +1,215 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+)
+
+// A DiffChange describes how a file differs between two trees.
+type DiffChange rune
+
+const (
+	Added    DiffChange = 'A'
+	Removed  DiffChange = 'R'
+	Modified DiffChange = 'M'
+
+	// MetadataChanged means only the permissions or owner
+	// changed.
+	MetadataChanged DiffChange = 'm'
+)
+
+// String returns a lowercase name of the change.
+func (c DiffChange) String() string {
+	switch c {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case MetadataChanged:
+		return "metadata"
+	default:
+		return "unknown"
+	}
+}
+
+// A DiffEntry is a file or directory that differs. Old is nil if it
+// was added, and New is nil if it was removed.
+type DiffEntry struct {
+	Path   fs.Path
+	Change DiffChange
+	Old    os.FileInfo
+	New    os.FileInfo
+}
+
+// A Diff compares two file trees, using the same rules as an Upload
+// uses to decide what to transfer. While Run is executing, Stats can
+// be used to get progress information.
+type Diff struct {
+	process
+
+	sharedInodes bool
+	stats        ProcessStats
+	fun          func(*DiffEntry)
+}
+
+// NewDiff creates a diff from the old tree to the new tree. The
+// function is called with each difference, concurrently, in no
+// particular order. The contents of removed directories are reported
+// as removed, too.
+func NewDiff(oldFS, newFS fs.ReadableFileSystem, fun func(*DiffEntry), opts ...DiffOpt) *Diff {
+	d := &Diff{
+		process: process{
+			src:          newFS,
+			dest:         oldFS,
+			ignoreFilter: func(fs.Path, os.FileInfo) bool { return false },
+			nconc:        1,
+		},
+		fun: fun,
+	}
+	d.process.stats = &d.stats
+	d.process.transfer = d.compare
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// A DiffOpt is an option to NewDiff.
+type DiffOpt func(*Diff)
+
+// WithDiffConcurrency sets the concurrency, in files.
+func WithDiffConcurrency(nconc int) DiffOpt {
+	return func(d *Diff) {
+		d.nconc = nconc
+	}
+}
+
+// WithSharedInodes tells the diff that both trees are in the same
+// file system, and unchanged files are hardlinked, like the snapshots
+// of a COW. Files with the same inode are then unchanged, without
+// comparing their metadata.
+func WithSharedInodes() DiffOpt {
+	return func(d *Diff) {
+		d.sharedInodes = true
+	}
+}
+
+// Stats returns statistics about the trees compared so far. The
+// source is the new tree.
+func (d *Diff) Stats() ProcessStats {
+	var ps ProcessStats
+	ps.CopyFrom(&d.stats)
+	return ps
+}
+
+// compare reports the differences of a file pair. It is the transfer
+// function of the process.
+func (d *Diff) compare(ctx context.Context, fp *filePair) error {
+	if fp.src == nil && fp.dest.IsDir() {
+		// The process doesn't list removed directories.
+		return d.removeTree(fp.path, fp.dest)
+	}
+
+	c, err := d.change(fp)
+	if err != nil {
+		return err
+	}
+	if c != 0 {
+		d.fun(&DiffEntry{Path: fp.path, Change: c, Old: fp.dest, New: fp.src})
+	}
+	return nil
+}
+
+// removeTree reports a removed directory, and everything in it.
+func (d *Diff) removeTree(path fs.Path, fi os.FileInfo) error {
+	if d.ignoreFilter("/"+path+"/", fi) {
+		return nil
+	}
+	d.fun(&DiffEntry{Path: path, Change: Removed, Old: fi})
+
+	fis, err := readdir(d.dest, path)
+	if fs.IsPermission(err) {
+		glog.Warningf("Listing directory failed (ignored): %v", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, cfi := range fis {
+		cpath := path.Resolve(fs.Path(cfi.Name()))
+		if cfi.IsDir() {
+			if err := d.removeTree(cpath, cfi); err != nil {
+				return err
+			}
+		} else if !d.ignoreFilter("/"+cpath, cfi) {
+			d.fun(&DiffEntry{Path: cpath, Change: Removed, Old: cfi})
+		}
+	}
+	return nil
+}
+
+// change returns how a file pair differs, or zero if it doesn't.
+func (d *Diff) change(fp *filePair) (DiffChange, error) {
+	op := fp.FileOperation()
+	switch op {
+	case Create:
+		return Added, nil
+	case Remove:
+		return Removed, nil
+	}
+
+	if fp.src.Mode().Type() != fp.dest.Mode().Type() {
+		return Modified, nil
+	}
+
+	srcAttrs, srcOK := fs.FileAttrsFromFileInfo(fp.src)
+	destAttrs, destOK := fs.FileAttrsFromFileInfo(fp.dest)
+	if d.sharedInodes && !fp.src.IsDir() && srcOK && destOK && srcAttrs.Inode != 0 && srcAttrs.Inode == destAttrs.Inode {
+		return 0, nil
+	}
+
+	switch fp.src.Mode().Type() {
+	case os.ModeDir:
+		if op == Update {
+			return MetadataChanged, nil
+		}
+
+	case os.ModeSymlink:
+		// Symlinks are always recreated by an upload, so their
+		// times are meaningless.
+		srcTarget, err := d.src.Readlink(fp.path)
+		if err != nil {
+			return 0, err
+		}
+		destTarget, err := d.dest.Readlink(fp.path)
+		if err != nil {
+			return 0, err
+		}
+		if srcTarget != destTarget {
+			return Modified, nil
+		}
+		return 0, nil
+
+	default:
+		if op == Update {
+			md := fp.dest.ModTime().Sub(fp.src.ModTime())
+			if md < 0 {
+				md = -md
+			}
+			if fp.src.Size() != fp.dest.Size() || md > 1*time.Second {
+				return Modified, nil
+			}
+			return MetadataChanged, nil
+		}
+	}
+
+	if srcOK && destOK && (srcAttrs.UID != destAttrs.UID || srcAttrs.GID != destAttrs.GID) {
+		return MetadataChanged, nil
+	}
+	return 0, nil
+}
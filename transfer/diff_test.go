@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestDiffRun(t *testing.T) {
+	src := fs.NewMemory()
+	for _, dir := range []fs.Path{"a", "gone"} {
+		if err := src.Mkdir(dir, 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	writeMemoryFile(t, src, "a/same", "same")
+	writeMemoryFile(t, src, "a/mod", "old")
+	writeMemoryFile(t, src, "a/meta", "meta")
+	writeMemoryFile(t, src, "gone/file", "gone")
+	if err := src.Symlink("a/same", "link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	dest := fs.NewMemory()
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(i int) {
+		t.Helper()
+
+		cow, err := fs.NewCOW(dest, "host", start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		u := NewUpload(cow, src, WithConcurrency(1), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }))
+		if err := u.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if err := cow.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+	}
+
+	run(0)
+	writeMemoryFile(t, src, "a/mod", "modified")
+	if err := src.Chmod("a/meta", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := src.RemoveAll("gone"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	writeMemoryFile(t, src, "new", "new")
+	run(1)
+
+	oldFS, err := fs.OpenCOWSnapshot(dest, "host", "latest~1")
+	if err != nil {
+		t.Fatalf("OpenCOWSnapshot failed: %v", err)
+	}
+	newFS, err := fs.OpenCOWSnapshot(dest, "host", "latest")
+	if err != nil {
+		t.Fatalf("OpenCOWSnapshot failed: %v", err)
+	}
+
+	tsts := []struct {
+		Name string
+		Opts []DiffOpt
+	}{
+		{"metadata", nil},
+		{"sharedInodes", []DiffOpt{WithSharedInodes()}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			got := map[fs.Path]DiffChange{}
+			d := NewDiff(oldFS, newFS, func(e *DiffEntry) {
+				mu.Lock()
+				defer mu.Unlock()
+				got[e.Path] = e.Change
+			}, append([]DiffOpt{WithDiffConcurrency(4)}, tst.Opts...)...)
+			if err := d.Run(context.Background()); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			want := map[fs.Path]DiffChange{
+				"a/meta":    MetadataChanged,
+				"a/mod":     Modified,
+				"gone":      Removed,
+				"gone/file": Removed,
+				"new":       Added,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Run: got %v, want %v", diffChangeStrings(got), diffChangeStrings(want))
+			}
+		})
+	}
+}
+
+// diffChangeStrings formats changes for test errors.
+func diffChangeStrings(m map[fs.Path]DiffChange) []string {
+	var ss []string
+	for p, c := range m {
+		ss = append(ss, string(p)+"="+c.String())
+	}
+	sort.Strings(ss)
+	return ss
+}
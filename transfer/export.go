@@ -0,0 +1,176 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+)
+
+// ExportTar writes a file system as a tar archive. Hardlinks within
+// the file system, symlinks, special files, modes, owners and
+// modification times are preserved. Sockets are skipped. Entries are
+// written depth-first, in name order.
+func ExportTar(ctx context.Context, w io.Writer, src fs.ReadableFileSystem) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]fs.Path{}
+
+	err := walkTree(ctx, src, func(path fs.Path, fi os.FileInfo) error {
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := src.Readlink(path)
+			if err != nil {
+				return err
+			}
+			link = string(target)
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			glog.Infof("Skipped socket %q.", path)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = string(path)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		attrs, ok := fs.FileAttrsFromFileInfo(fi)
+		if ok {
+			hdr.Uid = attrs.UID
+			hdr.Gid = attrs.GID
+			// FileInfoHeader looks up names on this machine,
+			// which may not match the file system's IDs.
+			hdr.Uname = ""
+			hdr.Gname = ""
+		}
+
+		if ok && fi.Mode().IsRegular() && attrs.NLinks > 1 && attrs.Inode != 0 {
+			if first, ok := links[attrs.Inode]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = string(first)
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			links[attrs.Inode] = path
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			return copyFileTo(tw, src, path, fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExportZip writes a file system as a zip archive. Symlinks are
+// stored the way Info-ZIP does, as files containing the target. Zip
+// files don't support hardlinks and owners, so hardlinked files are
+// stored once per path, and owners are lost. Special files are
+// skipped. Entries are written depth-first, in name order.
+func ExportZip(ctx context.Context, w io.Writer, src fs.ReadableFileSystem) error {
+	zw := zip.NewWriter(w)
+
+	err := walkTree(ctx, src, func(path fs.Path, fi os.FileInfo) error {
+		switch fi.Mode().Type() {
+		case 0, os.ModeDir, os.ModeSymlink:
+		default:
+			glog.Infof("Skipped special file %q (type %s).", path, fi.Mode().Type().String())
+			return nil
+		}
+
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = string(path)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch fi.Mode().Type() {
+		case 0:
+			return copyFileTo(fw, src, path, fi.Size())
+
+		case os.ModeSymlink:
+			target, err := src.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, string(target))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// walkTree calls the function for each file and directory in the
+// file system, depth-first and in name order. Directories are visited
+// before their contents.
+func walkTree(ctx context.Context, src fs.ReadableFileSystem, fun func(fs.Path, os.FileInfo) error) error {
+	var rec func(dir fs.Path) error
+	rec = func(dir fs.Path) error {
+		fis, err := readdir(src, dir)
+		if err != nil {
+			return err
+		}
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+
+		for _, fi := range fis {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			path := dir.Resolve(fs.Path(fi.Name()))
+			if err := fun(path, fi); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				if err := rec(path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return rec(".")
+}
+
+// copyFileTo writes the contents of a file. The file must still have
+// the listed size, since archive headers have already been written.
+func copyFileTo(w io.Writer, src fs.ReadableFileSystem, path fs.Path, size int64) error {
+	fr, err := src.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	if _, err := io.CopyN(w, fr, size); err == io.EOF {
+		return &os.PathError{Op: "export", Path: string(path), Err: io.ErrUnexpectedEOF}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
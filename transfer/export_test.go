@@ -0,0 +1,169 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+// newExportTestFS returns a file system with a directory, files, a
+// hardlink and a symlink.
+func newExportTestFS(t *testing.T) (*fs.Memory, time.Time) {
+	t.Helper()
+
+	m := fs.NewMemory()
+	if err := m.Mkdir("a", 0750, 1000, 1001); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	writeMemoryFile(t, m, "a/file", "hello")
+	writeMemoryFile(t, m, "b", "world!")
+	if err := m.Chmod("a/file", 0640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := m.Lchown("a/file", 1000, 1001); err != nil {
+		t.Fatalf("Lchown failed: %v", err)
+	}
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := m.Chtimes("a/file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := m.Link("a/file", "c"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if err := m.Symlink("a/file", "d"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	return m, mtime
+}
+
+func TestExportTar(t *testing.T) {
+	m, mtime := newExportTestFS(t)
+
+	var buf bytes.Buffer
+	if err := ExportTar(context.Background(), &buf, m); err != nil {
+		t.Fatalf("ExportTar failed: %v", err)
+	}
+
+	type entry struct {
+		Name     string
+		Type     byte
+		Mode     int64
+		UID, GID int
+		Linkname string
+		Content  string
+	}
+	var got []entry
+	hdrs := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		bs, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		hdrs[hdr.Name] = hdr
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("ExportTar %q: got names %q/%q, want none", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+		e := entry{Name: hdr.Name, Type: hdr.Typeflag, Mode: hdr.Mode & 0777, Linkname: hdr.Linkname, Content: string(bs)}
+		if hdr.Name == "a/" || hdr.Name == "a/file" {
+			e.UID, e.GID = hdr.Uid, hdr.Gid
+		}
+		got = append(got, e)
+	}
+
+	want := []entry{
+		{Name: "a/", Type: tar.TypeDir, Mode: 0750, UID: 1000, GID: 1001},
+		{Name: "a/file", Type: tar.TypeReg, Mode: 0640, UID: 1000, GID: 1001, Content: "hello"},
+		{Name: "b", Type: tar.TypeReg, Mode: 0666, Content: "world!"},
+		{Name: "c", Type: tar.TypeLink, Mode: 0640, Linkname: "a/file"},
+		{Name: "d", Type: tar.TypeSymlink, Mode: 0777, Linkname: "a/file"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ExportTar: got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ExportTar %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if hdr := hdrs["a/file"]; hdr != nil && !hdr.ModTime.Equal(mtime) {
+		t.Errorf("ExportTar ModTime: got %v, want %v", hdr.ModTime, mtime)
+	}
+}
+
+func TestExportZip(t *testing.T) {
+	m, mtime := newExportTestFS(t)
+
+	var buf bytes.Buffer
+	if err := ExportZip(context.Background(), &buf, m); err != nil {
+		t.Fatalf("ExportZip failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+
+	type entry struct {
+		Name    string
+		Mode    os.FileMode
+		Content string
+	}
+	var got []entry
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		bs, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		got = append(got, entry{Name: f.Name, Mode: f.Mode(), Content: string(bs)})
+
+		if f.Name == "a/file" && !f.Modified.Equal(mtime) {
+			t.Errorf("ExportZip Modified: got %v, want %v", f.Modified, mtime)
+		}
+	}
+
+	want := []entry{
+		{Name: "a/", Mode: os.ModeDir | 0750},
+		{Name: "a/file", Mode: 0640, Content: "hello"},
+		{Name: "b", Mode: 0666, Content: "world!"},
+		{Name: "c", Mode: 0640, Content: "hello"},
+		{Name: "d", Mode: os.ModeSymlink | 0777, Content: "a/file"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ExportZip: got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ExportZip %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestExportCanceled(t *testing.T) {
+	m, _ := newExportTestFS(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ExportTar(ctx, ioutil.Discard, m); err != context.Canceled {
+		t.Errorf("ExportTar error: got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,182 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/tommie/fisy/fs"
+)
+
+// An ignoreScope holds the rules of the ignore files found in a
+// directory. Rules of ancestor directories are in the parent scope.
+type ignoreScope struct {
+	parent *ignoreScope
+	dir    fs.Path
+	rules  []ignoreRule
+}
+
+// An ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+	gi     *ignore.GitIgnore
+	negate bool
+}
+
+// ignored returns whether the path, relative to the root, matches
+// the rules. As in gitignore, the last matching rule of the deepest
+// directory decides. A nil scope ignores nothing.
+func (s *ignoreScope) ignored(p fs.Path, isDir bool) bool {
+	for sc := s; sc != nil; sc = sc.parent {
+		rel := "/" + strings.TrimPrefix(path.Clean("/"+string(p)), path.Clean("/"+string(sc.dir)))
+		rel = path.Clean(rel)
+		if isDir {
+			rel += "/"
+		}
+		for i := len(sc.rules) - 1; i >= 0; i-- {
+			if sc.rules[i].gi.MatchesPath(rel) {
+				return !sc.rules[i].negate
+			}
+		}
+	}
+	return false
+}
+
+// parseIgnoreRules parses the lines of an ignore file. Each line is
+// compiled separately, so a negation can override a rule in another
+// file.
+func parseIgnoreRules(lines []string) []ignoreRule {
+	var ret []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var negate bool
+		if strings.HasPrefix(line, "!") {
+			negate = true
+			line = line[1:]
+		}
+		ret = append(ret, ignoreRule{gi: ignore.CompileIgnoreLines(line), negate: negate})
+	}
+	return ret
+}
+
+// scopeIgnoreFiles reads the ignore files among the source files in a
+// directory, and attaches the resulting scope to the file pairs.
+func (p *process) scopeIgnoreFiles(dir fs.Path, fps []*filePair, parent *ignoreScope) error {
+	scope, err := p.readIgnoreScope(dir, fps, parent)
+	if err != nil {
+		return err
+	}
+	for _, fp := range fps {
+		fp.ignores = scope
+	}
+	return nil
+}
+
+// readIgnoreScope reads the ignore files among the source files in a
+// directory, and returns the scope for its children. Later file names
+// in ignoreFiles take precedence.
+func (p *process) readIgnoreScope(dir fs.Path, fps []*filePair, parent *ignoreScope) (*ignoreScope, error) {
+	if len(p.ignoreFiles) == 0 {
+		return parent, nil
+	}
+
+	byPath := make(map[fs.Path]*filePair, len(fps))
+	for _, fp := range fps {
+		byPath[fp.path] = fp
+	}
+
+	var rules []ignoreRule
+	for _, name := range p.ignoreFiles {
+		fp := byPath[dir.Resolve(fs.Path(name))]
+		if fp == nil || fp.src == nil || !fp.src.Mode().IsRegular() {
+			continue
+		}
+		lines, err := readIgnoreFile(p.src, fp.path)
+		if fs.IsPermission(err) {
+			glog.Warningf("Reading ignore file failed (ignored): %v", err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parseIgnoreRules(lines)...)
+	}
+	if len(rules) == 0 {
+		return parent, nil
+	}
+	return &ignoreScope{parent: parent, dir: dir, rules: rules}, nil
+}
+
+// cacheDirTagName is the name of the marker file in the Cache
+// Directory Tagging Specification,
+// https://bford.info/cachedir/.
+const cacheDirTagName = "CACHEDIR.TAG"
+
+// cacheDirTagSignature is the required start of a CACHEDIR.TAG file.
+var cacheDirTagSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// hasExcludeMarker returns whether any of the source files in a
+// directory is an exclusion marker. A CACHEDIR.TAG file is only a
+// marker if it starts with the signature.
+func (p *process) hasExcludeMarker(fps []*filePair) (bool, error) {
+	for _, fp := range fps {
+		if fp.src == nil || !fp.src.Mode().IsRegular() {
+			continue
+		}
+		for _, name := range p.excludeMarkers {
+			if fp.src.Name() != name {
+				continue
+			}
+			if name != cacheDirTagName {
+				return true, nil
+			}
+			ok, err := isCacheDirTag(p.src, fp.path)
+			if fs.IsPermission(err) {
+				glog.Warningf("Reading cache directory tag failed (ignored): %v", err)
+			} else if err != nil {
+				return false, err
+			} else if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isCacheDirTag returns whether the file has a valid CACHEDIR.TAG
+// signature.
+func isCacheDirTag(src fs.ReadableFileSystem, path fs.Path) (bool, error) {
+	fr, err := src.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fr.Close()
+
+	bs := make([]byte, len(cacheDirTagSignature))
+	if _, err := io.ReadFull(fr, bs); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(bs, cacheDirTagSignature), nil
+}
+
+// readIgnoreFile returns the lines of an ignore file.
+func readIgnoreFile(src fs.ReadableFileSystem, path fs.Path) ([]string, error) {
+	fr, err := src.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bs), "\n"), nil
+}
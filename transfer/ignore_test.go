@@ -0,0 +1,173 @@
+package transfer
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestIgnoreScopeIgnored(t *testing.T) {
+	root := &ignoreScope{
+		dir:   fs.Path("."),
+		rules: parseIgnoreRules([]string{"# comment", "*.log", "build/", "/top", "!keep.log", ""}),
+	}
+	sub := &ignoreScope{
+		parent: root,
+		dir:    fs.Path("a/b"),
+		rules:  parseIgnoreRules([]string{"!debug.log", "/local", "*.tmp"}),
+	}
+
+	tsts := []struct {
+		name  string
+		scope *ignoreScope
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"nil", nil, "x.log", false, false},
+		{"glob", root, "x.log", false, true},
+		{"globNested", root, "a/x.log", false, true},
+		{"negated", root, "a/keep.log", false, false},
+		{"dirOnlyFile", root, "build", false, false},
+		{"dirOnlyDir", root, "a/build", true, true},
+		{"anchored", root, "top", false, true},
+		{"anchoredNested", root, "a/top", false, false},
+		{"other", root, "a/x.txt", false, false},
+
+		{"inherited", sub, "a/b/x.log", false, true},
+		{"subNegatesParent", sub, "a/b/debug.log", false, false},
+		{"subAnchored", sub, "a/b/local", false, true},
+		{"subAnchoredNested", sub, "a/b/c/local", false, false},
+		{"subGlob", sub, "a/b/c/x.tmp", false, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			if got := tst.scope.ignored(fs.Path(tst.path), tst.isDir); got != tst.want {
+				t.Errorf("ignored(%q): got %v, want %v", tst.path, got, tst.want)
+			}
+		})
+	}
+}
+
+func TestUploadRunIgnoreFiles(t *testing.T) {
+	src := fs.NewMemory()
+	for _, dir := range []string{"a", "a/b", "c"} {
+		if err := src.Mkdir(fs.Path(dir), 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	files := map[string]string{
+		".fisyignore":     "*.o\n/c/\n",
+		"x.o":             "",
+		"x.c":             "",
+		"a/.gitignore":    "*.c\n",
+		"a/x.c":           "",
+		"a/b/.fisyignore": "!x.o\n",
+		"a/b/x.o":         "",
+		"a/b/y.c":         "",
+		"c/x.c":           "",
+	}
+	for name, content := range files {
+		writeMemoryFile(t, src, name, content)
+	}
+
+	dest := fs.NewMemory()
+	u := NewUpload(dest, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithIgnoreFiles(".gitignore", ".fisyignore"))
+	if err := u.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := listMemoryFiles(t, dest, ".")
+	want := []string{".fisyignore", "a", "a/.gitignore", "a/b", "a/b/.fisyignore", "a/b/x.o", "x.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run: got %q, want %q", got, want)
+	}
+
+	// A changed ignore file takes effect on the next run.
+	writeMemoryFile(t, src, "a/.gitignore", "")
+	u = NewUpload(dest, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithIgnoreFiles(".gitignore", ".fisyignore"))
+	if err := u.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got = listMemoryFiles(t, dest, ".")
+	want = []string{".fisyignore", "a", "a/.gitignore", "a/b", "a/b/.fisyignore", "a/b/x.o", "a/b/y.c", "a/x.c", "x.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run (changed): got %q, want %q", got, want)
+	}
+}
+
+func writeMemoryFile(t *testing.T, m *fs.Memory, name, content string) {
+	t.Helper()
+
+	fw, err := m.Create(fs.Path(name))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, content); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// listMemoryFiles returns the paths of all files in the directory,
+// recursively and sorted.
+func listMemoryFiles(t *testing.T, m *fs.Memory, dir fs.Path) []string {
+	t.Helper()
+
+	fr, err := m.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fis, err := fr.Readdir()
+	fr.Close()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+
+	var ret []string
+	for _, fi := range fis {
+		p := dir.Resolve(fs.Path(fi.Name()))
+		ret = append(ret, string(p))
+		if fi.Mode()&os.ModeDir != 0 {
+			ret = append(ret, listMemoryFiles(t, m, p)...)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestUploadRunExcludeIfPresent(t *testing.T) {
+	src := fs.NewMemory()
+	for _, dir := range []string{"cache", "fake", "marked", "plain"} {
+		if err := src.Mkdir(fs.Path(dir), 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		writeMemoryFile(t, src, dir+"/file", "")
+	}
+	writeMemoryFile(t, src, "cache/CACHEDIR.TAG", "Signature: 8a477f597d28d172789f06886806bc55\n# A cache.\n")
+	writeMemoryFile(t, src, "fake/CACHEDIR.TAG", "Signature: none\n")
+	writeMemoryFile(t, src, "marked/.nobackup", "")
+
+	dest := fs.NewMemory()
+	u := NewUpload(dest, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithExcludeIfPresent("CACHEDIR.TAG", ".nobackup"))
+	if err := u.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := listMemoryFiles(t, dest, ".")
+	want := []string{"fake", "fake/CACHEDIR.TAG", "fake/file", "plain", "plain/file"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run: got %q, want %q", got, want)
+	}
+	if got, want := int(u.Stats().IgnoredDirectories), 2; got != want {
+		t.Errorf("Run stats.IgnoredDirectories: got %v, want %v", got, want)
+	}
+}
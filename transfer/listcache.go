@@ -0,0 +1,220 @@
+package transfer
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+// A ListingCache remembers destination directory listings between
+// runs, so unchanged directories don't have to be listed again. It
+// must be safe for concurrent use.
+type ListingCache interface {
+	// Get returns the destination listing of a directory, if the
+	// source directory still has the given key.
+	Get(path fs.Path, key ListingKey) ([]os.FileInfo, bool)
+
+	// Put records the destination listing of a directory, after
+	// all its children have been transferred.
+	Put(path fs.Path, key ListingKey, fis []os.FileInfo)
+
+	// Delete forgets a directory.
+	Delete(path fs.Path)
+}
+
+// A ListingKey identifies a version of a source directory. Adding,
+// removing or renaming a child changes the modification time.
+type ListingKey struct {
+	ModTime int64
+	Inode   uint64
+}
+
+// listingKeyFromFileInfo returns the key of a source directory, or
+// false if the file system doesn't have inodes.
+func listingKeyFromFileInfo(fi os.FileInfo) (ListingKey, bool) {
+	attrs, ok := fs.FileAttrsFromFileInfo(fi)
+	if !ok || attrs.Inode == 0 {
+		return ListingKey{}, false
+	}
+	return ListingKey{ModTime: fi.ModTime().UnixNano(), Inode: attrs.Inode}, true
+}
+
+// A FileListingCache is a ListingCache stored in a local file. The
+// listings are only valid for one generation of the destination,
+// e.g. the COW snapshot that was written. Only listings put since
+// opening are saved.
+type FileListingCache struct {
+	path string
+
+	mu   sync.Mutex
+	old  map[fs.Path]*cachedListing
+	curr map[fs.Path]*cachedListing
+}
+
+// OpenFileListingCache reads a cache file. If it doesn't exist, or
+// was saved for another generation, the cache starts out empty.
+func OpenFileListingCache(path, generation string) (*FileListingCache, error) {
+	c := &FileListingCache{
+		path: path,
+		old:  map[fs.Path]*cachedListing{},
+		curr: map[fs.Path]*cachedListing{},
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil {
+		// A corrupt cache is only a performance problem.
+		return c, nil
+	}
+	if cf.Version == cacheFileVersion && cf.Generation == generation {
+		c.old = cf.Listings
+	}
+	return c, nil
+}
+
+// Save writes the listings put since opening, for the given
+// generation. The file is replaced atomically.
+func (c *FileListingCache) Save(generation string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	cf := cacheFile{
+		Version:    cacheFileVersion,
+		Generation: generation,
+		Listings:   c.curr,
+	}
+	if err := gob.NewEncoder(f).Encode(&cf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+func (c *FileListingCache) Get(path fs.Path, key ListingKey) ([]os.FileInfo, bool) {
+	c.mu.Lock()
+	cl := c.old[path]
+	c.mu.Unlock()
+
+	if cl == nil || cl.Key != key {
+		return nil, false
+	}
+	fis := make([]os.FileInfo, 0, len(cl.Entries))
+	for i := range cl.Entries {
+		fis = append(fis, &cl.Entries[i])
+	}
+	return fis, true
+}
+
+func (c *FileListingCache) Put(path fs.Path, key ListingKey, fis []os.FileInfo) {
+	cl := &cachedListing{Key: key, Entries: make([]cachedFileInfo, 0, len(fis))}
+	for _, fi := range fis {
+		cl.Entries = append(cl.Entries, cachedFileInfo{
+			FName:    fi.Name(),
+			FSize:    fi.Size(),
+			FMode:    fi.Mode(),
+			FModTime: fi.ModTime(),
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.curr[path] = cl
+}
+
+func (c *FileListingCache) Delete(path fs.Path) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.old, path)
+	delete(c.curr, path)
+}
+
+// cacheFileVersion is incremented on incompatible changes.
+const cacheFileVersion = 1
+
+// A cacheFile is the on-disk format of a FileListingCache.
+type cacheFile struct {
+	Version    int
+	Generation string
+	Listings   map[fs.Path]*cachedListing
+}
+
+type cachedListing struct {
+	Key     ListingKey
+	Entries []cachedFileInfo
+}
+
+// A cachedFileInfo is the part of a destination file that is
+// compared to the source. It has no system-specific information.
+type cachedFileInfo struct {
+	FName    string
+	FSize    int64
+	FMode    os.FileMode
+	FModTime time.Time
+}
+
+func (fi *cachedFileInfo) Name() string       { return fi.FName }
+func (fi *cachedFileInfo) Size() int64        { return fi.FSize }
+func (fi *cachedFileInfo) Mode() os.FileMode  { return fi.FMode }
+func (fi *cachedFileInfo) ModTime() time.Time { return fi.FModTime }
+func (fi *cachedFileInfo) IsDir() bool        { return fi.FMode.IsDir() }
+func (fi *cachedFileInfo) Sys() interface{}   { return nil }
+
+// A listingRecorder collects the resulting destination listing of a
+// directory while its children are transferred.
+type listingRecorder struct {
+	path fs.Path
+	key  ListingKey
+
+	mu      sync.Mutex
+	pending int
+	failed  bool
+	fis     []os.FileInfo
+}
+
+// done records the outcome of transferring a child. When all children
+// are done, the listing is put in the cache, unless one failed.
+func (r *listingRecorder) done(cache ListingCache, fi os.FileInfo, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.failed = true
+	} else if fi != nil {
+		r.fis = append(r.fis, fi)
+	}
+	r.pending--
+	if r.pending > 0 {
+		return
+	}
+
+	if r.failed {
+		cache.Delete(r.path)
+	} else {
+		cache.Put(r.path, r.key, r.fis)
+	}
+}
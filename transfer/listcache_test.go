@@ -0,0 +1,184 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestFileListingCache(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "listcache-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	path := filepath.Join(tmpd, "sub", "cache.gob")
+	key := ListingKey{ModTime: 42, Inode: 43}
+	mtime := time.Unix(1234, 0).UTC()
+
+	c, err := OpenFileListingCache(path, "gen1")
+	if err != nil {
+		t.Fatalf("OpenFileListingCache failed: %v", err)
+	}
+	if _, ok := c.Get("a", key); ok {
+		t.Errorf("Get(a): got %v, want false", ok)
+	}
+	c.Put("a", key, []os.FileInfo{&cachedFileInfo{FName: "file", FSize: 10, FMode: 0644, FModTime: mtime}})
+	c.Put("b", key, nil)
+	c.Delete("b")
+	if err := c.Save("gen2"); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		c, err := OpenFileListingCache(path, "gen2")
+		if err != nil {
+			t.Fatalf("OpenFileListingCache failed: %v", err)
+		}
+		fis, ok := c.Get("a", key)
+		if !ok {
+			t.Fatalf("Get(a): got %v, want true", ok)
+		}
+		if len(fis) != 1 {
+			t.Fatalf("Get(a): got %v, want one entry", fis)
+		}
+		if got, want := fis[0], (&cachedFileInfo{FName: "file", FSize: 10, FMode: 0644, FModTime: mtime}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(a): got %+v, want %+v", got, want)
+		}
+
+		if _, ok := c.Get("a", ListingKey{ModTime: 42, Inode: 44}); ok {
+			t.Errorf("Get(a, other key): got %v, want false", ok)
+		}
+		if _, ok := c.Get("b", key); ok {
+			t.Errorf("Get(b): got %v, want false", ok)
+		}
+	})
+
+	t.Run("otherGeneration", func(t *testing.T) {
+		c, err := OpenFileListingCache(path, "gen3")
+		if err != nil {
+			t.Fatalf("OpenFileListingCache failed: %v", err)
+		}
+		if _, ok := c.Get("a", key); ok {
+			t.Errorf("Get(a): got %v, want false", ok)
+		}
+	})
+
+	t.Run("onlyPutIsSaved", func(t *testing.T) {
+		c, err := OpenFileListingCache(path, "gen2")
+		if err != nil {
+			t.Fatalf("OpenFileListingCache failed: %v", err)
+		}
+		if err := c.Save("gen2"); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+
+		c, err = OpenFileListingCache(path, "gen2")
+		if err != nil {
+			t.Fatalf("OpenFileListingCache failed: %v", err)
+		}
+		if _, ok := c.Get("a", key); ok {
+			t.Errorf("Get(a): got %v, want false", ok)
+		}
+	})
+}
+
+func TestUploadRunListingCache(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "listcache-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+	cachePath := filepath.Join(tmpd, "cache.gob")
+
+	src := fs.NewMemory()
+	for _, dir := range []string{"a", "a/b"} {
+		if err := src.Mkdir(fs.Path(dir), 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	writeMemoryFile(t, src, "a/file1", "content 1")
+	writeMemoryFile(t, src, "a/b/file2", "content 2")
+
+	dest := fs.NewMemory()
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(i int) (UploadStats, fs.Path) {
+		t.Helper()
+
+		cow, err := fs.NewCOW(dest, "host", start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("NewCOW failed: %v", err)
+		}
+		cache, err := OpenFileListingCache(cachePath, string(cow.ReadRoot()))
+		if err != nil {
+			t.Fatalf("OpenFileListingCache failed: %v", err)
+		}
+
+		u := NewUpload(cow, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithListingCache(cache))
+		if err := u.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if err := cow.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		if err := cache.Save(string(cow.WriteRoot())); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		return u.Stats(), cow.WriteRoot()
+	}
+
+	stats, _ := run(0)
+	if got, want := stats.CachedListings, uint64(0); got != want {
+		t.Errorf("Run 0 CachedListings: got %v, want %v", got, want)
+	}
+
+	stats, root := run(1)
+	if got, want := stats.CachedListings, uint64(2); got != want {
+		t.Errorf("Run 1 CachedListings: got %v, want %v", got, want)
+	}
+	if got, want := stats.KeptFiles, uint64(2); got != want {
+		t.Errorf("Run 1 KeptFiles: got %v, want %v", got, want)
+	}
+	got := listMemoryFiles(t, dest, root)
+	want := []string{string(root.Resolve("a")), string(root.Resolve("a/b")), string(root.Resolve("a/b/file2")), string(root.Resolve("a/file1"))}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run 1: got %q, want %q", got, want)
+	}
+
+	// Changing a file doesn't change the directory, but the file is
+	// still compared to the cached listing.
+	writeMemoryFile(t, src, "a/b/file2", "content 2, changed")
+	stats, _ = run(2)
+	if got, want := stats.CachedListings, uint64(2); got != want {
+		t.Errorf("Run 2 CachedListings: got %v, want %v", got, want)
+	}
+	if got, want := stats.UploadedFiles, uint64(1); got != want {
+		t.Errorf("Run 2 UploadedFiles: got %v, want %v", got, want)
+	}
+
+	// Adding a file changes the directory.
+	writeMemoryFile(t, src, "a/b/file3", "content 3")
+	stats, _ = run(3)
+	if got, want := stats.CachedListings, uint64(1); got != want {
+		t.Errorf("Run 3 CachedListings: got %v, want %v", got, want)
+	}
+	if got, want := stats.UploadedFiles, uint64(1); got != want {
+		t.Errorf("Run 3 UploadedFiles: got %v, want %v", got, want)
+	}
+
+	// The server moved on.
+	if err := os.Remove(cachePath); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	stats, _ = run(4)
+	if got, want := stats.CachedListings, uint64(0); got != want {
+		t.Errorf("Run 4 CachedListings: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package transfer
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+)
+
+// A MoveTracker remembers where source files were stored at the
+// destination, by source inode, so a moved file can be kept from its
+// old path instead of uploaded again. It must be safe for concurrent
+// use.
+type MoveTracker interface {
+	// Lookup returns the path a file with the key was stored at in
+	// the generation being read from.
+	Lookup(key MoveKey) (fs.Path, bool)
+
+	// Record notes that a file with the key is stored at the path
+	// in the generation being written.
+	Record(key MoveKey, path fs.Path)
+}
+
+// A MoveKeeper can keep a file from another path of the generation
+// being read from. fs.COW implements it.
+type MoveKeeper interface {
+	KeepFrom(oldpath, path fs.Path) error
+}
+
+// A MoveKey identifies a source file, and the metadata it has at the
+// destination. Since the stored file is hardlinked, the metadata must
+// also be equal.
+//
+// The inode is the only identity, so a FileMoveTracker keeps one path
+// per inode. For hardlinked source files, the last recorded path wins,
+// which is fine, since all paths have the same contents. An inode can
+// be reused by a new file after the old one is deleted. Lookup then
+// trusts the match if the metadata is also equal, and may keep the
+// old contents. Requiring the modification time to the nanosecond
+// makes this unlikely. Paths that aren't recorded in a run are
+// forgotten when the tracker is saved.
+type MoveKey struct {
+	Inode   uint64
+	Size    int64
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime int64
+}
+
+// moveKey returns the key of a regular source file, or false if the
+// file system doesn't have inodes.
+func (u *Upload) moveKey(fi os.FileInfo) (MoveKey, bool) {
+	attrs, ok := fs.FileAttrsFromFileInfo(fi)
+	if !ok || attrs.Inode == 0 {
+		return MoveKey{}, false
+	}
+	uid, gid := u.destOwner(fi)
+	return MoveKey{
+		Inode:   attrs.Inode,
+		Size:    fi.Size(),
+		Mode:    fi.Mode() & commonModeMask,
+		UID:     uid,
+		GID:     gid,
+		ModTime: fi.ModTime().UnixNano(),
+	}, true
+}
+
+// keepMoved keeps a regular file from the path it had in the previous
+// generation, if it was moved. Returns false if it has to be
+// transferred.
+func (u *Upload) keepMoved(fp *filePair) bool {
+	mk, ok := u.dest.(MoveKeeper)
+	if !ok {
+		return false
+	}
+	key, ok := u.moveKey(fp.src)
+	if !ok {
+		return false
+	}
+	oldpath, ok := u.moves.Lookup(key)
+	if !ok || oldpath == fp.path {
+		return false
+	}
+
+	if err := mk.KeepFrom(oldpath, fp.path); err != nil {
+		if !fs.IsNotExist(err) {
+			glog.Warningf("Keeping moved file %q from %q failed (ignored): %v", fp.path, oldpath, err)
+		}
+		return false
+	}
+	glog.V(1).Infof("Keeping file %q, moved from %q...", fp.path, oldpath)
+	return true
+}
+
+// recordMove remembers where a transferred regular file is stored.
+func (u *Upload) recordMove(fp *filePair) {
+	if key, ok := u.moveKey(fp.src); ok {
+		u.moves.Record(key, fp.path)
+	}
+}
+
+// A FileMoveTracker is a MoveTracker stored in a local file. Like
+// FileListingCache, the paths are only valid for one generation of
+// the destination. Only paths recorded since opening are saved.
+type FileMoveTracker struct {
+	path string
+
+	mu   sync.Mutex
+	old  map[uint64]*trackedFile
+	curr map[uint64]*trackedFile
+}
+
+// OpenFileMoveTracker reads a tracker file. If it doesn't exist, or
+// was saved for another generation, the tracker starts out empty.
+func OpenFileMoveTracker(path, generation string) (*FileMoveTracker, error) {
+	t := &FileMoveTracker{
+		path: path,
+		old:  map[uint64]*trackedFile{},
+		curr: map[uint64]*trackedFile{},
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tf moveTrackerFile
+	if err := gob.NewDecoder(f).Decode(&tf); err != nil {
+		// A corrupt file is only a performance problem.
+		return t, nil
+	}
+	if tf.Version == moveTrackerFileVersion && tf.Generation == generation {
+		t.old = tf.Files
+	}
+	return t, nil
+}
+
+// Save writes the paths recorded since opening, for the given
+// generation. The file is replaced atomically.
+func (t *FileMoveTracker) Save(generation string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(t.path), filepath.Base(t.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	tf := moveTrackerFile{
+		Version:    moveTrackerFileVersion,
+		Generation: generation,
+		Files:      t.curr,
+	}
+	if err := gob.NewEncoder(f).Encode(&tf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), t.path)
+}
+
+func (t *FileMoveTracker) Lookup(key MoveKey) (fs.Path, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tf := t.old[key.Inode]
+	if tf == nil || tf.Key != key {
+		return "", false
+	}
+	return tf.Path, true
+}
+
+func (t *FileMoveTracker) Record(key MoveKey, path fs.Path) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.curr[key.Inode] = &trackedFile{Key: key, Path: path}
+}
+
+// moveTrackerFileVersion is incremented on incompatible changes.
+const moveTrackerFileVersion = 1
+
+// A moveTrackerFile is the on-disk format of a FileMoveTracker.
+type moveTrackerFile struct {
+	Version    int
+	Generation string
+	Files      map[uint64]*trackedFile
+}
+
+type trackedFile struct {
+	Key  MoveKey
+	Path fs.Path
+}
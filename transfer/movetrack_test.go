@@ -0,0 +1,204 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestFileMoveTracker(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "movetrack-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	path := filepath.Join(tmpd, "sub", "moves.gob")
+	key := MoveKey{Inode: 42, Size: 10, Mode: 0644, ModTime: 43}
+
+	tr, err := OpenFileMoveTracker(path, "gen1")
+	if err != nil {
+		t.Fatalf("OpenFileMoveTracker failed: %v", err)
+	}
+	if _, ok := tr.Lookup(key); ok {
+		t.Errorf("Lookup: got %v, want false", ok)
+	}
+	tr.Record(key, "a/file")
+	if _, ok := tr.Lookup(key); ok {
+		t.Errorf("Lookup(recorded): got %v, want false", ok)
+	}
+	if err := tr.Save("gen2"); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		tr, err := OpenFileMoveTracker(path, "gen2")
+		if err != nil {
+			t.Fatalf("OpenFileMoveTracker failed: %v", err)
+		}
+		if got, ok := tr.Lookup(key); !ok || got != "a/file" {
+			t.Errorf("Lookup: got %q, %v, want %q, true", got, ok, "a/file")
+		}
+
+		other := key
+		other.Size = 11
+		if _, ok := tr.Lookup(other); ok {
+			t.Errorf("Lookup(other): got %v, want false", ok)
+		}
+	})
+
+	t.Run("otherGeneration", func(t *testing.T) {
+		tr, err := OpenFileMoveTracker(path, "gen1")
+		if err != nil {
+			t.Fatalf("OpenFileMoveTracker failed: %v", err)
+		}
+		if _, ok := tr.Lookup(key); ok {
+			t.Errorf("Lookup: got %v, want false", ok)
+		}
+	})
+}
+
+func TestUploadRunMoves(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "movetrack-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	src := fs.NewMemory()
+	if err := src.Mkdir("a", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	writeMemoryFile(t, src, "a/file1", "content 1")
+	writeMemoryFile(t, src, "file2", "content 2")
+
+	dest := fs.NewMemory()
+	run := func(i int) UploadStats {
+		t.Helper()
+		return runMoveTrackedUpload(t, dest, src, filepath.Join(tmpd, "moves.gob"), i)
+	}
+
+	stats := run(0)
+	if stats.MovedFiles != 0 || stats.UploadedFiles != 2 {
+		t.Errorf("Run 0: got %d moved and %d uploaded files, want 0 and 2", stats.MovedFiles, stats.UploadedFiles)
+	}
+
+	if err := src.Rename("file2", "a/file3"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	stats = run(1)
+	if stats.MovedFiles != 1 || stats.MovedBytes != 9 || stats.KeptFiles != 1 || stats.UploadedFiles != 0 {
+		t.Errorf("Run 1: got %d moved files (%d bytes), %d kept and %d uploaded, want 1 (9 bytes), 1 and 0", stats.MovedFiles, stats.MovedBytes, stats.KeptFiles, stats.UploadedFiles)
+	}
+
+	// The new path is tracked, so it can move again.
+	if err := src.Rename("a/file3", "file4"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	stats = run(2)
+	if stats.MovedFiles != 1 || stats.UploadedFiles != 0 {
+		t.Errorf("Run 2: got %d moved and %d uploaded files, want 1 and 0", stats.MovedFiles, stats.UploadedFiles)
+	}
+
+	fr, err := dest.Open("host/2021-01-01T00-02-00.000000/file4")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if got, want := string(bs), "content 2"; got != want {
+		t.Errorf("ReadAll: got %q, want %q", got, want)
+	}
+}
+
+func TestUploadRunMovesHardlinked(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "movetrack-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	src := fs.NewMemory()
+	for _, dir := range []fs.Path{"a", "b"} {
+		if err := src.Mkdir(dir, 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	writeMemoryFile(t, src, "a/file1", "content 1")
+	if err := src.Link("a/file1", "a/file2"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	dest := fs.NewMemory()
+	run := func(i int) UploadStats {
+		t.Helper()
+		return runMoveTrackedUpload(t, dest, src, filepath.Join(tmpd, "moves.gob"), i)
+	}
+
+	if stats := run(0); stats.UploadedBytes != 9 {
+		t.Errorf("Run 0: got %d uploaded bytes, want 9", stats.UploadedBytes)
+	}
+
+	// Only one path per inode is tracked, but the hardlinks have
+	// the same contents, so either can be kept.
+	if err := src.Rename("a/file2", "b/file3"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	stats := run(1)
+	if stats.MovedFiles != 1 || stats.UploadedBytes != 0 {
+		t.Errorf("Run 1: got %d moved files and %d uploaded bytes, want 1 and 0", stats.MovedFiles, stats.UploadedBytes)
+	}
+
+	for _, path := range []fs.Path{"a/file1", "b/file3"} {
+		fr, err := dest.Open(fs.Path("host/2021-01-01T00-01-00.000000").Resolve(path))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		bs, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if got, want := string(bs), "content 1"; got != want {
+			t.Errorf("ReadAll(%q): got %q, want %q", path, got, want)
+		}
+	}
+	if _, err := dest.Open("host/2021-01-01T00-01-00.000000/a/file2"); !fs.IsNotExist(err) {
+		t.Errorf("Open(a/file2) error: got %v, want NotExist", err)
+	}
+}
+
+// runMoveTrackedUpload uploads src to a new COW snapshot, i minutes
+// after a fixed time, using a FileMoveTracker at trackerPath.
+func runMoveTrackedUpload(t *testing.T, dest fs.WriteableFileSystem, src fs.ReadableFileSystem, trackerPath string, i int) UploadStats {
+	t.Helper()
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	cow, err := fs.NewCOW(dest, "host", start.Add(time.Duration(i)*time.Minute))
+	if err != nil {
+		t.Fatalf("NewCOW failed: %v", err)
+	}
+	tr, err := OpenFileMoveTracker(trackerPath, string(cow.ReadRoot()))
+	if err != nil {
+		t.Fatalf("OpenFileMoveTracker failed: %v", err)
+	}
+	u := NewUpload(cow, src, WithConcurrency(1), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithMoveTracker(tr))
+	if err := u.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := cow.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if err := tr.Save(string(cow.WriteRoot())); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	return u.Stats()
+}
@@ -14,10 +14,13 @@ import (
 // A process contains information about an in-progress transfer. While
 // Run is executing, Stats can be used to get progress information.
 type process struct {
-	src          fs.ReadableFileSystem
-	dest         fs.WriteableFileSystem
-	ignoreFilter func(fs.Path) bool
-	nconc        int
+	src            fs.ReadableFileSystem
+	dest           fs.ReadableFileSystem
+	ignoreFilter   func(fs.Path, os.FileInfo) bool
+	ignoreFiles    []string
+	excludeMarkers []string
+	listingCache   ListingCache
+	nconc          int
 
 	stats    *ProcessStats
 	transfer func(context.Context, *filePair) error
@@ -26,23 +29,175 @@ type process struct {
 // Run performs a parallel file transfer. Only one Run should be
 // executing for a process.
 func (p *process) Run(ctx context.Context) error {
+	if pf, ok := p.dest.(fs.Prefetcher); ok {
+		// Without the prefetched listings, directories are
+		// listed one by one. The destination may not exist yet.
+		if err := pf.Prefetch(fs.Path(".")); err != nil && !fs.IsNotExist(err) {
+			glog.Warningf("Prefetching the destination failed: %v", err)
+		}
+	}
+
 	fps, err := p.listDir(fs.Path("."))
 	if err != nil {
 		return err
 	}
+	if err := p.scopeIgnoreFiles(fs.Path("."), fps, nil); err != nil {
+		return err
+	}
 
 	return filePairPDFS(ctx, fps, p.process, p.nconc)
 }
 
+// RunPaths is like Run, but only transfers the given files and
+// directories, recursively. Paths inside ignored directories, or
+// whose parent directory no longer exists at the source, are
+// skipped. The metadata of the parent directories is not updated.
+func (p *process) RunPaths(ctx context.Context, paths []fs.Path) error {
+	paths = coalescePaths(paths)
+	if len(paths) == 1 && paths[0] == "." {
+		return p.Run(ctx)
+	}
+
+	byDir := map[fs.Path]map[fs.Path]bool{}
+	var dirs []fs.Path
+	for _, path := range paths {
+		dir := path.Dir()
+		if byDir[dir] == nil {
+			byDir[dir] = map[fs.Path]bool{}
+			dirs = append(dirs, dir)
+		}
+		byDir[dir][path] = true
+	}
+
+	var roots []*filePair
+	for _, dir := range dirs {
+		scope, ignored, err := p.dirScope(dir)
+		if fs.IsNotExist(err) {
+			glog.V(2).Infof("Skipping paths in removed directory %q.", dir)
+			continue
+		} else if err != nil {
+			return err
+		} else if ignored {
+			glog.V(3).Infof("Skipping paths in ignored directory %q.", dir)
+			continue
+		}
+
+		fps, err := p.listDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fp := range fps {
+			if byDir[dir][fp.path] {
+				fp.ignores = scope
+				roots = append(roots, fp)
+			}
+		}
+	}
+
+	return filePairPDFS(ctx, roots, p.process, p.nconc)
+}
+
+// dirScope walks the source from the root to the directory, and
+// returns the ignore scope for its children. It also returns whether
+// the directory, or any of its parents, is ignored.
+func (p *process) dirScope(dir fs.Path) (*ignoreScope, bool, error) {
+	var scope *ignoreScope
+	cur := fs.Path(".")
+	var comps []fs.Path
+	for d := dir; d != "."; d = d.Dir() {
+		comps = append([]fs.Path{d.Base()}, comps...)
+	}
+
+	for i := 0; ; i++ {
+		fis, err := readdir(p.src, cur)
+		if err != nil {
+			return nil, false, err
+		}
+		fps := make([]*filePair, 0, len(fis))
+		for _, fi := range fis {
+			fps = append(fps, &filePair{path: cur.Resolve(fs.Path(fi.Name())), src: fi})
+		}
+
+		if i > 0 {
+			excluded, err := p.hasExcludeMarker(fps)
+			if err != nil {
+				return nil, false, err
+			} else if excluded {
+				return nil, true, nil
+			}
+		}
+
+		scope, err = p.readIgnoreScope(cur, fps, scope)
+		if err != nil {
+			return nil, false, err
+		}
+		if i == len(comps) {
+			return scope, false, nil
+		}
+
+		next := cur.Resolve(comps[i])
+		var fp *filePair
+		for _, cfp := range fps {
+			if cfp.path == next {
+				fp = cfp
+				break
+			}
+		}
+		if fp == nil || !fp.src.IsDir() {
+			return nil, false, &os.PathError{Op: "readdir", Path: string(next), Err: os.ErrNotExist}
+		}
+		fp.ignores = scope
+		if p.isIgnored(fp, true) {
+			return nil, true, nil
+		}
+		cur = next
+	}
+}
+
+// coalescePaths returns the sorted paths, without duplicates and
+// without paths inside other paths in the list.
+func coalescePaths(paths []fs.Path) []fs.Path {
+	set := make(map[fs.Path]bool, len(paths))
+	for _, path := range paths {
+		set[path.Resolve(".")] = true
+	}
+	if set["."] {
+		return []fs.Path{"."}
+	}
+
+	var ret []fs.Path
+	for path := range set {
+		inside := false
+		for d := path.Dir(); d != "."; d = d.Dir() {
+			if set[d] {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			ret = append(ret, path)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
 // process is invoked once per file or directory. For directories, it
 // returns the children at the source. When this returns, the
 // directory/file has been fully created.
-func (p *process) process(ctx context.Context, fp *filePair) ([]*filePair, error) {
+func (p *process) process(ctx context.Context, fp *filePair) (_ []*filePair, rerr error) {
 	atomic.AddUint32(&p.stats.InProgress, 1)
 	defer atomic.AddUint32(&p.stats.InProgress, ^uint32(0))
 
 	isDir := fp.FileInfo().Mode().IsDir()
 
+	var ignored bool
+	if fp.listing != nil {
+		defer func() {
+			fp.listing.done(p.listingCache, resultFileInfo(fp, ignored), rerr)
+		}()
+	}
+
 	if fp.src != nil {
 		if isDir {
 			atomic.AddUint64(&p.stats.SourceDirectories, 1)
@@ -52,57 +207,162 @@ func (p *process) process(ctx context.Context, fp *filePair) ([]*filePair, error
 		}
 	}
 
-	filterPath := "/" + fp.path
-	if isDir {
-		filterPath += "/"
-	}
-	if p.ignoreFilter(filterPath) {
-		if isDir {
-			atomic.AddUint64(&p.stats.IgnoredDirectories, 1)
-		} else {
-			atomic.AddUint64(&p.stats.IgnoredFiles, 1)
-		}
-		glog.V(3).Infof("Ignored %q.", fp.path)
+	if p.isIgnored(fp, isDir) {
+		ignored = true
+		p.ignored(fp, isDir)
 		return nil, nil
 	}
 
 	var fps []*filePair
 	var eg errgroup.Group
 	if fp.src != nil && isDir {
-		// There is no need to list the directory if it was
-		// removed, since using RemoveAll can be more
-		// efficient than doing it recursively here.
-		eg.Go(func() error {
+		if len(p.excludeMarkers) > 0 {
+			// The listing is needed to decide whether to
+			// transfer the directory at all.
 			var err error
-			fps, err = p.listDir(fp.path)
-			if err == nil {
-				return nil
-			} else if fs.IsPermission(err) {
-				glog.Warningf("Listing directory failed (ignored): %v", err)
-				return nil
+			fps, err = p.listChildren(fp)
+			if err != nil {
+				return nil, p.failed(fp, isDir, err)
 			}
-			return err
-		})
+			excluded, err := p.hasExcludeMarker(fps)
+			if err != nil {
+				return nil, p.failed(fp, isDir, err)
+			} else if excluded {
+				ignored = true
+				p.ignored(fp, isDir)
+				return nil, nil
+			}
+		} else {
+			// There is no need to list the directory if it was
+			// removed, since using RemoveAll can be more
+			// efficient than doing it recursively here.
+			eg.Go(func() error {
+				var err error
+				fps, err = p.listChildren(fp)
+				return err
+			})
+		}
 	}
 	eg.Go(func() error {
 		return p.transfer(ctx, fp)
 	})
 	if err := eg.Wait(); err != nil {
-		if isDir {
-			atomic.AddUint64(&p.stats.FailedDirectories, 1)
-		} else {
-			atomic.AddUint64(&p.stats.FailedFiles, 1)
+		return nil, p.failed(fp, isDir, err)
+	}
+	return fps, nil
+}
+
+// isIgnored returns whether the file or directory matches the ignore
+// filter or an ignore file.
+func (p *process) isIgnored(fp *filePair, isDir bool) bool {
+	filterPath := "/" + fp.path
+	if isDir {
+		filterPath += "/"
+	}
+	return p.ignoreFilter(filterPath, fp.FileInfo()) || fp.ignores.ignored(fp.path, isDir)
+}
+
+// ignored updates statistics for an ignored file or directory.
+func (p *process) ignored(fp *filePair, isDir bool) {
+	if isDir {
+		atomic.AddUint64(&p.stats.IgnoredDirectories, 1)
+	} else {
+		atomic.AddUint64(&p.stats.IgnoredFiles, 1)
+	}
+	glog.V(3).Infof("Ignored %q.", fp.path)
+}
+
+// failed updates statistics for a failed file or directory, and
+// returns the error.
+func (p *process) failed(fp *filePair, isDir bool, err error) error {
+	if isDir {
+		atomic.AddUint64(&p.stats.FailedDirectories, 1)
+	} else {
+		atomic.AddUint64(&p.stats.FailedFiles, 1)
+	}
+
+	glog.Errorf("Failed to transfer %q: %v", fp.path, err)
+	glog.V(1).Infof("Source: %+v\nDestination: %+v", fp.src, fp.dest)
+	return err
+}
+
+// listChildren lists a source directory, and reads its ignore
+// files. Permission errors are logged, and yield no children. The
+// destination listing is taken from the listing cache, if the source
+// directory is unchanged.
+func (p *process) listChildren(fp *filePair) ([]*filePair, error) {
+	readDest := func() ([]os.FileInfo, error) { return readdir(p.dest, fp.path) }
+	var key ListingKey
+	var cacheable bool
+	if p.listingCache != nil {
+		key, cacheable = listingKeyFromFileInfo(fp.src)
+	}
+	if cacheable && fp.dest != nil && fp.dest.IsDir() {
+		if fis, ok := p.listingCache.Get(fp.path, key); ok {
+			glog.V(3).Infof("Using cached listing of %q.", fp.path)
+			atomic.AddUint64(&p.stats.CachedListings, 1)
+			readDest = func() ([]os.FileInfo, error) { return fis, nil }
 		}
+	}
 
-		glog.Errorf("Failed to transfer %q: %v", fp.path, err)
-		glog.V(1).Infof("Source: %+v\nDestination: %+v", fp.src, fp.dest)
+	fps, err := p.listDirFrom(fp.path, readDest)
+	if fs.IsPermission(err) {
+		glog.Warningf("Listing directory failed (ignored): %v", err)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := p.scopeIgnoreFiles(fp.path, fps, fp.ignores); err != nil {
 		return nil, err
 	}
+
+	if cacheable {
+		if len(fps) == 0 {
+			p.listingCache.Put(fp.path, key, nil)
+		}
+		r := &listingRecorder{path: fp.path, key: key, pending: len(fps)}
+		for _, cfp := range fps {
+			cfp.listing = r
+		}
+	}
+
 	return fps, nil
 }
 
+// resultFileInfo returns what the destination file looks like after
+// processing, as far as deciding what to transfer is concerned.
+func resultFileInfo(fp *filePair, ignored bool) os.FileInfo {
+	if ignored {
+		// Ignored files are left as they are.
+		return fp.dest
+	} else if fp.src == nil {
+		// Removed.
+		return nil
+	}
+
+	switch fp.src.Mode().Type() {
+	case 0, os.ModeDir:
+		return &cachedFileInfo{FName: fp.src.Name(), FSize: fp.src.Size(), FMode: fp.src.Mode(), FModTime: fp.src.ModTime()}
+
+	case os.ModeSymlink:
+		// Symlink times can't be set, so they are always
+		// transferred. See createSymlink.
+		return &cachedFileInfo{FName: fp.src.Name(), FSize: fp.src.Size(), FMode: fp.src.Mode()}
+
+	default:
+		// Special files are not transferred.
+		return fp.dest
+	}
+}
+
 // listDir creates file pairs for the children of the given directory.
 func (p *process) listDir(path fs.Path) ([]*filePair, error) {
+	return p.listDirFrom(path, func() ([]os.FileInfo, error) { return readdir(p.dest, path) })
+}
+
+// listDirFrom is like listDir, but uses readDest to list the
+// destination directory.
+func (p *process) listDirFrom(path fs.Path, readDest func() ([]os.FileInfo, error)) ([]*filePair, error) {
 	var eg errgroup.Group
 	var srcfiles, destfiles []os.FileInfo
 	eg.Go(func() error {
@@ -116,7 +376,7 @@ func (p *process) listDir(path fs.Path) ([]*filePair, error) {
 	})
 	eg.Go(func() error {
 		var err error
-		destfiles, err = readdir(p.dest, path)
+		destfiles, err = readDest()
 		if err != nil && !fs.IsNotExist(err) {
 			return err
 		}
@@ -201,6 +461,10 @@ type ProcessStats struct {
 
 	FailedFiles       uint64
 	FailedDirectories uint64
+
+	// CachedListings counts destination directories that were not
+	// listed, because the listing cache was used.
+	CachedListings uint64
 }
 
 // CopyFrom does atomic reads from source, and assigns to the receiver.
@@ -213,4 +477,5 @@ func (ps *ProcessStats) CopyFrom(src *ProcessStats) {
 	ps.IgnoredDirectories = atomic.LoadUint64(&src.IgnoredDirectories)
 	ps.FailedFiles = atomic.LoadUint64(&src.FailedFiles)
 	ps.FailedDirectories = atomic.LoadUint64(&src.FailedDirectories)
+	ps.CachedListings = atomic.LoadUint64(&src.CachedListings)
 }
@@ -49,13 +49,39 @@ func TestProcessRun(t *testing.T) {
 	}
 }
 
+func TestProcessRunPrefetchesDest(t *testing.T) {
+	p := newTestProcess()
+	dest := &prefetchingFileSystem{fakeListingFileSystem: p.dest.(*fakeListingFileSystem)}
+	p.dest = dest
+
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if want := []fs.Path{"."}; !reflect.DeepEqual(dest.prefetched, want) {
+		t.Errorf("Prefetch calls: got %v, want %v", dest.prefetched, want)
+	}
+}
+
+// A prefetchingFileSystem records Prefetch calls.
+type prefetchingFileSystem struct {
+	*fakeListingFileSystem
+
+	prefetched []fs.Path
+}
+
+func (fs *prefetchingFileSystem) Prefetch(path fs.Path) error {
+	fs.prefetched = append(fs.prefetched, path)
+	return nil
+}
+
 func TestProcessIgnoreFilter(t *testing.T) {
 	ctx := context.Background()
 
 	t.Run("dir", func(t *testing.T) {
 		p := newTestProcess()
 
-		p.ignoreFilter = func(path fs.Path) bool {
+		p.ignoreFilter = func(path fs.Path, fi os.FileInfo) bool {
 			return path == fs.Path("/dir1/")
 		}
 
@@ -85,7 +111,7 @@ func TestProcessIgnoreFilter(t *testing.T) {
 	t.Run("file", func(t *testing.T) {
 		p := newTestProcess()
 
-		p.ignoreFilter = func(path fs.Path) bool {
+		p.ignoreFilter = func(path fs.Path, fi os.FileInfo) bool {
 			return path == fs.Path("/file1")
 		}
 
@@ -288,7 +314,7 @@ func newTestProcess() process {
 				},
 			},
 		},
-		ignoreFilter: func(fs.Path) bool { return false },
+		ignoreFilter: func(fs.Path, os.FileInfo) bool { return false },
 		nconc:        1,
 
 		stats:    &ProcessStats{},
@@ -353,3 +379,23 @@ func (fi *fakeListingFileInfo) Mode() os.FileMode  { return fi.mode }
 func (fi *fakeListingFileInfo) ModTime() time.Time { return fi.mtime }
 func (fi *fakeListingFileInfo) Size() int64        { return fi.size }
 func (fi *fakeListingFileInfo) Sys() interface{}   { return nil }
+
+func TestCoalescePaths(t *testing.T) {
+	tsts := []struct {
+		name string
+		in   []fs.Path
+		want []fs.Path
+	}{
+		{"empty", nil, nil},
+		{"root", []fs.Path{"a", ".", "b"}, []fs.Path{"."}},
+		{"duplicates", []fs.Path{"b", "a", "b/"}, []fs.Path{"a", "b"}},
+		{"nested", []fs.Path{"a/b/c", "a-c", "a", "b/c"}, []fs.Path{"a", "a-c", "b/c"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			if got := coalescePaths(tst.in); !reflect.DeepEqual(got, tst.want) {
+				t.Errorf("coalescePaths: got %q, want %q", got, tst.want)
+			}
+		})
+	}
+}
@@ -40,6 +40,13 @@ type filePair struct {
 	path fs.Path
 	src  os.FileInfo
 	dest os.FileInfo
+
+	// ignores are the ignore file rules applying to the file.
+	ignores *ignoreScope
+
+	// listing collects the destination listing of the parent
+	// directory, if it can be cached.
+	listing *listingRecorder
 }
 
 // FileInfo returns overall file information about the file.
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/tommie/fisy/fs"
@@ -17,9 +18,13 @@ import (
 type Upload struct {
 	process
 
-	srcLinks linkSet
-	gidMap   func(int) int
-	uidMap   func(int) int
+	dest        fs.WriteableFileSystem
+	srcLinks    linkSet
+	dedup       Deduplicator
+	moves       MoveTracker
+	gidMap      func(int) int
+	uidMap      func(int) int
+	retryPolicy remote.RetryPolicy
 
 	stats    UploadStats
 	fileHook FileHook
@@ -33,9 +38,11 @@ func NewUpload(dest fs.WriteableFileSystem, src fs.ReadableFileSystem, opts ...U
 			dest: dest,
 		},
 
-		srcLinks: newLinkSet(),
-		gidMap:   func(srcGID int) int { return srcGID },
-		uidMap:   func(srcUID int) int { return srcUID },
+		dest:        dest,
+		srcLinks:    newLinkSet(),
+		gidMap:      func(srcGID int) int { return srcGID },
+		uidMap:      func(srcUID int) int { return srcUID },
+		retryPolicy: remote.DefaultRetryPolicy,
 
 		fileHook: func(os.FileInfo, FileOperation, *uint64, error) {},
 	}
@@ -51,13 +58,62 @@ func NewUpload(dest fs.WriteableFileSystem, src fs.ReadableFileSystem, opts ...U
 type UploadOpt func(*Upload)
 
 // WithIgnoreFilter adds a filter function. If the function returns
-// true for a file or directory, it will be completely ignored.
-func WithIgnoreFilter(fun func(fs.Path) bool) UploadOpt {
+// true for a file or directory, it will be completely ignored. The
+// path starts with a slash, and directory paths end with a
+// slash. The file information is from the source, or from the
+// destination if the file only exists there.
+func WithIgnoreFilter(fun func(fs.Path, os.FileInfo) bool) UploadOpt {
 	return func(u *Upload) {
 		u.ignoreFilter = fun
 	}
 }
 
+// WithIgnoreFiles sets the names of ignore files to read in each
+// source directory. Their rules, in .gitignore format, apply to the
+// directory and its subdirectories. Later names take precedence.
+func WithIgnoreFiles(names ...string) UploadOpt {
+	return func(u *Upload) {
+		u.ignoreFiles = names
+	}
+}
+
+// WithExcludeIfPresent makes directories containing a file with any
+// of the given names ignored. A file named CACHEDIR.TAG must have the
+// signature required by the Cache Directory Tagging Specification.
+func WithExcludeIfPresent(names ...string) UploadOpt {
+	return func(u *Upload) {
+		u.excludeMarkers = names
+	}
+}
+
+// WithListingCache makes the upload use cached destination directory
+// listings where the source directory is unchanged. The caller is
+// responsible for only using a cache that matches the destination.
+func WithListingCache(c ListingCache) UploadOpt {
+	return func(u *Upload) {
+		u.listingCache = c
+	}
+}
+
+// WithDeduplicator makes the upload link new regular files to stored
+// copies with the same content, instead of uploading them again. The
+// deduplicator must write to the destination.
+func WithDeduplicator(d Deduplicator) UploadOpt {
+	return func(u *Upload) {
+		u.dedup = d
+	}
+}
+
+// WithMoveTracker makes the upload keep moved files from their old
+// path, instead of uploading them again. The destination must be a
+// MoveKeeper, and the caller is responsible for only using a tracker
+// that matches the generation it reads from.
+func WithMoveTracker(t MoveTracker) UploadOpt {
+	return func(u *Upload) {
+		u.moves = t
+	}
+}
+
 // WithConcurrency sets the transfer concurrency, in files.
 func WithConcurrency(nconc int) UploadOpt {
 	if nconc < 1 {
@@ -96,19 +152,30 @@ func WithUIDMap(fun func(srcUID int) int) UploadOpt {
 	}
 }
 
+// WithRetryPolicy sets how failed file transfers are retried. By
+// default, this is remote.DefaultRetryPolicy. Retries are counted in
+// UploadStats.TransferRetries before the policy's OnRetry is called.
+func WithRetryPolicy(p remote.RetryPolicy) UploadOpt {
+	return func(u *Upload) {
+		u.retryPolicy = p
+	}
+}
+
 // Transfer ensures a single file or directory has been fully
 // transferred. It may do retries in case of failure.
 func (u *Upload) transfer(ctx context.Context, fp *filePair) error {
-	var nattempts int
+	policy := u.retryPolicy
+	onRetry := policy.OnRetry
+	policy.OnRetry = func(attempt int, delay time.Duration, err error) {
+		atomic.AddUint64(&u.stats.TransferRetries, 1)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+	}
 
 	var uploadedBytes uint64
 	u.fileHook(fp.FileInfo(), fp.FileOperation(), &uploadedBytes, InProgress)
-	err := remote.Idempotent(ctx, func() error {
-		nattempts++
-		if nattempts > 1 {
-			atomic.AddUint64(&u.stats.TransferRetries, 1)
-		}
-
+	err := policy.Idempotent(ctx, func() error {
 		switch fp.FileInfo().Mode().Type() {
 		case os.ModeDir:
 			return u.transferDirectory(fp)
@@ -159,6 +226,14 @@ func (u *Upload) transferFile(fp *filePair, byteCount *uint64) (rerr error) {
 		}()
 	}
 
+	if u.moves != nil && fp.src.Mode().IsRegular() {
+		defer func() {
+			if rerr == nil {
+				u.recordMove(fp)
+			}
+		}()
+	}
+
 	if !fileNeedsTransfer(fp.dest, fp.src) {
 		glog.V(1).Infof("Keeping file %q...", fp.path)
 		if err := u.dest.Keep(fp.path); err == nil {
@@ -176,7 +251,17 @@ func (u *Upload) transferFile(fp *filePair, byteCount *uint64) (rerr error) {
 		return u.createSymlink(fp)
 	}
 
-	return u.copyFile(fp, byteCount)
+	if u.moves != nil && fp.src.Mode().IsRegular() && u.keepMoved(fp) {
+		atomic.AddUint64(&u.stats.MovedBytes, uint64(fp.src.Size()))
+		atomic.AddUint64(&u.stats.MovedFiles, 1)
+		return nil
+	}
+
+	if u.dedup != nil && fp.src.Mode().IsRegular() && fp.src.Size() > 0 {
+		return u.dedupFile(fp, byteCount)
+	}
+
+	return u.copyFile(fp, byteCount, nil)
 }
 
 func (u *Upload) createSymlink(fp *filePair) error {
@@ -199,8 +284,9 @@ func (u *Upload) createSymlink(fp *filePair) error {
 	return u.dest.Symlink(linkdest, fp.path)
 }
 
-// copyFile copies a file byte-by-byte.
-func (u *Upload) copyFile(fp *filePair, byteCount *uint64) error {
+// copyFile copies a file byte-by-byte. If hash is not nil, the
+// uploaded bytes are also written to it.
+func (u *Upload) copyFile(fp *filePair, byteCount *uint64, hash io.Writer) error {
 	sf, err := u.src.Open(fp.path)
 	if err != nil {
 		if fs.IsNotExist(err) {
@@ -231,21 +317,16 @@ func (u *Upload) copyFile(fp *filePair, byteCount *uint64) error {
 			}
 
 			glog.V(1).Infof("Uploading file %q (%d bytes)...", fp.path, fp.src.Size())
-			i, err := io.Copy(df, &countingReadCloser{sf, byteCount})
+			i, err := copyData(df, sf, byteCount, hash)
 			if err != nil {
 				return err
 			}
 			uploadedBytes = uint64(i)
 
-			attrs, ok := fs.FileAttrsFromFileInfo(fp.src)
-			if ok {
+			if attrs, ok := fs.FileAttrsFromFileInfo(fp.src); ok {
 				atime = attrs.AccessTime
-			} else {
-				attrs.UID = -1
-				attrs.GID = -1
 			}
-			uid := u.uidMap(attrs.UID)
-			gid := u.gidMap(attrs.GID)
+			uid, gid := u.destOwner(fp.src)
 			if uid != -1 || gid != -1 {
 				if err := df.Chown(uid, gid); err != nil {
 					return err
@@ -275,6 +356,24 @@ func (u *Upload) copyFile(fp *filePair, byteCount *uint64) error {
 	return nil
 }
 
+// copyData copies the contents of a file. Local files are copied, or
+// cloned, by the kernel, unless the contents must be hashed.
+func copyData(df fs.FileWriter, sf fs.FileReader, byteCount *uint64, hash io.Writer) (int64, error) {
+	if hash == nil {
+		n, ok, err := fs.CopyLocalFile(df, sf)
+		if ok || err != nil {
+			atomic.AddUint64(byteCount, uint64(n))
+			return n, err
+		}
+	}
+
+	var r io.Reader = &countingReadCloser{sf, byteCount}
+	if hash != nil {
+		r = io.TeeReader(r, hash)
+	}
+	return io.Copy(df, r)
+}
+
 // transferDirectory transfers a single directory.
 func (u *Upload) transferDirectory(fp *filePair) error {
 	if fp.src == nil {
@@ -374,6 +473,12 @@ func (u *Upload) Stats() UploadStats {
 		RemovedFiles:       atomic.LoadUint64(&u.stats.RemovedFiles),
 		RemovedDirectories: atomic.LoadUint64(&u.stats.RemovedDirectories),
 
+		DedupedBytes: atomic.LoadUint64(&u.stats.DedupedBytes),
+		DedupedFiles: atomic.LoadUint64(&u.stats.DedupedFiles),
+
+		MovedBytes: atomic.LoadUint64(&u.stats.MovedBytes),
+		MovedFiles: atomic.LoadUint64(&u.stats.MovedFiles),
+
 		DiscardedFiles:  atomic.LoadUint64(&u.stats.DiscardedFiles),
 		TransferRetries: atomic.LoadUint64(&u.stats.TransferRetries),
 	}
@@ -400,6 +505,16 @@ type UploadStats struct {
 	RemovedFiles       uint64
 	RemovedDirectories uint64
 
+	// DedupedBytes and DedupedFiles count regular files that were
+	// linked to stored copies, instead of uploaded.
+	DedupedBytes uint64
+	DedupedFiles uint64
+
+	// MovedBytes and MovedFiles count regular files that were kept
+	// from another path, because they were moved.
+	MovedBytes uint64
+	MovedFiles uint64
+
 	DiscardedFiles  uint64
 	TransferRetries uint64
 }
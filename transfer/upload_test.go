@@ -2,7 +2,11 @@ package transfer
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"syscall"
 	"testing"
@@ -11,16 +15,17 @@ import (
 	"fmt"
 	"github.com/pkg/sftp"
 	"github.com/tommie/fisy/fs"
+	"github.com/tommie/fisy/remote"
 )
 
 func TestNewUpload(t *testing.T) {
 	const ignoredPath fs.Path = "/dir2/"
 
-	u := newTestUpload(WithIgnoreFilter(func(path fs.Path) bool {
+	u := newTestUpload(WithIgnoreFilter(func(path fs.Path, fi os.FileInfo) bool {
 		return path == ignoredPath
 	}))
 
-	if got, want := u.process.ignoreFilter(ignoredPath), true; got != want {
+	if got, want := u.process.ignoreFilter(ignoredPath, nil), true; got != want {
 		t.Errorf("NewUpload ignoreFilter(%q): got %v, want %v", ignoredPath, got, want)
 	}
 	if want := 2; u.process.nconc != want {
@@ -82,6 +87,40 @@ func TestUploadTransfer(t *testing.T) {
 		}
 	})
 
+	t.Run("retryPolicy", func(t *testing.T) {
+		var attempts []int
+		u := newTestUpload(WithRetryPolicy(remote.RetryPolicy{
+			InitialDelay: 1 * time.Millisecond,
+			OnRetry: func(attempt int, delay time.Duration, err error) {
+				attempts = append(attempts, attempt)
+			},
+		}))
+
+		if err := u.transfer(ctx, &filePair{path: "retry-file", src: &fakeListingFileInfo{name: "retry-file"}}); err != nil {
+			t.Fatalf("transfer failed: %v", err)
+		}
+
+		if want := []int{1}; !reflect.DeepEqual(attempts, want) {
+			t.Errorf("OnRetry attempts: got %v, want %v", attempts, want)
+		}
+		if got, want := int(u.stats.TransferRetries), 1; got != want {
+			t.Errorf("stats.TransferRetries: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("retryPolicyGivesUp", func(t *testing.T) {
+		u := newTestUpload(WithRetryPolicy(remote.RetryPolicy{MaxAttempts: 1}))
+
+		err := u.transfer(ctx, &filePair{path: "retry-file", src: &fakeListingFileInfo{name: "retry-file"}})
+		if rerr := (*remote.RetriesExhaustedError)(nil); !errors.As(err, &rerr) {
+			t.Fatalf("transfer error: got %v, want RetriesExhaustedError", err)
+		}
+
+		if got, want := int(u.stats.TransferRetries), 0; got != want {
+			t.Errorf("stats.TransferRetries: got %v, want %v", got, want)
+		}
+	})
+
 	t.Run("fileHook", func(t *testing.T) {
 		var fis []os.FileInfo
 		var ops []FileOperation
@@ -392,7 +431,7 @@ func TestUploadCopyFile(t *testing.T) {
 		err := u.copyFile(&filePair{
 			path: "file1",
 			src:  &fakeUploadFileInfo{fakeListingFileInfo: fakeListingFileInfo{name: "file1", size: 4711}},
-		}, new(uint64))
+		}, new(uint64), nil)
 		if err != nil {
 			t.Fatalf("copyFile failed: %v", err)
 		}
@@ -423,11 +462,51 @@ func TestUploadCopyFile(t *testing.T) {
 		}
 	})
 
+	t.Run("local", func(t *testing.T) {
+		tmpd, err := ioutil.TempDir("", "upload-test-")
+		if err != nil {
+			t.Fatalf("TempDir failed: %v", err)
+		}
+		defer os.RemoveAll(tmpd)
+		for _, name := range []string{"src", "dest"} {
+			if err := os.Mkdir(filepath.Join(tmpd, name), 0700); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpd, "src", "file1"), []byte("hello"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		fi, err := os.Lstat(filepath.Join(tmpd, "src", "file1"))
+		if err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+
+		u := NewUpload(fs.NewLocal(filepath.Join(tmpd, "dest")), fs.NewLocal(filepath.Join(tmpd, "src")))
+		var byteCount uint64
+		if err := u.copyFile(&filePair{path: "file1", src: fi}, &byteCount, nil); err != nil {
+			t.Fatalf("copyFile failed: %v", err)
+		}
+
+		got, err := ioutil.ReadFile(filepath.Join(tmpd, "dest", "file1"))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("ReadFile: got %q, want %q", got, "hello")
+		}
+		if got, want := int(byteCount), 5; got != want {
+			t.Errorf("byteCount: got %v, want %v", got, want)
+		}
+		if got, want := int(u.stats.UploadedBytes), 5; got != want {
+			t.Errorf("stats.UploadedBytes: got %v, want %v", got, want)
+		}
+	})
+
 	t.Run("discarded", func(t *testing.T) {
 		u := newTestUpload()
 
 		src := &fakeUploadFileInfo{fakeListingFileInfo: fakeListingFileInfo{name: "missing-file"}}
-		err := u.copyFile(&filePair{path: "missing-file", src: src}, new(uint64))
+		err := u.copyFile(&filePair{path: "missing-file", src: src}, new(uint64), nil)
 		if want := errDiscarded; err != want {
 			t.Fatalf("copyFile error: got %v, want %v", err, want)
 		}
@@ -441,7 +520,7 @@ func TestUploadCopyFile(t *testing.T) {
 		u := newTestUpload()
 
 		src := &fakeUploadFileInfo{fakeListingFileInfo: fakeListingFileInfo{name: "create-failing-file"}}
-		err := u.copyFile(&filePair{path: "create-failing-file", src: src}, new(uint64))
+		err := u.copyFile(&filePair{path: "create-failing-file", src: src}, new(uint64), nil)
 		if want := errMocked; err != want {
 			t.Fatalf("copyFile error: got %v, want %v", err, want)
 		}
@@ -455,7 +534,7 @@ func TestUploadCopyFile(t *testing.T) {
 		u := newTestUpload()
 
 		src := &fakeUploadFileInfo{fakeListingFileInfo: fakeListingFileInfo{name: "create-readonly-file"}}
-		err := u.copyFile(&filePair{path: "create-readonly-file", src: src}, new(uint64))
+		err := u.copyFile(&filePair{path: "create-readonly-file", src: src}, new(uint64), nil)
 		if err != nil {
 			t.Fatalf("copyFile failed: %v", err)
 		}
@@ -476,7 +555,7 @@ func TestUploadCopyFile(t *testing.T) {
 		u := newTestUpload()
 
 		src := &fakeUploadFileInfo{fakeListingFileInfo: fakeListingFileInfo{name: "chmod-failing-file"}}
-		err := u.copyFile(&filePair{path: "chmod-failing-file", src: src}, new(uint64))
+		err := u.copyFile(&filePair{path: "chmod-failing-file", src: src}, new(uint64), nil)
 		if want := errMocked; err != want {
 			t.Fatalf("copyFile error: got %v, want %v", err, want)
 		}
@@ -704,6 +783,10 @@ func TestUploadStats(t *testing.T) {
 			KeptDirectories:    8,
 			RemovedFiles:       9,
 			RemovedDirectories: 10,
+			DedupedBytes:       14,
+			DedupedFiles:       15,
+			MovedBytes:         16,
+			MovedFiles:         17,
 			DiscardedFiles:     11,
 			TransferRetries:    12,
 		}
@@ -718,6 +801,77 @@ func TestUploadStats(t *testing.T) {
 	})
 }
 
+func TestUploadRunMemory(t *testing.T) {
+	src := fs.NewMemory()
+	if err := src.Mkdir("dir1", 0750, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	fw, err := src.Create("dir1/file1")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(fw, "content 1\n"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := src.Link("dir1/file1", "hardlink1"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if err := src.Symlink("dir1/file1", "symlink1"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	dest := fs.NewMemory()
+	if err := dest.Mkdir("dir-removed", 0755, -1, -1); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	u := NewUpload(dest, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }))
+	if err := u.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	fr, err := dest.Open(".")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fis, err := fr.Readdir()
+	fr.Close()
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fmt.Sprintf("%s %v", fi.Name(), fi.Mode()))
+	}
+	want := []string{"dir1 drwxr-x---", "hardlink1 -rw-rw-rw-", "symlink1 Lrwxrwxrwx"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run: got %q, want %q", got, want)
+	}
+
+	fr, err = dest.Open("hardlink1")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if attrs, _ := fs.FileAttrsFromFileInfo(fi); attrs.NLinks != 2 {
+		t.Errorf("Run hardlink1 NLinks: got %v, want 2", attrs.NLinks)
+	}
+	bs, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if want := "content 1\n"; string(bs) != want {
+		t.Errorf("Run hardlink1 content: got %q, want %q", bs, want)
+	}
+}
+
 func newTestUpload(opts ...UploadOpt) *Upload {
 	opts = append(opts, WithConcurrency(2))
 	return NewUpload(
@@ -929,3 +1083,44 @@ func (fi *fakeUploadFileInfo) Sys() interface{} {
 	}
 	return &syscall.Stat_t{Ino: fi.inode, Nlink: 2}
 }
+
+func TestUploadRunPathsMemory(t *testing.T) {
+	src := fs.NewMemory()
+	for _, dir := range []string{"a", "a/b", "c", "ignored"} {
+		if err := src.Mkdir(fs.Path(dir), 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	for _, name := range []string{".fisyignore", "a/b/file1", "a/b/file2", "a/b/x.o", "c/file", "ignored/file"} {
+		content := ""
+		if name == ".fisyignore" {
+			content = "/ignored/\n*.o\n"
+		}
+		writeMemoryFile(t, src, name, content)
+	}
+
+	dest := fs.NewMemory()
+	for _, dir := range []string{"a", "a/b", "a/b/removed"} {
+		if err := dest.Mkdir(fs.Path(dir), 0755, -1, -1); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+
+	u := NewUpload(dest, src, WithConcurrency(2), WithIgnoreFilter(func(fs.Path, os.FileInfo) bool { return false }), WithIgnoreFiles(".fisyignore"))
+	paths := []fs.Path{"a/b/file1", "a/b/x.o", "a/b/removed", "ignored/file", "missing/file"}
+	if err := u.RunPaths(context.Background(), paths); err != nil {
+		t.Fatalf("RunPaths failed: %v", err)
+	}
+
+	got := listMemoryFiles(t, dest, ".")
+	want := []string{"a", "a/b", "a/b/file1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RunPaths: got %q, want %q", got, want)
+	}
+	if got, want := u.Stats().UploadedFiles, uint64(1); got != want {
+		t.Errorf("RunPaths UploadedFiles: got %v, want %v", got, want)
+	}
+	if got, want := u.Stats().RemovedDirectories, uint64(1); got != want {
+		t.Errorf("RunPaths RemovedDirectories: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+//go:build linux
+// +build linux
+
+package watch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/tommie/fisy/fs"
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the events that can change what is transferred.
+const inotifyMask = unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_MODIFY |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// inotifyEventBuffer is the number of paths that can be queued while
+// the consumer is busy. Beyond that, a rescan is requested.
+const inotifyEventBuffer = 4096
+
+// An inotifySource watches every directory in a tree. New
+// directories are watched as they appear.
+type inotifySource struct {
+	root string
+	fd   int
+	f    *os.File
+
+	// wds and dirs are only used by run, after construction.
+	wds  map[int32]fs.Path
+	dirs map[fs.Path]int32
+	lost bool
+
+	events chan fs.Path
+	errs   chan error
+}
+
+func newInotifySource(root string) (source, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	s := &inotifySource{
+		root: root,
+		fd:   fd,
+		// A non-blocking file is handled by the runtime poller,
+		// so Close interrupts Read.
+		f: os.NewFile(uintptr(fd), "inotify"),
+
+		wds:  map[int32]fs.Path{},
+		dirs: map[fs.Path]int32{},
+
+		events: make(chan fs.Path, inotifyEventBuffer),
+		errs:   make(chan error, 1),
+	}
+	if err := s.addTree(fs.Path(".")); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *inotifySource) Events() <-chan fs.Path { return s.events }
+func (s *inotifySource) Errors() <-chan error   { return s.errs }
+
+func (s *inotifySource) Close() error {
+	return s.f.Close()
+}
+
+// run reads and handles events until the source is closed.
+func (s *inotifySource) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.f.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			s.errs <- err
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(ev.Len)], "\x00"))
+			off = nameStart + int(ev.Len)
+
+			if err := s.handle(ev, name); err != nil {
+				s.errs <- err
+				return
+			}
+		}
+	}
+}
+
+// handle updates the watches for an event, and emits the changed path.
+func (s *inotifySource) handle(ev *unix.InotifyEvent, name string) error {
+	if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+		glog.Warningf("The inotify queue overflowed. Requesting a rescan.")
+		s.emit("")
+		return nil
+	}
+
+	dir, ok := s.wds[ev.Wd]
+	if !ok {
+		return nil
+	}
+
+	if ev.Mask&unix.IN_IGNORED != 0 {
+		delete(s.wds, ev.Wd)
+		if s.dirs[dir] == ev.Wd {
+			delete(s.dirs, dir)
+		}
+		return nil
+	}
+
+	if name == "" {
+		// An event on the watched directory itself. Its parent
+		// reports the change.
+		if dir == "." && ev.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+			return fmt.Errorf("the watched directory was removed: %s", s.root)
+		}
+		return nil
+	}
+
+	path := dir.Resolve(fs.Path(name))
+	if ev.Mask&unix.IN_ISDIR != 0 {
+		if ev.Mask&(unix.IN_MOVED_FROM|unix.IN_DELETE) != 0 {
+			s.removeTree(path)
+		}
+		if ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			if err := s.addTree(path); err != nil {
+				// Changes below the directory would be
+				// missed until the next rescan.
+				glog.Warningf("Watching new directory failed: %v", err)
+				s.emit("")
+			}
+		}
+	}
+
+	s.emit(path)
+	return nil
+}
+
+// emit queues a changed path. An empty path requests a rescan. If the
+// consumer is too slow, a rescan is requested instead of blocking.
+func (s *inotifySource) emit(path fs.Path) {
+	if s.lost {
+		select {
+		case s.events <- "":
+			s.lost = false
+		default:
+			return
+		}
+	}
+
+	select {
+	case s.events <- path:
+	default:
+		s.lost = true
+	}
+}
+
+// addTree watches a directory and all its subdirectories. Directories
+// that disappear while walking are skipped.
+func (s *inotifySource) addTree(dir fs.Path) error {
+	return filepath.Walk(filepath.Join(s.root, string(dir)), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if os.IsPermission(err) {
+			glog.Warningf("Not watching directory (ignored): %v", err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		wd, err := unix.InotifyAddWatch(s.fd, path, inotifyMask)
+		switch err {
+		case nil:
+		case unix.ENOENT, unix.ENOTDIR:
+			return filepath.SkipDir
+		case unix.EACCES:
+			glog.Warningf("Not watching directory %q (ignored): %v", path, err)
+			return filepath.SkipDir
+		case unix.ENOSPC:
+			return fmt.Errorf("inotify watch limit reached, see fs.inotify.max_user_watches: %s", path)
+		default:
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+
+		s.wds[int32(wd)] = fs.Path(rel)
+		s.dirs[fs.Path(rel)] = int32(wd)
+		return nil
+	})
+}
+
+// removeTree stops watching a directory and all its subdirectories.
+func (s *inotifySource) removeTree(dir fs.Path) {
+	prefix := string(dir) + "/"
+	for path, wd := range s.dirs {
+		if path != dir && !strings.HasPrefix(string(path), prefix) {
+			continue
+		}
+		// The watch may already be gone, if the directory was
+		// removed.
+		unix.InotifyRmWatch(s.fd, uint32(wd))
+		delete(s.dirs, path)
+		delete(s.wds, wd)
+	}
+}
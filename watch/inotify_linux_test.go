@@ -0,0 +1,76 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestInotifySource(t *testing.T) {
+	tmpd, err := ioutil.TempDir("", "watch-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpd)
+
+	if err := os.Mkdir(filepath.Join(tmpd, "old"), 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	s, err := newInotifySource(tmpd)
+	if err != nil {
+		t.Fatalf("newInotifySource failed: %v", err)
+	}
+	defer s.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(tmpd, "old", "file"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	waitForInotifyEvent(t, s, "old/file")
+
+	if err := os.MkdirAll(filepath.Join(tmpd, "new", "sub"), 0700); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	waitForInotifyEvent(t, s, "new")
+
+	// The new directory is watched, without a rescan.
+	if err := ioutil.WriteFile(filepath.Join(tmpd, "new", "sub", "file"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	waitForInotifyEvent(t, s, "new/sub/file")
+
+	if err := os.Rename(filepath.Join(tmpd, "new"), filepath.Join(tmpd, "moved")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	waitForInotifyEvent(t, s, "moved")
+	if err := ioutil.WriteFile(filepath.Join(tmpd, "moved", "sub", "file2"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	waitForInotifyEvent(t, s, "moved/sub/file2")
+}
+
+// waitForInotifyEvent reads events until the path is seen.
+func waitForInotifyEvent(t *testing.T, s source, want fs.Path) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-s.Events():
+			if got == "" {
+				t.Fatalf("Events: got a rescan request, want %q", want)
+			}
+			if got == want {
+				return
+			}
+		case err := <-s.Errors():
+			t.Fatalf("Errors: got %v, want %q", err, want)
+		case <-timeout:
+			t.Fatalf("Events: timed out waiting for %q", want)
+		}
+	}
+}
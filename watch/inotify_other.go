@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package watch
+
+func newInotifySource(root string) (source, error) {
+	return nil, ErrNotSupported
+}
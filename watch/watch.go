@@ -0,0 +1,199 @@
+// Package watch reports changes in a local directory tree, so they
+// can be transferred without walking the whole tree.
+package watch
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+// ErrNotSupported is returned by NewWatcher on platforms without a
+// change notification mechanism.
+var ErrNotSupported = errors.New("watching is not supported on this platform")
+
+// A Batch is a set of changes that have settled.
+type Batch struct {
+	// Paths are the changed files and directories, relative to the
+	// root. A changed directory means its whole subtree may have
+	// changed.
+	Paths []fs.Path
+
+	// Rescan is true if the whole tree should be transferred,
+	// because the rescan interval has elapsed, or because events
+	// may have been lost. Paths are then empty.
+	Rescan bool
+}
+
+// A Watcher reports changes in a directory tree, in batches.
+type Watcher struct {
+	quietPeriod    time.Duration
+	maxDelay       time.Duration
+	rescanInterval time.Duration
+
+	src        source
+	lastRescan time.Time
+	pending    map[fs.Path]bool
+	overflowed bool
+}
+
+// A source delivers raw change events.
+type source interface {
+	// Events returns the channel of changes. An empty path means
+	// events were lost.
+	Events() <-chan fs.Path
+
+	// Errors returns the channel of fatal errors.
+	Errors() <-chan error
+
+	Close() error
+}
+
+// A WatcherOpt is an option to NewWatcher.
+type WatcherOpt func(*Watcher)
+
+// WithQuietPeriod sets how long no events must be seen before a batch
+// is returned.
+func WithQuietPeriod(d time.Duration) WatcherOpt {
+	return func(w *Watcher) {
+		w.quietPeriod = d
+	}
+}
+
+// WithMaxDelay sets how long a batch can be delayed by a continuous
+// stream of events.
+func WithMaxDelay(d time.Duration) WatcherOpt {
+	return func(w *Watcher) {
+		w.maxDelay = d
+	}
+}
+
+// WithRescanInterval sets how often a full rescan is requested. Zero
+// disables periodic rescans.
+func WithRescanInterval(d time.Duration) WatcherOpt {
+	return func(w *Watcher) {
+		w.rescanInterval = d
+	}
+}
+
+// NewWatcher starts watching the directory tree at root. The first
+// batch returned by Next is always a rescan, since changes made
+// before the watcher started are unknown.
+func NewWatcher(root string, opts ...WatcherOpt) (*Watcher, error) {
+	src, err := newInotifySource(root)
+	if err != nil {
+		return nil, err
+	}
+	return newWatcher(src, opts...), nil
+}
+
+func newWatcher(src source, opts ...WatcherOpt) *Watcher {
+	w := &Watcher{
+		quietPeriod:    2 * time.Second,
+		maxDelay:       30 * time.Second,
+		rescanInterval: time.Hour,
+
+		src:        src,
+		pending:    map[fs.Path]bool{},
+		overflowed: true,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.src.Close()
+}
+
+// Rescan makes the next batch a rescan, e.g. because transferring
+// the previous batch failed.
+func (w *Watcher) Rescan() {
+	w.overflowed = true
+}
+
+// Next blocks until a batch of changes is ready, and returns it.
+func (w *Watcher) Next(ctx context.Context) (*Batch, error) {
+	var rescan <-chan time.Time
+	if w.rescanInterval > 0 && !w.lastRescan.IsZero() {
+		t := time.NewTimer(time.Until(w.lastRescan.Add(w.rescanInterval)))
+		defer t.Stop()
+		rescan = t.C
+	}
+
+	// The quiet timer restarts on every event. The max delay timer
+	// starts on the first event.
+	var quiet, maxDelay *time.Timer
+	var quietC, maxDelayC <-chan time.Time
+	defer func() {
+		if quiet != nil {
+			quiet.Stop()
+		}
+		if maxDelay != nil {
+			maxDelay.Stop()
+		}
+	}()
+	startQuiet := func() {
+		if quiet != nil {
+			quiet.Stop()
+		}
+		quiet = time.NewTimer(w.quietPeriod)
+		quietC = quiet.C
+	}
+	if len(w.pending) > 0 {
+		// Left over from a cancelled call.
+		startQuiet()
+	}
+
+loop:
+	for !w.overflowed {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case err := <-w.src.Errors():
+			return nil, err
+
+		case path := <-w.src.Events():
+			if path == "" {
+				w.overflowed = true
+				continue
+			}
+			w.pending[path] = true
+			startQuiet()
+			if maxDelay == nil {
+				maxDelay = time.NewTimer(w.maxDelay)
+				maxDelayC = maxDelay.C
+			}
+
+		case <-quietC:
+			break loop
+
+		case <-maxDelayC:
+			break loop
+
+		case <-rescan:
+			w.overflowed = true
+		}
+	}
+
+	if w.overflowed {
+		w.overflowed = false
+		w.pending = map[fs.Path]bool{}
+		w.lastRescan = time.Now()
+		return &Batch{Rescan: true}, nil
+	}
+
+	b := &Batch{}
+	for path := range w.pending {
+		b.Paths = append(b.Paths, path)
+	}
+	sort.Slice(b.Paths, func(i, j int) bool { return b.Paths[i] < b.Paths[j] })
+	w.pending = map[fs.Path]bool{}
+	return b, nil
+}
@@ -0,0 +1,145 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tommie/fisy/fs"
+)
+
+func TestWatcherNext(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("firstIsRescan", func(t *testing.T) {
+		w := newWatcher(newFakeSource())
+
+		got, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if want := (&Batch{Rescan: true}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Next: got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("debounce", func(t *testing.T) {
+		src := newFakeSource()
+		w := newWatcher(src, WithQuietPeriod(10*time.Millisecond), WithMaxDelay(time.Hour))
+		w.overflowed = false
+
+		src.events <- "b"
+		src.events <- "a"
+		src.events <- "b"
+
+		got, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if want := (&Batch{Paths: []fs.Path{"a", "b"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Next: got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("maxDelay", func(t *testing.T) {
+		src := newFakeSource()
+		w := newWatcher(src, WithQuietPeriod(time.Hour), WithMaxDelay(10*time.Millisecond))
+		w.overflowed = false
+
+		src.events <- "a"
+
+		got, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if want := (&Batch{Paths: []fs.Path{"a"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Next: got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		src := newFakeSource()
+		w := newWatcher(src, WithQuietPeriod(time.Hour))
+		w.overflowed = false
+
+		src.events <- "a"
+		src.events <- ""
+
+		got, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if want := (&Batch{Rescan: true}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Next: got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("rescanInterval", func(t *testing.T) {
+		w := newWatcher(newFakeSource(), WithRescanInterval(10*time.Millisecond))
+
+		for i := 0; i < 2; i++ {
+			got, err := w.Next(ctx)
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if want := (&Batch{Rescan: true}); !reflect.DeepEqual(got, want) {
+				t.Errorf("Next: got %+v, want %+v", got, want)
+			}
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		src := newFakeSource()
+		w := newWatcher(src)
+		w.overflowed = false
+
+		errMocked := errors.New("mocked")
+		src.errs <- errMocked
+
+		if _, err := w.Next(ctx); !errors.Is(err, errMocked) {
+			t.Errorf("Next err: got %v, want %v", err, errMocked)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		src := newFakeSource()
+		w := newWatcher(src, WithQuietPeriod(time.Hour), WithMaxDelay(time.Hour))
+		w.overflowed = false
+
+		src.events <- "a"
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, err := w.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Next err: got %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		// Pending paths are kept for the next call.
+		w.quietPeriod = 10 * time.Millisecond
+		got, err := w.Next(context.Background())
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if want := (&Batch{Paths: []fs.Path{"a"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Next: got %+v, want %+v", got, want)
+		}
+	})
+}
+
+type fakeSource struct {
+	events chan fs.Path
+	errs   chan error
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{
+		events: make(chan fs.Path, 16),
+		errs:   make(chan error, 1),
+	}
+}
+
+func (s *fakeSource) Events() <-chan fs.Path { return s.events }
+func (s *fakeSource) Errors() <-chan error   { return s.errs }
+func (s *fakeSource) Close() error           { return nil }